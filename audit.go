@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Audited entities
+const (
+	AuditAnimal   = "animal"
+	AuditSpecies  = "species"
+	AuditCategory = "category"
+	AuditGeofence = "geofence"
+)
+
+// Audited actions
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+)
+
+// FieldChange is the value of a field before and after a change, null when the field wasn't set
+type FieldChange struct {
+	Before interface{} `json:"before" bson:"before"`
+	After  interface{} `json:"after" bson:"after"`
+}
+
+// AuditEvent records a single change to an animal, species, category or geofence
+type AuditEvent struct {
+	ID        primitive.ObjectID     `json:"_id" bson:"_id"`
+	Entity    string                 `json:"entity" bson:"entity"`
+	EntityID  primitive.ObjectID     `json:"entity_id" bson:"entity_id"`
+	Action    string                 `json:"action" bson:"action"`
+	Actor     string                 `json:"actor" bson:"actor"`
+	RequestID string                 `json:"request_id" bson:"request_id"`
+	Timestamp time.Time              `json:"timestamp" bson:"timestamp"`
+	Changes   map[string]FieldChange `json:"changes" bson:"changes"`
+	Tenant    string                 `json:"-" bson:"tenant,omitempty"`
+}
+
+// changeLog records the audit events of a request
+type changeLog struct {
+	actor     string
+	requestID string
+}
+
+// newChangeLog returns the change log of the request
+func (s *server) newChangeLog(c *fiber.Ctx) changeLog {
+	requestID, _ := c.Locals("requestid").(string)
+	return changeLog{actor: s.requestActor(c), requestID: strings.Clone(requestID)}
+}
+
+// record stores an audit event with the differences between the before and after states of
+// a record, either of which is nil when the record didn't exist
+func (l changeLog) record(ctx context.Context, store Store, entity string, id primitive.ObjectID, action string, before, after interface{}) error {
+	changes, err := diffRecords(before, after)
+	if err != nil {
+		return err
+	}
+
+	return store.Audit().Append(ctx, &AuditEvent{
+		ID:        primitive.NewObjectID(),
+		Entity:    entity,
+		EntityID:  id,
+		Action:    action,
+		Actor:     l.actor,
+		RequestID: l.requestID,
+		Timestamp: time.Now().UTC(),
+		Changes:   changes,
+	})
+}
+
+// auditedStore records an audit event for every change made through its repositories, in
+// the same transaction as the change
+type auditedStore struct {
+	Store
+	changes changeLog
+}
+
+// auditedStore returns the store to make the changes requested by c through
+func (s *server) auditedStore(c *fiber.Ctx) Store {
+	return auditedStore{Store: s.store, changes: s.newChangeLog(c)}
+}
+
+func (s auditedStore) Animals() AnimalRepository {
+	return auditedAnimals{
+		AnimalRepository: s.Store.Animals(),
+		records: auditedRecords[Animal]{
+			store:  s,
+			entity: AuditAnimal,
+			repo:   func(tx Store) recordRepository[Animal] { return tx.Animals() },
+			id:     func(animal *Animal) primitive.ObjectID { return animal.ID },
+		},
+	}
+}
+
+func (s auditedStore) Species() SpeciesRepository {
+	return auditedSpecies{
+		SpeciesRepository: s.Store.Species(),
+		records: auditedRecords[Species]{
+			store:  s,
+			entity: AuditSpecies,
+			repo:   func(tx Store) recordRepository[Species] { return tx.Species() },
+			id:     func(species *Species) primitive.ObjectID { return species.ID },
+		},
+	}
+}
+
+func (s auditedStore) Categories() CategoryRepository {
+	return auditedCategories{
+		CategoryRepository: s.Store.Categories(),
+		records: auditedRecords[Category]{
+			store:  s,
+			entity: AuditCategory,
+			repo:   func(tx Store) recordRepository[Category] { return tx.Categories() },
+			id:     func(category *Category) primitive.ObjectID { return category.ID },
+		},
+	}
+}
+
+func (s auditedStore) Geofences() GeofenceRepository {
+	return auditedGeofences{
+		GeofenceRepository: s.Store.Geofences(),
+		records: auditedRecords[Geofence]{
+			store:  s,
+			entity: AuditGeofence,
+			repo:   func(tx Store) recordRepository[Geofence] { return tx.Geofences() },
+			id:     func(geofence *Geofence) primitive.ObjectID { return geofence.ID },
+		},
+	}
+}
+
+func (s auditedStore) WithTransaction(ctx context.Context, fn func(ctx context.Context, tx Store) error) error {
+	return s.Store.WithTransaction(ctx, func(ctx context.Context, tx Store) error {
+		return fn(ctx, auditedStore{Store: tx, changes: s.changes})
+	})
+}
+
+// recordRepository is the part of the repositories the audit wraps
+type recordRepository[T any] interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*T, error)
+	Create(ctx context.Context, record *T) error
+	Update(ctx context.Context, record *T) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// auditedRecords records the changes made through the repository returned by repo
+type auditedRecords[T any] struct {
+	store  auditedStore
+	entity string
+	repo   func(tx Store) recordRepository[T]
+	id     func(record *T) primitive.ObjectID
+}
+
+func (r auditedRecords[T]) create(ctx context.Context, record *T) error {
+	return r.store.Store.WithTransaction(ctx, func(ctx context.Context, tx Store) error {
+		if err := r.repo(tx).Create(ctx, record); err != nil {
+			return err
+		}
+		return r.store.changes.record(ctx, tx, r.entity, r.id(record), AuditCreate, nil, record)
+	})
+}
+
+func (r auditedRecords[T]) update(ctx context.Context, record *T) error {
+	return r.store.Store.WithTransaction(ctx, func(ctx context.Context, tx Store) error {
+		before, err := r.repo(tx).Get(ctx, r.id(record))
+		if err != nil {
+			return err
+		}
+		if err := r.repo(tx).Update(ctx, record); err != nil {
+			return err
+		}
+
+		// Moving a record in or out of the trash is stored as an update, log it as what it is
+		action := AuditUpdate
+		if before, ok := any(*before).(trashable); ok {
+			switch wasDeleted, isDeleted := before.deletion().IsDeleted(), any(*record).(trashable).deletion().IsDeleted(); {
+			case !wasDeleted && isDeleted:
+				action = AuditDelete
+			case wasDeleted && !isDeleted:
+				action = AuditRestore
+			}
+		}
+
+		return r.store.changes.record(ctx, tx, r.entity, r.id(record), action, before, record)
+	})
+}
+
+func (r auditedRecords[T]) delete(ctx context.Context, id primitive.ObjectID) error {
+	return r.store.Store.WithTransaction(ctx, func(ctx context.Context, tx Store) error {
+		before, err := r.repo(tx).Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := r.repo(tx).Delete(ctx, id); err != nil {
+			return err
+		}
+		return r.store.changes.record(ctx, tx, r.entity, id, AuditDelete, before, nil)
+	})
+}
+
+type auditedAnimals struct {
+	AnimalRepository
+	records auditedRecords[Animal]
+}
+
+func (r auditedAnimals) Create(ctx context.Context, animal *Animal) error {
+	return r.records.create(ctx, animal)
+}
+
+func (r auditedAnimals) Update(ctx context.Context, animal *Animal) error {
+	return r.records.update(ctx, animal)
+}
+
+func (r auditedAnimals) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return r.records.delete(ctx, id)
+}
+
+type auditedSpecies struct {
+	SpeciesRepository
+	records auditedRecords[Species]
+}
+
+func (r auditedSpecies) Create(ctx context.Context, species *Species) error {
+	return r.records.create(ctx, species)
+}
+
+func (r auditedSpecies) Update(ctx context.Context, species *Species) error {
+	return r.records.update(ctx, species)
+}
+
+func (r auditedSpecies) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return r.records.delete(ctx, id)
+}
+
+type auditedCategories struct {
+	CategoryRepository
+	records auditedRecords[Category]
+}
+
+func (r auditedCategories) Create(ctx context.Context, category *Category) error {
+	return r.records.create(ctx, category)
+}
+
+func (r auditedCategories) Update(ctx context.Context, category *Category) error {
+	return r.records.update(ctx, category)
+}
+
+func (r auditedCategories) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return r.records.delete(ctx, id)
+}
+
+type auditedGeofences struct {
+	GeofenceRepository
+	records auditedRecords[Geofence]
+}
+
+func (r auditedGeofences) Create(ctx context.Context, geofence *Geofence) error {
+	return r.records.create(ctx, geofence)
+}
+
+func (r auditedGeofences) Update(ctx context.Context, geofence *Geofence) error {
+	return r.records.update(ctx, geofence)
+}
+
+func (r auditedGeofences) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return r.records.delete(ctx, id)
+}
+
+// diffRecords compares the JSON representations of two records field by field
+func diffRecords(before, after interface{}) (map[string]FieldChange, error) {
+	beforeFields, err := jsonFields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := jsonFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := map[string]FieldChange{}
+	for field, value := range beforeFields {
+		if !reflect.DeepEqual(value, afterFields[field]) {
+			changes[field] = FieldChange{Before: value, After: afterFields[field]}
+		}
+	}
+	for field, value := range afterFields {
+		if _, ok := beforeFields[field]; !ok {
+			changes[field] = FieldChange{After: value}
+		}
+	}
+	delete(changes, "_id")
+	return changes, nil
+}
+
+// jsonFields returns the top-level fields of the record as it is rendered by the API
+func jsonFields(record interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	err = json.Unmarshal(data, &fields)
+	return fields, err
+}
+
+// Get the history of an animal
+// @Summary Get the history of an animal
+// @Description Get the audit events of an animal, newest first. The history outlives the animal.
+// @Tags animals
+// @Accept json
+// @Produce json
+// @Param id path string true "Animal ID"
+// @Param limit query int false "Limit"
+// @Param skip query int false "Skip"
+// @Success 200 {array} AuditEvent
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /animals/{id}/history [get]
+func (s *server) getAnimalHistory(c *fiber.Ctx) error {
+	return s.history(c, AuditAnimal, "Animal", func(ctx context.Context, id primitive.ObjectID) error {
+		_, err := s.store.Animals().Get(ctx, id)
+		return err
+	})
+}
+
+// Get the history of a species
+// @Summary Get the history of a species
+// @Description Get the audit events of a species, newest first. The history outlives the species.
+// @Tags species
+// @Accept json
+// @Produce json
+// @Param id path string true "Species ID"
+// @Param limit query int false "Limit"
+// @Param skip query int false "Skip"
+// @Success 200 {array} AuditEvent
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /species/{id}/history [get]
+func (s *server) getSpeciesHistory(c *fiber.Ctx) error {
+	return s.history(c, AuditSpecies, "Species", func(ctx context.Context, id primitive.ObjectID) error {
+		_, err := s.store.Species().Get(ctx, id)
+		return err
+	})
+}
+
+// Get the history of a category
+// @Summary Get the history of a category
+// @Description Get the audit events of a category, newest first. The history outlives the category.
+// @Tags categories
+// @Accept json
+// @Produce json
+// @Param id path string true "Category ID"
+// @Param limit query int false "Limit"
+// @Param skip query int false "Skip"
+// @Success 200 {array} AuditEvent
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /categories/{id}/history [get]
+func (s *server) getCategoryHistory(c *fiber.Ctx) error {
+	return s.history(c, AuditCategory, "Category", func(ctx context.Context, id primitive.ObjectID) error {
+		_, err := s.store.Categories().Get(ctx, id)
+		return err
+	})
+}
+
+// history answers with the audit events of a single record. Records without events are
+// looked up with exists to tell unknown IDs apart from records that predate the audit log.
+func (s *server) history(c *fiber.Ctx, entity, name string, exists func(ctx context.Context, id primitive.ObjectID) error) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return invalidID("Invalid ID")
+	}
+	if id.IsZero() {
+		// A zero entity ID would match the events of every record
+		return notFound(name)
+	}
+
+	query := AuditQuery{Entity: entity, EntityID: id}
+	if query.Limit, err = s.pageSize(c); err != nil {
+		return err
+	}
+	if query.Skip, err = pageSkip(c); err != nil {
+		return err
+	}
+
+	events, err := s.store.Audit().List(c.UserContext(), query)
+	if err == nil && len(events) == 0 && query.Skip == 0 {
+		err = exists(c.UserContext(), id)
+	}
+	if errors.Is(err, ErrNotFound) {
+		return notFound(name)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(events)
+}
+
+// Get the audit log
+// @Summary Get the audit log
+// @Description Get the audit events of every record, newest first
+// @Tags audit
+// @Accept json
+// @Produce json
+// @Param entity query string false "Entity" Enums(animal, species, category, geofence)
+// @Param entity_id query string false "Entity ID"
+// @Param action query string false "Action" Enums(create, update, delete, restore)
+// @Param actor query string false "Actor"
+// @Param request_id query string false "Request ID"
+// @Param from query string false "Only events at or after this time (RFC 3339)"
+// @Param to query string false "Only events before this time (RFC 3339)"
+// @Param limit query int false "Limit"
+// @Param skip query int false "Skip"
+// @Success 200 {array} AuditEvent
+// @Failure 400 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /audit [get]
+func (s *server) getAuditLog(c *fiber.Ctx) error {
+	query := AuditQuery{
+		Entity:    c.Query("entity"),
+		Action:    c.Query("action"),
+		Actor:     c.Query("actor"),
+		RequestID: c.Query("request_id"),
+	}
+
+	var err error
+	if query.Limit, err = s.pageSize(c); err != nil {
+		return err
+	}
+	if query.Skip, err = pageSkip(c); err != nil {
+		return err
+	}
+	if entityID := c.Query("entity_id"); entityID != "" {
+		if query.EntityID, err = primitive.ObjectIDFromHex(entityID); err != nil {
+			return invalidID("Invalid entity ID format")
+		}
+	}
+	if from := c.Query("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return invalidParameter("Invalid from time")
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return invalidParameter("Invalid to time")
+		}
+	}
+
+	events, err := s.store.Audit().List(c.UserContext(), query)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(events)
+}
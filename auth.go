@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuthConfig holds the credentials accepted on the routes that change data
+type AuthConfig struct {
+	// Disabled leaves every route open, for local development
+	Disabled bool
+	APIKeys  []StaticAPIKey
+	// HS256Secret verifies HS256 tokens, RSAKeys verify RS256 tokens by their key ID
+	HS256Secret []byte
+	RSAKeys     map[string]*rsa.PublicKey
+	// Issuer and Audience are checked against the claims of tokens when they are set
+	Issuer   string
+	Audience string
+}
+
+// StaticAPIKey is a key from the configuration and the name of whoever holds it
+type StaticAPIKey struct {
+	Name string
+	Key  string
+	// Roles are given to the key on top of those the policy gives its name
+	Roles []string
+	// Tenants are the zoos the key may act for when there are several
+	Tenants []string
+}
+
+// configured reports whether any credentials are accepted
+func (a AuthConfig) configured() bool {
+	return len(a.APIKeys) > 0 || len(a.HS256Secret) > 0 || len(a.RSAKeys) > 0
+}
+
+// loadAuthConfig reads the accepted credentials from the environment: API_KEYS lists
+// name:key pairs separated by commas, JWT_HS256_SECRET is the secret of HS256 tokens and
+// JWT_JWKS_FILE a JSON Web Key Set with the public keys of RS256 tokens
+func loadAuthConfig() (AuthConfig, error) {
+	var auth AuthConfig
+	var err error
+
+	auth.Disabled, err = parseBool("AUTH_DISABLED", false)
+	if err != nil {
+		return auth, err
+	}
+
+	if keys := os.Getenv("API_KEYS"); keys != "" {
+		for _, pair := range strings.Split(keys, ",") {
+			name, key, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok || name == "" || key == "" {
+				return auth, errors.New("API_KEYS: expected comma-separated name:key pairs")
+			}
+			auth.APIKeys = append(auth.APIKeys, StaticAPIKey{Name: name, Key: key})
+		}
+	}
+
+	auth.HS256Secret = []byte(os.Getenv("JWT_HS256_SECRET"))
+	if file := os.Getenv("JWT_JWKS_FILE"); file != "" {
+		if auth.RSAKeys, err = readJWKS(file); err != nil {
+			return auth, fmt.Errorf("JWT_JWKS_FILE: %w", err)
+		}
+	}
+	auth.Issuer = os.Getenv("JWT_ISSUER")
+	auth.Audience = os.Getenv("JWT_AUDIENCE")
+	return auth, nil
+}
+
+// readJWKS reads the RSA public keys of a JSON Web Key Set (RFC 7517) by their key ID, other
+// key types are skipped
+func readJWKS(file string) (map[string]*rsa.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: invalid modulus", key.Kid)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("key %q: invalid exponent", key.Kid)
+		}
+		if _, ok := keys[key.Kid]; ok {
+			return nil, fmt.Errorf("key %q is given more than once", key.Kid)
+		}
+		keys[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no RSA signing keys")
+	}
+	return keys, nil
+}
+
+// Principal is whoever a request was authenticated as
+type Principal struct {
+	Subject string
+	// UserID is the stored user the request was authenticated as, zero for the static API keys
+	// and tokens
+	UserID primitive.ObjectID
+	// Method is how the request was authenticated, "api_key", "jwt" or "password"
+	Method string
+	// Roles are the roles of the user, the roles claim of the token or the roles of the static key
+	Roles []string
+	// Scopes limit the permissions of an API key, it has every permission of its user without
+	Scopes []string
+	// Claims are the claims of the token, nil for the other methods
+	Claims jwt.MapClaims
+	// Tenant is the zoo the principal belongs to, empty for the static API keys
+	Tenant string
+	// Tenants are the zoos a static API key may act for
+	Tenants []string
+}
+
+// principalKey is the key of the authenticated principal in the locals of a request
+type principalKey struct{}
+
+// requestPrincipal returns whoever the request was authenticated as, nil when it wasn't
+func requestPrincipal(c *fiber.Ctx) *Principal {
+	principal, _ := c.Locals(principalKey{}).(*Principal)
+	return principal
+}
+
+// authenticate checks the credentials of the request: an API key in the X-API-Key header, or a
+// JWT or the password of a user in the Authorization header. It returns nil without an error for
+// requests without any.
+func (s *server) authenticate(c *fiber.Ctx) (*Principal, error) {
+	if key := c.Get("X-API-Key"); key != "" {
+		if id, secret, ok := parseAPIKey(key); ok {
+			return s.authenticateKey(c, id, secret)
+		}
+		for _, apiKey := range s.config.Auth.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey.Key)) == 1 {
+				return &Principal{Subject: apiKey.Name, Method: "api_key", Roles: apiKey.Roles, Tenants: apiKey.Tenants}, nil
+			}
+		}
+		return nil, unauthorized(c, "invalid_api_key", "Invalid API key", "")
+	}
+
+	authorization := c.Get(fiber.HeaderAuthorization)
+	if authorization == "" {
+		return nil, nil
+	}
+	scheme, credentials, _ := strings.Cut(authorization, " ")
+	credentials = strings.TrimSpace(credentials)
+	switch {
+	case strings.EqualFold(scheme, "Basic"):
+		return s.authenticatePassword(c, credentials)
+	case !strings.EqualFold(scheme, "Bearer") || credentials == "":
+		return nil, unauthorized(c, "invalid_token", "Authorization must be a bearer token or basic credentials", "invalid_request")
+	}
+	principal, err := s.config.Auth.parseToken(credentials)
+	if err == nil {
+		principal.Tenant, err = s.config.Tenancy.claimTenant(principal.Claims)
+	}
+	if err != nil {
+		return nil, unauthorized(c, "invalid_token", "Invalid token: "+err.Error(), "invalid_token")
+	}
+	return principal, nil
+}
+
+// parseToken verifies the signature and claims of a JWT. Tokens must expire and name their
+// subject.
+func (a AuthConfig) parseToken(token string) (*Principal, error) {
+	var methods []string
+	if len(a.HS256Secret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if len(a.RSAKeys) > 0 {
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("tokens are not accepted")
+	}
+
+	options := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired(), jwt.WithLeeway(30 * time.Second)}
+	if a.Issuer != "" {
+		options = append(options, jwt.WithIssuer(a.Issuer))
+	}
+	if a.Audience != "" {
+		options = append(options, jwt.WithAudience(a.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, a.verificationKey, options...); err != nil {
+		return nil, err
+	}
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return &Principal{Subject: subject, Method: "jwt", Roles: claimRoles(claims), Claims: claims}, nil
+}
+
+// verificationKey returns the key the token is verified with, RS256 tokens name theirs in the
+// kid header unless the key set has a single key
+func (a AuthConfig) verificationKey(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() == jwt.SigningMethodHS256.Alg() {
+		return a.HS256Secret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := a.RSAKeys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(a.RSAKeys) == 1 {
+		for _, key := range a.RSAKeys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// unauthorized is the problem of a request without valid credentials, the WWW-Authenticate
+// header tells clients how to authenticate (RFC 6750)
+func unauthorized(c *fiber.Ctx, code, detail, bearerError string) *Problem {
+	challenge := `Bearer realm="api"`
+	if bearerError != "" {
+		challenge += fmt.Sprintf(`, error=%q`, bearerError)
+	}
+	c.Set(fiber.HeaderWWWAuthenticate, challenge)
+	return newProblem(fiber.StatusUnauthorized, code, detail)
+}
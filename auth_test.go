@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The static API key and the token secret of authConfig
+const (
+	testAPIKey = "ops-key"
+	testSecret = "a secret of at least thirty-two bytes"
+)
+
+// authConfig is the test configuration with authentication enabled, accepting testAPIKey, held by
+// an admin named ops, and HS256 tokens signed with testSecret
+func authConfig() Config {
+	config := testConfig()
+	config.Auth = AuthConfig{
+		APIKeys:     []StaticAPIKey{{Name: "ops", Key: testAPIKey, Roles: defaultAPIKeyRoles}},
+		HS256Secret: []byte(testSecret),
+	}
+	return config
+}
+
+// signToken returns an HS256 token with the claims, signed with the secret
+func signToken(t *testing.T, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// bearer returns the headers sending the token
+func bearer(token string) []string {
+	return []string{fiber.HeaderAuthorization, "Bearer " + token}
+}
+
+// basic returns the headers sending the username and password
+func basic(username, password string) []string {
+	return []string{fiber.HeaderAuthorization, "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))}
+}
+
+func TestAuthenticate(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Unix()
+	valid := signToken(t, testSecret, jwt.MapClaims{"sub": "alice", "exp": expires, "roles": []string{"admin"}})
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"sub": "alice", "exp": expires, "roles": "admin"}).
+		SignedString(jwt.UnsafeAllowNoneSignatureType)
+	const animal = `{"animal_name":"Leo","birthdate":"2020-01-02T00:00:00Z"}`
+
+	tests := []struct {
+		name    string
+		headers []string
+		status  int
+		code    string
+	}{
+		{"without credentials", nil, fiber.StatusUnauthorized, "unauthenticated"},
+		{"static API key", []string{"X-API-Key", testAPIKey}, fiber.StatusCreated, ""},
+		{"unknown API key", []string{"X-API-Key", "nope"}, fiber.StatusUnauthorized, "invalid_api_key"},
+		{"unknown issued API key", []string{"X-API-Key", formatAPIKey(primitive.NewObjectID(), "secret")}, fiber.StatusUnauthorized, "invalid_api_key"},
+		{"token", bearer(valid), fiber.StatusCreated, ""},
+		{"token with a single role", bearer(signToken(t, testSecret, jwt.MapClaims{"sub": "alice", "exp": expires, "roles": "admin"})), fiber.StatusCreated, ""},
+		{"expired token", bearer(signToken(t, testSecret, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix(), "roles": "admin"})), fiber.StatusUnauthorized, "invalid_token"},
+		{"token without expiry", bearer(signToken(t, testSecret, jwt.MapClaims{"sub": "alice", "roles": "admin"})), fiber.StatusUnauthorized, "invalid_token"},
+		{"token without subject", bearer(signToken(t, testSecret, jwt.MapClaims{"exp": expires, "roles": "admin"})), fiber.StatusUnauthorized, "invalid_token"},
+		{"token signed with another secret", bearer(signToken(t, "another secret of thirty-two bytes", jwt.MapClaims{"sub": "alice", "exp": expires})), fiber.StatusUnauthorized, "invalid_token"},
+		{"unsigned token", bearer(unsigned), fiber.StatusUnauthorized, "invalid_token"},
+		{"malformed token", bearer("nope"), fiber.StatusUnauthorized, "invalid_token"},
+		{"empty bearer token", []string{fiber.HeaderAuthorization, "Bearer "}, fiber.StatusUnauthorized, "invalid_token"},
+		{"unknown scheme", []string{fiber.HeaderAuthorization, "Token " + valid}, fiber.StatusUnauthorized, "invalid_token"},
+		{"malformed basic credentials", []string{fiber.HeaderAuthorization, "Basic %%%"}, fiber.StatusUnauthorized, "invalid_credentials"},
+		{"unknown user", basic("alice", "secretpass"), fiber.StatusUnauthorized, "invalid_credentials"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newApp(newServer(newMemoryStore(), authConfig()))
+			status, body := send(t, app, fiber.MethodPost, "/api/animals", animal, tt.headers...)
+			if status != tt.status || (tt.code != "" && field(body, "code") != tt.code) {
+				t.Errorf("got status %d and %v, want %d with code %q", status, body, tt.status, tt.code)
+			}
+		})
+	}
+}
+
+// Every route is open when authentication is disabled, and the credentials sent aren't checked
+func TestAuthDisabled(t *testing.T) {
+	app := newTestApp(t)
+	tests := []struct {
+		method  string
+		path    string
+		body    string
+		headers []string
+		status  int
+	}{
+		{fiber.MethodPost, "/api/animals", `{"animal_name":"Leo","birthdate":"2020-01-02T00:00:00Z"}`, nil, fiber.StatusCreated},
+		{fiber.MethodGet, "/api/trash", "", nil, fiber.StatusOK},
+		{fiber.MethodGet, "/api/users", "", nil, fiber.StatusOK},
+		{fiber.MethodGet, "/api/animals", "", []string{"X-API-Key", "nope"}, fiber.StatusOK},
+	}
+	for _, tt := range tests {
+		status, body := send(t, app, tt.method, tt.path, tt.body, tt.headers...)
+		if status != tt.status {
+			t.Errorf("%s %s: got status %d, want %d: %v", tt.method, tt.path, status, tt.status, body)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config holds the application settings read from the environment
+type Config struct {
+	DeletePolicies DeletePolicies
+	// TrashRetention is how long deleted records stay in the trash before they are purged
+	TrashRetention time.Duration
+	// TrashPurgeInterval is how often the purge job runs
+	TrashPurgeInterval time.Duration
+	// MaxPageSize is the largest number of records a list endpoint returns at once
+	MaxPageSize int
+	// AllowRegexMatch lets clients filter the list endpoints with regular expressions
+	AllowRegexMatch bool
+	Auth            AuthConfig
+	Policy          Policy
+	Tenancy         TenancyConfig
+}
+
+// loadConfig reads the configuration from the environment, applying defaults for unset variables
+func loadConfig() (Config, error) {
+	var config Config
+	var err error
+
+	config.DeletePolicies.CategorySpecies, err = parseDeletePolicy("DELETE_POLICY_CATEGORY_SPECIES")
+	if err != nil {
+		return config, err
+	}
+
+	config.DeletePolicies.SpeciesAnimals, err = parseDeletePolicy("DELETE_POLICY_SPECIES_ANIMALS")
+	if err != nil {
+		return config, err
+	}
+
+	config.TrashRetention, err = parseDuration("TRASH_RETENTION", 30*24*time.Hour)
+	if err != nil {
+		return config, err
+	}
+
+	config.TrashPurgeInterval, err = parseDuration("TRASH_PURGE_INTERVAL", time.Hour)
+	if err != nil {
+		return config, err
+	}
+
+	config.MaxPageSize, err = parsePositiveInt("MAX_PAGE_SIZE", 100)
+	if err != nil {
+		return config, err
+	}
+
+	config.AllowRegexMatch, err = parseBool("ALLOW_REGEX_MATCH", false)
+	if err != nil {
+		return config, err
+	}
+
+	config.Auth, err = loadAuthConfig()
+	if err != nil {
+		return config, err
+	}
+
+	config.Policy, err = loadPolicy()
+	if err != nil {
+		return config, err
+	}
+	if os.Getenv("RBAC_POLICY_FILE") == "" {
+		for i := range config.Auth.APIKeys {
+			config.Auth.APIKeys[i].Roles = defaultAPIKeyRoles
+		}
+	}
+
+	config.Tenancy, err = loadTenancyConfig()
+	if err != nil {
+		return config, err
+	}
+
+	if err := loadAPIKeyTenants(&config.Auth, config.Tenancy); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// parseDeletePolicy reads a delete policy from the environment variable, defaulting to restrict
+func parseDeletePolicy(name string) (DeletePolicy, error) {
+	switch policy := DeletePolicy(os.Getenv(name)); policy {
+	case "":
+		return DeleteRestrict, nil
+	case DeleteRestrict, DeleteCascade, DeleteNullify:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("%s: unknown delete policy %q", name, policy)
+	}
+}
+
+// parseDuration reads a positive duration such as "720h" from the environment variable
+func parseDuration(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("%s: duration must be positive", name)
+	}
+	return duration, nil
+}
+
+// parsePositiveInt reads a positive integer from the environment variable
+func parsePositiveInt(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("%s: value must be positive", name)
+	}
+	return n, nil
+}
+
+// parseBool reads a boolean such as "true" or "0" from the environment variable
+func parseBool(name string, fallback bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", name, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DeletePolicy decides what happens to the records referencing a deleted record
+type DeletePolicy string
+
+const (
+	// DeleteRestrict refuses to delete records that are still referenced
+	DeleteRestrict DeletePolicy = "restrict"
+	// DeleteCascade deletes the referencing records as well
+	DeleteCascade DeletePolicy = "cascade"
+	// DeleteNullify clears the reference on the referencing records
+	DeleteNullify DeletePolicy = "nullify"
+)
+
+// DeletePolicies holds the delete policy of each relationship
+type DeletePolicies struct {
+	// CategorySpecies applies to the species of a deleted category
+	CategorySpecies DeletePolicy
+	// SpeciesAnimals applies to the animals of a deleted species
+	SpeciesAnimals DeletePolicy
+}
+
+// DeletePlan lists the records affected by a delete
+type DeletePlan struct {
+	DeletedCategories []primitive.ObjectID `json:"deleted_categories"`
+	DeletedSpecies    []primitive.ObjectID `json:"deleted_species"`
+	DeletedAnimals    []primitive.ObjectID `json:"deleted_animals"`
+	NullifiedSpecies  []primitive.ObjectID `json:"nullified_species"`
+	NullifiedAnimals  []primitive.ObjectID `json:"nullified_animals"`
+}
+
+// DependentsError reports a delete refused by the restrict policy
+type DependentsError struct {
+	Entity     string                          `json:"entity"`
+	ID         primitive.ObjectID              `json:"id"`
+	Dependents map[string][]primitive.ObjectID `json:"dependents"`
+}
+
+func (e *DependentsError) Error() string {
+	return fmt.Sprintf("%s %s is still referenced", e.Entity, e.ID.Hex())
+}
+
+// errNoTransactions is returned for deletes that change more than one record on a store without
+// transactions, where a failure halfway would leave some of the changes in place
+var errNoTransactions = errors.New("the delete changes several records and the store has no transactions")
+
+// deletePlanner works out which records a delete affects under the configured policies
+type deletePlanner struct {
+	store    Store
+	policies DeletePolicies
+	// ifMatch is the If-Match header of the request, checked against the record the delete starts from
+	ifMatch string
+	plan    DeletePlan
+}
+
+func newDeletePlanner(store Store, policies DeletePolicies) *deletePlanner {
+	return &deletePlanner{
+		store:    store,
+		policies: policies,
+		plan: DeletePlan{
+			DeletedCategories: []primitive.ObjectID{},
+			DeletedSpecies:    []primitive.ObjectID{},
+			DeletedAnimals:    []primitive.ObjectID{},
+			NullifiedSpecies:  []primitive.ObjectID{},
+			NullifiedAnimals:  []primitive.ObjectID{},
+		},
+	}
+}
+
+// category plans the delete of a category and, depending on the policy, its species
+func (p *deletePlanner) category(ctx context.Context, id primitive.ObjectID) error {
+	category, err := live(p.store.Categories().Get(ctx, id))
+	if err != nil {
+		return err
+	}
+	if err := p.checkIfMatch(category.Version); err != nil {
+		return err
+	}
+
+	species, err := p.store.Species().ListByCategory(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if len(species) > 0 {
+		switch p.policies.CategorySpecies {
+		case DeleteCascade:
+			for _, specie := range species {
+				if err := p.species(ctx, specie.ID); err != nil {
+					return err
+				}
+			}
+		case DeleteNullify:
+			for _, specie := range species {
+				p.plan.NullifiedSpecies = append(p.plan.NullifiedSpecies, specie.ID)
+			}
+		default:
+			ids := make([]primitive.ObjectID, len(species))
+			for i, specie := range species {
+				ids[i] = specie.ID
+			}
+			return &DependentsError{Entity: "category", ID: id, Dependents: map[string][]primitive.ObjectID{"species": ids}}
+		}
+	}
+
+	p.plan.DeletedCategories = append(p.plan.DeletedCategories, id)
+	return nil
+}
+
+// species plans the delete of a species and, depending on the policy, its animals
+func (p *deletePlanner) species(ctx context.Context, id primitive.ObjectID) error {
+	species, err := live(p.store.Species().Get(ctx, id))
+	if err != nil {
+		return err
+	}
+	if err := p.checkIfMatch(species.Version); err != nil {
+		return err
+	}
+
+	animals, err := p.store.Animals().ListBySpecies(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if len(animals) > 0 {
+		switch p.policies.SpeciesAnimals {
+		case DeleteCascade:
+			for _, animal := range animals {
+				p.plan.DeletedAnimals = append(p.plan.DeletedAnimals, animal.ID)
+			}
+		case DeleteNullify:
+			for _, animal := range animals {
+				p.plan.NullifiedAnimals = append(p.plan.NullifiedAnimals, animal.ID)
+			}
+		default:
+			ids := make([]primitive.ObjectID, len(animals))
+			for i, animal := range animals {
+				ids[i] = animal.ID
+			}
+			return &DependentsError{Entity: "species", ID: id, Dependents: map[string][]primitive.ObjectID{"animals": ids}}
+		}
+	}
+
+	p.plan.DeletedSpecies = append(p.plan.DeletedSpecies, id)
+	return nil
+}
+
+// animal plans the delete of an animal, nothing references animals
+func (p *deletePlanner) animal(ctx context.Context, id primitive.ObjectID) error {
+	animal, err := live(p.store.Animals().Get(ctx, id))
+	if err != nil {
+		return err
+	}
+	if err := p.checkIfMatch(animal.Version); err != nil {
+		return err
+	}
+
+	p.plan.DeletedAnimals = append(p.plan.DeletedAnimals, id)
+	return nil
+}
+
+// checkIfMatch compares the If-Match header with the version of the first record planned, the
+// records reached through the delete policies aren't checked
+func (p *deletePlanner) checkIfMatch(version int64) error {
+	ifMatch := p.ifMatch
+	p.ifMatch = ""
+	if ifMatch != "" && !matchETag(ifMatch, etag(version), false) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// records counts the records the plan changes
+func (plan *DeletePlan) records() int {
+	return len(plan.DeletedCategories) + len(plan.DeletedSpecies) + len(plan.DeletedAnimals) +
+		len(plan.NullifiedSpecies) + len(plan.NullifiedAnimals)
+}
+
+// apply carries out the plan, clearing references and moving the deleted records to the trash
+func (plan *DeletePlan) apply(ctx context.Context, store Store, deletion Deletion) error {
+	for _, id := range plan.NullifiedAnimals {
+		animal, err := store.Animals().Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		animal.Species = primitive.NilObjectID
+		if err := store.Animals().Update(ctx, animal); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range plan.NullifiedSpecies {
+		species, err := store.Species().Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		species.Category = primitive.NilObjectID
+		if err := store.Species().Update(ctx, species); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range plan.DeletedAnimals {
+		animal, err := store.Animals().Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		animal.Deletion = deletion
+		if err := store.Animals().Update(ctx, animal); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range plan.DeletedSpecies {
+		species, err := store.Species().Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		species.Deletion = deletion
+		if err := store.Species().Update(ctx, species); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range plan.DeletedCategories {
+		category, err := store.Categories().Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		category.Deletion = deletion
+		if err := store.Categories().Update(ctx, category); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteWithPolicies plans a delete with planFn and applies it in a transaction, the deleted
+// records stay in the trash until they are restored or purged. Deletes that change several
+// records are refused when the store has no transactions. With ?dry_run=true the plan is only
+// reported.
+func (s *server) deleteWithPolicies(c *fiber.Ctx, name string, planFn func(ctx context.Context, p *deletePlanner) error) error {
+	dryRun := c.QueryBool("dry_run")
+	now := time.Now().UTC()
+	deletion := Deletion{DeletedAt: &now, DeletedBy: s.requestActor(c)}
+
+	var plan DeletePlan
+	err := s.auditedStore(c).WithTransaction(c.UserContext(), func(ctx context.Context, tx Store) error {
+		p := newDeletePlanner(tx, s.config.DeletePolicies)
+		p.ifMatch = c.Get(fiber.HeaderIfMatch)
+		if err := planFn(ctx, p); err != nil {
+			return err
+		}
+
+		plan = p.plan
+		if dryRun {
+			return nil
+		}
+		if plan.records() > 1 && !tx.Transactional() {
+			return errNoTransactions
+		}
+		return plan.apply(ctx, tx, deletion)
+	})
+
+	if err != nil {
+		return entityProblem(c, name, err)
+	}
+
+	if dryRun {
+		return c.JSON(fiber.Map{"dry_run": true, "affected": plan})
+	}
+	return c.JSON(fiber.Map{"success": "true", "affected": plan})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// errPreconditionFailed is returned when the If-Match header doesn't match the current version
+var errPreconditionFailed = errors.New("precondition failed")
+
+// etag returns the entity tag of a record version
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// matchETag reports whether the If-Match or If-None-Match header lists the entity tag. "*"
+// matches any tag, weak comparison also accepts the weak form W/"tag".
+func matchETag(header, tag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch returns errPreconditionFailed when the request has an If-Match header that
+// doesn't match the current version of the record
+func checkIfMatch(c *fiber.Ctx, version int64) error {
+	if ifMatch := c.Get(fiber.HeaderIfMatch); ifMatch != "" && !matchETag(ifMatch, etag(version), false) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// notModified reports whether the If-None-Match header of the request matches the current
+// version of the record, in which case the client's copy is up to date
+func notModified(c *fiber.Ctx, version int64) bool {
+	ifNoneMatch := c.Get(fiber.HeaderIfNoneMatch)
+	return ifNoneMatch != "" && matchETag(ifNoneMatch, etag(version), true)
+}
+
+// preconditionFailed is the problem of a write whose If-Match header is out of date
+func preconditionFailed(name string) *Problem {
+	return newProblem(fiber.StatusPreconditionFailed, "precondition_failed",
+		name+" has been modified since the version given in If-Match")
+}
+
+// versionConflict is the problem of a write that lost the race against a concurrent change.
+// Requests with If-Match asked for exactly this check, the others are told to retry.
+func versionConflict(c *fiber.Ctx, name string) *Problem {
+	if c.Get(fiber.HeaderIfMatch) != "" {
+		return preconditionFailed(name)
+	}
+	return newProblem(fiber.StatusConflict, "version_conflict", name+" was modified concurrently, retry the request")
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// filterType is the type of a field that can be filtered on, it decides how values are parsed
+type filterType int
+
+const (
+	filterString filterType = iota
+	filterDate
+	filterID
+)
+
+// Fields the list endpoints can be filtered on
+var (
+	animalFilterFields = map[string]filterType{
+		"animal_name": filterString,
+		"birthdate":   filterDate,
+		"species":     filterString,
+		"category":    filterString,
+	}
+	speciesFilterFields = map[string]filterType{
+		"species_name": filterString,
+		"image":        filterString,
+		"category":     filterID,
+	}
+	categoryFilterFields = map[string]filterType{
+		"category_name": filterString,
+	}
+)
+
+// filterOps maps the comparison operators of the filter syntax to their ops
+var filterOps = map[string]FilterOp{
+	"=":  FilterEq,
+	"!=": FilterNe,
+	">":  FilterGt,
+	">=": FilterGte,
+	"<":  FilterLt,
+	"<=": FilterLte,
+}
+
+// tokenKind is the kind of a token of a filter expression
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenWord
+	tokenString
+	tokenOp
+	tokenAnd
+	tokenOr
+	tokenOpen
+	tokenClose
+)
+
+// filterToken is a token of a filter expression and its byte offset in the expression
+type filterToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// parseFilter parses a filter expression like "birthdate>=2020-01-01;category=in(Mammals,Birds)"
+// into a Filter over the given fields. Conditions compare a field with =, !=, <, <=, > or >=, or
+// check it against a list with =in(...) or !=in(...). They are combined with ";" (and) and ","
+// (or), where and binds tighter, and grouped with parentheses. Values containing one of the
+// characters ;,()=!<>"' are quoted with " or '. An empty expression returns a nil filter, invalid
+// ones a *Problem giving the position of the offending token.
+func parseFilter(input string, fields map[string]filterType) (Filter, error) {
+	if strings.TrimSpace(input) == "" {
+		return nil, nil
+	}
+
+	tokens, err := lexFilter(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{input: input, tokens: tokens, fields: fields}
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token.kind != tokenEnd {
+		return nil, p.problem(token, "expected ; or , between conditions")
+	}
+	return filter, nil
+}
+
+// lexFilter splits a filter expression into tokens, ending with a tokenEnd
+func lexFilter(input string) ([]filterToken, error) {
+	var tokens []filterToken
+	for pos := 0; pos < len(input); {
+		switch ch := input[pos]; {
+		case ch == ' ' || ch == '\t':
+			pos++
+		case ch == ';':
+			tokens = append(tokens, filterToken{tokenAnd, ";", pos})
+			pos++
+		case ch == ',':
+			tokens = append(tokens, filterToken{tokenOr, ",", pos})
+			pos++
+		case ch == '(':
+			tokens = append(tokens, filterToken{tokenOpen, "(", pos})
+			pos++
+		case ch == ')':
+			tokens = append(tokens, filterToken{tokenClose, ")", pos})
+			pos++
+		case strings.ContainsRune("=!<>", rune(ch)):
+			op := input[pos : pos+1]
+			if pos+1 < len(input) && input[pos+1] == '=' && ch != '=' {
+				op = input[pos : pos+2]
+			}
+			if _, ok := filterOps[op]; !ok {
+				return nil, filterProblem(input, filterToken{tokenOp, op, pos}, "unknown operator")
+			}
+			tokens = append(tokens, filterToken{tokenOp, op, pos})
+			pos += len(op)
+		case ch == '"' || ch == '\'':
+			var text strings.Builder
+			end := pos + 1
+			for ; end < len(input) && input[end] != ch; end++ {
+				if input[end] == '\\' && end+1 < len(input) {
+					end++
+				}
+				text.WriteByte(input[end])
+			}
+			if end == len(input) {
+				return nil, filterProblem(input, filterToken{tokenString, input[pos:], pos}, "unterminated quoted value")
+			}
+			tokens = append(tokens, filterToken{tokenString, text.String(), pos})
+			pos = end + 1
+		default:
+			end := pos
+			for end < len(input) && !strings.ContainsRune(";,()=!<>\"'", rune(input[end])) {
+				end++
+			}
+			tokens = append(tokens, filterToken{tokenWord, strings.TrimRight(input[pos:end], " \t"), pos})
+			pos = end
+		}
+	}
+	return append(tokens, filterToken{kind: tokenEnd, pos: len(input)}), nil
+}
+
+// filterParser is a recursive descent parser over the tokens of a filter expression
+type filterParser struct {
+	input  string
+	tokens []filterToken
+	next   int
+	fields map[string]filterType
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) take() filterToken {
+	token := p.tokens[p.next]
+	if token.kind != tokenEnd {
+		p.next++
+	}
+	return token
+}
+
+// parseOr parses conditions separated by ","
+func (p *filterParser) parseOr() (Filter, error) {
+	var or FilterOr
+	for {
+		filter, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, filter)
+		if p.peek().kind != tokenOr {
+			break
+		}
+		p.take()
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+// parseAnd parses conditions separated by ";"
+func (p *filterParser) parseAnd() (Filter, error) {
+	var and FilterAnd
+	for {
+		filter, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, filter)
+		if p.peek().kind != tokenAnd {
+			break
+		}
+		p.take()
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+// parseTerm parses a condition or a parenthesized expression
+func (p *filterParser) parseTerm() (Filter, error) {
+	if p.peek().kind != tokenOpen {
+		return p.parseCondition()
+	}
+
+	p.take()
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.take(); token.kind != tokenClose {
+		return nil, p.problem(token, "expected )")
+	}
+	return filter, nil
+}
+
+// parseCondition parses a field, an operator and a value or a list of values
+func (p *filterParser) parseCondition() (Filter, error) {
+	field := p.take()
+	if field.kind != tokenWord {
+		return nil, p.problem(field, "expected a field name")
+	}
+	fieldType, ok := p.fields[field.text]
+	if !ok {
+		return nil, p.problem(field, fmt.Sprintf("unknown field %q, filterable fields are %s", field.text, p.fieldNames()))
+	}
+
+	op := p.take()
+	if op.kind != tokenOp {
+		return nil, p.problem(op, "expected an operator: =, !=, <, <=, >, >= or =in(...)")
+	}
+	condition := FilterCondition{Field: field.text, Op: filterOps[op.text]}
+
+	// A list of values, which a quoted "in" isn't
+	if token := p.peek(); token.kind == tokenWord && token.text == "in" && p.tokens[p.next+1].kind == tokenOpen {
+		switch condition.Op {
+		case FilterEq:
+			condition.Op = FilterIn
+		case FilterNe:
+			condition.Op = FilterNin
+		default:
+			return nil, p.problem(op, "lists can only be compared with = or !=")
+		}
+		p.take()
+		p.take()
+		for {
+			value, err := p.parseValue(fieldType)
+			if err != nil {
+				return nil, err
+			}
+			condition.Values = append(condition.Values, value)
+			if p.peek().kind != tokenOr {
+				break
+			}
+			p.take()
+		}
+		if token := p.take(); token.kind != tokenClose {
+			return nil, p.problem(token, "expected , or ) in the list")
+		}
+		return condition, nil
+	}
+
+	value, err := p.parseValue(fieldType)
+	if err != nil {
+		return nil, err
+	}
+	condition.Values = []interface{}{value}
+	return condition, nil
+}
+
+// parseValue parses a value of the given type
+func (p *filterParser) parseValue(fieldType filterType) (interface{}, error) {
+	token := p.take()
+	if token.kind != tokenWord && token.kind != tokenString {
+		return nil, p.problem(token, "expected a value")
+	}
+
+	switch fieldType {
+	case filterDate:
+		for _, layout := range []string{time.DateOnly, time.RFC3339} {
+			if t, err := time.Parse(layout, token.text); err == nil {
+				return primitive.NewDateTimeFromTime(t), nil
+			}
+		}
+		return nil, p.problem(token, "expected a date like 2020-01-31 or 2020-01-31T12:00:00Z")
+	case filterID:
+		id, err := primitive.ObjectIDFromHex(token.text)
+		if err != nil {
+			return nil, p.problem(token, "expected an ID")
+		}
+		return id, nil
+	default:
+		return token.text, nil
+	}
+}
+
+// fieldNames lists the filterable fields for error messages
+func (p *filterParser) fieldNames() string {
+	var names []string
+	for name := range p.fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+func (p *filterParser) problem(token filterToken, message string) *Problem {
+	return filterProblem(p.input, token, message)
+}
+
+// filterProblem is the problem of an invalid filter expression. It points at the offending
+// token with its text and its position, counting characters from 1.
+func filterProblem(input string, token filterToken, message string) *Problem {
+	position := utf8.RuneCountInString(input[:token.pos]) + 1
+	var detail string
+	if token.kind == tokenEnd {
+		detail = fmt.Sprintf("Invalid filter at the end: %s", message)
+	} else {
+		detail = fmt.Sprintf("Invalid filter at position %d (%q): %s", position, token.text, message)
+	}
+	problem := newProblem(fiber.StatusBadRequest, "invalid_filter", detail)
+	problem.Extensions = fiber.Map{"position": position, "token": token.text}
+	return problem
+}
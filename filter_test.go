@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testStores returns the stores the filter tests run against, each one empty
+func testStores(t *testing.T) map[string]func() Store {
+	t.Helper()
+	return map[string]func() Store{
+		"memory": func() Store { return newMemoryStore() },
+		"sqlite": func() Store {
+			store, err := newSQLStore(context.Background(), sqliteDialect, filepath.Join(t.TempDir(), "zoo.db"))
+			if err != nil {
+				t.Fatalf("opening the sqlite store: %v", err)
+			}
+			t.Cleanup(func() { store.Close(context.Background()) })
+			return store
+		},
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	id := primitive.NewObjectID()
+	date := primitive.NewDateTimeFromTime(time.Date(2020, 1, 31, 0, 0, 0, 0, time.UTC))
+	tests := []struct {
+		input  string
+		fields map[string]filterType
+		want   Filter
+	}{
+		{"", animalFilterFields, nil},
+		{"  ", animalFilterFields, nil},
+		{"animal_name=Leo", animalFilterFields, FilterCondition{"animal_name", FilterEq, []interface{}{"Leo"}}},
+		{"animal_name != 'Leo, the lion'", animalFilterFields, FilterCondition{"animal_name", FilterNe, []interface{}{"Leo, the lion"}}},
+		{`animal_name="say \"hi\""`, animalFilterFields, FilterCondition{"animal_name", FilterEq, []interface{}{`say "hi"`}}},
+		{"birthdate>=2020-01-31", animalFilterFields, FilterCondition{"birthdate", FilterGte, []interface{}{date}}},
+		{"birthdate<2020-01-31T00:00:00Z", animalFilterFields, FilterCondition{"birthdate", FilterLt, []interface{}{date}}},
+		{"species=in(Lion,Tiger)", animalFilterFields, FilterCondition{"species", FilterIn, []interface{}{"Lion", "Tiger"}}},
+		{"species!=in(Lion)", animalFilterFields, FilterCondition{"species", FilterNin, []interface{}{"Lion"}}},
+		{"species='in'", animalFilterFields, FilterCondition{"species", FilterEq, []interface{}{"in"}}},
+		{"category=" + id.Hex(), speciesFilterFields, FilterCondition{"category", FilterEq, []interface{}{id}}},
+		{
+			"species=Lion;animal_name=Leo,species=Tiger", animalFilterFields,
+			FilterOr{
+				FilterAnd{
+					FilterCondition{"species", FilterEq, []interface{}{"Lion"}},
+					FilterCondition{"animal_name", FilterEq, []interface{}{"Leo"}},
+				},
+				FilterCondition{"species", FilterEq, []interface{}{"Tiger"}},
+			},
+		},
+		{
+			"species=Lion;(animal_name=Leo,animal_name=Nala)", animalFilterFields,
+			FilterAnd{
+				FilterCondition{"species", FilterEq, []interface{}{"Lion"}},
+				FilterOr{
+					FilterCondition{"animal_name", FilterEq, []interface{}{"Leo"}},
+					FilterCondition{"animal_name", FilterEq, []interface{}{"Nala"}},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseFilter(tt.input, tt.fields)
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	fields := map[string]filterType{"animal_name": filterString, "birthdate": filterDate, "category": filterID}
+	tests := []struct {
+		input    string
+		position int
+		token    string
+	}{
+		{"animal_name==Leo", 13, "="},
+		{"animal_name=<Leo", 13, "<"},
+		{"animal_name='Leo", 13, "'Leo"},
+		{"name=Leo", 1, "name"},
+		{"=Leo", 1, "="},
+		{"animal_name", 12, ""},
+		{"animal_name=", 13, ""},
+		{"animal_name=Leo;", 17, ""},
+		{"(animal_name=Leo", 17, ""},
+		{"animal_name=Leo)", 16, ")"},
+		{"animal_name=in(Leo", 19, ""},
+		{"animal_name=in(Leo;Nala)", 19, ";"},
+		{"animal_name<in(Leo)", 12, "<"},
+		{"birthdate>=31/01/2020", 12, "31/01/2020"},
+		{"category=nope", 10, "nope"},
+		// Positions count characters, not bytes
+		{"animal_name='Léo';ä", 19, "ä"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := parseFilter(tt.input, fields)
+			var problem *Problem
+			if !errors.As(err, &problem) {
+				t.Fatalf("got error %v, want a problem", err)
+			}
+			if problem.Code != "invalid_filter" || problem.Status != fiber.StatusBadRequest {
+				t.Errorf("got %d %s, want %d invalid_filter", problem.Status, problem.Code, fiber.StatusBadRequest)
+			}
+			if problem.Extensions["position"] != tt.position || problem.Extensions["token"] != tt.token {
+				t.Errorf("got position %v and token %q, want %d and %q: %s",
+					problem.Extensions["position"], problem.Extensions["token"], tt.position, tt.token, problem.Detail)
+			}
+		})
+	}
+}
+
+// Animals without a species only match the negated conditions, the same way in every store
+func TestFilterMissingFields(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"species=Lion", []string{"Leo"}},
+		{"species!=Lion", []string{"Nobody", "Tigger"}},
+		{"species=in(Lion,Tiger)", []string{"Leo", "Tigger"}},
+		{"species!=in(Lion)", []string{"Nobody", "Tigger"}},
+		{"species!=in(Lion,Tiger)", []string{"Nobody"}},
+		{"species>A", []string{"Leo", "Tigger"}},
+		{"species!=Lion;animal_name!=Nobody", []string{"Tigger"}},
+		{"species=Lion,species!=in(Lion,Tiger)", []string{"Leo", "Nobody"}},
+	}
+	for name, newStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			app := newApp(newServer(newStore(), testConfig()))
+			lion := create(t, app, "/api/species", `{"species_name":"Lion","image":"lion.jpg"}`)
+			tiger := create(t, app, "/api/species", `{"species_name":"Tiger","image":"tiger.jpg"}`)
+			create(t, app, "/api/animals", `{"animal_name":"Leo","birthdate":"2020-01-02T00:00:00Z","species":"`+lion+`"}`)
+			create(t, app, "/api/animals", `{"animal_name":"Tigger","birthdate":"2020-01-02T00:00:00Z","species":"`+tiger+`"}`)
+			create(t, app, "/api/animals", `{"animal_name":"Nobody","birthdate":"2020-01-02T00:00:00Z"}`)
+
+			for _, tt := range tests {
+				status, body := send(t, app, fiber.MethodGet, "/api/animals?sort=animal_name&filter="+url.QueryEscape(tt.filter), "")
+				records, _ := body.([]any)
+				var got []string
+				for _, record := range records {
+					got = append(got, field(record, "animal_name").(string))
+				}
+				if status != fiber.StatusOK || !slices.Equal(got, tt.want) {
+					t.Errorf("%s: got status %d and %v, want %d and %v", tt.filter, status, got, fiber.StatusOK, tt.want)
+				}
+			}
+		})
+	}
+}
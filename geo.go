@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// earthRadius is the radius distances are computed with in meters, the one MongoDB uses
+const earthRadius = 6378100
+
+// geoDistance returns the great-circle distance between two [longitude, latitude] positions
+// in meters
+func geoDistance(a, b []float64) float64 {
+	lat1, lat2 := a[1]*math.Pi/180, b[1]*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b[0] - a[0]) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// ringContains reports whether the position lies inside the closed ring or on its boundary,
+// treating longitude and latitude as plane coordinates
+func ringContains(ring [][]float64, position []float64) bool {
+	x, y := position[0], position[1]
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi, xj, yj := ring[i][0], ring[i][1], ring[j][0], ring[j][1]
+		// On the edge from j to i
+		if (x-xi)*(yj-yi) == (y-yi)*(xj-xi) && math.Min(xi, xj) <= x && x <= math.Max(xi, xj) &&
+			math.Min(yi, yj) <= y && y <= math.Max(yi, yj) {
+			return true
+		}
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// matchGeo reports whether a record matches the geo query and returns the distance of its
+// location from the near position. The area is matched against the location and the habitat,
+// which is nil for records without one.
+func matchGeo(geo GeoQuery, location Geometry, habitat *Geometry) (distance *float64, ok bool) {
+	if geo.Near == nil && geo.Area == nil {
+		return nil, true
+	}
+	if geo.Area != nil && !geometryIntersects(&location, geo.Area) && !geometryIntersects(habitat, geo.Area) {
+		return nil, false
+	}
+	if geo.Near != nil {
+		parts, err := location.parts()
+		if location.IsZero() || err != nil {
+			return nil, false
+		}
+		d := parts.distance(geo.Near)
+		if geo.MaxDistance > 0 && d > geo.MaxDistance {
+			return nil, false
+		}
+		distance = &d
+	}
+	return distance, true
+}
+
+// geometryIntersects reports whether a stored geometry shares a point with the area inside the
+// ring, missing and invalid geometries don't
+func geometryIntersects(geometry *Geometry, ring [][]float64) bool {
+	if geometry == nil || geometry.IsZero() {
+		return false
+	}
+	parts, err := geometry.parts()
+	return err == nil && parts.intersects(ring)
+}
+
+// sortable adds the distance to the sortable fields of near queries
+func (g GeoQuery) sortable(fields []string) []string {
+	if g.Near == nil {
+		return fields
+	}
+	return append(append([]string{}, fields...), "distance")
+}
+
+// defaultSort sorts near queries nearest first
+func (g GeoQuery) defaultSort() []SortKey {
+	if g.Near == nil {
+		return nil
+	}
+	return []SortKey{{Field: "distance"}}
+}
+
+// geoQuery reads the geospatial query parameters of the list endpoints: near (a "lat,lng"
+// position) with an optional max_distance in meters, and either bbox
+// ("min_lng,min_lat,max_lng,max_lat") or within (a GeoJSON Polygon without holes)
+func geoQuery(c *fiber.Ctx) (GeoQuery, error) {
+	var geo GeoQuery
+	if near := c.Query("near"); near != "" {
+		values, err := parseFloats(near, 2)
+		if err != nil || !validPosition(values[1], values[0]) {
+			return geo, invalidParameter("near must be a latitude between -90 and 90 and a longitude between -180 and 180, like 60.17,24.94")
+		}
+		geo.Near = []float64{values[1], values[0]}
+	}
+
+	if maxDistance := c.Query("max_distance"); maxDistance != "" {
+		d, err := strconv.ParseFloat(maxDistance, 64)
+		switch {
+		case err != nil || !(d > 0) || math.IsInf(d, 0):
+			return geo, invalidParameter("max_distance must be a positive number of meters")
+		case geo.Near == nil:
+			return geo, invalidParameter("max_distance needs near")
+		}
+		geo.MaxDistance = d
+	}
+
+	bbox, within := c.Query("bbox"), c.Query("within")
+	switch {
+	case bbox != "" && within != "":
+		return geo, invalidParameter("Use either bbox or within")
+	case bbox != "":
+		b, err := parseFloats(bbox, 4)
+		if err != nil || !validPosition(b[0], b[1]) || !validPosition(b[2], b[3]) || b[0] >= b[2] || b[1] >= b[3] {
+			return geo, invalidParameter("bbox must be min_lng,min_lat,max_lng,max_lat with the minimums below the maximums")
+		}
+		geo.Area = [][]float64{{b[0], b[1]}, {b[2], b[1]}, {b[2], b[3]}, {b[0], b[3]}, {b[0], b[1]}}
+	case within != "":
+		var polygon struct {
+			Type        string        `json:"type"`
+			Coordinates [][][]float64 `json:"coordinates"`
+		}
+		if err := json.Unmarshal([]byte(within), &polygon); err != nil || polygon.Type != "Polygon" {
+			return geo, invalidParameter("within must be a GeoJSON Polygon")
+		}
+		if len(polygon.Coordinates) != 1 {
+			return geo, invalidParameter("within must be a Polygon with one ring")
+		}
+		if err := validateRing(polygon.Coordinates[0]); err != nil {
+			return geo, invalidParameter("within: " + err.Error())
+		}
+		geo.Area = polygon.Coordinates[0]
+	}
+	return geo, nil
+}
+
+// validateRing checks that a linear ring has at least four and at most maxRingPositions valid
+// positions and is closed
+func validateRing(ring [][]float64) error {
+	if len(ring) < 4 {
+		return fmt.Errorf("a ring needs at least 4 positions")
+	}
+	if len(ring) > maxRingPositions {
+		return fmt.Errorf("a ring can have at most %d positions", maxRingPositions)
+	}
+	for _, position := range ring {
+		if !validCoordinates(position) {
+			return errInvalidPosition
+		}
+	}
+	first, last := ring[0], ring[len(ring)-1]
+	if first[0] != last[0] || first[1] != last[1] {
+		return fmt.Errorf("a ring must end with its first position")
+	}
+	return nil
+}
+
+// validPosition reports whether the longitude and latitude are in range
+func validPosition(lng, lat float64) bool {
+	return lng >= -180 && lng <= 180 && lat >= -90 && lat <= 90
+}
+
+// parseFloats parses a comma-separated list of n numbers
+func parseFloats(value string, n int) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != n {
+		return nil, fmt.Errorf("expected %d numbers", n)
+	}
+	values := make([]float64, n)
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Geofence is a named area animals are expected to stay in. It applies to the animals it lists
+// and to every animal of the species it lists.
+type Geofence struct {
+	ID      primitive.ObjectID   `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name    string               `json:"name" bson:"name" validate:"notblank"`
+	Area    Geometry             `json:"area" bson:"area" validate:"required,geometry,area"`
+	Animals []primitive.ObjectID `json:"animals" bson:"animals" swaggertype:"array,string"`
+	Species []primitive.ObjectID `json:"species" bson:"species" swaggertype:"array,string"`
+	Version int64                `json:"version" bson:"version"`
+	Tenant  string               `json:"-" bson:"tenant,omitempty"`
+}
+
+// appliesTo reports whether the geofence watches the animal
+func (g Geofence) appliesTo(animal *Animal) bool {
+	return slices.Contains(g.Animals, animal.ID) || (!animal.Species.IsZero() && slices.Contains(g.Species, animal.Species))
+}
+
+// contains reports whether the position lies inside the area of the geofence
+func (g Geofence) contains(position []float64) bool {
+	parts, err := g.Area.parts()
+	if err != nil {
+		return false
+	}
+	for _, polygon := range parts.polygons {
+		if polygonContains(polygon, position) {
+			return true
+		}
+	}
+	return false
+}
+
+// Alert statuses, alerts are raised open and can be acknowledged before they are resolved
+const (
+	AlertOpen         = "open"
+	AlertAcknowledged = "acknowledged"
+	AlertResolved     = "resolved"
+)
+
+// alertStatuses lists the statuses in the order alerts go through them
+var alertStatuses = []string{AlertOpen, AlertAcknowledged, AlertResolved}
+
+// AlertGeofenceExit is the type of the alerts raised for animals found outside a geofence
+const AlertGeofenceExit = "geofence_exit"
+
+// Alert is raised when an animal is found outside a geofence that applies to it
+type Alert struct {
+	ID         primitive.ObjectID `json:"_id" bson:"_id"`
+	Type       string             `json:"type" bson:"type" example:"geofence_exit"`
+	AnimalID   primitive.ObjectID `json:"animal" bson:"animal"`
+	GeofenceID primitive.ObjectID `json:"geofence" bson:"geofence"`
+	// Location is where the animal was when the alert was raised
+	Location       Point      `json:"location" bson:"location"`
+	Status         string     `json:"status" bson:"status" example:"open"`
+	RaisedAt       time.Time  `json:"raised_at" bson:"raised_at"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty" bson:"acknowledged_at,omitempty"`
+	AcknowledgedBy string     `json:"acknowledged_by,omitempty" bson:"acknowledged_by,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty" bson:"resolved_at,omitempty"`
+	ResolvedBy     string     `json:"resolved_by,omitempty" bson:"resolved_by,omitempty"`
+	Version        int64      `json:"version" bson:"version"`
+	Tenant         string     `json:"-" bson:"tenant,omitempty"`
+}
+
+// checkGeofences raises an alert for every geofence of the animal its location lies outside of.
+// An animal that is still outside a geofence it already has an unresolved alert for doesn't get
+// another one.
+func checkGeofences(ctx context.Context, tx Store, animal *Animal) error {
+	if animal.Location.IsZero() {
+		return nil
+	}
+	geofences, err := tx.Geofences().List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, geofence := range geofences {
+		if !geofence.appliesTo(animal) || geofence.contains(animal.Location.Coordinates) {
+			continue
+		}
+		unresolved, err := tx.Alerts().List(ctx, AlertQuery{
+			Statuses:   []string{AlertOpen, AlertAcknowledged},
+			AnimalID:   animal.ID,
+			GeofenceID: geofence.ID,
+			Limit:      1,
+		})
+		if err != nil {
+			return err
+		}
+		if len(unresolved) > 0 {
+			continue
+		}
+		err = tx.Alerts().Create(ctx, &Alert{
+			ID:         primitive.NewObjectID(),
+			Type:       AlertGeofenceExit,
+			AnimalID:   animal.ID,
+			GeofenceID: geofence.ID,
+			Location:   animal.Location,
+			Status:     AlertOpen,
+			RaisedAt:   time.Now().UTC().Truncate(time.Millisecond),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Geofence handlers
+// Get all geofences
+// @Summary Get all geofences
+// @Description Get every geofence, sorted by name
+// @Tags geofences
+// @Accept json
+// @Produce json
+// @Success 200 {array} Geofence
+// @Failure 500 {object} Problem
+// @Router /geofences [get]
+func (s *server) getGeofences(c *fiber.Ctx) error {
+	geofences, err := s.store.Geofences().List(c.UserContext())
+	if err != nil {
+		return err
+	}
+	return c.JSON(geofences)
+}
+
+// Get a geofence by ID
+// @Summary Get a geofence by ID
+// @Description Get a geofence by its ID
+// @Tags geofences
+// @Accept json
+// @Produce json
+// @Param id path string true "Geofence ID"
+// @Param If-None-Match header string false "ETag of a cached copy"
+// @Success 200 {object} Geofence
+// @Header 200 {string} ETag "Version of the geofence"
+// @Success 304 {string} string "Not Modified"
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Router /geofences/{id} [get]
+func (s *server) getGeofenceByID(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return invalidID("Invalid ID")
+	}
+
+	geofence, err := s.store.Geofences().Get(c.UserContext(), id)
+	if err != nil {
+		return entityProblem(c, "Geofence", err)
+	}
+
+	c.Set(fiber.HeaderETag, etag(geofence.Version))
+	if notModified(c, geofence.Version) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	return c.JSON(geofence)
+}
+
+// Create a geofence
+// @Summary Create a new geofence
+// @Description Create a geofence, a Polygon or MultiPolygon area that the listed animals and the animals of the listed species are expected to stay in. Animals are checked against it whenever their location changes.
+// @Tags geofences
+// @Accept json
+// @Produce json
+// @Param geofence body Geofence true "Geofence"
+// @Success 201 {object} Geofence
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /geofences [post]
+func (s *server) createGeofence(c *fiber.Ctx) error {
+	geofence := new(Geofence)
+	if err := decodeJSONBody(c, geofence); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid_body", err.Error())
+	}
+	geofence.ID = primitive.NilObjectID
+
+	if err := s.checkGeofence(c.UserContext(), geofence); err != nil {
+		return err
+	}
+	if err := s.auditedStore(c).Geofences().Create(c.UserContext(), geofence); err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderETag, etag(geofence.Version))
+	return c.Status(201).JSON(geofence)
+}
+
+// Replace a geofence
+// @Summary Replace a geofence
+// @Description Replace the name, area and links of a geofence. Animals are checked against the new area the next time their location changes.
+// @Tags geofences
+// @Accept json
+// @Produce json
+// @Param id path string true "Geofence ID"
+// @Param If-Match header string false "ETag the geofence must still have"
+// @Param geofence body Geofence true "Geofence"
+// @Success 200 {object} Geofence
+// @Header 200 {string} ETag "New version of the geofence"
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 412 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /geofences/{id} [put]
+func (s *server) replaceGeofence(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return invalidID("Invalid ID")
+	}
+
+	current, err := s.store.Geofences().Get(c.UserContext(), id)
+	if err != nil {
+		return entityProblem(c, "Geofence", err)
+	}
+	if err := checkIfMatch(c, current.Version); err != nil {
+		return preconditionFailed("Geofence")
+	}
+
+	geofence := new(Geofence)
+	if err := decodeJSONBody(c, geofence); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid_body", err.Error())
+	}
+	geofence.ID, geofence.Version = id, current.Version
+
+	if err := s.checkGeofence(c.UserContext(), geofence); err != nil {
+		return err
+	}
+	if err := s.auditedStore(c).Geofences().Update(c.UserContext(), geofence); err != nil {
+		return entityProblem(c, "Geofence", err)
+	}
+
+	c.Set(fiber.HeaderETag, etag(geofence.Version))
+	return c.JSON(geofence)
+}
+
+// Delete a geofence
+// @Summary Delete a geofence
+// @Description Permanently delete a geofence, the alerts it raised are kept
+// @Tags geofences
+// @Accept json
+// @Produce json
+// @Param id path string true "Geofence ID"
+// @Success 200 {object} Response
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /geofences/{id} [delete]
+func (s *server) deleteGeofence(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return invalidID("Invalid ID")
+	}
+
+	if err := s.auditedStore(c).Geofences().Delete(c.UserContext(), id); err != nil {
+		return entityProblem(c, "Geofence", err)
+	}
+	return c.JSON(fiber.Map{"message": "Geofence deleted successfully"})
+}
+
+// checkGeofence validates the geofence and verifies that the animals and species it lists exist
+// and aren't in the trash. Each of them is kept once.
+func (s *server) checkGeofence(ctx context.Context, geofence *Geofence) error {
+	geofence.Animals = compactIDs(geofence.Animals)
+	geofence.Species = compactIDs(geofence.Species)
+	if err := validateRecord(geofence); err != nil {
+		return err
+	}
+
+	for _, id := range geofence.Animals {
+		_, err := live(s.store.Animals().Get(ctx, id))
+		if errors.Is(err, ErrNotFound) {
+			return &ReferenceError{Field: "animals", ID: id}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range geofence.Species {
+		if id.IsZero() {
+			return &ReferenceError{Field: "species", ID: id}
+		}
+		if err := s.checkSpeciesReference(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactIDs drops repeated IDs, keeping the first of each, and never returns nil so the lists
+// are stored and answered as arrays
+func compactIDs(ids []primitive.ObjectID) []primitive.ObjectID {
+	compacted := []primitive.ObjectID{}
+	for _, id := range ids {
+		if !slices.Contains(compacted, id) {
+			compacted = append(compacted, id)
+		}
+	}
+	return compacted
+}
+
+// Alert handlers
+// Get alerts
+// @Summary Get alerts
+// @Description Get the alerts raised for animals found outside their geofences, newest first
+// @Tags alerts
+// @Accept json
+// @Produce json
+// @Param status query string false "Comma-separated statuses to keep: open, acknowledged or resolved"
+// @Param animal query string false "Animal ID"
+// @Param geofence query string false "Geofence ID"
+// @Param limit query int false "Limit" default(10)
+// @Param skip query int false "Skip"
+// @Success 200 {array} Alert
+// @Failure 400 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /alerts [get]
+func (s *server) getAlerts(c *fiber.Ctx) error {
+	var query AlertQuery
+	var err error
+	if query.Limit, err = s.pageSize(c); err != nil {
+		return err
+	}
+	if query.Skip, err = pageSkip(c); err != nil {
+		return err
+	}
+
+	if status := c.Query("status"); status != "" {
+		for _, value := range strings.Split(status, ",") {
+			value = strings.TrimSpace(value)
+			if !slices.Contains(alertStatuses, value) {
+				return invalidParameter(fmt.Sprintf("Unknown status %q, expected %s", value, strings.Join(alertStatuses, ", ")))
+			}
+			query.Statuses = append(query.Statuses, value)
+		}
+	}
+	if animal := c.Query("animal"); animal != "" {
+		if query.AnimalID, err = primitive.ObjectIDFromHex(animal); err != nil {
+			return invalidID("Invalid animal ID format")
+		}
+	}
+	if geofence := c.Query("geofence"); geofence != "" {
+		if query.GeofenceID, err = primitive.ObjectIDFromHex(geofence); err != nil {
+			return invalidID("Invalid geofence ID format")
+		}
+	}
+
+	alerts, err := s.store.Alerts().List(c.UserContext(), query)
+	if err != nil {
+		return err
+	}
+	return c.JSON(alerts)
+}
+
+// Acknowledge an alert
+// @Summary Acknowledge an alert
+// @Description Mark an open alert as seen by the actor, it stays unresolved
+// @Tags alerts
+// @Accept json
+// @Produce json
+// @Param id path string true "Alert ID"
+// @Param X-Actor header string false "Who is acknowledging the alert, when authentication is disabled"
+// @Success 200 {object} Alert
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /alerts/{id}/acknowledge [post]
+func (s *server) acknowledgeAlert(c *fiber.Ctx) error {
+	return s.changeAlert(c, func(alert *Alert, now time.Time, actor string) error {
+		if alert.Status != AlertOpen {
+			return newProblem(fiber.StatusConflict, "invalid_transition", "Only open alerts can be acknowledged, this one is "+alert.Status)
+		}
+		alert.Status, alert.AcknowledgedAt, alert.AcknowledgedBy = AlertAcknowledged, &now, actor
+		return nil
+	})
+}
+
+// Resolve an alert
+// @Summary Resolve an alert
+// @Description Close an open or acknowledged alert. The next location change that finds the animal outside the geofence raises a new one.
+// @Tags alerts
+// @Accept json
+// @Produce json
+// @Param id path string true "Alert ID"
+// @Param X-Actor header string false "Who is resolving the alert, when authentication is disabled"
+// @Success 200 {object} Alert
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /alerts/{id}/resolve [post]
+func (s *server) resolveAlert(c *fiber.Ctx) error {
+	return s.changeAlert(c, func(alert *Alert, now time.Time, actor string) error {
+		if alert.Status == AlertResolved {
+			return newProblem(fiber.StatusConflict, "invalid_transition", "Alert is already resolved")
+		}
+		alert.Status, alert.ResolvedAt, alert.ResolvedBy = AlertResolved, &now, actor
+		return nil
+	})
+}
+
+// changeAlert applies a status change to the alert in the path and answers the changed alert
+func (s *server) changeAlert(c *fiber.Ctx, change func(alert *Alert, now time.Time, actor string) error) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return invalidID("Invalid ID")
+	}
+
+	alert, err := s.store.Alerts().Get(c.UserContext(), id)
+	if err == nil {
+		err = change(alert, time.Now().UTC().Truncate(time.Millisecond), s.requestActor(c))
+	}
+	if err == nil {
+		err = s.store.Alerts().Update(c.UserContext(), alert)
+	}
+	if err != nil {
+		return entityProblem(c, "Alert", err)
+	}
+	return c.JSON(alert)
+}
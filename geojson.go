@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// mimeGeoJSON is the content type of GeoJSON documents
+const mimeGeoJSON = "application/geo+json"
+
+// located is implemented by the records that can be answered as GeoJSON features
+type located interface {
+	location() Geometry
+}
+
+func (a AnimalDetail) location() Geometry { return a.Location.geometry() }
+func (s Species) location() Geometry      { return s.Location }
+
+// Feature is a record as a GeoJSON feature, its location is the geometry and its other fields
+// are the properties
+type Feature struct {
+	Type       string                 `json:"type" example:"Feature"`
+	ID         string                 `json:"id,omitempty" example:"66a0f1c2e4b0a1b2c3d4e5f6"`
+	Geometry   *Geometry              `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// FeatureCollection is a list of records as GeoJSON
+type FeatureCollection struct {
+	Type     string    `json:"type" example:"FeatureCollection"`
+	Features []Feature `json:"features"`
+}
+
+// wantsGeoJSON reports whether the client prefers GeoJSON over plain JSON
+func wantsGeoJSON(c *fiber.Ctx) bool {
+	return c.Accepts(fiber.MIMEApplicationJSON, mimeGeoJSON) == mimeGeoJSON
+}
+
+// newFeatureCollection turns located records into GeoJSON features. Records without a location
+// get a null geometry.
+func newFeatureCollection(records []located) (*FeatureCollection, error) {
+	collection := &FeatureCollection{Type: "FeatureCollection", Features: []Feature{}}
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		var properties map[string]interface{}
+		if err := json.Unmarshal(data, &properties); err != nil {
+			return nil, err
+		}
+
+		feature := Feature{Type: "Feature", Properties: properties}
+		feature.ID, _ = properties["_id"].(string)
+		delete(properties, "_id")
+		delete(properties, "location")
+		if location := record.location(); !location.IsZero() {
+			feature.Geometry = &location
+		}
+		collection.Features = append(collection.Features, feature)
+	}
+	return collection, nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Geometry is a GeoJSON geometry (RFC 7946) of any type
+type Geometry struct {
+	Type string `json:"type" bson:"type" example:"Polygon"`
+	// Coordinates nest positions as deep as the type needs, from a single position for a Point
+	// to a list of polygons for a MultiPolygon. GeometryCollections have Geometries instead.
+	Coordinates interface{} `json:"coordinates,omitempty" bson:"coordinates,omitempty"`
+	Geometries  []Geometry  `json:"geometries,omitempty" bson:"geometries,omitempty"`
+}
+
+// IsZero reports whether the geometry is unset, unset geometries are left out of stored documents
+func (g Geometry) IsZero() bool {
+	return g.Type == ""
+}
+
+// geometry returns the point as a Geometry
+func (p Point) geometry() Geometry {
+	if p.IsZero() {
+		return Geometry{}
+	}
+	return Geometry{Type: p.Type, Coordinates: p.Coordinates}
+}
+
+// geometryCoordinates describes the coordinates each geometry type has
+var geometryCoordinates = map[string]string{
+	"Point":           "a position",
+	"MultiPoint":      "a list of positions",
+	"LineString":      "a list of positions",
+	"MultiLineString": "a list of lines",
+	"Polygon":         "a list of linear rings",
+	"MultiPolygon":    "a list of polygons",
+}
+
+// maxRingPositions and maxGeometryPositions bound the work of validating the geometries clients
+// send, checking that a ring doesn't cross itself takes time growing with the square of its positions
+const (
+	maxRingPositions     = 1000
+	maxGeometryPositions = 10000
+)
+
+// geometryParts is a geometry broken down into the points, lines and polygons it is made of
+type geometryParts struct {
+	points   [][]float64
+	lines    [][][]float64
+	polygons [][][][]float64
+}
+
+// positions counts the positions of all the parts
+func (p geometryParts) positions() int {
+	count := len(p.points)
+	for _, line := range p.lines {
+		count += len(line)
+	}
+	for _, polygon := range p.polygons {
+		for _, ring := range polygon {
+			count += len(ring)
+		}
+	}
+	return count
+}
+
+// parts breaks the geometry down, failing when its coordinates don't fit its type
+func (g Geometry) parts() (geometryParts, error) {
+	var parts geometryParts
+	err := g.collect(&parts, false)
+	return parts, err
+}
+
+func (g Geometry) collect(parts *geometryParts, member bool) error {
+	if g.Type == "GeometryCollection" {
+		if member {
+			return errors.New("geometry collections must not be nested")
+		}
+		for _, geometry := range g.Geometries {
+			if err := geometry.collect(parts, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	description, ok := geometryCoordinates[g.Type]
+	if !ok {
+		return fmt.Errorf("unknown geometry type %q", g.Type)
+	}
+	// Decoded coordinates are generic, stored ones may be BSON arrays, so they are read through JSON
+	data, err := json.Marshal(g.Coordinates)
+	if err != nil {
+		return err
+	}
+	invalid := fmt.Errorf("the coordinates of a %s must be %s", g.Type, description)
+	switch g.Type {
+	case "Point":
+		var position []float64
+		if json.Unmarshal(data, &position) != nil {
+			return invalid
+		}
+		parts.points = append(parts.points, position)
+	case "MultiPoint":
+		var positions [][]float64
+		if json.Unmarshal(data, &positions) != nil || len(positions) == 0 {
+			return invalid
+		}
+		parts.points = append(parts.points, positions...)
+	case "LineString":
+		var line [][]float64
+		if json.Unmarshal(data, &line) != nil {
+			return invalid
+		}
+		parts.lines = append(parts.lines, line)
+	case "MultiLineString":
+		var lines [][][]float64
+		if json.Unmarshal(data, &lines) != nil || len(lines) == 0 {
+			return invalid
+		}
+		parts.lines = append(parts.lines, lines...)
+	case "Polygon":
+		var polygon [][][]float64
+		if json.Unmarshal(data, &polygon) != nil {
+			return invalid
+		}
+		parts.polygons = append(parts.polygons, polygon)
+	case "MultiPolygon":
+		var polygons [][][][]float64
+		if json.Unmarshal(data, &polygons) != nil || len(polygons) == 0 {
+			return invalid
+		}
+		parts.polygons = append(parts.polygons, polygons...)
+	}
+	return nil
+}
+
+// validate checks the geometry the way RFC 7946 describes it: positions start with a longitude
+// and a latitude in range, lines have at least two positions, and polygons are made of closed rings
+// that don't cross themselves, the outer ring running counterclockwise and the holes clockwise
+func (g Geometry) validate() error {
+	parts, err := g.parts()
+	if err != nil {
+		return err
+	}
+	if len(parts.points)+len(parts.lines)+len(parts.polygons) == 0 {
+		return errors.New("the geometry is empty")
+	}
+	if parts.positions() > maxGeometryPositions {
+		return fmt.Errorf("a geometry can have at most %d positions", maxGeometryPositions)
+	}
+
+	for _, position := range parts.points {
+		if !validCoordinates(position) {
+			return errInvalidPosition
+		}
+	}
+	for _, line := range parts.lines {
+		if len(line) < 2 {
+			return errors.New("a line needs at least 2 positions")
+		}
+		for _, position := range line {
+			if !validCoordinates(position) {
+				return errInvalidPosition
+			}
+		}
+	}
+	for i, polygon := range parts.polygons {
+		if len(polygon) == 0 {
+			return errors.New("a polygon needs an outer ring")
+		}
+		for j, ring := range polygon {
+			if err := validatePolygonRing(ring, j > 0); err != nil {
+				if len(parts.polygons) > 1 {
+					return fmt.Errorf("polygon %d, ring %d: %w", i+1, j+1, err)
+				}
+				return fmt.Errorf("ring %d: %w", j+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// errInvalidPosition is returned for positions that aren't a longitude and a latitude in range,
+// optionally followed by an altitude
+var errInvalidPosition = errors.New("positions must be a longitude between -180 and 180 and a latitude between -90 and 90, optionally followed by an altitude")
+
+// validCoordinates reports whether the position is a longitude and a latitude in range, which
+// may be followed by an altitude. Points of animals have no altitude, their tags say so.
+func validCoordinates(position []float64) bool {
+	return (len(position) == 2 || len(position) == 3) && validPosition(position[0], position[1])
+}
+
+// validatePolygonRing checks a ring of a polygon, holes wind the other way round than outer rings
+func validatePolygonRing(ring [][]float64, hole bool) error {
+	if err := validateRing(ring); err != nil {
+		return err
+	}
+	if ringCrossesItself(ring) {
+		return errors.New("a ring must not cross itself")
+	}
+	area := ringArea(ring)
+	switch {
+	case area == 0:
+		return errors.New("a ring must enclose an area")
+	case !hole && area < 0:
+		return errors.New("outer rings must run counterclockwise")
+	case hole && area > 0:
+		return errors.New("holes must run clockwise")
+	}
+	return nil
+}
+
+// ringArea returns the signed area of a closed ring in the plane, positive for rings running
+// counterclockwise
+func ringArea(ring [][]float64) float64 {
+	var area float64
+	for i := 1; i < len(ring); i++ {
+		area += ring[i-1][0]*ring[i][1] - ring[i][0]*ring[i-1][1]
+	}
+	return area / 2
+}
+
+// ringCrossesItself reports whether two edges of a closed ring that don't follow each other meet
+func ringCrossesItself(ring [][]float64) bool {
+	edges := len(ring) - 1
+	for i := 0; i < edges; i++ {
+		for j := i + 2; j < edges; j++ {
+			if i == 0 && j == edges-1 {
+				continue
+			}
+			if segmentsIntersect(ring[i], ring[i+1], ring[j], ring[j+1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// segmentsIntersect reports whether the segments ab and cd share a point, treating longitude and
+// latitude as plane coordinates
+func segmentsIntersect(a, b, c, d []float64) bool {
+	d1, d2 := orientation(c, d, a), orientation(c, d, b)
+	d3, d4 := orientation(a, b, c), orientation(a, b, d)
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+	return (d1 == 0 && onSegment(c, d, a)) || (d2 == 0 && onSegment(c, d, b)) ||
+		(d3 == 0 && onSegment(a, b, c)) || (d4 == 0 && onSegment(a, b, d))
+}
+
+// orientation is positive when p lies left of the line from a to b and negative when it lies right
+func orientation(a, b, p []float64) float64 {
+	return (b[0]-a[0])*(p[1]-a[1]) - (b[1]-a[1])*(p[0]-a[0])
+}
+
+// onSegment reports whether p, which lies on the line through a and b, is between them
+func onSegment(a, b, p []float64) bool {
+	return math.Min(a[0], b[0]) <= p[0] && p[0] <= math.Max(a[0], b[0]) &&
+		math.Min(a[1], b[1]) <= p[1] && p[1] <= math.Max(a[1], b[1])
+}
+
+// polygonContains reports whether the position lies inside the outer ring of the polygon and
+// outside its holes
+func polygonContains(polygon [][][]float64, position []float64) bool {
+	if len(polygon) == 0 || !ringContains(polygon[0], position) {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if ringContains(hole, position) {
+			return false
+		}
+	}
+	return true
+}
+
+// pathMeetsRing reports whether a position of the path lies inside the ring or one of its
+// segments crosses the ring
+func pathMeetsRing(path, ring [][]float64) bool {
+	for i, position := range path {
+		if ringContains(ring, position) {
+			return true
+		}
+		if i == 0 {
+			continue
+		}
+		for j := 1; j < len(ring); j++ {
+			if segmentsIntersect(path[i-1], position, ring[j-1], ring[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// intersects reports whether the geometry shares a point with the area inside the ring
+func (p geometryParts) intersects(ring [][]float64) bool {
+	for _, position := range p.points {
+		if ringContains(ring, position) {
+			return true
+		}
+	}
+	for _, line := range p.lines {
+		if pathMeetsRing(line, ring) {
+			return true
+		}
+	}
+	for _, polygon := range p.polygons {
+		// Either the polygon reaches into the ring or the ring lies inside the polygon
+		if len(polygon) > 0 && (pathMeetsRing(polygon[0], ring) || polygonContains(polygon, ring[0])) {
+			return true
+		}
+	}
+	return false
+}
+
+// distance returns the distance in meters from the position to the nearest point of the
+// geometry, zero inside its polygons
+func (p geometryParts) distance(from []float64) float64 {
+	nearest := math.Inf(1)
+	for _, position := range p.points {
+		nearest = math.Min(nearest, geoDistance(from, position))
+	}
+	paths := p.lines
+	for _, polygon := range p.polygons {
+		if polygonContains(polygon, from) {
+			return 0
+		}
+		paths = append(paths, polygon...)
+	}
+	for _, path := range paths {
+		for i := 1; i < len(path); i++ {
+			nearest = math.Min(nearest, segmentDistance(from, path[i-1], path[i]))
+		}
+		if len(path) == 1 {
+			nearest = math.Min(nearest, geoDistance(from, path[0]))
+		}
+	}
+	return nearest
+}
+
+// segmentDistance returns the distance in meters from the position to the segment ab. The
+// nearest point of the segment is found in a plane centered on the position, which is accurate
+// enough for segments that don't span large parts of the globe.
+func segmentDistance(from, a, b []float64) float64 {
+	scale := math.Cos(from[1] * math.Pi / 180)
+	ax, ay := (a[0]-from[0])*scale, a[1]-from[1]
+	dx, dy := (b[0]-a[0])*scale, b[1]-a[1]
+	t := 0.0
+	if length := dx*dx + dy*dy; length > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/length))
+	}
+	return geoDistance(from, []float64{a[0] + t*(b[0]-a[0]), a[1] + t*(b[1]-a[1])})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// circle returns a closed ring of n positions running counterclockwise round 24.9,60.2
+func circle(n int) string {
+	positions := make([]string, n)
+	for i := range positions[:n-1] {
+		angle := 2 * math.Pi * float64(i) / float64(n-1)
+		positions[i] = fmt.Sprintf("[%f,%f]", 24.9+math.Cos(angle)/10, 60.2+math.Sin(angle)/10)
+	}
+	positions[n-1] = positions[0]
+	return "[" + strings.Join(positions, ",") + "]"
+}
+
+func TestGeometryValidate(t *testing.T) {
+	const (
+		square     = `[[0,0],[10,0],[10,10],[0,10],[0,0]]`
+		clockwise  = `[[0,0],[0,10],[10,10],[10,0],[0,0]]`
+		hole       = `[[2,2],[2,4],[4,4],[4,2],[2,2]]`
+		holeCCW    = `[[2,2],[4,2],[4,4],[2,4],[2,2]]`
+		bowTie     = `[[0,0],[10,10],[10,0],[0,10],[0,0]]`
+		touching   = `[[0,0],[10,0],[5,5],[10,10],[0,10],[5,5],[0,0]]`
+		collinear  = `[[0,0],[5,0],[10,0],[0,0]]`
+		unclosed   = `[[0,0],[10,0],[10,10],[0,10],[0,1]]`
+		triangle   = `[[0,0],[10,0],[0,0]]`
+		manyPoints = 10001
+	)
+	points := make([]string, manyPoints)
+	for i := range points {
+		points[i] = "[1,2]"
+	}
+
+	tests := []struct {
+		name     string
+		geometry string
+		// err is part of the expected error, empty for valid geometries
+		err string
+	}{
+		{"point", `{"type":"Point","coordinates":[24.9,60.2]}`, ""},
+		{"point with altitude", `{"type":"Point","coordinates":[24.9,60.2,12]}`, ""},
+		{"point with four coordinates", `{"type":"Point","coordinates":[24.9,60.2,12,1]}`, "positions must be"},
+		{"point out of range", `{"type":"Point","coordinates":[181,0]}`, "positions must be"},
+		{"line of one position", `{"type":"LineString","coordinates":[[0,0]]}`, "at least 2 positions"},
+		{"counterclockwise polygon", `{"type":"Polygon","coordinates":[` + square + `]}`, ""},
+		{"clockwise polygon", `{"type":"Polygon","coordinates":[` + clockwise + `]}`, "outer rings must run counterclockwise"},
+		{"clockwise hole", `{"type":"Polygon","coordinates":[` + square + `,` + hole + `]}`, ""},
+		{"counterclockwise hole", `{"type":"Polygon","coordinates":[` + square + `,` + holeCCW + `]}`, "ring 2: holes must run clockwise"},
+		{"bow tie", `{"type":"Polygon","coordinates":[` + bowTie + `]}`, "must not cross itself"},
+		{"ring touching itself", `{"type":"Polygon","coordinates":[` + touching + `]}`, "must not cross itself"},
+		{"ring without an area", `{"type":"Polygon","coordinates":[` + collinear + `]}`, "must enclose an area"},
+		{"unclosed ring", `{"type":"Polygon","coordinates":[` + unclosed + `]}`, "must end with its first position"},
+		{"ring of three positions", `{"type":"Polygon","coordinates":[` + triangle + `]}`, "at least 4 positions"},
+		{"polygon without rings", `{"type":"Polygon","coordinates":[]}`, "needs an outer ring"},
+		{"multipolygon", `{"type":"MultiPolygon","coordinates":[[` + square + `],[` + clockwise + `]]}`, "polygon 2, ring 1: outer rings"},
+		{"polygon with altitudes", `{"type":"Polygon","coordinates":[[[0,0,1],[10,0,1],[10,10,1],[0,10,1],[0,0,1]]]}`, ""},
+		{"largest ring", `{"type":"Polygon","coordinates":[` + circle(maxRingPositions) + `]}`, ""},
+		{"ring too large", `{"type":"Polygon","coordinates":[` + circle(maxRingPositions+1) + `]}`, "at most 1000 positions"},
+		{"geometry too large", `{"type":"MultiPoint","coordinates":[` + strings.Join(points, ",") + `]}`, "at most 10000 positions"},
+		{"collection", `{"type":"GeometryCollection","geometries":[{"type":"Point","coordinates":[1,2]},{"type":"Polygon","coordinates":[` + square + `]}]}`, ""},
+		{"nested collection", `{"type":"GeometryCollection","geometries":[{"type":"GeometryCollection"}]}`, "must not be nested"},
+		{"empty collection", `{"type":"GeometryCollection","geometries":[]}`, "the geometry is empty"},
+		{"unknown type", `{"type":"Circle","coordinates":[1,2]}`, "unknown geometry type"},
+		{"coordinates of another type", `{"type":"Polygon","coordinates":[1,2]}`, "must be a list of linear rings"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var geometry Geometry
+			if err := json.Unmarshal([]byte(tt.geometry), &geometry); err != nil {
+				t.Fatal(err)
+			}
+			err := geometry.validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// Animals are located by a longitude and a latitude, without the altitude other geometries may have
+func TestAnimalLocation(t *testing.T) {
+	tests := []struct {
+		location string
+		status   int
+	}{
+		{`{"type":"Point","coordinates":[24.9,60.2]}`, fiber.StatusCreated},
+		{`{"type":"Point","coordinates":[24.9,60.2,12]}`, fiber.StatusUnprocessableEntity},
+		{`{"type":"Point","coordinates":[24.9]}`, fiber.StatusUnprocessableEntity},
+		{`{"type":"Point","coordinates":[24.9,91]}`, fiber.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.location, func(t *testing.T) {
+			app := newTestApp(t)
+			status, body := send(t, app, fiber.MethodPost, "/api/animals",
+				`{"animal_name":"Leo","birthdate":"2020-01-02T00:00:00Z","location":`+tt.location+`}`)
+			if status != tt.status {
+				t.Errorf("got status %d, want %d: %v", status, tt.status, body)
+			}
+		})
+	}
+}
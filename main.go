@@ -2,17 +2,21 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"os"
+	"reflect"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/joho/godotenv"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 
 	_ "github.com/MetroHege/go-rest-api/docs"
 	fiberSwagger "github.com/swaggo/fiber-swagger"
@@ -21,50 +25,113 @@ import (
 // Models
 // Point struct
 type Point struct {
-	Type        string    `json:"type" bson:"type"`
-	Coordinates []float64 `json:"coordinates" bson:"coordinates"`
+	Type        string    `json:"type" bson:"type" validate:"required_with=Coordinates,omitempty,eq=Point"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates" validate:"required_with=Type,omitempty,len=2,coordinates"`
+}
+
+// IsZero reports whether the point is unset, unset points are left out of stored documents
+func (p Point) IsZero() bool {
+	return p.Type == ""
+}
+
+// Deletion records when and by whom a record was moved to the trash
+type Deletion struct {
+	DeletedAt *time.Time `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty" bson:"deleted_by,omitempty"`
+}
+
+// IsDeleted reports whether the record is in the trash
+func (d Deletion) IsDeleted() bool {
+	return d.DeletedAt != nil
+}
+
+func (d Deletion) deletion() Deletion {
+	return d
+}
+
+// trashable is implemented by the records embedding Deletion
+type trashable interface {
+	deletion() Deletion
 }
 
 // Category struct
 type Category struct {
 	ID           primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	CategoryName string             `json:"category_name" bson:"category_name"`
+	CategoryName string             `json:"category_name" bson:"category_name" validate:"notblank"`
+	Version      int64              `json:"version" bson:"version"`
+	Tenant       string             `json:"-" bson:"tenant,omitempty"`
+	Deletion     `bson:",inline"`
 }
 
 // Species struct
 type Species struct {
 	ID          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	SpeciesName string             `json:"species_name" bson:"species_name"`
+	SpeciesName string             `json:"species_name" bson:"species_name" validate:"notblank"`
 	Image       string             `json:"image" bson:"image"`
 	Category    primitive.ObjectID `json:"category,omitempty" bson:"category,omitempty"`
-	Location    Point              `json:"location" bson:"location"`
+	Location    Geometry           `json:"location" bson:"location,omitempty" validate:"geometry"`
+	Habitat     *Geometry          `json:"habitat,omitempty" bson:"habitat,omitempty" validate:"omitempty,geometry"`
+	Version     int64              `json:"version" bson:"version"`
+	Tenant      string             `json:"-" bson:"tenant,omitempty"`
+	Deletion    `bson:",inline"`
+	// Distance is set by near queries to the distance from their point in meters, it isn't stored
+	Distance *float64 `json:"distance,omitempty" bson:"distance,omitempty"`
 }
 
 // Animal struct
 type Animal struct {
 	ID         primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	AnimalName string             `json:"animal_name" bson:"animal_name"`
-	Birthdate  time.Time          `json:"birthdate" bson:"birthdate"`
+	AnimalName string             `json:"animal_name" bson:"animal_name" validate:"notblank"`
+	Birthdate  time.Time          `json:"birthdate" bson:"birthdate" validate:"required,notfuture"`
 	Species    primitive.ObjectID `json:"species,omitempty" bson:"species,omitempty"`
-	Location   Point              `json:"location" bson:"location"`
+	Location   Point              `json:"location" bson:"location,omitempty"`
+	Version    int64              `json:"version" bson:"version"`
+	// Tenant is the zoo the record belongs to when zoos share the database
+	Tenant   string `json:"-" bson:"tenant,omitempty"`
+	Deletion `bson:",inline"`
 }
 
 // Response represents a generic API response
 type Response struct {
 	Success bool   `json:"success"`
 	Message string `json:"message"`
-	Error   string `json:"error,omitempty"`
 }
 
-// CategoryUpdateRequest represents the request body for updating a category
+// AnimalUpdateRequest represents the request body for updating an animal, fields that are left
+// out keep their value
+type AnimalUpdateRequest struct {
+	AnimalName *string             `json:"animal_name,omitempty"`
+	Birthdate  *time.Time          `json:"birthdate,omitempty"`
+	Species    *primitive.ObjectID `json:"species,omitempty" swaggertype:"string"`
+	Location   *Point              `json:"location,omitempty"`
+}
+
+// SpeciesUpdateRequest represents the request body for updating a species, fields that are left
+// out keep their value
+type SpeciesUpdateRequest struct {
+	SpeciesName *string             `json:"species_name,omitempty"`
+	Image       *string             `json:"image,omitempty"`
+	Category    *primitive.ObjectID `json:"category,omitempty" swaggertype:"string"`
+	Location    *Geometry           `json:"location,omitempty"`
+	Habitat     *Geometry           `json:"habitat,omitempty"`
+}
+
+// CategoryUpdateRequest represents the request body for updating a category, fields that are
+// left out keep their value
 type CategoryUpdateRequest struct {
-	CategoryName string `json:"category_name"`
+	CategoryName *string `json:"category_name,omitempty"`
 }
 
-// MongoDB collections
-var animalCollection *mongo.Collection
-var speciesCollection *mongo.Collection
-var categoryCollection *mongo.Collection
+// server holds the dependencies shared by the HTTP handlers
+type server struct {
+	store  Store
+	config Config
+}
+
+// newServer returns a server whose handlers use the given store and configuration
+func newServer(store Store, config Config) *server {
+	return &server{store: store, config: config}
+}
 
 // @title Go REST API
 // @version 1.0
@@ -81,7 +148,18 @@ var categoryCollection *mongo.Collection
 // @host localhost:5000
 // @BasePath /api
 
+// @securityDefinitions.apikey ApiKeyAuth
+// @in header
+// @name X-API-Key
+// @description Static API key or a key issued to a user
+
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
+// @description HS256 or RS256 JWT, sent as "Bearer <token>"
+
 // @securityDefinitions.basic BasicAuth
+// @description Username and password of a user
 
 // Main function
 func main() {
@@ -90,201 +168,226 @@ func main() {
 		log.Fatal("Error loading .env file", err)
 	}
 
-	MONGODB_URI := os.Getenv("MONGODB_URI")
-	fmt.Println("MONGODB_URI:", MONGODB_URI)
-
-	clientOptions := options.Client().ApplyURI(MONGODB_URI)
-	client, err := mongo.Connect(context.Background(), clientOptions)
-
+	config, err := loadConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer client.Disconnect(context.Background())
-
-	err = client.Ping(context.Background(), nil)
+	store, err := openTenantStore(context.Background(), config.Tenancy)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fmt.Println("Connected to MongoDB!")
+	defer store.Close(context.Background())
+
+	if config.Auth.Disabled {
+		fmt.Println("Authentication is disabled, anyone can change data")
+	} else if !config.Auth.configured() {
+		fmt.Println("No API keys or JWT keys are configured, only the stored users with a role can change data")
+	}
+	if config.Tenancy.enabled() {
+		fmt.Printf("Serving tenants %s with the %s strategy\n", strings.Join(config.Tenancy.Tenants, ", "), config.Tenancy.Strategy)
+	}
+
+	srv := newServer(store, config)
+	go srv.runPurgeJob(context.Background())
+
+	app := newApp(srv)
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "5000"
+	}
 
-	animalCollection = client.Database("golang_db").Collection("animals")
-	speciesCollection = client.Database("golang_db").Collection("species")
-	categoryCollection = client.Database("golang_db").Collection("categories")
+	log.Fatal(app.Listen("0.0.0.0:" + port))
+}
 
-	app := fiber.New()
+// newApp returns the application serving the routes of the server
+func newApp(srv *server) *fiber.App {
+	app := fiber.New(fiber.Config{ErrorHandler: problemHandler})
+	app.Use(requestid.New())
 
 	// Swagger route
 	app.Get("/swagger/*", fiberSwagger.WrapHandler)
 
 	// Animal routes
-	app.Get("/api/animals", getAnimals)
-	app.Get("/api/animals/:id", getAnimalByID)
-	app.Post("/api/animals", createAnimal)
-	app.Patch("/api/animals/:id", updateAnimal)
-	app.Delete("/api/animals/:id", deleteAnimal)
+	app.Get("/api/animals", srv.authorize("animals:read"), srv.getAnimals)
+	app.Get("/api/animals/:id", srv.authorize("animals:read"), srv.getAnimalByID)
+	app.Post("/api/animals", srv.authorize("animals:write"), srv.createAnimal)
+	app.Put("/api/animals/:id", srv.authorize("animals:write"), srv.replaceAnimal)
+	app.Patch("/api/animals/:id", srv.authorize("animals:write"), srv.updateAnimal)
+	app.Delete("/api/animals/:id", srv.authorize("animals:delete"), srv.deleteAnimal)
+	app.Post("/api/animals/:id/restore", srv.authorize("animals:delete"), srv.restoreAnimal)
+	app.Get("/api/animals/:id/history", srv.authorize("animals:read"), srv.getAnimalHistory)
+	app.Post("/api/animals/:id/locations", srv.authorize("animals:write"), srv.addAnimalLocations)
+	app.Get("/api/animals/:id/track", srv.authorize("animals:read"), srv.getAnimalTrack)
 
 	// Species routes
-	app.Get("/api/species", getSpecies)
-	app.Get("/api/species/:id", getSpeciesByID)
-	app.Post("/api/species", createSpecies)
-	app.Patch("/api/species/:id", updateSpecies)
-	app.Delete("/api/species/:id", deleteSpecies)
+	app.Get("/api/species", srv.authorize("species:read"), srv.getSpecies)
+	app.Get("/api/species/:id", srv.authorize("species:read"), srv.getSpeciesByID)
+	app.Post("/api/species", srv.authorize("species:write"), srv.createSpecies)
+	app.Put("/api/species/:id", srv.authorize("species:write"), srv.replaceSpecies)
+	app.Patch("/api/species/:id", srv.authorize("species:write"), srv.updateSpecies)
+	app.Delete("/api/species/:id", srv.authorize("species:delete"), srv.deleteSpecies)
+	app.Post("/api/species/:id/restore", srv.authorize("species:delete"), srv.restoreSpecies)
+	app.Get("/api/species/:id/history", srv.authorize("species:read"), srv.getSpeciesHistory)
 
 	// Category routes
-	app.Get("/api/categories", getCategories)
-	app.Get("/api/categories/:id", getCategoryByID)
-	app.Post("/api/categories", createCategory)
-	app.Patch("/api/categories/:id", updateCategory)
-	app.Delete("/api/categories/:id", deleteCategory)
+	app.Get("/api/categories", srv.authorize("categories:read"), srv.getCategories)
+	app.Get("/api/categories/:id", srv.authorize("categories:read"), srv.getCategoryByID)
+	app.Post("/api/categories", srv.authorize("categories:write"), srv.createCategory)
+	app.Put("/api/categories/:id", srv.authorize("categories:write"), srv.replaceCategory)
+	app.Patch("/api/categories/:id", srv.authorize("categories:write"), srv.updateCategory)
+	app.Delete("/api/categories/:id", srv.authorize("categories:delete"), srv.deleteCategory)
+	app.Post("/api/categories/:id/restore", srv.authorize("categories:delete"), srv.restoreCategory)
+	app.Get("/api/categories/:id/history", srv.authorize("categories:read"), srv.getCategoryHistory)
+
+	// Trash routes
+	app.Get("/api/trash", srv.authorize("trash:read"), srv.getTrash)
+
+	// Audit routes
+	app.Get("/api/audit", srv.authorize("audit:read"), srv.getAuditLog)
+
+	// Geofence routes
+	app.Get("/api/geofences", srv.authorize("geofences:read"), srv.getGeofences)
+	app.Get("/api/geofences/:id", srv.authorize("geofences:read"), srv.getGeofenceByID)
+	app.Post("/api/geofences", srv.authorize("geofences:write"), srv.createGeofence)
+	app.Put("/api/geofences/:id", srv.authorize("geofences:write"), srv.replaceGeofence)
+	app.Delete("/api/geofences/:id", srv.authorize("geofences:delete"), srv.deleteGeofence)
+
+	// Alert routes
+	app.Get("/api/alerts", srv.authorize("alerts:read"), srv.getAlerts)
+	app.Post("/api/alerts/:id/acknowledge", srv.authorize("alerts:write"), srv.acknowledgeAlert)
+	app.Post("/api/alerts/:id/resolve", srv.authorize("alerts:write"), srv.resolveAlert)
+
+	// User routes, users can manage their own account and keys
+	app.Get("/api/users", srv.authorize("users:read"), srv.getUsers)
+	app.Get("/api/users/:id", srv.authorizeSelf("users:read"), srv.getUserByID)
+	app.Post("/api/users", srv.authorize("users:write"), srv.createUser)
+	app.Delete("/api/users/:id", srv.authorize("users:delete"), srv.deleteUser)
+	app.Put("/api/users/:id/roles", srv.authorize("users:write"), srv.replaceUserRoles)
+	app.Put("/api/users/:id/password", srv.authorizeSelf("users:write"), srv.changePassword)
+	app.Get("/api/users/:id/keys", srv.authorizeSelf("users:read"), srv.getAPIKeys)
+	app.Post("/api/users/:id/keys", srv.authorizeSelf("users:write"), srv.createAPIKey)
+	app.Post("/api/users/:id/keys/:key/rotate", srv.authorizeSelf("users:write"), srv.rotateAPIKey)
+	app.Delete("/api/users/:id/keys/:key", srv.authorizeSelf("users:write"), srv.revokeAPIKey)
+
+	return app
+}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "5000"
-	}
+// openStore opens the storage backend selected by the STORAGE_BACKEND environment variable.
+// A tenant gets a database of its own: MongoDB names it after the tenant and DATABASE_URL
+// must contain {tenant}, which is replaced with it.
+func openStore(ctx context.Context, tenant string) (Store, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "mongodb":
+		MONGODB_URI := os.Getenv("MONGODB_URI")
+		fmt.Println("MONGODB_URI:", MONGODB_URI)
+
+		database := "golang_db"
+		if tenant != "" {
+			database += "_" + tenant
+		}
+		store, err := newMongoStore(ctx, MONGODB_URI, database)
+		if err != nil {
+			return nil, err
+		}
 
-	log.Fatal(app.Listen("0.0.0.0:" + port))
+		fmt.Println("Connected to MongoDB!")
+		if !store.transactions {
+			fmt.Println("MongoDB is not a replica set, deletes that cascade or nullify will be refused")
+		}
+		return store, nil
+	case "postgres", "sqlite":
+		dialect := postgresDialect
+		if backend == "sqlite" {
+			dialect = sqliteDialect
+		}
+
+		dsn := os.Getenv("DATABASE_URL")
+		if tenant != "" {
+			if !strings.Contains(dsn, "{tenant}") {
+				return nil, errors.New("DATABASE_URL must contain {tenant} to give every tenant a database")
+			}
+			dsn = strings.ReplaceAll(dsn, "{tenant}", tenant)
+		}
+		store, err := newSQLStore(ctx, dialect, dsn)
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Printf("Connected to %s!\n", backend)
+		return store, nil
+	case "memory":
+		fmt.Println("Using in-memory storage")
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
 }
 
 // Animal handlers
 // Get all animals
 // @Summary Get all animals
-// @Description Get all animals with filtering, sorting, and pagination
+// @Description Get all animals with filtering, sorting, and pagination. With Accept: application/geo+json the page is a GeoJSON FeatureCollection.
 // @Tags animals
 // @Accept json
-// @Produce json
+// @Produce json,application/geo+json
 // @Param animal_name query string false "Animal Name"
 // @Param species_name query string false "Species Name"
 // @Param category_name query string false "Category Name"
-// @Param sort_by query string false "Sort By"
-// @Param sort_order query string false "Sort Order"
-// @Param limit query int false "Limit"
-// @Param skip query int false "Skip"
-// @Success 200 {array} Animal
-// @Failure 500 {object} Response
+// @Param match query string false "How the name filters match: exact, prefix, contains or regex (when enabled)" Enums(exact, prefix, contains, regex) default(contains)
+// @Param filter query string false "Filter expression, e.g. birthdate>=2020-01-01;category=in(Mammals,Birds) on animal_name, birthdate, species and category"
+// @Param near query string false "Latitude and longitude, e.g. 60.17,24.94. Sorts nearest first and sets the distance in meters"
+// @Param max_distance query number false "Largest distance from near in meters"
+// @Param bbox query string false "Bounding box min_lng,min_lat,max_lng,max_lat"
+// @Param within query string false "GeoJSON Polygon the location must lie in"
+// @Param sort query string false "Comma-separated fields to sort on, prefixed with - for descending: animal_name, birthdate, species, category or distance (with near), e.g. -birthdate,animal_name"
+// @Param sort_by query string false "Single field to sort on, use sort instead"
+// @Param sort_order query string false "asc or desc, the order of sort_by"
+// @Param limit query int false "Page size, at most the configured maximum" default(10)
+// @Param cursor query string false "Cursor from the Link header of the previous response"
+// @Param skip query int false "Skip, only used without a cursor"
+// @Success 200 {array} AnimalDetail
+// @Header 200 {integer} X-Total-Count "Number of matching records"
+// @Header 200 {string} Link "Links to the next and previous pages"
+// @Failure 400 {object} Problem
+// @Failure 500 {object} Problem
 // @Router /animals [get]
-func getAnimals(c *fiber.Ctx) error {
-	var animals []bson.M
-
-	// Filtering
-	filter := bson.M{}
-	if animalName := c.Query("animal_name"); animalName != "" {
-		filter["animal_name"] = bson.M{"$regex": animalName, "$options": "i"}
-	}
-	if speciesName := c.Query("species_name"); speciesName != "" {
-		filter["species_info.species_name"] = bson.M{"$regex": speciesName, "$options": "i"}
-	}
-	if categoryName := c.Query("category_name"); categoryName != "" {
-		filter["category_info.category_name"] = bson.M{"$regex": categoryName, "$options": "i"}
-	}
-
-	// Sorting
-	sort := bson.D{}
-	if sortBy := c.Query("sort_by"); sortBy != "" {
-		sortOrder := 1
-		if c.Query("sort_order") == "desc" {
-			sortOrder = -1
-		}
-		sort = append(sort, bson.E{Key: sortBy, Value: sortOrder})
-	} else {
-		// Default sort by animal_name in ascending order
-		sort = append(sort, bson.E{Key: "animal_name", Value: 1})
-	}
-
-	// Pagination
-	limit := c.QueryInt("limit", 10)
-	skip := c.QueryInt("skip", 0)
-
-	lookupSpeciesStage := bson.D{
-		{Key: "$lookup", Value: bson.D{
-			{Key: "from", Value: "species"},
-			{Key: "localField", Value: "species"},
-			{Key: "foreignField", Value: "_id"},
-			{Key: "as", Value: "species_info"},
-		}},
-	}
-
-	unwindSpeciesStage := bson.D{
-		{Key: "$unwind", Value: bson.D{
-			{Key: "path", Value: "$species_info"},
-			{Key: "preserveNullAndEmptyArrays", Value: true},
-		}},
-	}
-
-	lookupCategoryStage := bson.D{
-		{Key: "$lookup", Value: bson.D{
-			{Key: "from", Value: "categories"},
-			{Key: "localField", Value: "species_info.category"},
-			{Key: "foreignField", Value: "_id"},
-			{Key: "as", Value: "category_info"},
-		}},
-	}
-
-	unwindCategoryStage := bson.D{
-		{Key: "$unwind", Value: bson.D{
-			{Key: "path", Value: "$category_info"},
-			{Key: "preserveNullAndEmptyArrays", Value: true},
-		}},
-	}
-
-	matchStage := bson.D{
-		{Key: "$match", Value: filter},
+func (s *server) getAnimals(c *fiber.Ctx) error {
+	geo, err := geoQuery(c)
+	if err != nil {
+		return err
 	}
-
-	projectStage := bson.D{
-		{Key: "$project", Value: bson.D{
-			{Key: "_id", Value: 1},
-			{Key: "animal_name", Value: 1},
-			{Key: "birthdate", Value: 1},
-			{Key: "species", Value: "$species_info.species_name"},
-			{Key: "category", Value: "$category_info.category_name"},
-			{Key: "location", Value: 1},
-		}},
+	page, err := s.pageOptions(c, geo.sortable(animalSortFields), geo.defaultSort()...)
+	if err != nil {
+		return err
 	}
-
-	sortStage := bson.D{
-		{Key: "$sort", Value: sort},
+	match, err := s.matchMode(c, "animal_name", "species_name", "category_name")
+	if err != nil {
+		return err
 	}
-
-	limitStage := bson.D{
-		{Key: "$limit", Value: limit},
+	query := AnimalQuery{
+		ListOptions:  page.ListOptions,
+		AnimalName:   match.pattern(c.Query("animal_name")),
+		SpeciesName:  match.pattern(c.Query("species_name")),
+		CategoryName: match.pattern(c.Query("category_name")),
+		Geo:          geo,
 	}
-
-	skipStage := bson.D{
-		{Key: "$skip", Value: skip},
+	if query.Filter, err = parseFilter(c.Query("filter"), animalFilterFields); err != nil {
+		return err
 	}
 
-	cursor, err := animalCollection.Aggregate(context.Background(), mongo.Pipeline{
-		lookupSpeciesStage, unwindSpeciesStage, lookupCategoryStage, unwindCategoryStage, matchStage, projectStage, sortStage, skipStage, limitStage,
-	})
+	animals, err := s.store.Animals().List(c.UserContext(), query)
 	if err != nil {
-		log.Printf("Error during aggregation: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Internal Server Error",
-		})
-	}
-	defer cursor.Close(context.Background())
-
-	for cursor.Next(context.Background()) {
-		var animal bson.M
-		if err := cursor.Decode(&animal); err != nil {
-			log.Printf("Error decoding animal: %v", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Internal Server Error",
-			})
-		}
-		animals = append(animals, animal)
+		return err
 	}
-
-	if err := cursor.Err(); err != nil {
-		log.Printf("Cursor error: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Internal Server Error",
-		})
+	total, err := s.store.Animals().Count(c.UserContext(), query)
+	if err != nil {
+		return err
 	}
 
-	return c.JSON(animals)
+	return sendPage(c, page, animals, total, "animal_name")
 }
 
 // Get an animal by ID
@@ -294,93 +397,35 @@ func getAnimals(c *fiber.Ctx) error {
 // @Accept json
 // @Produce json
 // @Param id path string true "Animal ID"
-// @Success 200 {object} Animal
-// @Failure 400 {object} Response
-// @Failure 500 {object} Response
+// @Param If-None-Match header string false "ETag of a cached copy"
+// @Success 200 {object} AnimalDetail
+// @Header 200 {string} ETag "Version of the animal"
+// @Success 304 {string} string "Not Modified"
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
 // @Router /animals/{id} [get]
-func getAnimalByID(c *fiber.Ctx) error {
+func (s *server) getAnimalByID(c *fiber.Ctx) error {
 	animalID := c.Params("id")
 	objID, err := primitive.ObjectIDFromHex(animalID)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid ID format",
-		})
-	}
-
-	lookupSpeciesStage := bson.D{
-		{Key: "$lookup", Value: bson.D{
-			{Key: "from", Value: "species"},
-			{Key: "localField", Value: "species"},
-			{Key: "foreignField", Value: "_id"},
-			{Key: "as", Value: "species_info"},
-		}},
-	}
-
-	unwindSpeciesStage := bson.D{
-		{Key: "$unwind", Value: bson.D{
-			{Key: "path", Value: "$species_info"},
-			{Key: "preserveNullAndEmptyArrays", Value: true},
-		}},
-	}
-
-	lookupCategoryStage := bson.D{
-		{Key: "$lookup", Value: bson.D{
-			{Key: "from", Value: "categories"},
-			{Key: "localField", Value: "species_info.category"},
-			{Key: "foreignField", Value: "_id"},
-			{Key: "as", Value: "category_info"},
-		}},
-	}
-
-	unwindCategoryStage := bson.D{
-		{Key: "$unwind", Value: bson.D{
-			{Key: "path", Value: "$category_info"},
-			{Key: "preserveNullAndEmptyArrays", Value: true},
-		}},
-	}
-
-	matchStage := bson.D{
-		{Key: "$match", Value: bson.D{
-			{Key: "_id", Value: objID},
-		}},
+		return invalidID("Invalid ID format")
 	}
 
-	projectStage := bson.D{
-		{Key: "$project", Value: bson.D{
-			{Key: "_id", Value: 1},
-			{Key: "animal_name", Value: 1},
-			{Key: "birthdate", Value: 1},
-			{Key: "species", Value: "$species_info.species_name"},
-			{Key: "category", Value: "$category_info.category_name"},
-			{Key: "location", Value: 1},
-		}},
+	animal, err := s.store.Animals().GetDetail(c.UserContext(), objID)
+	if errors.Is(err, ErrNotFound) {
+		return notFound("Animal")
 	}
-
-	cursor, err := animalCollection.Aggregate(context.Background(), mongo.Pipeline{
-		matchStage, lookupSpeciesStage, unwindSpeciesStage, lookupCategoryStage, unwindCategoryStage, projectStage,
-	})
 	if err != nil {
-		log.Printf("Error during aggregation: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Internal Server Error",
-		})
+		return err
 	}
-	defer cursor.Close(context.Background())
 
-	if cursor.Next(context.Background()) {
-		var animal bson.M
-		if err := cursor.Decode(&animal); err != nil {
-			log.Printf("Error decoding animal: %v", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Internal Server Error",
-			})
-		}
-		return c.JSON(animal)
+	c.Set(fiber.HeaderETag, etag(animal.Version))
+	if notModified(c, animal.Version) {
+		return c.SendStatus(fiber.StatusNotModified)
 	}
 
-	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-		"error": "Animal not found",
-	})
+	return c.JSON(animal)
 }
 
 // Create an animal
@@ -391,169 +436,213 @@ func getAnimalByID(c *fiber.Ctx) error {
 // @Produce json
 // @Param animal body Animal true "Animal"
 // @Success 201 {object} Animal
-// @Failure 400 {object} Response
-// @Failure 500 {object} Response
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
 // @Router /animals [post]
-func createAnimal(c *fiber.Ctx) error {
+func (s *server) createAnimal(c *fiber.Ctx) error {
 	animal := new(Animal)
 
 	if err := c.BodyParser(animal); err != nil {
 		return err
 	}
+	animal.ID = primitive.NilObjectID
+	animal.Deletion = Deletion{}
 
-	insertResult, err := animalCollection.InsertOne(context.Background(), animal)
-	if err != nil {
+	if err := validateRecord(animal); err != nil {
+		return err
+	}
+
+	if err := s.checkSpeciesReference(c.UserContext(), animal.Species); err != nil {
 		return err
 	}
 
-	animal.ID = insertResult.InsertedID.(primitive.ObjectID)
+	if err := s.writeAnimal(c, animal, true, Point{}); err != nil {
+		return err
+	}
 
 	return c.Status(201).JSON(animal)
 }
 
 // Update an animal
 // @Summary Update an animal
-// @Description Update an existing animal
+// @Description Update an existing animal. A JSON body changes the fields it supplies, a JSON merge patch (RFC 7386) or JSON patch (RFC 6902) is applied to the animal and removes the fields it sets to null or removes. A failing JSON patch test operation leaves the animal unchanged.
 // @Tags animals
-// @Accept json
+// @Accept json,application/merge-patch+json,application/json-patch+json
 // @Produce json
 // @Param id path string true "Animal ID"
-// @Param animal body Animal true "Animal"
+// @Param If-Match header string false "ETag the animal must still have"
+// @Param animal body AnimalUpdateRequest true "Animal fields to change"
 // @Success 200 {object} Response
-// @Failure 400 {object} Response
-// @Failure 500 {object} Response
+// @Header 200 {string} ETag "New version of the animal"
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 412 {object} Problem
+// @Failure 415 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
 // @Router /animals/{id} [patch]
-func updateAnimal(c *fiber.Ctx) error {
+func (s *server) updateAnimal(c *fiber.Ctx) error {
 	id := c.Params("id")
 	ObjectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+		return invalidID("Invalid ID")
 	}
 
-	filter := bson.M{"_id": ObjectID}
-	update := bson.M{"$set": bson.M{
-		"animal_name": c.FormValue("animal_name"),
-		"birthdate":   c.FormValue("birthdate"),
-		"species":     c.FormValue("species"),
-		"location":    c.FormValue("location"),
-	}}
+	animal, err := live(s.store.Animals().Get(c.UserContext(), ObjectID))
+	if errors.Is(err, ErrNotFound) {
+		return notFound("Animal")
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkIfMatch(c, animal.Version); err != nil {
+		return preconditionFailed("Animal")
+	}
 
-	_, err = animalCollection.UpdateOne(context.Background(), filter, update)
+	var updateData AnimalUpdateRequest
+	replace, err := decodePatch(c, newAnimalUpdate(animal), &updateData)
 	if err != nil {
 		return err
 	}
 
+	species, location := animal.Species, animal.Location
+	updateData.apply(animal, replace)
+	if err := validateRecord(animal); err != nil {
+		return err
+	}
+	if animal.Species != species && !animal.Species.IsZero() {
+		if err := s.checkSpeciesReference(c.UserContext(), animal.Species); err != nil {
+			return err
+		}
+	}
+
+	err = s.writeAnimal(c, animal, false, location)
+	if errors.Is(err, ErrNotFound) {
+		return notFound("Animal")
+	}
+	if errors.Is(err, ErrVersionConflict) {
+		return versionConflict(c, "Animal")
+	}
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderETag, etag(animal.Version))
 	return c.Status(200).JSON(fiber.Map{"success": "true"})
 }
 
 // Delete an animal
 // @Summary Delete an animal
-// @Description Delete an animal by ID
+// @Description Move an animal to the trash
 // @Tags animals
 // @Accept json
 // @Produce json
 // @Param id path string true "Animal ID"
+// @Param dry_run query bool false "Only report the records that would be affected"
+// @Param X-Actor header string false "Who is deleting the record, recorded in the trash, when authentication is disabled"
+// @Param If-Match header string false "ETag the record must still have"
 // @Success 200 {object} Response
-// @Failure 400 {object} Response
-// @Failure 500 {object} Response
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 412 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
 // @Router /animals/{id} [delete]
-func deleteAnimal(c *fiber.Ctx) error {
+func (s *server) deleteAnimal(c *fiber.Ctx) error {
 	id := c.Params("id")
 	ObjectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
-	}
-
-	filter := bson.M{"_id": ObjectID}
-	_, err = animalCollection.DeleteOne(context.Background(), filter)
-	if err != nil {
-		return err
+		return invalidID("Invalid ID")
 	}
 
-	return c.Status(200).JSON(fiber.Map{"success": "true"})
+	return s.deleteWithPolicies(c, "Animal", func(ctx context.Context, p *deletePlanner) error {
+		return p.animal(ctx, ObjectID)
+	})
 }
 
 // Species handlers
 // Get all species with filtering, sorting, and pagination
 // @Summary Get all species
-// @Description Get all species with filtering, sorting, and pagination
+// @Description Get all species with filtering, sorting, and pagination. With Accept: application/geo+json the page is a GeoJSON FeatureCollection.
 // @Tags species
 // @Accept json
-// @Produce json
+// @Produce json,application/geo+json
 // @Param species_name query string false "Species Name"
 // @Param category_id query string false "Category ID"
-// @Param sort_by query string false "Sort By"
-// @Param sort_order query string false "Sort Order"
-// @Param limit query int false "Limit"
-// @Param skip query int false "Skip"
+// @Param match query string false "How the name filters match: exact, prefix, contains or regex (when enabled)" Enums(exact, prefix, contains, regex) default(contains)
+// @Param filter query string false "Filter expression, e.g. species_name=Lion,species_name=Eagle on species_name, image and category (an ID)"
+// @Param near query string false "Latitude and longitude, e.g. 60.17,24.94. Sorts nearest first and sets the distance in meters"
+// @Param max_distance query number false "Largest distance from near in meters"
+// @Param bbox query string false "Bounding box the location or the habitat must intersect, min_lng,min_lat,max_lng,max_lat"
+// @Param within query string false "GeoJSON Polygon the location or the habitat must intersect"
+// @Param sort query string false "Comma-separated fields to sort on, prefixed with - for descending: species_name, image, category or distance (with near), e.g. category,-species_name"
+// @Param sort_by query string false "Single field to sort on, use sort instead"
+// @Param sort_order query string false "asc or desc, the order of sort_by"
+// @Param limit query int false "Page size, at most the configured maximum" default(10)
+// @Param cursor query string false "Cursor from the Link header of the previous response"
+// @Param skip query int false "Skip, only used without a cursor"
 // @Success 200 {array} Species
-// @Failure 500 {object} Response
+// @Header 200 {integer} X-Total-Count "Number of matching records"
+// @Header 200 {string} Link "Links to the next and previous pages"
+// @Failure 400 {object} Problem
+// @Failure 500 {object} Problem
 // @Router /species [get]
-func getSpecies(c *fiber.Ctx) error {
-	var species []Species
-
-	// Filtering
-	filter := bson.M{}
-	if speciesName := c.Query("species_name"); speciesName != "" {
-		filter["species_name"] = bson.M{"$regex": speciesName, "$options": "i"}
+func (s *server) getSpecies(c *fiber.Ctx) error {
+	geo, err := geoQuery(c)
+	if err != nil {
+		return err
+	}
+	page, err := s.pageOptions(c, geo.sortable(speciesSortFields), geo.defaultSort()...)
+	if err != nil {
+		return err
+	}
+	match, err := s.matchMode(c, "species_name")
+	if err != nil {
+		return err
+	}
+	query := SpeciesQuery{
+		ListOptions: page.ListOptions,
+		SpeciesName: match.pattern(c.Query("species_name")),
+		Geo:         geo,
+	}
+	if query.Filter, err = parseFilter(c.Query("filter"), speciesFilterFields); err != nil {
+		return err
 	}
 	if categoryID := c.Query("category_id"); categoryID != "" {
 		objID, err := primitive.ObjectIDFromHex(categoryID)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Invalid category ID format",
-			})
+			return invalidID("Invalid category ID format")
 		}
-		filter["category"] = objID
+		query.CategoryID = objID
 	}
 
-	// Sorting
-	sort := bson.D{}
-	if sortBy := c.Query("sort_by"); sortBy != "" {
-		sortOrder := 1
-		if c.Query("sort_order") == "desc" {
-			sortOrder = -1
-		}
-		sort = append(sort, bson.E{Key: sortBy, Value: sortOrder})
-	} else {
-		// Default sort by species_name in ascending order
-		sort = append(sort, bson.E{Key: "species_name", Value: 1})
-	}
-
-	// Pagination
-	limit := c.QueryInt("limit", 10)
-	skip := c.QueryInt("skip", 0)
-
-	findOptions := options.Find()
-	findOptions.SetSort(sort)
-	findOptions.SetLimit(int64(limit))
-	findOptions.SetSkip(int64(skip))
-
-	cursor, err := speciesCollection.Find(context.Background(), filter, findOptions)
+	species, err := s.store.Species().List(c.UserContext(), query)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Internal Server Error",
-		})
-	}
-	defer cursor.Close(context.Background())
-
-	for cursor.Next(context.Background()) {
-		var specie Species
-		if err := cursor.Decode(&specie); err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Internal Server Error",
-			})
-		}
-		species = append(species, specie)
+		return err
 	}
-
-	if err := cursor.Err(); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Internal Server Error",
-		})
+	total, err := s.store.Species().Count(c.UserContext(), query)
+	if err != nil {
+		return err
 	}
 
-	return c.JSON(species)
+	return sendPage(c, page, species, total, "species_name")
 }
 
 // Get a species by ID
@@ -563,25 +652,34 @@ func getSpecies(c *fiber.Ctx) error {
 // @Accept json
 // @Produce json
 // @Param id path string true "Species ID"
+// @Param If-None-Match header string false "ETag of a cached copy"
 // @Success 200 {object} Species
-// @Failure 400 {object} Response
-// @Failure 404 {object} Response
-// @Failure 500 {object} Response
+// @Header 200 {string} ETag "Version of the species"
+// @Success 304 {string} string "Not Modified"
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
 // @Router /species/{id} [get]
-func getSpeciesByID(c *fiber.Ctx) error {
+func (s *server) getSpeciesByID(c *fiber.Ctx) error {
 	id := c.Params("id")
 	ObjectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+		return invalidID("Invalid ID")
 	}
 
-	var specie Species
-	filter := bson.M{"_id": ObjectID}
-	err = speciesCollection.FindOne(context.Background(), filter).Decode(&specie)
+	specie, err := live(s.store.Species().Get(c.UserContext(), ObjectID))
+	if errors.Is(err, ErrNotFound) {
+		return notFound("Species")
+	}
 	if err != nil {
 		return err
 	}
 
+	c.Set(fiber.HeaderETag, etag(specie.Version))
+	if notModified(c, specie.Version) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
 	return c.JSON(specie)
 }
 
@@ -593,123 +691,148 @@ func getSpeciesByID(c *fiber.Ctx) error {
 // @Produce json
 // @Param species body Species true "Species"
 // @Success 201 {object} Species
-// @Failure 400 {object} Response
-// @Failure 500 {object} Response
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
 // @Router /species [post]
-func createSpecies(c *fiber.Ctx) error {
+func (s *server) createSpecies(c *fiber.Ctx) error {
 	specie := new(Species)
 
 	if err := c.BodyParser(specie); err != nil {
 		return err
 	}
+	specie.ID = primitive.NilObjectID
+	specie.Deletion = Deletion{}
+	specie.Distance = nil
 
-	insertResult, err := speciesCollection.InsertOne(context.Background(), specie)
-	if err != nil {
+	if err := validateRecord(specie); err != nil {
+		return err
+	}
+
+	if err := s.checkCategoryReference(c.UserContext(), specie.Category); err != nil {
 		return err
 	}
 
-	specie.ID = insertResult.InsertedID.(primitive.ObjectID)
+	if err := s.auditedStore(c).Species().Create(c.UserContext(), specie); err != nil {
+		return err
+	}
 
 	return c.Status(201).JSON(specie)
 }
 
 // Update a species
 // @Summary Update a species
-// @Description Update a species by its ID
+// @Description Update a species by its ID. A JSON body changes the fields it supplies, a JSON merge patch (RFC 7386) or JSON patch (RFC 6902) is applied to the species and removes the fields it sets to null or removes. A failing JSON patch test operation leaves the species unchanged.
 // @Tags species
-// @Accept json
+// @Accept json,application/merge-patch+json,application/json-patch+json
 // @Produce json
 // @Param id path string true "Species ID"
-// @Param species body Species true "Species"
+// @Param If-Match header string false "ETag the species must still have"
+// @Param species body SpeciesUpdateRequest true "Species fields to change"
 // @Success 200 {object} Response
-// @Failure 400 {object} Response
-// @Failure 404 {object} Response
-// @Failure 500 {object} Response
+// @Header 200 {string} ETag "New version of the species"
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 412 {object} Problem
+// @Failure 415 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
 // @Router /species/{id} [patch]
-func updateSpecies(c *fiber.Ctx) error {
+func (s *server) updateSpecies(c *fiber.Ctx) error {
 	id := c.Params("id")
 	ObjectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		log.Printf("Invalid ID: %v", err)
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+		return invalidID("Invalid ID")
 	}
 
-	var updateData struct {
-		SpeciesName string `json:"species_name"`
-		Image       string `json:"image"`
-		Category    string `json:"category"`
-		Location    Point  `json:"location"`
+	specie, err := live(s.store.Species().Get(c.UserContext(), ObjectID))
+	if errors.Is(err, ErrNotFound) {
+		return notFound("Species")
 	}
-
-	if err := c.BodyParser(&updateData); err != nil {
-		log.Printf("Failed to parse request body: %v", err)
-		return c.Status(400).JSON(fiber.Map{"error": "Failed to parse request body"})
+	if err != nil {
+		return err
 	}
-
-	log.Printf("Update Data: %+v", updateData)
-
-	update := bson.M{"$set": bson.M{}}
-
-	if updateData.SpeciesName != "" {
-		update["$set"].(bson.M)["species_name"] = updateData.SpeciesName
+	if err := checkIfMatch(c, specie.Version); err != nil {
+		return preconditionFailed("Species")
 	}
-	if updateData.Image != "" {
-		update["$set"].(bson.M)["image"] = updateData.Image
+
+	var updateData SpeciesUpdateRequest
+	replace, err := decodePatch(c, newSpeciesUpdate(specie), &updateData)
+	if err != nil {
+		return err
 	}
-	if updateData.Location.Type != "" && len(updateData.Location.Coordinates) == 2 {
-		update["$set"].(bson.M)["location"] = updateData.Location
+
+	category := specie.Category
+	updateData.apply(specie, replace)
+	if err := validateRecord(specie); err != nil {
+		return err
 	}
-	if updateData.Category != "" {
-		categoryID, err := primitive.ObjectIDFromHex(updateData.Category)
-		if err != nil {
-			log.Printf("Invalid category ID: %v", err)
-			return c.Status(400).JSON(fiber.Map{"error": "Invalid category ID"})
+	if specie.Category != category && !specie.Category.IsZero() {
+		if err := s.checkCategoryReference(c.UserContext(), specie.Category); err != nil {
+			return err
 		}
-		update["$set"].(bson.M)["category"] = categoryID
 	}
 
-	log.Printf("Update BSON: %+v", update)
-
-	filter := bson.M{"_id": ObjectID}
-	result, err := speciesCollection.UpdateOne(context.Background(), filter, update)
+	err = s.auditedStore(c).Species().Update(c.UserContext(), specie)
+	if errors.Is(err, ErrNotFound) {
+		return notFound("Species")
+	}
+	if errors.Is(err, ErrVersionConflict) {
+		return versionConflict(c, "Species")
+	}
 	if err != nil {
-		log.Printf("Error updating species: %v", err)
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to update species"})
+		return err
 	}
 
-	if result.MatchedCount == 0 {
-		return c.Status(404).JSON(fiber.Map{"error": "Species not found"})
-	}
+	c.Set(fiber.HeaderETag, etag(specie.Version))
 
 	return c.JSON(fiber.Map{"success": "true"})
 }
 
 // Delete a species
 // @Summary Delete a species
-// @Description Delete a species by its ID
+// @Description Move a species to the trash, its animals are handled according to the configured delete policy
 // @Tags species
 // @Accept json
 // @Produce json
 // @Param id path string true "Species ID"
+// @Param dry_run query bool false "Only report the records that would be affected"
+// @Param X-Actor header string false "Who is deleting the record, recorded in the trash, when authentication is disabled"
+// @Param If-Match header string false "ETag the record must still have"
 // @Success 200 {object} Response
-// @Failure 400 {object} Response
-// @Failure 404 {object} Response
-// @Failure 500 {object} Response
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 412 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
 // @Router /species/{id} [delete]
-func deleteSpecies(c *fiber.Ctx) error {
+func (s *server) deleteSpecies(c *fiber.Ctx) error {
 	id := c.Params("id")
 	ObjectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+		return invalidID("Invalid ID")
 	}
 
-	filter := bson.M{"_id": ObjectID}
-	_, err = speciesCollection.DeleteOne(context.Background(), filter)
-	if err != nil {
-		return err
-	}
-
-	return c.Status(200).JSON(fiber.Map{"success": "true"})
+	return s.deleteWithPolicies(c, "Species", func(ctx context.Context, p *deletePlanner) error {
+		return p.species(ctx, ObjectID)
+	})
 }
 
 // Category handlers
@@ -720,69 +843,47 @@ func deleteSpecies(c *fiber.Ctx) error {
 // @Accept json
 // @Produce json
 // @Param category_name query string false "Category Name"
-// @Param sort_by query string false "Sort By"
-// @Param sort_order query string false "Sort Order"
-// @Param limit query int false "Limit"
-// @Param skip query int false "Skip"
+// @Param match query string false "How the name filters match: exact, prefix, contains or regex (when enabled)" Enums(exact, prefix, contains, regex) default(contains)
+// @Param filter query string false "Filter expression, e.g. category_name=in(Mammals,Birds) on category_name"
+// @Param sort query string false "Comma-separated fields to sort on, prefixed with - for descending: category_name, e.g. -category_name"
+// @Param sort_by query string false "Single field to sort on, use sort instead"
+// @Param sort_order query string false "asc or desc, the order of sort_by"
+// @Param limit query int false "Page size, at most the configured maximum" default(10)
+// @Param cursor query string false "Cursor from the Link header of the previous response"
+// @Param skip query int false "Skip, only used without a cursor"
 // @Success 200 {array} Category
-// @Failure 500 {object} Response
+// @Header 200 {integer} X-Total-Count "Number of matching records"
+// @Header 200 {string} Link "Links to the next and previous pages"
+// @Failure 400 {object} Problem
+// @Failure 500 {object} Problem
 // @Router /categories [get]
-func getCategories(c *fiber.Ctx) error {
-	var categories []Category
-
-	// Filtering
-	filter := bson.M{}
-	if categoryName := c.Query("category_name"); categoryName != "" {
-		filter["category_name"] = bson.M{"$regex": categoryName, "$options": "i"}
-	}
-
-	// Sorting
-	sort := bson.D{}
-	if sortBy := c.Query("sort_by"); sortBy != "" {
-		sortOrder := 1
-		if c.Query("sort_order") == "desc" {
-			sortOrder = -1
-		}
-		sort = append(sort, bson.E{Key: sortBy, Value: sortOrder})
-	} else {
-		// Default sort by category_name in ascending order
-		sort = append(sort, bson.E{Key: "category_name", Value: 1})
+func (s *server) getCategories(c *fiber.Ctx) error {
+	page, err := s.pageOptions(c, categorySortFields)
+	if err != nil {
+		return err
 	}
-
-	// Pagination
-	limit := c.QueryInt("limit", 10)
-	skip := c.QueryInt("skip", 0)
-
-	findOptions := options.Find()
-	findOptions.SetSort(sort)
-	findOptions.SetLimit(int64(limit))
-	findOptions.SetSkip(int64(skip))
-
-	cursor, err := categoryCollection.Find(context.Background(), filter, findOptions)
+	match, err := s.matchMode(c, "category_name")
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Internal Server Error",
-		})
+		return err
 	}
-	defer cursor.Close(context.Background())
-
-	for cursor.Next(context.Background()) {
-		var category Category
-		if err := cursor.Decode(&category); err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Internal Server Error",
-			})
-		}
-		categories = append(categories, category)
+	query := CategoryQuery{
+		ListOptions:  page.ListOptions,
+		CategoryName: match.pattern(c.Query("category_name")),
+	}
+	if query.Filter, err = parseFilter(c.Query("filter"), categoryFilterFields); err != nil {
+		return err
 	}
 
-	if err := cursor.Err(); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Internal Server Error",
-		})
+	categories, err := s.store.Categories().List(c.UserContext(), query)
+	if err != nil {
+		return err
+	}
+	total, err := s.store.Categories().Count(c.UserContext(), query)
+	if err != nil {
+		return err
 	}
 
-	return c.JSON(categories)
+	return sendPage(c, page, categories, total, "category_name")
 }
 
 // Get a category by ID
@@ -792,24 +893,33 @@ func getCategories(c *fiber.Ctx) error {
 // @Accept json
 // @Produce json
 // @Param id path string true "Category ID"
+// @Param If-None-Match header string false "ETag of a cached copy"
 // @Success 200 {object} Category
-// @Failure 400 {object} Response
-// @Failure 404 {object} Response
+// @Header 200 {string} ETag "Version of the category"
+// @Success 304 {string} string "Not Modified"
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
 // @Router /categories/{id} [get]
-func getCategoryByID(c *fiber.Ctx) error {
+func (s *server) getCategoryByID(c *fiber.Ctx) error {
 	id := c.Params("id")
 	ObjectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+		return invalidID("Invalid ID")
 	}
 
-	var category Category
-	filter := bson.M{"_id": ObjectID}
-	err = categoryCollection.FindOne(context.Background(), filter).Decode(&category)
+	category, err := live(s.store.Categories().Get(c.UserContext(), ObjectID))
+	if errors.Is(err, ErrNotFound) {
+		return notFound("Category")
+	}
 	if err != nil {
 		return err
 	}
 
+	c.Set(fiber.HeaderETag, etag(category.Version))
+	if notModified(c, category.Version) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
 	return c.JSON(category)
 }
 
@@ -821,95 +931,199 @@ func getCategoryByID(c *fiber.Ctx) error {
 // @Produce json
 // @Param category body Category true "Category"
 // @Success 201 {object} Category
-// @Failure 400 {object} Response
-// @Failure 500 {object} Response
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
 // @Router /categories [post]
-func createCategory(c *fiber.Ctx) error {
+func (s *server) createCategory(c *fiber.Ctx) error {
 	category := new(Category)
 
 	if err := c.BodyParser(category); err != nil {
 		return err
 	}
+	category.ID = primitive.NilObjectID
+	category.Deletion = Deletion{}
 
-	insertResult, err := categoryCollection.InsertOne(context.Background(), category)
-	if err != nil {
+	if err := validateRecord(category); err != nil {
 		return err
 	}
 
-	category.ID = insertResult.InsertedID.(primitive.ObjectID)
+	if err := s.auditedStore(c).Categories().Create(c.UserContext(), category); err != nil {
+		return err
+	}
 
 	return c.Status(201).JSON(category)
 }
 
 // Update a category
 // @Summary Update a category
-// @Description Update a category by ID
+// @Description Update a category by ID. A JSON body changes the fields it supplies, a JSON merge patch (RFC 7386) or JSON patch (RFC 6902) is applied to the category. A failing JSON patch test operation leaves the category unchanged.
 // @Tags categories
-// @Accept json
+// @Accept json,application/merge-patch+json,application/json-patch+json
 // @Produce json
 // @Param id path string true "Category ID"
+// @Param If-Match header string false "ETag the category must still have"
 // @Param category body CategoryUpdateRequest true "Category Data"
 // @Success 200 {object} Response
-// @Failure 400 {object} Response
-// @Failure 500 {object} Response
+// @Header 200 {string} ETag "New version of the category"
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 412 {object} Problem
+// @Failure 415 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
 // @Router /categories/{id} [patch]
-func updateCategory(c *fiber.Ctx) error {
+func (s *server) updateCategory(c *fiber.Ctx) error {
 	id := c.Params("id")
 	ObjectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+		return invalidID("Invalid ID")
 	}
 
-	var updateData struct {
-		CategoryName string `json:"category_name"`
+	category, err := live(s.store.Categories().Get(c.UserContext(), ObjectID))
+	if errors.Is(err, ErrNotFound) {
+		return notFound("Category")
 	}
-
-	if err := c.BodyParser(&updateData); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Failed to parse request body"})
+	if err != nil {
+		return err
+	}
+	if err := checkIfMatch(c, category.Version); err != nil {
+		return preconditionFailed("Category")
 	}
 
-	fmt.Println("Update Data:", updateData)
+	var updateData CategoryUpdateRequest
+	replace, err := decodePatch(c, newCategoryUpdate(category), &updateData)
+	if err != nil {
+		return err
+	}
 
-	update := bson.M{
-		"$set": bson.M{
-			"category_name": updateData.CategoryName,
-		},
+	updateData.apply(category, replace)
+	if err := validateRecord(category); err != nil {
+		return err
 	}
 
-	filter := bson.M{"_id": ObjectID}
-	result, err := categoryCollection.UpdateOne(context.Background(), filter, update)
+	err = s.auditedStore(c).Categories().Update(c.UserContext(), category)
+	if errors.Is(err, ErrNotFound) {
+		return notFound("Category")
+	}
+	if errors.Is(err, ErrVersionConflict) {
+		return versionConflict(c, "Category")
+	}
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to update category"})
+		return err
 	}
 
-	fmt.Println("Update Result:", result)
+	c.Set(fiber.HeaderETag, etag(category.Version))
 
 	return c.JSON(fiber.Map{"message": "Category updated successfully"})
 }
 
 // Delete a category
 // @Summary Delete a category
-// @Description Delete a category by ID
+// @Description Move a category to the trash, its species are handled according to the configured delete policy
 // @Tags categories
 // @Accept json
 // @Produce json
 // @Param id path string true "Category ID"
+// @Param dry_run query bool false "Only report the records that would be affected"
+// @Param X-Actor header string false "Who is deleting the record, recorded in the trash, when authentication is disabled"
+// @Param If-Match header string false "ETag the record must still have"
 // @Success 200 {object} Response
-// @Failure 400 {object} Response
-// @Failure 500 {object} Response
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 412 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
 // @Router /categories/{id} [delete]
-func deleteCategory(c *fiber.Ctx) error {
+func (s *server) deleteCategory(c *fiber.Ctx) error {
 	id := c.Params("id")
 	ObjectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+		return invalidID("Invalid ID")
 	}
 
-	filter := bson.M{"_id": ObjectID}
-	_, err = categoryCollection.DeleteOne(context.Background(), filter)
-	if err != nil {
-		return err
+	return s.deleteWithPolicies(c, "Category", func(ctx context.Context, p *deletePlanner) error {
+		return p.category(ctx, ObjectID)
+	})
+}
+
+// decodeJSONBody decodes the JSON object in the request body into the struct v field by field,
+// so errors can name the offending field. Fields v doesn't have are rejected. The returned
+// errors are meant for the client.
+func decodeJSONBody(c *fiber.Ctx, v interface{}) error {
+	if !c.Is("json") {
+		return errors.New("Request body must be JSON")
 	}
+	return decodeJSONFields(c.Body(), v)
+}
 
-	return c.Status(200).JSON(fiber.Map{"success": "true"})
+// decodeJSONFields decodes a JSON object into the struct v the way decodeJSONBody does
+func decodeJSONFields(data []byte, v interface{}) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return errors.New("Request body must be a JSON object")
+	}
+
+	target := reflect.ValueOf(v).Elem()
+	for i := 0; i < target.NumField(); i++ {
+		name, _, _ := strings.Cut(target.Type().Field(i).Tag.Get("json"), ",")
+		raw, ok := fields[name]
+		if !ok || name == "-" {
+			continue
+		}
+		delete(fields, name)
+
+		field := target.Field(i)
+		if err := json.Unmarshal(raw, field.Addr().Interface()); err != nil {
+			return fmt.Errorf("Field %s must be of type %s", name, jsonTypeName(field.Type()))
+		}
+	}
+
+	if len(fields) > 0 {
+		return fmt.Errorf("Unknown field %s", slices.Sorted(maps.Keys(fields))[0])
+	}
+	return nil
+}
+
+// jsonTypeName describes the JSON form of a Go type
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return "string (RFC 3339 time)"
+	case reflect.TypeOf(primitive.ObjectID{}):
+		return "string (ID)"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// testConfig is the configuration of the test servers, with authentication disabled
+func testConfig() Config {
+	return Config{
+		DeletePolicies: DeletePolicies{CategorySpecies: DeleteRestrict, SpeciesAnimals: DeleteRestrict},
+		MaxPageSize:    100,
+		Auth:           AuthConfig{Disabled: true},
+		Policy:         defaultPolicy,
+	}
+}
+
+// newTestApp returns the routes of a server with an empty in-memory store and the test
+// configuration
+func newTestApp(t *testing.T) *fiber.App {
+	t.Helper()
+	return newApp(newServer(newMemoryStore(), testConfig()))
+}
+
+// send makes a request to the app and returns the status and the decoded JSON body. headers are
+// pairs of names and values, bodies are sent as JSON unless they name another content type.
+func send(t *testing.T, app *fiber.App, method, path, body string, headers ...string) (int, any) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading the body: %v", method, path, err)
+	}
+	var decoded any
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("%s %s: decoding %q: %v", method, path, data, err)
+		}
+	}
+	return resp.StatusCode, decoded
+}
+
+// create posts the record to the collection and returns its ID
+func create(t *testing.T, app *fiber.App, path, body string, headers ...string) string {
+	t.Helper()
+	status, created := send(t, app, fiber.MethodPost, path, body, headers...)
+	id, _ := field(created, "_id").(string)
+	if status != fiber.StatusCreated || id == "" {
+		t.Fatalf("POST %s: got status %d and %v, want %d and the created record", path, status, created, fiber.StatusCreated)
+	}
+	return id
+}
+
+// field returns a member of a decoded JSON object, nil when the body isn't one
+func field(body any, name string) any {
+	object, _ := body.(map[string]any)
+	return object[name]
+}
+
+func TestCRUD(t *testing.T) {
+	tests := []struct {
+		path   string
+		create string
+		update string
+		// name is the member holding the name, which update changes to "Renamed"
+		name string
+	}{
+		{"/api/categories", `{"category_name":"Mammals"}`, `{"category_name":"Renamed"}`, "category_name"},
+		{"/api/species", `{"species_name":"Lion","image":"lion.jpg"}`, `{"species_name":"Renamed"}`, "species_name"},
+		{"/api/animals", `{"animal_name":"Leo","birthdate":"2020-01-02T00:00:00Z"}`, `{"animal_name":"Renamed"}`, "animal_name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			app := newTestApp(t)
+
+			status, created := send(t, app, fiber.MethodPost, tt.path, tt.create)
+			if status != fiber.StatusCreated {
+				t.Fatalf("create: got status %d, want %d: %v", status, fiber.StatusCreated, created)
+			}
+			id, _ := field(created, "_id").(string)
+			if id == "" {
+				t.Fatalf("create: no ID in %v", created)
+			}
+			record := tt.path + "/" + id
+
+			status, got := send(t, app, fiber.MethodGet, record, "")
+			if status != fiber.StatusOK || field(got, "_id") != id {
+				t.Fatalf("get: got status %d and %v, want %d and the created record", status, got, fiber.StatusOK)
+			}
+
+			status, list := send(t, app, fiber.MethodGet, tt.path, "")
+			if records, _ := list.([]any); status != fiber.StatusOK || len(records) != 1 {
+				t.Fatalf("list: got status %d and %v, want %d and one record", status, list, fiber.StatusOK)
+			}
+
+			if status, body := send(t, app, fiber.MethodPatch, record, tt.update); status != fiber.StatusOK {
+				t.Fatalf("update: got status %d, want %d: %v", status, fiber.StatusOK, body)
+			}
+			if _, got := send(t, app, fiber.MethodGet, record, ""); field(got, tt.name) != "Renamed" {
+				t.Fatalf("update: got %v, want %s Renamed", got, tt.name)
+			}
+
+			if status, body := send(t, app, fiber.MethodDelete, record, ""); status != fiber.StatusOK {
+				t.Fatalf("delete: got status %d, want %d: %v", status, fiber.StatusOK, body)
+			}
+			if status, _ := send(t, app, fiber.MethodGet, record, ""); status != fiber.StatusNotFound {
+				t.Fatalf("get after delete: got status %d, want %d", status, fiber.StatusNotFound)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	const missing = "aaaaaaaaaaaaaaaaaaaaaaaa"
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"get animal with invalid ID", fiber.MethodGet, "/api/animals/nope", "", fiber.StatusBadRequest, "invalid_id"},
+		{"get species with invalid ID", fiber.MethodGet, "/api/species/nope", "", fiber.StatusBadRequest, "invalid_id"},
+		{"get category with invalid ID", fiber.MethodGet, "/api/categories/nope", "", fiber.StatusBadRequest, "invalid_id"},
+		{"update animal with invalid ID", fiber.MethodPatch, "/api/animals/nope", `{}`, fiber.StatusBadRequest, "invalid_id"},
+		{"delete species with invalid ID", fiber.MethodDelete, "/api/species/nope", "", fiber.StatusBadRequest, "invalid_id"},
+		{"get missing animal", fiber.MethodGet, "/api/animals/" + missing, "", fiber.StatusNotFound, "not_found"},
+		{"get missing species", fiber.MethodGet, "/api/species/" + missing, "", fiber.StatusNotFound, "not_found"},
+		{"get missing category", fiber.MethodGet, "/api/categories/" + missing, "", fiber.StatusNotFound, "not_found"},
+		{"update missing category", fiber.MethodPatch, "/api/categories/" + missing, `{"category_name":"Birds"}`, fiber.StatusNotFound, "not_found"},
+		{"delete missing animal", fiber.MethodDelete, "/api/animals/" + missing, "", fiber.StatusNotFound, "not_found"},
+		{"create category without a name", fiber.MethodPost, "/api/categories", `{"category_name":""}`, fiber.StatusUnprocessableEntity, "validation_failed"},
+		{"create animal without a birthdate", fiber.MethodPost, "/api/animals", `{"animal_name":"Leo"}`, fiber.StatusUnprocessableEntity, "validation_failed"},
+		{"create animal of a missing species", fiber.MethodPost, "/api/animals", `{"animal_name":"Leo","birthdate":"2020-01-02T00:00:00Z","species":"` + missing + `"}`, fiber.StatusUnprocessableEntity, "reference_not_found"},
+		{"create category with a malformed body", fiber.MethodPost, "/api/categories", `{"category_name":1}`, fiber.StatusBadRequest, "invalid_body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			status, body := send(t, app, tt.method, tt.path, tt.body)
+			if status != tt.status || field(body, "code") != tt.code {
+				t.Errorf("got status %d and %v, want %d with code %s", status, body, tt.status, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// MatchMode is how the name filters of the list endpoints compare names, always ignoring case
+type MatchMode string
+
+const (
+	MatchExact    MatchMode = "exact"
+	MatchPrefix   MatchMode = "prefix"
+	MatchContains MatchMode = "contains"
+	// MatchRegex uses the filter as a regular expression, it has to be enabled in the config
+	MatchRegex MatchMode = "regex"
+)
+
+// maxRegexLength limits the regular expressions clients can filter with
+const maxRegexLength = 100
+
+// pattern turns a filter value into the regular expression the repositories match with. Only
+// MatchRegex passes the value on as it is, the other modes escape it.
+func (m MatchMode) pattern(value string) string {
+	if value == "" {
+		return ""
+	}
+	switch m {
+	case MatchExact:
+		return "^" + regexp.QuoteMeta(value) + "$"
+	case MatchPrefix:
+		return "^" + regexp.QuoteMeta(value)
+	case MatchRegex:
+		return value
+	default:
+		return regexp.QuoteMeta(value)
+	}
+}
+
+// matchMode reads the match query parameter, which defaults to contains. In regex mode the
+// values of the given filter parameters must be valid and short regular expressions.
+func (s *server) matchMode(c *fiber.Ctx, params ...string) (MatchMode, error) {
+	mode := MatchMode(c.Query("match", string(MatchContains)))
+	switch mode {
+	case MatchExact, MatchPrefix, MatchContains:
+		return mode, nil
+	case MatchRegex:
+	default:
+		return "", invalidParameter(fmt.Sprintf("Unknown match mode %q, use exact, prefix, contains or regex", mode))
+	}
+
+	if !s.config.AllowRegexMatch {
+		return "", newProblem(fiber.StatusBadRequest, "regex_disabled", "Regular expression filters are disabled")
+	}
+	for _, param := range params {
+		value := c.Query(param)
+		if len(value) > maxRegexLength {
+			return "", invalidParameter(fmt.Sprintf("%s must be at most %d characters in regex mode", param, maxRegexLength))
+		}
+		if _, err := regexp.Compile(value); err != nil {
+			return "", invalidParameter(fmt.Sprintf("%s is not a valid regular expression: %v", param, err))
+		}
+	}
+	return mode, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// defaultPageSize is the number of records a list endpoint returns without a limit parameter
+const defaultPageSize = 10
+
+// cursorToken is the content of the opaque cursor tokens handed out in the Link header
+type cursorToken struct {
+	// Sort is the sort order the cursor was made for, it is only valid in that order
+	Sort   string             `bson:"s"`
+	Values []interface{}      `bson:"v"`
+	ID     primitive.ObjectID `bson:"id"`
+	Before bool               `bson:"b,omitempty"`
+}
+
+// encodeCursor turns a cursor into an URL safe token
+func encodeCursor(sortSpec string, cursor Cursor) (string, error) {
+	data, err := bson.Marshal(cursorToken{Sort: sortSpec, Values: cursor.Values, ID: cursor.ID, Before: cursor.Before})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor reads a cursor token, rejecting tokens made for another sort order
+func decodeCursor(token, sortSpec string) (*Cursor, error) {
+	invalid := newProblem(fiber.StatusBadRequest, "invalid_cursor", "Invalid cursor, start again from the first page")
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, invalid
+	}
+	var decoded cursorToken
+	if err := bson.Unmarshal(data, &decoded); err != nil {
+		return nil, invalid
+	}
+	if decoded.Sort != sortSpec {
+		return nil, newProblem(fiber.StatusBadRequest, "invalid_cursor", "Cursor was made for another sort order")
+	}
+	return &Cursor{Values: decoded.Values, ID: decoded.ID, Before: decoded.Before}, nil
+}
+
+// formatSort describes sort keys as a string, descending fields are prefixed with "-"
+func formatSort(keys []SortKey) string {
+	fields := make([]string, len(keys))
+	for i, key := range keys {
+		fields[i] = key.Field
+		if key.Desc {
+			fields[i] = "-" + key.Field
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// page is a request for a page of a listing
+type page struct {
+	ListOptions
+	// Size is the number of records on the page, one more is read to tell whether there are more
+	Size int64
+}
+
+// Fields the list endpoints can be sorted on
+var (
+	animalSortFields   = []string{"animal_name", "birthdate", "species", "category"}
+	speciesSortFields  = []string{"species_name", "image", "category"}
+	categorySortFields = []string{"category_name"}
+)
+
+// parseSort reads a sort parameter like "-birthdate,animal_name", a list of fields that are
+// sorted on in turn, descending when prefixed with "-". Only the given fields are accepted.
+func parseSort(value string, sortable []string) ([]SortKey, error) {
+	var keys []SortKey
+	seen := map[string]bool{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		key := SortKey{Field: strings.TrimPrefix(field, "-"), Desc: strings.HasPrefix(field, "-")}
+		switch {
+		case key.Field == "":
+			return nil, sortProblem(fmt.Sprintf("Invalid sort %q, expected a comma-separated list of fields", value), sortable)
+		case !slices.Contains(sortable, key.Field):
+			return nil, sortProblem(fmt.Sprintf("Unknown sort field %q", key.Field), sortable)
+		case seen[key.Field]:
+			return nil, sortProblem(fmt.Sprintf("Sort field %q is given more than once", key.Field), sortable)
+		}
+		seen[key.Field] = true
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// sortProblem is the problem of an invalid sort parameter, it lists the sortable fields
+func sortProblem(detail string, sortable []string) *Problem {
+	p := newProblem(fiber.StatusBadRequest, "invalid_sort", detail)
+	p.Extensions = fiber.Map{"sortable": sortable}
+	return p
+}
+
+// pageOptions reads the sorting and pagination query parameters shared by the list endpoints.
+// The records can be sorted on the sortable fields, the default sort applies when the request
+// has none. The older sort_by and sort_order parameters are still accepted for a single field.
+// Pages are limited to the configured maximum size, and the skip parameter is still accepted
+// when paging without a cursor.
+func (s *server) pageOptions(c *fiber.Ctx, sortable []string, defaultSort ...SortKey) (page, error) {
+	p := page{ListOptions: ListOptions{Sort: defaultSort}}
+	sort := c.Query("sort")
+	if sort == "" && c.Query("sort_by") != "" {
+		sort = c.Query("sort_by")
+		if c.Query("sort_order") == "desc" {
+			sort = "-" + sort
+		}
+	}
+	if sort != "" {
+		keys, err := parseSort(sort, sortable)
+		if err != nil {
+			return p, err
+		}
+		p.Sort = keys
+	}
+
+	size, err := s.pageSize(c)
+	if err != nil {
+		return p, err
+	}
+	p.Size = size
+	p.Limit = p.Size + 1
+
+	if token := c.Query("cursor"); token != "" {
+		cursor, err := decodeCursor(token, formatSort(p.Sort))
+		if err != nil {
+			return p, err
+		}
+		p.Cursor = cursor
+	} else if p.Skip, err = pageSkip(c); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// pageSize reads the limit parameter, capped to the configured maximum page size
+func (s *server) pageSize(c *fiber.Ctx) (int64, error) {
+	size := int64(defaultPageSize)
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || n < 1 {
+			return 0, invalidParameter("limit must be a positive integer")
+		}
+		size = n
+	}
+	return min(size, int64(s.config.MaxPageSize)), nil
+}
+
+// pageSkip reads the skip parameter
+func pageSkip(c *fiber.Ctx) (int64, error) {
+	skip, err := strconv.ParseInt(c.Query("skip", "0"), 10, 64)
+	if err != nil || skip < 0 {
+		return 0, invalidParameter("skip must be a non-negative integer")
+	}
+	return skip, nil
+}
+
+// sendPage answers a list request with a page of the records read with the page options. The
+// total number of matching records is sent in the X-Total-Count header and the neighbouring
+// pages are linked in the Link header (RFC 8288). Clients asking for application/geo+json get
+// records with a location as a FeatureCollection.
+func sendPage[T any](c *fiber.Ctx, p page, records []T, total int64, defaultSort string) error {
+	more := int64(len(records)) > p.Size
+	if more {
+		records = records[:p.Size]
+	}
+	before := p.Cursor != nil && p.Cursor.Before
+	if before {
+		// Backward pages are read nearest first
+		for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+			records[i], records[j] = records[j], records[i]
+		}
+	}
+
+	hasPrev := p.Skip > 0 || (p.Cursor != nil && !before) || (before && more)
+	hasNext := more || before
+	var links []string
+	if len(records) > 0 && hasNext {
+		link, err := pageLink(c, p, records[len(records)-1], false, defaultSort)
+		if err != nil {
+			return err
+		}
+		links = append(links, link+`; rel="next"`)
+	}
+	if len(records) > 0 && hasPrev {
+		link, err := pageLink(c, p, records[0], true, defaultSort)
+		if err != nil {
+			return err
+		}
+		links = append(links, link+`; rel="prev"`)
+	}
+
+	c.Set("X-Total-Count", strconv.FormatInt(total, 10))
+	if len(links) > 0 {
+		c.Set(fiber.HeaderLink, strings.Join(links, ", "))
+	}
+
+	// Records with a location can also be answered as GeoJSON
+	if _, ok := any(*new(T)).(located); ok {
+		c.Vary(fiber.HeaderAccept)
+		if wantsGeoJSON(c) {
+			features := make([]located, len(records))
+			for i, record := range records {
+				features[i] = any(record).(located)
+			}
+			collection, err := newFeatureCollection(features)
+			if err != nil {
+				return err
+			}
+			return c.JSON(collection, mimeGeoJSON)
+		}
+	}
+	return c.JSON(records)
+}
+
+// pageLink links the page after or before the record, keeping the other query parameters
+func pageLink(c *fiber.Ctx, p page, record interface{}, before bool, defaultSort string) (string, error) {
+	doc, err := toDocument(record)
+	if err != nil {
+		return "", err
+	}
+	cursor := Cursor{Before: before}
+	keys := p.Sort
+	if len(keys) == 0 {
+		keys = []SortKey{{Field: defaultSort}}
+	}
+	for _, key := range keys {
+		cursor.Values = append(cursor.Values, lookupField(doc, key.Field))
+	}
+	cursor.ID, _ = doc["_id"].(primitive.ObjectID)
+
+	token, err := encodeCursor(formatSort(p.Sort), cursor)
+	if err != nil {
+		return "", err
+	}
+
+	query, err := url.ParseQuery(string(c.Request().URI().QueryString()))
+	if err != nil {
+		return "", err
+	}
+	query.Del("skip")
+	query.Set("cursor", token)
+	return "<" + c.BaseURL() + c.Path() + "?" + query.Encode() + ">", nil
+}
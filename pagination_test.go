@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	id := primitive.NewObjectID()
+	tests := []struct {
+		name   string
+		sort   string
+		cursor Cursor
+	}{
+		{"default sort", "", Cursor{Values: []interface{}{"Leo"}, ID: id}},
+		{"several fields", "-species,animal_name", Cursor{Values: []interface{}{"Lion", "Leo"}, ID: id}},
+		{"missing value", "category", Cursor{Values: []interface{}{nil}, ID: id}},
+		{"backwards", "-category_name", Cursor{Values: []interface{}{"Birds"}, ID: id, Before: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := encodeCursor(tt.sort, tt.cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeCursor(token, tt.sort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.cursor) {
+				t.Errorf("got %+v, want %+v", *got, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorRejects(t *testing.T) {
+	token, err := encodeCursor("animal_name", Cursor{Values: []interface{}{"Leo"}, ID: primitive.NewObjectID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := base64.RawURLEncoding.DecodeString(token)
+	flipped := append([]byte{}, data...)
+	flipped[0] ^= 0xff
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"not base64", "not a cursor!"},
+		{"not BSON", base64.RawURLEncoding.EncodeToString([]byte("garbage"))},
+		{"truncated", token[:len(token)/2]},
+		{"tampered length", base64.RawURLEncoding.EncodeToString(flipped)},
+		{"another sort order", mustEncodeCursor(t, "-animal_name")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeCursor(tt.token, "animal_name")
+			problem, ok := err.(*Problem)
+			if !ok || problem.Code != "invalid_cursor" {
+				t.Errorf("got %v, want an invalid_cursor problem", err)
+			}
+		})
+	}
+}
+
+func mustEncodeCursor(t *testing.T, sort string) string {
+	t.Helper()
+	token, err := encodeCursor(sort, Cursor{Values: []interface{}{"Leo"}, ID: primitive.NewObjectID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// linkPattern matches a link of the Link header and its relation
+var linkPattern = regexp.MustCompile(`<([^>]+)>; rel="(\w+)"`)
+
+// getPage gets a page of a listing and returns the names on it and its links by relation
+func getPage(t *testing.T, app *fiber.App, target string) ([]string, map[string]string) {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, target, nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("GET %s: got status %d, want %d", target, resp.StatusCode, fiber.StatusOK)
+	}
+	var records []struct {
+		Name string `json:"category_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, record := range records {
+		names = append(names, record.Name)
+	}
+	links := map[string]string{}
+	for _, match := range linkPattern.FindAllStringSubmatch(resp.Header.Get(fiber.HeaderLink), -1) {
+		link, err := url.Parse(match[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		links[match[2]] = link.RequestURI()
+	}
+	return names, links
+}
+
+func TestCursorPaging(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"ascending", "sort=category_name", []string{"Amphibians", "Birds", "Fish", "Insects", "Mammals"}},
+		{"descending", "sort=-category_name", []string{"Mammals", "Insects", "Fish", "Birds", "Amphibians"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			for _, name := range []string{"Fish", "Mammals", "Amphibians", "Insects", "Birds"} {
+				create(t, app, "/api/categories", `{"category_name":"`+name+`"}`)
+			}
+
+			var got []string
+			var pages []string
+			target := "/api/categories?limit=2&" + tt.query
+			for target != "" {
+				names, links := getPage(t, app, target)
+				got = append(got, names...)
+				pages = append(pages, target)
+				target = links["next"]
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v following the next links, want %v", got, tt.want)
+			}
+
+			// The prev link of the last page leads back to the page before it
+			_, links := getPage(t, app, pages[len(pages)-1])
+			names, _ := getPage(t, app, links["prev"])
+			if !reflect.DeepEqual(names, tt.want[2:4]) {
+				t.Errorf("got %v following the prev link, want %v", names, tt.want[2:4])
+			}
+		})
+	}
+}
+
+func TestCursorQueryRejects(t *testing.T) {
+	app := newTestApp(t)
+	create(t, app, "/api/categories", `{"category_name":"Birds"}`)
+	token := mustEncodeCursor(t, "category_name")
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"tampered cursor", "cursor=" + token[:len(token)-4] + "AAAA"},
+		{"garbage cursor", "cursor=%25%25%25"},
+		{"cursor of another sort order", "cursor=" + token + "&sort=-category_name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := send(t, app, fiber.MethodGet, "/api/categories?"+tt.query, "")
+			if status != fiber.StatusBadRequest || field(body, "code") != "invalid_cursor" {
+				t.Errorf("got status %d and %v, want %d with code invalid_cursor", status, body, fiber.StatusBadRequest)
+			}
+		})
+	}
+}
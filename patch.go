@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Content types accepted by the PATCH endpoints besides plain JSON
+const (
+	mimeMergePatch = "application/merge-patch+json"
+	mimeJSONPatch  = "application/json-patch+json"
+)
+
+// decodePatch decodes the body of a PATCH request into update, a pointer to one of the
+// *UpdateRequest types. Plain JSON bodies only fill in the fields they mention. JSON merge
+// patches (RFC 7386) and JSON patches (RFC 6902) are applied to current, the same type filled
+// in from the stored record, and replace is true because update then describes the whole
+// record: fields it leaves nil were removed by the patch. The returned errors are *Problem.
+func decodePatch(c *fiber.Ctx, current, update interface{}) (replace bool, err error) {
+	mediaType, _, _ := strings.Cut(c.Get(fiber.HeaderContentType), ";")
+	var patch func(document []byte) ([]byte, error)
+	switch strings.ToLower(strings.TrimSpace(mediaType)) {
+	case fiber.MIMEApplicationJSON:
+		if err := decodeJSONBody(c, update); err != nil {
+			return false, newProblem(fiber.StatusBadRequest, "invalid_body", err.Error())
+		}
+		return false, nil
+	case mimeMergePatch:
+		patch = func(document []byte) ([]byte, error) {
+			return jsonpatch.MergePatch(document, c.Body())
+		}
+	case mimeJSONPatch:
+		operations, err := jsonpatch.DecodePatch(c.Body())
+		if err != nil {
+			return false, newProblem(fiber.StatusBadRequest, "invalid_patch", "Invalid JSON patch: "+err.Error())
+		}
+		patch = operations.Apply
+	default:
+		return false, newProblem(fiber.StatusUnsupportedMediaType, "unsupported_media_type",
+			fmt.Sprintf("Content type must be application/json, %s or %s", mimeMergePatch, mimeJSONPatch))
+	}
+
+	document, err := json.Marshal(current)
+	if err != nil {
+		return false, err
+	}
+
+	// The patch is applied to a copy of the document, a failing operation leaves nothing half done
+	patched, err := patch(document)
+	switch {
+	case errors.Is(err, jsonpatch.ErrTestFailed):
+		return false, newProblem(fiber.StatusConflict, "patch_test_failed", "Patch test failed: "+err.Error())
+	case errors.Is(err, jsonpatch.ErrMissing), errors.Is(err, jsonpatch.ErrInvalid):
+		return false, newProblem(fiber.StatusUnprocessableEntity, "patch_not_applicable", "Patch does not apply: "+err.Error())
+	case err != nil:
+		return false, newProblem(fiber.StatusBadRequest, "invalid_patch", "Invalid patch: "+err.Error())
+	}
+
+	if err := decodeJSONFields(patched, update); err != nil {
+		return false, newProblem(fiber.StatusUnprocessableEntity, "invalid_body", "Patched record is invalid: "+err.Error())
+	}
+	return true, nil
+}
+
+// newAnimalUpdate describes an animal as the document patches are applied to
+func newAnimalUpdate(animal *Animal) *AnimalUpdateRequest {
+	return &AnimalUpdateRequest{
+		AnimalName: optional(animal.AnimalName),
+		Birthdate:  optional(animal.Birthdate),
+		Species:    optional(animal.Species),
+		Location:   optionalValue(animal.Location),
+	}
+}
+
+// apply sets the fields of the update on the animal
+func (u *AnimalUpdateRequest) apply(animal *Animal, replace bool) {
+	setField(&animal.AnimalName, u.AnimalName, replace)
+	setField(&animal.Birthdate, u.Birthdate, replace)
+	setField(&animal.Species, u.Species, replace)
+	setField(&animal.Location, u.Location, replace)
+}
+
+// newSpeciesUpdate describes a species as the document patches are applied to
+func newSpeciesUpdate(species *Species) *SpeciesUpdateRequest {
+	return &SpeciesUpdateRequest{
+		SpeciesName: optional(species.SpeciesName),
+		Image:       optional(species.Image),
+		Category:    optional(species.Category),
+		Location:    optionalValue(species.Location),
+		Habitat:     species.Habitat,
+	}
+}
+
+// apply sets the fields of the update on the species
+func (u *SpeciesUpdateRequest) apply(species *Species, replace bool) {
+	setField(&species.SpeciesName, u.SpeciesName, replace)
+	setField(&species.Image, u.Image, replace)
+	setField(&species.Category, u.Category, replace)
+	setField(&species.Location, u.Location, replace)
+	if u.Habitat != nil || replace {
+		species.Habitat = u.Habitat
+	}
+}
+
+// newCategoryUpdate describes a category as the document patches are applied to
+func newCategoryUpdate(category *Category) *CategoryUpdateRequest {
+	return &CategoryUpdateRequest{CategoryName: optional(category.CategoryName)}
+}
+
+// apply sets the fields of the update on the category
+func (u *CategoryUpdateRequest) apply(category *Category, replace bool) {
+	setField(&category.CategoryName, u.CategoryName, replace)
+}
+
+// setField copies a decoded request field to the record. Fields that weren't supplied are left
+// alone, unless replace is set and they are cleared.
+func setField[T any](field *T, value *T, replace bool) {
+	switch {
+	case value != nil:
+		*field = *value
+	case replace:
+		var zero T
+		*field = zero
+	}
+}
+
+// optional returns a pointer to the value, or nil for zero values so they are left out of
+// patch documents
+func optional[T comparable](value T) *T {
+	var zero T
+	if value == zero {
+		return nil
+	}
+	return &value
+}
+
+// optionalValue is optional for values that aren't comparable, like points and geometries
+func optionalValue[T interface{ IsZero() bool }](value T) *T {
+	if value.IsZero() {
+		return nil
+	}
+	return &value
+}
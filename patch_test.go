@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestPatchAnimal(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		code        string
+		// animalName and hasSpecies describe the stored animal afterwards
+		animalName string
+		hasSpecies bool
+	}{
+		{"plain JSON changes the fields it mentions", fiber.MIMEApplicationJSON, `{"animal_name":"Max"}`, fiber.StatusOK, "", "Max", true},
+		{"merge patch changes a field", mimeMergePatch, `{"animal_name":"Max"}`, fiber.StatusOK, "", "Max", true},
+		{"merge patch removes a field", mimeMergePatch, `{"species":null}`, fiber.StatusOK, "", "Leo", false},
+		{"JSON patch replaces a field", mimeJSONPatch, `[{"op":"replace","path":"/animal_name","value":"Max"}]`, fiber.StatusOK, "", "Max", true},
+		{"JSON patch removes a field", mimeJSONPatch, `[{"op":"remove","path":"/species"}]`, fiber.StatusOK, "", "Leo", false},
+		{"passing test applies the patch", mimeJSONPatch, `[{"op":"test","path":"/animal_name","value":"Leo"},{"op":"replace","path":"/animal_name","value":"Max"}]`, fiber.StatusOK, "", "Max", true},
+		{"failing test applies nothing", mimeJSONPatch, `[{"op":"replace","path":"/animal_name","value":"Max"},{"op":"test","path":"/animal_name","value":"Leo"},{"op":"remove","path":"/species"}]`, fiber.StatusConflict, "patch_test_failed", "Leo", true},
+		{"missing path applies nothing", mimeJSONPatch, `[{"op":"replace","path":"/animal_name","value":"Max"},{"op":"remove","path":"/location"}]`, fiber.StatusUnprocessableEntity, "patch_not_applicable", "Leo", true},
+		{"malformed JSON patch", mimeJSONPatch, `{"op":"replace"}`, fiber.StatusBadRequest, "invalid_patch", "Leo", true},
+		{"patched record of the wrong type", mimeJSONPatch, `[{"op":"replace","path":"/birthdate","value":42}]`, fiber.StatusUnprocessableEntity, "invalid_body", "Leo", true},
+		{"patched record failing validation", mimeMergePatch, `{"animal_name":""}`, fiber.StatusUnprocessableEntity, "validation_failed", "Leo", true},
+		{"unsupported content type", fiber.MIMETextPlain, `animal_name=Max`, fiber.StatusUnsupportedMediaType, "unsupported_media_type", "Leo", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			species := create(t, app, "/api/species", `{"species_name":"Lion"}`)
+			id := create(t, app, "/api/animals", `{"animal_name":"Leo","birthdate":"2020-01-02T00:00:00Z","species":"`+species+`"}`)
+
+			status, body := send(t, app, fiber.MethodPatch, "/api/animals/"+id, tt.body, fiber.HeaderContentType, tt.contentType)
+			if status != tt.status || (tt.code != "" && field(body, "code") != tt.code) {
+				t.Fatalf("got status %d and %v, want %d with code %q", status, body, tt.status, tt.code)
+			}
+
+			_, animal := send(t, app, fiber.MethodGet, "/api/animals/"+id, "")
+			if field(animal, "animal_name") != tt.animalName || (field(animal, "species") != nil) != tt.hasSpecies {
+				t.Errorf("stored animal %v, want name %s and species %t", animal, tt.animalName, tt.hasSpecies)
+			}
+			wantVersion := 2.0
+			if tt.status != fiber.StatusOK {
+				wantVersion = 1
+			}
+			if field(animal, "version") != wantVersion {
+				t.Errorf("stored version %v, want %v", field(animal, "version"), wantVersion)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// mimeProblemJSON is the content type of error responses
+const mimeProblemJSON = "application/problem+json"
+
+// Problem is an error answered as an RFC 7807 problem details object. Handlers return it, or
+// one of the typed errors problemFor knows, and problemHandler writes the response.
+type Problem struct {
+	Type     string `json:"type" example:"about:blank"`
+	Title    string `json:"title" example:"Not Found"`
+	Status   int    `json:"status" example:"404"`
+	Detail   string `json:"detail,omitempty" example:"Animal not found"`
+	Instance string `json:"instance,omitempty" example:"/api/animals/66a0f1c2e4b0a1b2c3d4e5f6"`
+	// Code identifies the kind of problem and doesn't change with the wording of Detail
+	Code string `json:"code" example:"not_found"`
+	// Extensions are added to the problem object as extra members
+	Extensions fiber.Map `json:"-"`
+}
+
+// newProblem returns a problem with the given status, code and detail
+func newProblem(status int, code, detail string) *Problem {
+	return &Problem{Status: status, Code: code, Detail: detail}
+}
+
+func (p *Problem) Error() string {
+	return p.Detail
+}
+
+// MarshalJSON writes the extensions next to the standard members
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	members := fiber.Map{}
+	for name, value := range p.Extensions {
+		members[name] = value
+	}
+	type problem Problem
+	data, err := json.Marshal((*problem)(p))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, err
+	}
+	return json.Marshal(members)
+}
+
+// invalidID is the problem of a malformed ID in the path or query
+func invalidID(detail string) *Problem {
+	return newProblem(fiber.StatusBadRequest, "invalid_id", detail)
+}
+
+// invalidParameter is the problem of a malformed query parameter
+func invalidParameter(detail string) *Problem {
+	return newProblem(fiber.StatusBadRequest, "invalid_parameter", detail)
+}
+
+// notFound is the problem of a missing record of the named entity
+func notFound(name string) *Problem {
+	return newProblem(fiber.StatusNotFound, "not_found", name+" not found")
+}
+
+// entityProblem names the entity in the problems of the errors shared by the handlers of its
+// records, other errors are returned as they are
+func entityProblem(c *fiber.Ctx, name string, err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return notFound(name)
+	case errors.Is(err, errPreconditionFailed):
+		return preconditionFailed(name)
+	case errors.Is(err, ErrVersionConflict):
+		return versionConflict(c, name)
+	default:
+		return err
+	}
+}
+
+// problemFor turns the errors returned by handlers into problems. Errors it doesn't know are
+// internal errors, their details are logged and not shown to the client.
+func problemFor(err error) *Problem {
+	var problem *Problem
+	var validationErr *ValidationError
+	var refErr *ReferenceError
+	var dependentsErr *DependentsError
+	var fiberErr *fiber.Error
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &problem):
+		return problem
+	case errors.As(err, &validationErr):
+		p := newProblem(fiber.StatusUnprocessableEntity, "validation_failed", "Validation failed")
+		p.Extensions = fiber.Map{"fields": validationErr.Fields}
+		return p
+	case errors.As(err, &refErr):
+		p := newProblem(fiber.StatusUnprocessableEntity, "reference_not_found", refErr.Error())
+		p.Extensions = fiber.Map{"reference": refErr}
+		return p
+	case errors.As(err, &dependentsErr):
+		p := newProblem(fiber.StatusConflict, "delete_restricted", dependentsErr.Error())
+		p.Extensions = fiber.Map{"dependents": dependentsErr.Dependents}
+		return p
+	case errors.Is(err, ErrNotFound):
+		return newProblem(fiber.StatusNotFound, "not_found", "Record not found")
+	case errors.Is(err, ErrVersionConflict):
+		return newProblem(fiber.StatusConflict, "version_conflict", "Record was modified concurrently, retry the request")
+	case errors.Is(err, errNoTransactions):
+		return newProblem(fiber.StatusConflict, "transactions_unavailable",
+			"The delete would change several records, which needs transactions that MongoDB only supports on a replica set. Delete the dependent records first.")
+	case errors.Is(err, errNoTenant):
+		return newProblem(fiber.StatusBadRequest, "tenant_required", "Name the tenant in the "+tenantHeader+" header")
+	case errors.Is(err, ErrUsernameTaken):
+		return newProblem(fiber.StatusConflict, "username_taken", "Another user has this username")
+	case errors.Is(err, ErrDuplicateID):
+		return newProblem(fiber.StatusConflict, "duplicate_id", "Record was created concurrently, retry the request")
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return newProblem(fiber.StatusBadRequest, "invalid_body", "Failed to parse request body: "+err.Error())
+	case errors.As(err, &fiberErr):
+		return newProblem(fiberErr.Code, statusCode(fiberErr.Code), fiberErr.Message)
+	default:
+		return newProblem(fiber.StatusInternalServerError, "internal_error", "Internal Server Error")
+	}
+}
+
+// statusCode derives a problem code from an HTTP status, e.g. "method_not_allowed"
+func statusCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// problemHandler is the error handler of the app, it answers every error with a problem
+func problemHandler(c *fiber.Ctx, err error) error {
+	problem := problemFor(err)
+	if problem.Status >= fiber.StatusInternalServerError {
+		log.Printf("Error handling %s %s: %v", c.Method(), c.OriginalURL(), err)
+	}
+
+	response := *problem
+	if response.Type == "" {
+		response.Type = "about:blank"
+	}
+	if response.Title == "" {
+		response.Title = http.StatusText(response.Status)
+	}
+	if response.Instance == "" {
+		response.Instance = c.OriginalURL()
+	}
+	return c.Status(response.Status).JSON(&response, mimeProblemJSON)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Policy grants permissions like "animals:write" to roles and roles to principals. Permissions
+// name a resource and an action, either can be "*" to match every one, and "*" alone matches
+// everything.
+type Policy struct {
+	// Roles maps the role names to the permissions they grant
+	Roles map[string][]string `json:"roles"`
+	// Subjects maps principals to their roles, static API keys by their name, tokens by their
+	// subject and users by their username. Tokens can also list roles in their roles claim and
+	// users have the roles they were given.
+	Subjects map[string][]string `json:"subjects"`
+	// Authenticated lists the permissions of every authenticated principal
+	Authenticated []string `json:"authenticated"`
+	// Anonymous lists the permissions of requests without credentials
+	Anonymous []string `json:"anonymous"`
+}
+
+// defaultPolicy applies without a policy file: everyone can read the records of the zoo, every
+// authenticated principal can also read the trash and the audit log, and changes need a role.
+// Readers can read everything and admins can do everything, the static API keys are admins.
+var defaultPolicy = Policy{
+	Roles: map[string][]string{
+		"admin":  {"*"},
+		"reader": {"*:read"},
+	},
+	Authenticated: []string{"animals:read", "species:read", "categories:read", "geofences:read", "alerts:read",
+		"trash:read", "audit:read"},
+	Anonymous: []string{"animals:read", "species:read", "categories:read", "geofences:read", "alerts:read"},
+}
+
+// defaultAPIKeyRoles are the roles of the static API keys under the default policy, so they can
+// create the first users
+var defaultAPIKeyRoles = []string{"admin"}
+
+// permissionPattern matches the permissions a policy can grant
+var permissionPattern = regexp.MustCompile(`^(\*|(\*|[a-z_]+):(\*|[a-z_]+))$`)
+
+// loadPolicy reads the policy from the JSON file named by RBAC_POLICY_FILE, falling back to the
+// default policy
+func loadPolicy() (Policy, error) {
+	file := os.Getenv("RBAC_POLICY_FILE")
+	if file == "" {
+		return defaultPolicy, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return Policy{}, fmt.Errorf("RBAC_POLICY_FILE: %w", err)
+	}
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return Policy{}, fmt.Errorf("RBAC_POLICY_FILE: %w", err)
+	}
+	if err := policy.validate(); err != nil {
+		return Policy{}, fmt.Errorf("RBAC_POLICY_FILE: %w", err)
+	}
+	return policy, nil
+}
+
+// validate checks that the permissions are well-formed and the subjects have known roles
+func (p Policy) validate() error {
+	lists := map[string][]string{"authenticated": p.Authenticated, "anonymous": p.Anonymous}
+	for role, permissions := range p.Roles {
+		lists["role "+role] = permissions
+	}
+	for name, permissions := range lists {
+		for _, permission := range permissions {
+			if !permissionPattern.MatchString(permission) {
+				return fmt.Errorf("%s: invalid permission %q, expected resource:action", name, permission)
+			}
+		}
+	}
+	for subject, roles := range p.Subjects {
+		for _, role := range roles {
+			if _, ok := p.Roles[role]; !ok {
+				return fmt.Errorf("subject %s: unknown role %q", subject, role)
+			}
+		}
+	}
+	return nil
+}
+
+// permissions returns every permission the principal holds
+func (p Policy) permissions(principal *Principal) []string {
+	permissions := append([]string{}, p.Authenticated...)
+	roles := append(append([]string{}, p.Subjects[principal.Subject]...), principal.Roles...)
+	for _, role := range roles {
+		permissions = append(permissions, p.Roles[role]...)
+	}
+	return permissions
+}
+
+// claimRoles returns the roles listed in the roles claim of a token, as an array or a single
+// string
+func claimRoles(claims jwt.MapClaims) []string {
+	switch roles := claims["roles"].(type) {
+	case string:
+		return []string{roles}
+	case []interface{}:
+		var names []string
+		for _, role := range roles {
+			if name, ok := role.(string); ok {
+				names = append(names, name)
+			}
+		}
+		return names
+	default:
+		return nil
+	}
+}
+
+// grants reports whether one of the permissions matches the required one
+func grants(permissions []string, required string) bool {
+	resource, action, _ := strings.Cut(required, ":")
+	return slices.ContainsFunc(permissions, func(permission string) bool {
+		if permission == "*" {
+			return true
+		}
+		r, a, _ := strings.Cut(permission, ":")
+		return (r == "*" || r == resource) && (a == "*" || a == action)
+	})
+}
+
+// authorize lets through the requests holding the permission. Requests without credentials
+// have the anonymous permissions and are answered 401 when they fall short, authenticated ones
+// are answered 403. API keys with scopes also need the permission in their scopes. Nothing is
+// checked when authentication is disabled.
+func (s *server) authorize(permission string) fiber.Handler {
+	return s.checkAccess(permission, false)
+}
+
+// authorizeSelf is authorize that also lets users at the routes of their own account, the one
+// whose ID is the id path parameter
+func (s *server) authorizeSelf(permission string) fiber.Handler {
+	return s.checkAccess(permission, true)
+}
+
+func (s *server) checkAccess(permission string, self bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		// Users and their keys are looked up in the zoo of the request
+		tenant, err := s.requestTenant(c)
+		if err != nil {
+			return err
+		}
+		if s.config.Auth.Disabled {
+			if err := s.scopeTenant(c, tenant, nil); err != nil {
+				return err
+			}
+			return c.Next()
+		}
+
+		principal, err := s.authenticate(c)
+		if err != nil {
+			return err
+		}
+		if err := s.scopeTenant(c, tenant, principal); err != nil {
+			return err
+		}
+		if principal == nil {
+			if grants(s.config.Policy.Anonymous, permission) {
+				return c.Next()
+			}
+			return unauthorized(c, "unauthenticated", "Authentication required, send an API key in X-API-Key, or a bearer token or basic credentials in Authorization", "")
+		}
+
+		c.Locals(principalKey{}, principal)
+		owner := self && !principal.UserID.IsZero() && principal.UserID.Hex() == c.Params("id")
+		if !owner && !grants(s.config.Policy.permissions(principal), permission) {
+			return forbidden(permission)
+		}
+		if len(principal.Scopes) > 0 && !grants(principal.Scopes, permission) {
+			return forbidden(permission)
+		}
+		return c.Next()
+	}
+}
+
+// forbidden is the problem of an authenticated request missing a permission, which is named in
+// the permission member
+func forbidden(permission string) *Problem {
+	p := newProblem(fiber.StatusForbidden, "permission_denied", "Missing permission "+permission)
+	p.Extensions = fiber.Map{"permission": permission}
+	return p
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestGrants(t *testing.T) {
+	tests := []struct {
+		permissions []string
+		required    string
+		want        bool
+	}{
+		{nil, "animals:read", false},
+		{[]string{"animals:read"}, "animals:read", true},
+		{[]string{"animals:read"}, "animals:write", false},
+		{[]string{"animals:read"}, "species:read", false},
+		{[]string{"animals:*"}, "animals:delete", true},
+		{[]string{"animals:*"}, "species:delete", false},
+		{[]string{"*:read"}, "users:read", true},
+		{[]string{"*:read"}, "users:write", false},
+		{[]string{"*:*"}, "users:write", true},
+		{[]string{"*"}, "audit:read", true},
+		{[]string{"species:read", "animals:write"}, "animals:write", true},
+	}
+	for _, tt := range tests {
+		if got := grants(tt.permissions, tt.required); got != tt.want {
+			t.Errorf("grants(%v, %s) = %t, want %t", tt.permissions, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		// err is part of the expected error, empty for valid policies
+		err string
+	}{
+		{"default policy", defaultPolicy, ""},
+		{"wildcards", Policy{Roles: map[string][]string{"auditor": {"*:read", "audit:*"}, "root": {"*"}}}, ""},
+		{"subject of a known role", Policy{Roles: map[string][]string{"keeper": {"animals:*"}}, Subjects: map[string][]string{"alice": {"keeper"}}}, ""},
+		{"subject of an unknown role", Policy{Subjects: map[string][]string{"alice": {"keeper"}}}, `subject alice: unknown role "keeper"`},
+		{"permission without an action", Policy{Roles: map[string][]string{"keeper": {"animals"}}}, `role keeper: invalid permission "animals"`},
+		{"capitalized permission", Policy{Anonymous: []string{"Animals:read"}}, `anonymous: invalid permission "Animals:read"`},
+		{"permission with a wildcard suffix", Policy{Authenticated: []string{"animals:read*"}}, `authenticated: invalid permission`},
+		{"nested permission", Policy{Authenticated: []string{"animals:read:own"}}, `authenticated: invalid permission`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// The default policy lets everyone read the zoo, the authenticated also read the trash and the
+// audit log, readers read everything and only admins change anything
+func TestDefaultPolicy(t *testing.T) {
+	token := func(roles ...string) []string {
+		return bearer(signToken(t, testSecret, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix(), "roles": roles}))
+	}
+	principals := map[string][]string{
+		"anonymous": nil,
+		"no roles":  token(),
+		"reader":    token("reader"),
+		"admin":     token("admin"),
+		"API key":   {"X-API-Key", testAPIKey},
+	}
+	const (
+		ok           = fiber.StatusOK
+		created      = fiber.StatusCreated
+		unauthorized = fiber.StatusUnauthorized
+		forbidden    = fiber.StatusForbidden
+	)
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		// want maps the principals to the status they get
+		want map[string]int
+	}{
+		{fiber.MethodGet, "/api/animals", "", map[string]int{"anonymous": ok, "no roles": ok, "reader": ok, "admin": ok, "API key": ok}},
+		{fiber.MethodGet, "/api/geofences", "", map[string]int{"anonymous": ok, "no roles": ok, "reader": ok, "admin": ok, "API key": ok}},
+		{fiber.MethodGet, "/api/trash", "", map[string]int{"anonymous": unauthorized, "no roles": ok, "reader": ok, "admin": ok, "API key": ok}},
+		{fiber.MethodGet, "/api/audit", "", map[string]int{"anonymous": unauthorized, "no roles": ok, "reader": ok, "admin": ok, "API key": ok}},
+		{fiber.MethodGet, "/api/users", "", map[string]int{"anonymous": unauthorized, "no roles": forbidden, "reader": ok, "admin": ok, "API key": ok}},
+		{fiber.MethodPost, "/api/categories", `{"category_name":"Mammals"}`, map[string]int{"anonymous": unauthorized, "no roles": forbidden, "reader": forbidden, "admin": created, "API key": created}},
+		{fiber.MethodPost, "/api/users", `{"username":"bob","password":"secretpass"}`, map[string]int{"anonymous": unauthorized, "no roles": forbidden, "reader": forbidden, "admin": created, "API key": created}},
+	}
+	for name, headers := range principals {
+		t.Run(name, func(t *testing.T) {
+			app := newApp(newServer(newMemoryStore(), authConfig()))
+			for _, tt := range tests {
+				status, body := send(t, app, tt.method, tt.path, tt.body, headers...)
+				if status != tt.want[name] {
+					t.Errorf("%s %s: got status %d, want %d: %v", tt.method, tt.path, status, tt.want[name], body)
+				}
+				if status == forbidden && (field(body, "code") != "permission_denied" || field(body, "permission") == nil) {
+					t.Errorf("%s %s: got %v, want permission_denied naming the permission", tt.method, tt.path, body)
+				}
+			}
+		})
+	}
+}
+
+// Policies give roles to subjects by name and can open routes to anonymous requests
+func TestPolicySubjects(t *testing.T) {
+	config := authConfig()
+	config.Policy = Policy{
+		Roles:     map[string][]string{"keeper": {"animals:*", "species:read"}},
+		Subjects:  map[string][]string{"alice": {"keeper"}},
+		Anonymous: []string{"categories:read", "categories:write"},
+	}
+	app := newApp(newServer(newMemoryStore(), config))
+	token := func(subject string) []string {
+		return bearer(signToken(t, testSecret, jwt.MapClaims{"sub": subject, "exp": time.Now().Add(time.Hour).Unix()}))
+	}
+
+	tests := []struct {
+		method  string
+		path    string
+		body    string
+		headers []string
+		status  int
+	}{
+		{fiber.MethodPost, "/api/animals", `{"animal_name":"Leo","birthdate":"2020-01-02T00:00:00Z"}`, token("alice"), fiber.StatusCreated},
+		{fiber.MethodPost, "/api/animals", `{"animal_name":"Leo","birthdate":"2020-01-02T00:00:00Z"}`, token("bob"), fiber.StatusForbidden},
+		{fiber.MethodGet, "/api/species", "", token("alice"), fiber.StatusOK},
+		{fiber.MethodPost, "/api/species", `{"species_name":"Lion","image":"lion.jpg"}`, token("alice"), fiber.StatusForbidden},
+		{fiber.MethodGet, "/api/animals", "", nil, fiber.StatusUnauthorized},
+		{fiber.MethodPost, "/api/categories", `{"category_name":"Mammals"}`, nil, fiber.StatusCreated},
+		// Authenticated principals don't have the anonymous permissions
+		{fiber.MethodGet, "/api/categories", "", token("bob"), fiber.StatusForbidden},
+	}
+	for _, tt := range tests {
+		status, body := send(t, app, tt.method, tt.path, tt.body, tt.headers...)
+		if status != tt.status {
+			t.Errorf("%s %s as %v: got status %d, want %d: %v", tt.method, tt.path, tt.headers, status, tt.status, body)
+		}
+	}
+}
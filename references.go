@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ReferenceError reports a reference to a species or category that doesn't exist
+type ReferenceError struct {
+	Field string             `json:"field"`
+	ID    primitive.ObjectID `json:"id"`
+}
+
+func (e *ReferenceError) Error() string {
+	return fmt.Sprintf("%s %s does not exist", e.Field, e.ID.Hex())
+}
+
+// checkSpeciesReference verifies that the referenced species exists and isn't in the trash, zero
+// IDs are not references
+func (s *server) checkSpeciesReference(ctx context.Context, id primitive.ObjectID) error {
+	if id.IsZero() {
+		return nil
+	}
+	_, err := live(s.store.Species().Get(ctx, id))
+	if errors.Is(err, ErrNotFound) {
+		return &ReferenceError{Field: "species", ID: id}
+	}
+	return err
+}
+
+// checkCategoryReference verifies that the referenced category exists and isn't in the trash, zero
+// IDs are not references
+func (s *server) checkCategoryReference(ctx context.Context, id primitive.ObjectID) error {
+	if id.IsZero() {
+		return nil
+	}
+	_, err := live(s.store.Categories().Get(ctx, id))
+	if errors.Is(err, ErrNotFound) {
+		return &ReferenceError{Field: "category", ID: id}
+	}
+	return err
+}
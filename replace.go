@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// errInTrash is returned when replacing a record that is in the trash
+var errInTrash = errors.New("in the trash")
+
+// Replace an animal
+// @Summary Replace an animal
+// @Description Replace every field of an animal, fields that are left out are cleared. With upsert the animal is created under the given ID if it doesn't exist.
+// @Tags animals
+// @Accept json
+// @Produce json
+// @Param id path string true "Animal ID"
+// @Param upsert query bool false "Create the animal if it doesn't exist"
+// @Param If-Match header string false "ETag the animal must still have"
+// @Param animal body AnimalUpdateRequest true "Animal, animal_name and birthdate are required"
+// @Success 200 {object} Animal
+// @Success 201 {object} Animal
+// @Header 200,201 {string} ETag "New version of the animal"
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 412 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /animals/{id} [put]
+func (s *server) replaceAnimal(c *fiber.Ctx) error {
+	id := c.Params("id")
+	ObjectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil || ObjectID.IsZero() {
+		return invalidID("Invalid ID")
+	}
+
+	var replacement AnimalUpdateRequest
+	if err := decodeReplacement(c, &replacement, "animal_name", "birthdate"); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid_body", err.Error())
+	}
+
+	animal, err := s.store.Animals().Get(c.UserContext(), ObjectID)
+	created := errors.Is(err, ErrNotFound) && c.QueryBool("upsert")
+	switch {
+	case created:
+		animal, err = &Animal{ID: ObjectID}, checkIfMatchMissing(c)
+	case err == nil && animal.IsDeleted():
+		err = errInTrash
+	case err == nil:
+		err = checkIfMatch(c, animal.Version)
+	}
+	var current Animal
+	if err == nil {
+		current = *animal
+		replacement.apply(animal, true)
+		err = validateRecord(animal)
+	}
+	if err == nil {
+		err = s.checkSpeciesReference(c.UserContext(), animal.Species)
+	}
+	switch {
+	case err != nil:
+	case created, !unchanged(&current, animal):
+		err = s.writeAnimal(c, animal, created, current.Location)
+	}
+	if err != nil {
+		return replaceProblem(c, "Animal", err)
+	}
+
+	c.Set(fiber.HeaderETag, etag(animal.Version))
+	if created {
+		return c.Status(201).JSON(animal)
+	}
+	return c.JSON(animal)
+}
+
+// Replace a species
+// @Summary Replace a species
+// @Description Replace every field of a species, fields that are left out are cleared. With upsert the species is created under the given ID if it doesn't exist.
+// @Tags species
+// @Accept json
+// @Produce json
+// @Param id path string true "Species ID"
+// @Param upsert query bool false "Create the species if it doesn't exist"
+// @Param If-Match header string false "ETag the species must still have"
+// @Param species body SpeciesUpdateRequest true "Species, species_name is required"
+// @Success 200 {object} Species
+// @Success 201 {object} Species
+// @Header 200,201 {string} ETag "New version of the species"
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 412 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /species/{id} [put]
+func (s *server) replaceSpecies(c *fiber.Ctx) error {
+	id := c.Params("id")
+	ObjectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil || ObjectID.IsZero() {
+		return invalidID("Invalid ID")
+	}
+
+	var replacement SpeciesUpdateRequest
+	if err := decodeReplacement(c, &replacement, "species_name"); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid_body", err.Error())
+	}
+
+	specie, err := s.store.Species().Get(c.UserContext(), ObjectID)
+	created := errors.Is(err, ErrNotFound) && c.QueryBool("upsert")
+	switch {
+	case created:
+		specie, err = &Species{ID: ObjectID}, checkIfMatchMissing(c)
+	case err == nil && specie.IsDeleted():
+		err = errInTrash
+	case err == nil:
+		err = checkIfMatch(c, specie.Version)
+	}
+	var current Species
+	if err == nil {
+		current = *specie
+		replacement.apply(specie, true)
+		err = validateRecord(specie)
+	}
+	if err == nil {
+		err = s.checkCategoryReference(c.UserContext(), specie.Category)
+	}
+	switch {
+	case err != nil:
+	case created:
+		err = s.auditedStore(c).Species().Create(c.UserContext(), specie)
+	case !unchanged(&current, specie):
+		err = s.auditedStore(c).Species().Update(c.UserContext(), specie)
+	}
+	if err != nil {
+		return replaceProblem(c, "Species", err)
+	}
+
+	c.Set(fiber.HeaderETag, etag(specie.Version))
+	if created {
+		return c.Status(201).JSON(specie)
+	}
+	return c.JSON(specie)
+}
+
+// Replace a category
+// @Summary Replace a category
+// @Description Replace a category. With upsert the category is created under the given ID if it doesn't exist.
+// @Tags categories
+// @Accept json
+// @Produce json
+// @Param id path string true "Category ID"
+// @Param upsert query bool false "Create the category if it doesn't exist"
+// @Param If-Match header string false "ETag the category must still have"
+// @Param category body CategoryUpdateRequest true "Category, category_name is required"
+// @Success 200 {object} Category
+// @Success 201 {object} Category
+// @Header 200,201 {string} ETag "New version of the category"
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 412 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /categories/{id} [put]
+func (s *server) replaceCategory(c *fiber.Ctx) error {
+	id := c.Params("id")
+	ObjectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil || ObjectID.IsZero() {
+		return invalidID("Invalid ID")
+	}
+
+	var replacement CategoryUpdateRequest
+	if err := decodeReplacement(c, &replacement, "category_name"); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid_body", err.Error())
+	}
+
+	category, err := s.store.Categories().Get(c.UserContext(), ObjectID)
+	created := errors.Is(err, ErrNotFound) && c.QueryBool("upsert")
+	switch {
+	case created:
+		category, err = &Category{ID: ObjectID}, checkIfMatchMissing(c)
+	case err == nil && category.IsDeleted():
+		err = errInTrash
+	case err == nil:
+		err = checkIfMatch(c, category.Version)
+	}
+	var current Category
+	if err == nil {
+		current = *category
+		replacement.apply(category, true)
+		err = validateRecord(category)
+	}
+	switch {
+	case err != nil:
+	case created:
+		err = s.auditedStore(c).Categories().Create(c.UserContext(), category)
+	case !unchanged(&current, category):
+		err = s.auditedStore(c).Categories().Update(c.UserContext(), category)
+	}
+	if err != nil {
+		return replaceProblem(c, "Category", err)
+	}
+
+	c.Set(fiber.HeaderETag, etag(category.Version))
+	if created {
+		return c.Status(201).JSON(category)
+	}
+	return c.JSON(category)
+}
+
+// decodeReplacement decodes the JSON body of a PUT request like decodeJSONBody, and also
+// rejects bodies that leave out one of the required fields
+func decodeReplacement(c *fiber.Ctx, v interface{}, required ...string) error {
+	if err := decodeJSONBody(c, v); err != nil {
+		return err
+	}
+
+	target := reflect.ValueOf(v).Elem()
+	for i := 0; i < target.NumField(); i++ {
+		name, _, _ := strings.Cut(target.Type().Field(i).Tag.Get("json"), ",")
+		for _, field := range required {
+			if field == name && target.Field(i).IsNil() {
+				return fmt.Errorf("Field %s is required", name)
+			}
+		}
+	}
+	return nil
+}
+
+// unchanged reports whether a replacement leaves the record as it was, in which case it isn't
+// written so pushing the same state again doesn't create new versions
+func unchanged(current, replaced interface{}) bool {
+	changes, err := diffRecords(current, replaced)
+	return err == nil && len(changes) == 0
+}
+
+// checkIfMatchMissing returns errPreconditionFailed when the request has an If-Match header,
+// which no version matches when the record doesn't exist yet
+func checkIfMatchMissing(c *fiber.Ctx) error {
+	if c.Get(fiber.HeaderIfMatch) != "" {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// replaceProblem names the entity in the problem of a failed replacement
+func replaceProblem(c *fiber.Ctx, name string, err error) error {
+	switch {
+	case errors.Is(err, ErrDuplicateID):
+		return newProblem(fiber.StatusConflict, "duplicate_id", name+" was created concurrently, retry the request")
+	case errors.Is(err, errInTrash):
+		return newProblem(fiber.StatusConflict, "in_trash", name+" is in the trash, restore it first")
+	default:
+		return entityProblem(c, name, err)
+	}
+}
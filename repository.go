@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrNotFound is returned by repositories when no record matches the given ID
+var ErrNotFound = errors.New("record not found")
+
+// ErrDuplicateID is returned by Create when the record comes with an ID that is already taken
+var ErrDuplicateID = errors.New("record ID already exists")
+
+// ErrUsernameTaken is returned by the user repository when another user has the username
+var ErrUsernameTaken = errors.New("username already taken")
+
+// ErrVersionConflict is returned by Update when the stored record is no longer at the version
+// of the record being written, because someone else changed it in the meantime
+var ErrVersionConflict = errors.New("record was modified concurrently")
+
+// SortKey is a field a listing is sorted on
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// Cursor points at the record on the edge of a page by the values of its sort fields and its ID
+type Cursor struct {
+	Values []interface{}
+	ID     primitive.ObjectID
+	// Before pages backwards, to the records in front of the one pointed at
+	Before bool
+}
+
+// ListOptions holds the sorting and pagination options shared by the list queries
+type ListOptions struct {
+	// Sort lists the fields to sort on, the ID is always added last so the order is stable
+	Sort []SortKey
+	// Cursor continues the listing after the record it points at. Backward cursors read the
+	// records in front of it in reverse order, nearest first.
+	Cursor *Cursor
+	Limit  int64
+	Skip   int64
+}
+
+// order returns the keys the records are read in, ending with the ID, and sorts on the default
+// field when no sort is given. Backward cursors reverse every key.
+func (o ListOptions) order(defaultField string) []SortKey {
+	keys := append([]SortKey{}, o.Sort...)
+	if len(keys) == 0 {
+		keys = append(keys, SortKey{Field: defaultField})
+	}
+	keys = append(keys, SortKey{Field: "_id"})
+	if o.Cursor != nil && o.Cursor.Before {
+		for i := range keys {
+			keys[i].Desc = !keys[i].Desc
+		}
+	}
+	return keys
+}
+
+// cursorValues returns the values of the cursor in the order of order()
+func (o ListOptions) cursorValues() []interface{} {
+	return append(append([]interface{}{}, o.Cursor.Values...), o.Cursor.ID)
+}
+
+// FilterOp is the comparison of a filter condition
+type FilterOp string
+
+const (
+	FilterEq  FilterOp = "eq"
+	FilterNe  FilterOp = "ne"
+	FilterGt  FilterOp = "gt"
+	FilterGte FilterOp = "gte"
+	FilterLt  FilterOp = "lt"
+	FilterLte FilterOp = "lte"
+	// FilterIn and FilterNin compare the field with a list of values
+	FilterIn  FilterOp = "in"
+	FilterNin FilterOp = "nin"
+)
+
+// Filter is a node of a parsed filter expression, a FilterAnd, FilterOr or FilterCondition
+type Filter interface {
+	isFilter()
+}
+
+// FilterAnd matches the records that match every filter
+type FilterAnd []Filter
+
+// FilterOr matches the records that match any of the filters
+type FilterOr []Filter
+
+// FilterCondition compares a field with values of the field's type: strings, dates as
+// primitive.DateTime and IDs as primitive.ObjectID. Only FilterIn and FilterNin have more than
+// one value. Records without the field only match FilterNe and FilterNin.
+type FilterCondition struct {
+	Field  string
+	Op     FilterOp
+	Values []interface{}
+}
+
+func (FilterAnd) isFilter()       {}
+func (FilterOr) isFilter()        {}
+func (FilterCondition) isFilter() {}
+
+// GeoQuery restricts a listing to the records located near a point or in an area. Positions
+// are [longitude, latitude] pairs like in GeoJSON, and records without a location are left out.
+// Distances are measured to the nearest point of a location, and the area keeps the records
+// whose location, or habitat for species, intersects it.
+type GeoQuery struct {
+	// Near gives every record its distance from the position in meters
+	Near []float64
+	// MaxDistance leaves out the records farther from Near, zero means no limit
+	MaxDistance float64
+	// Area is the outer ring of a polygon, the last position repeats the first
+	Area [][]float64
+}
+
+// AnimalQuery holds the filters accepted when listing animals, the names are case-insensitive
+// regular expressions
+type AnimalQuery struct {
+	ListOptions
+	AnimalName   string
+	SpeciesName  string
+	CategoryName string
+	// Filter is matched against the fields of AnimalDetail, it is nil when not filtering
+	Filter Filter
+	Geo    GeoQuery
+	// Tenant keeps the records of a zoo when zoos share the database, empty keeps every record
+	Tenant string
+}
+
+// SpeciesQuery holds the filters accepted when listing species, the name is a case-insensitive
+// regular expression
+type SpeciesQuery struct {
+	ListOptions
+	SpeciesName string
+	CategoryID  primitive.ObjectID
+	Filter      Filter
+	Geo         GeoQuery
+	Tenant      string
+}
+
+// CategoryQuery holds the filters accepted when listing categories, the name is a
+// case-insensitive regular expression
+type CategoryQuery struct {
+	ListOptions
+	CategoryName string
+	Filter       Filter
+	Tenant       string
+}
+
+// AuditQuery holds the filters accepted when listing audit events, zero values match everything
+type AuditQuery struct {
+	Entity    string
+	EntityID  primitive.ObjectID
+	Action    string
+	Actor     string
+	RequestID string
+	Tenant    string
+	// From and To limit the events to the half-open interval [From, To)
+	From  time.Time
+	To    time.Time
+	Limit int64
+	Skip  int64
+}
+
+// AnimalDetail is an animal with its species and category resolved to their names
+type AnimalDetail struct {
+	ID         primitive.ObjectID `json:"_id" bson:"_id"`
+	AnimalName string             `json:"animal_name" bson:"animal_name"`
+	Birthdate  time.Time          `json:"birthdate" bson:"birthdate"`
+	Species    string             `json:"species,omitempty" bson:"species,omitempty"`
+	Category   string             `json:"category,omitempty" bson:"category,omitempty"`
+	Location   Point              `json:"location" bson:"location,omitempty"`
+	Version    int64              `json:"version" bson:"version"`
+	// Distance from the point of a near query in meters
+	Distance *float64 `json:"distance,omitempty" bson:"distance,omitempty"`
+}
+
+// AnimalRepository stores animals. Animals in the trash are left out of List, GetDetail and
+// ListBySpecies, but Get still returns them.
+type AnimalRepository interface {
+	// List returns the animals matching the query, joined with their species and category
+	List(ctx context.Context, query AnimalQuery) ([]AnimalDetail, error)
+	// Count returns the number of animals matching the filters of the query
+	Count(ctx context.Context, query AnimalQuery) (int64, error)
+	// GetDetail returns a single animal joined with its species and category
+	GetDetail(ctx context.Context, id primitive.ObjectID) (*AnimalDetail, error)
+	Get(ctx context.Context, id primitive.ObjectID) (*Animal, error)
+	// ListBySpecies returns every animal of the species
+	ListBySpecies(ctx context.Context, speciesID primitive.ObjectID) ([]Animal, error)
+	// ListDeleted returns the animals in the trash, most recently deleted first
+	ListDeleted(ctx context.Context) ([]Animal, error)
+	// Create inserts the animal and sets its version to 1. The animal gets a new ID unless it
+	// already has one, which must not be taken.
+	Create(ctx context.Context, animal *Animal) error
+	// Update replaces the stored animal with the same ID if it is still at the animal's version,
+	// which is then incremented
+	Update(ctx context.Context, animal *Animal) error
+	// Delete permanently removes the animal
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// Purge permanently removes the animals deleted before the given time
+	Purge(ctx context.Context, before time.Time) (int64, error)
+}
+
+// SpeciesRepository stores species. Species in the trash are left out of List and
+// ListByCategory, but Get still returns them.
+type SpeciesRepository interface {
+	List(ctx context.Context, query SpeciesQuery) ([]Species, error)
+	// Count returns the number of species matching the filters of the query
+	Count(ctx context.Context, query SpeciesQuery) (int64, error)
+	Get(ctx context.Context, id primitive.ObjectID) (*Species, error)
+	// ListByCategory returns every species in the category
+	ListByCategory(ctx context.Context, categoryID primitive.ObjectID) ([]Species, error)
+	// ListDeleted returns the species in the trash, most recently deleted first
+	ListDeleted(ctx context.Context) ([]Species, error)
+	// Create inserts the species and sets its version to 1. The species gets a new ID unless it
+	// already has one, which must not be taken.
+	Create(ctx context.Context, species *Species) error
+	// Update replaces the stored species with the same ID if it is still at the species's version,
+	// which is then incremented
+	Update(ctx context.Context, species *Species) error
+	// Delete permanently removes the species
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// Purge permanently removes the species deleted before the given time
+	Purge(ctx context.Context, before time.Time) (int64, error)
+}
+
+// CategoryRepository stores categories. Categories in the trash are left out of List,
+// but Get still returns them.
+type CategoryRepository interface {
+	List(ctx context.Context, query CategoryQuery) ([]Category, error)
+	// Count returns the number of categories matching the filters of the query
+	Count(ctx context.Context, query CategoryQuery) (int64, error)
+	Get(ctx context.Context, id primitive.ObjectID) (*Category, error)
+	// ListDeleted returns the categories in the trash, most recently deleted first
+	ListDeleted(ctx context.Context) ([]Category, error)
+	// Create inserts the category and sets its version to 1. The category gets a new ID unless it
+	// already has one, which must not be taken.
+	Create(ctx context.Context, category *Category) error
+	// Update replaces the stored category with the same ID if it is still at the category's version,
+	// which is then incremented
+	Update(ctx context.Context, category *Category) error
+	// Delete permanently removes the category
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// Purge permanently removes the categories deleted before the given time
+	Purge(ctx context.Context, before time.Time) (int64, error)
+}
+
+// AuditRepository stores audit events, which are never changed once appended
+type AuditRepository interface {
+	Append(ctx context.Context, event *AuditEvent) error
+	// List returns the events matching the query, newest first
+	List(ctx context.Context, query AuditQuery) ([]AuditEvent, error)
+}
+
+// TrackQuery selects the location fixes of an animal
+type TrackQuery struct {
+	AnimalID primitive.ObjectID
+	// From and To limit the fixes to the half-open interval [From, To), zero times leave it open
+	From time.Time
+	To   time.Time
+	// After continues the track past this fix, only its time and ID are used
+	After *LocationFix
+	// Limit is the largest number of fixes returned, zero returns them all
+	Limit int64
+}
+
+// LocationRepository stores the location fixes of animals, which are never changed once appended
+type LocationRepository interface {
+	Append(ctx context.Context, fix *LocationFix) error
+	// List returns the fixes matching the query, oldest first
+	List(ctx context.Context, query TrackQuery) ([]LocationFix, error)
+	// Latest returns the most recent fix of the animal, ErrNotFound when it has none
+	Latest(ctx context.Context, animalID primitive.ObjectID) (*LocationFix, error)
+	// Purge permanently removes the fixes of animals that no longer exist
+	Purge(ctx context.Context) (int64, error)
+}
+
+// GeofenceRepository stores geofences
+type GeofenceRepository interface {
+	// List returns every geofence by name
+	List(ctx context.Context) ([]Geofence, error)
+	Get(ctx context.Context, id primitive.ObjectID) (*Geofence, error)
+	// Create inserts the geofence and sets its version to 1. The geofence gets a new ID unless
+	// it already has one, which must not be taken.
+	Create(ctx context.Context, geofence *Geofence) error
+	// Update replaces the stored geofence with the same ID if it is still at the geofence's
+	// version, which is then incremented
+	Update(ctx context.Context, geofence *Geofence) error
+	// Delete permanently removes the geofence
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// AlertQuery holds the filters accepted when listing alerts, zero values match everything
+type AlertQuery struct {
+	// Statuses keeps the alerts in one of the statuses
+	Statuses   []string
+	AnimalID   primitive.ObjectID
+	GeofenceID primitive.ObjectID
+	Tenant     string
+	Limit      int64
+	Skip       int64
+}
+
+// AlertRepository stores alerts
+type AlertRepository interface {
+	// List returns the alerts matching the query, newest first
+	List(ctx context.Context, query AlertQuery) ([]Alert, error)
+	Get(ctx context.Context, id primitive.ObjectID) (*Alert, error)
+	// Create inserts the alert, which comes with its ID, and sets its version to 1
+	Create(ctx context.Context, alert *Alert) error
+	// Update replaces the stored alert with the same ID if it is still at the alert's version,
+	// which is then incremented
+	Update(ctx context.Context, alert *Alert) error
+}
+
+// UserRepository stores users
+type UserRepository interface {
+	// List returns every user by username
+	List(ctx context.Context) ([]User, error)
+	Get(ctx context.Context, id primitive.ObjectID) (*User, error)
+	// GetByUsername returns the user of the tenant with the username, ErrNotFound when there is
+	// none. The tenant is empty for users tagged with none.
+	GetByUsername(ctx context.Context, tenant, username string) (*User, error)
+	// Create inserts the user, which comes with its ID, and sets its version to 1. It returns
+	// ErrUsernameTaken when another user of its tenant has the username.
+	Create(ctx context.Context, user *User) error
+	// Update replaces the stored user with the same ID if it is still at the user's version,
+	// which is then incremented
+	Update(ctx context.Context, user *User) error
+	// Delete permanently removes the user
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// APIKeyRepository stores the API keys issued to users
+type APIKeyRepository interface {
+	// ListByUser returns the keys of the user, oldest first
+	ListByUser(ctx context.Context, userID primitive.ObjectID) ([]APIKey, error)
+	Get(ctx context.Context, id primitive.ObjectID) (*APIKey, error)
+	// Create inserts the key, which comes with its ID, and sets its version to 1
+	Create(ctx context.Context, key *APIKey) error
+	// Update replaces the stored key with the same ID if it is still at the key's version, which
+	// is then incremented
+	Update(ctx context.Context, key *APIKey) error
+	// Touch records when the key was last used, leaving its version as it is
+	Touch(ctx context.Context, id primitive.ObjectID, at time.Time) error
+	// DeleteByUser permanently removes the keys of the user
+	DeleteByUser(ctx context.Context, userID primitive.ObjectID) error
+}
+
+// Store gives access to the repositories of a storage backend
+type Store interface {
+	Animals() AnimalRepository
+	Species() SpeciesRepository
+	Categories() CategoryRepository
+	Audit() AuditRepository
+	Locations() LocationRepository
+	Geofences() GeofenceRepository
+	Alerts() AlertRepository
+	Users() UserRepository
+	APIKeys() APIKeyRepository
+	// WithTransaction runs fn against a store whose changes are committed together when fn
+	// returns nil and discarded otherwise
+	WithTransaction(ctx context.Context, fn func(ctx context.Context, tx Store) error) error
+	// Transactional reports whether WithTransaction discards the changes of a failed fn, MongoDB
+	// only supports transactions on replica sets
+	Transactional() bool
+	Close(ctx context.Context) error
+}
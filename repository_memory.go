@@ -0,0 +1,1200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryStore is an in-memory storage backend, mainly useful for tests and local development
+type memoryStore struct {
+	mu *sync.RWMutex
+	// inTx marks the store handed to a transaction, which already holds the write lock
+	inTx       bool
+	animals    map[primitive.ObjectID]Animal
+	species    map[primitive.ObjectID]Species
+	categories map[primitive.ObjectID]Category
+	locations  map[primitive.ObjectID]LocationFix
+	geofences  map[primitive.ObjectID]Geofence
+	alerts     map[primitive.ObjectID]Alert
+	users      map[primitive.ObjectID]User
+	apiKeys    map[primitive.ObjectID]APIKey
+	// audit is shared by pointer so transactions append to the same log
+	audit *[]AuditEvent
+}
+
+// newMemoryStore returns an empty in-memory store
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		mu:         &sync.RWMutex{},
+		animals:    map[primitive.ObjectID]Animal{},
+		species:    map[primitive.ObjectID]Species{},
+		categories: map[primitive.ObjectID]Category{},
+		locations:  map[primitive.ObjectID]LocationFix{},
+		geofences:  map[primitive.ObjectID]Geofence{},
+		alerts:     map[primitive.ObjectID]Alert{},
+		users:      map[primitive.ObjectID]User{},
+		apiKeys:    map[primitive.ObjectID]APIKey{},
+		audit:      &[]AuditEvent{},
+	}
+}
+
+func (s *memoryStore) Animals() AnimalRepository      { return memoryAnimalRepository{s} }
+func (s *memoryStore) Species() SpeciesRepository     { return memorySpeciesRepository{s} }
+func (s *memoryStore) Categories() CategoryRepository { return memoryCategoryRepository{s} }
+func (s *memoryStore) Audit() AuditRepository         { return memoryAuditRepository{s} }
+func (s *memoryStore) Locations() LocationRepository  { return memoryLocationRepository{s} }
+func (s *memoryStore) Geofences() GeofenceRepository  { return memoryGeofenceRepository{s} }
+func (s *memoryStore) Alerts() AlertRepository        { return memoryAlertRepository{s} }
+func (s *memoryStore) Users() UserRepository          { return memoryUserRepository{s} }
+func (s *memoryStore) APIKeys() APIKeyRepository      { return memoryAPIKeyRepository{s} }
+
+func (s *memoryStore) Close(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Transactional() bool { return true }
+
+// WithTransaction runs fn while holding the write lock and restores the previous data if it fails
+func (s *memoryStore) WithTransaction(ctx context.Context, fn func(ctx context.Context, tx Store) error) error {
+	if s.inTx {
+		return fn(ctx, s)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	animals, species, categories := maps.Clone(s.animals), maps.Clone(s.species), maps.Clone(s.categories)
+	locations, geofences, alerts := maps.Clone(s.locations), maps.Clone(s.geofences), maps.Clone(s.alerts)
+	users, apiKeys := maps.Clone(s.users), maps.Clone(s.apiKeys)
+	events := len(*s.audit)
+
+	tx := *s
+	tx.inTx = true
+	if err := fn(ctx, &tx); err != nil {
+		restoreMap(s.animals, animals)
+		restoreMap(s.species, species)
+		restoreMap(s.categories, categories)
+		restoreMap(s.locations, locations)
+		restoreMap(s.geofences, geofences)
+		restoreMap(s.alerts, alerts)
+		restoreMap(s.users, users)
+		restoreMap(s.apiKeys, apiKeys)
+		*s.audit = (*s.audit)[:events]
+		return err
+	}
+	return nil
+}
+
+// restoreMap replaces the contents of m with the snapshot
+func restoreMap[K comparable, V any](m, snapshot map[K]V) {
+	clear(m)
+	maps.Copy(m, snapshot)
+}
+
+// rlock takes the read lock unless the store belongs to a transaction and returns the unlock function
+func (s *memoryStore) rlock() func() {
+	if s.inTx {
+		return func() {}
+	}
+	s.mu.RLock()
+	return s.mu.RUnlock
+}
+
+// lock takes the write lock unless the store belongs to a transaction and returns the unlock function
+func (s *memoryStore) lock() func() {
+	if s.inTx {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+// Animal repository
+
+type memoryAnimalRepository struct {
+	store *memoryStore
+}
+
+// detail joins the animal with its species and category, the caller must hold the lock
+func (r memoryAnimalRepository) detail(animal Animal) AnimalDetail {
+	detail := AnimalDetail{
+		ID:         animal.ID,
+		AnimalName: animal.AnimalName,
+		Birthdate:  animal.Birthdate,
+		Location:   animal.Location,
+		Version:    animal.Version,
+	}
+	if species, ok := r.store.species[animal.Species]; ok {
+		detail.Species = species.SpeciesName
+		if category, ok := r.store.categories[species.Category]; ok {
+			detail.Category = category.CategoryName
+		}
+	}
+	return detail
+}
+
+func (r memoryAnimalRepository) List(ctx context.Context, query AnimalQuery) ([]AnimalDetail, error) {
+	defer r.store.rlock()()
+
+	docs, err := r.documents(query)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDocuments[AnimalDetail](pageDocuments(docs, query.ListOptions, "animal_name"))
+}
+
+func (r memoryAnimalRepository) Count(ctx context.Context, query AnimalQuery) (int64, error) {
+	defer r.store.rlock()()
+
+	docs, err := r.documents(query)
+	return int64(len(docs)), err
+}
+
+// documents returns the live animals matching the filters of the query, the caller must hold the lock
+func (r memoryAnimalRepository) documents(query AnimalQuery) ([]bson.M, error) {
+	var docs []bson.M
+	for _, animal := range r.store.animals {
+		if animal.IsDeleted() || (query.Tenant != "" && animal.Tenant != query.Tenant) {
+			continue
+		}
+		detail := r.detail(animal)
+		distance, ok := matchGeo(query.Geo, detail.Location.geometry(), nil)
+		if !ok {
+			continue
+		}
+		detail.Distance = distance
+		doc, err := toDocument(detail)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+
+	return filterDocuments(docs, map[string]string{
+		"animal_name": query.AnimalName,
+		"species":     query.SpeciesName,
+		"category":    query.CategoryName,
+	}, query.Filter)
+}
+
+func (r memoryAnimalRepository) GetDetail(ctx context.Context, id primitive.ObjectID) (*AnimalDetail, error) {
+	defer r.store.rlock()()
+
+	animal, ok := r.store.animals[id]
+	if !ok || animal.IsDeleted() {
+		return nil, ErrNotFound
+	}
+	detail := cloneRecord(r.detail(animal))
+	return &detail, nil
+}
+
+func (r memoryAnimalRepository) Get(ctx context.Context, id primitive.ObjectID) (*Animal, error) {
+	defer r.store.rlock()()
+
+	animal, ok := r.store.animals[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	animal = cloneRecord(animal)
+	return &animal, nil
+}
+
+func (r memoryAnimalRepository) ListBySpecies(ctx context.Context, speciesID primitive.ObjectID) ([]Animal, error) {
+	defer r.store.rlock()()
+
+	animals := []Animal{}
+	for _, animal := range r.store.animals {
+		if animal.Species == speciesID && !animal.IsDeleted() {
+			animals = append(animals, cloneRecord(animal))
+		}
+	}
+	return animals, nil
+}
+
+func (r memoryAnimalRepository) ListDeleted(ctx context.Context) ([]Animal, error) {
+	defer r.store.rlock()()
+	return deletedRecords(r.store.animals), nil
+}
+
+func (r memoryAnimalRepository) Create(ctx context.Context, animal *Animal) error {
+	defer r.store.lock()()
+
+	if animal.ID.IsZero() {
+		animal.ID = primitive.NewObjectID()
+	} else if _, ok := r.store.animals[animal.ID]; ok {
+		return ErrDuplicateID
+	}
+	animal.Version = 1
+	r.store.animals[animal.ID] = cloneRecord(*animal)
+	return nil
+}
+
+func (r memoryAnimalRepository) Update(ctx context.Context, animal *Animal) error {
+	defer r.store.lock()()
+
+	stored, ok := r.store.animals[animal.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != animal.Version {
+		return ErrVersionConflict
+	}
+	animal.Version++
+	r.store.animals[animal.ID] = cloneRecord(*animal)
+	return nil
+}
+
+func (r memoryAnimalRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	defer r.store.lock()()
+
+	if _, ok := r.store.animals[id]; !ok {
+		return ErrNotFound
+	}
+	delete(r.store.animals, id)
+	return nil
+}
+
+func (r memoryAnimalRepository) Purge(ctx context.Context, before time.Time) (int64, error) {
+	defer r.store.lock()()
+	return purgeRecords(r.store.animals, before), nil
+}
+
+// Species repository
+
+type memorySpeciesRepository struct {
+	store *memoryStore
+}
+
+func (r memorySpeciesRepository) List(ctx context.Context, query SpeciesQuery) ([]Species, error) {
+	defer r.store.rlock()()
+
+	docs, err := r.documents(query)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDocuments[Species](pageDocuments(docs, query.ListOptions, "species_name"))
+}
+
+func (r memorySpeciesRepository) Count(ctx context.Context, query SpeciesQuery) (int64, error) {
+	defer r.store.rlock()()
+
+	docs, err := r.documents(query)
+	return int64(len(docs)), err
+}
+
+// documents returns the live species matching the filters of the query, the caller must hold the lock
+func (r memorySpeciesRepository) documents(query SpeciesQuery) ([]bson.M, error) {
+	var docs []bson.M
+	for _, species := range r.store.species {
+		if species.IsDeleted() || (!query.CategoryID.IsZero() && species.Category != query.CategoryID) ||
+			(query.Tenant != "" && species.Tenant != query.Tenant) {
+			continue
+		}
+		distance, ok := matchGeo(query.Geo, species.Location, species.Habitat)
+		if !ok {
+			continue
+		}
+		species.Distance = distance
+		doc, err := toDocument(species)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+
+	return filterDocuments(docs, map[string]string{"species_name": query.SpeciesName}, query.Filter)
+}
+
+func (r memorySpeciesRepository) Get(ctx context.Context, id primitive.ObjectID) (*Species, error) {
+	defer r.store.rlock()()
+
+	species, ok := r.store.species[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	species = cloneRecord(species)
+	return &species, nil
+}
+
+func (r memorySpeciesRepository) ListByCategory(ctx context.Context, categoryID primitive.ObjectID) ([]Species, error) {
+	defer r.store.rlock()()
+
+	species := []Species{}
+	for _, specie := range r.store.species {
+		if specie.Category == categoryID && !specie.IsDeleted() {
+			species = append(species, cloneRecord(specie))
+		}
+	}
+	return species, nil
+}
+
+func (r memorySpeciesRepository) ListDeleted(ctx context.Context) ([]Species, error) {
+	defer r.store.rlock()()
+	return deletedRecords(r.store.species), nil
+}
+
+func (r memorySpeciesRepository) Create(ctx context.Context, species *Species) error {
+	defer r.store.lock()()
+
+	if species.ID.IsZero() {
+		species.ID = primitive.NewObjectID()
+	} else if _, ok := r.store.species[species.ID]; ok {
+		return ErrDuplicateID
+	}
+	species.Version = 1
+	species.Distance = nil
+	r.store.species[species.ID] = cloneRecord(*species)
+	return nil
+}
+
+func (r memorySpeciesRepository) Update(ctx context.Context, species *Species) error {
+	defer r.store.lock()()
+
+	stored, ok := r.store.species[species.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != species.Version {
+		return ErrVersionConflict
+	}
+	species.Version++
+	species.Distance = nil
+	r.store.species[species.ID] = cloneRecord(*species)
+	return nil
+}
+
+func (r memorySpeciesRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	defer r.store.lock()()
+
+	if _, ok := r.store.species[id]; !ok {
+		return ErrNotFound
+	}
+	delete(r.store.species, id)
+	return nil
+}
+
+func (r memorySpeciesRepository) Purge(ctx context.Context, before time.Time) (int64, error) {
+	defer r.store.lock()()
+	return purgeRecords(r.store.species, before), nil
+}
+
+// Category repository
+
+type memoryCategoryRepository struct {
+	store *memoryStore
+}
+
+func (r memoryCategoryRepository) List(ctx context.Context, query CategoryQuery) ([]Category, error) {
+	defer r.store.rlock()()
+
+	docs, err := r.documents(query)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDocuments[Category](pageDocuments(docs, query.ListOptions, "category_name"))
+}
+
+func (r memoryCategoryRepository) Count(ctx context.Context, query CategoryQuery) (int64, error) {
+	defer r.store.rlock()()
+
+	docs, err := r.documents(query)
+	return int64(len(docs)), err
+}
+
+// documents returns the live categories matching the filters of the query, the caller must hold the lock
+func (r memoryCategoryRepository) documents(query CategoryQuery) ([]bson.M, error) {
+	var docs []bson.M
+	for _, category := range r.store.categories {
+		if category.IsDeleted() || (query.Tenant != "" && category.Tenant != query.Tenant) {
+			continue
+		}
+		doc, err := toDocument(category)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+
+	return filterDocuments(docs, map[string]string{"category_name": query.CategoryName}, query.Filter)
+}
+
+func (r memoryCategoryRepository) Get(ctx context.Context, id primitive.ObjectID) (*Category, error) {
+	defer r.store.rlock()()
+
+	category, ok := r.store.categories[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	category = cloneRecord(category)
+	return &category, nil
+}
+
+func (r memoryCategoryRepository) ListDeleted(ctx context.Context) ([]Category, error) {
+	defer r.store.rlock()()
+	return deletedRecords(r.store.categories), nil
+}
+
+func (r memoryCategoryRepository) Create(ctx context.Context, category *Category) error {
+	defer r.store.lock()()
+
+	if category.ID.IsZero() {
+		category.ID = primitive.NewObjectID()
+	} else if _, ok := r.store.categories[category.ID]; ok {
+		return ErrDuplicateID
+	}
+	category.Version = 1
+	r.store.categories[category.ID] = cloneRecord(*category)
+	return nil
+}
+
+func (r memoryCategoryRepository) Update(ctx context.Context, category *Category) error {
+	defer r.store.lock()()
+
+	stored, ok := r.store.categories[category.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != category.Version {
+		return ErrVersionConflict
+	}
+	category.Version++
+	r.store.categories[category.ID] = cloneRecord(*category)
+	return nil
+}
+
+func (r memoryCategoryRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	defer r.store.lock()()
+
+	if _, ok := r.store.categories[id]; !ok {
+		return ErrNotFound
+	}
+	delete(r.store.categories, id)
+	return nil
+}
+
+func (r memoryCategoryRepository) Purge(ctx context.Context, before time.Time) (int64, error) {
+	defer r.store.lock()()
+	return purgeRecords(r.store.categories, before), nil
+}
+
+// Audit repository
+
+type memoryAuditRepository struct {
+	store *memoryStore
+}
+
+func (r memoryAuditRepository) Append(ctx context.Context, event *AuditEvent) error {
+	defer r.store.lock()()
+
+	*r.store.audit = append(*r.store.audit, *event)
+	return nil
+}
+
+func (r memoryAuditRepository) List(ctx context.Context, query AuditQuery) ([]AuditEvent, error) {
+	defer r.store.rlock()()
+
+	events := []AuditEvent{}
+	skip := query.Skip
+	// Events are appended in order, so walking backwards gives the newest first
+	for i := len(*r.store.audit) - 1; i >= 0; i-- {
+		if query.Limit > 0 && int64(len(events)) == query.Limit {
+			break
+		}
+		event := (*r.store.audit)[i]
+		if !query.matches(event) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// matches reports whether the event passes the filters of the query
+func (q AuditQuery) matches(event AuditEvent) bool {
+	return (q.Entity == "" || event.Entity == q.Entity) &&
+		(q.EntityID.IsZero() || event.EntityID == q.EntityID) &&
+		(q.Action == "" || event.Action == q.Action) &&
+		(q.Actor == "" || event.Actor == q.Actor) &&
+		(q.RequestID == "" || event.RequestID == q.RequestID) &&
+		(q.Tenant == "" || event.Tenant == q.Tenant) &&
+		(q.From.IsZero() || !event.Timestamp.Before(q.From)) &&
+		(q.To.IsZero() || event.Timestamp.Before(q.To))
+}
+
+// Location repository
+
+type memoryLocationRepository struct {
+	store *memoryStore
+}
+
+func (r memoryLocationRepository) Append(ctx context.Context, fix *LocationFix) error {
+	defer r.store.lock()()
+
+	r.store.locations[fix.ID] = cloneRecord(*fix)
+	return nil
+}
+
+func (r memoryLocationRepository) List(ctx context.Context, query TrackQuery) ([]LocationFix, error) {
+	defer r.store.rlock()()
+
+	fixes := []LocationFix{}
+	for _, fix := range r.store.locations {
+		if fix.AnimalID == query.AnimalID &&
+			(query.From.IsZero() || !fix.RecordedAt.Before(query.From)) &&
+			(query.To.IsZero() || fix.RecordedAt.Before(query.To)) &&
+			(query.After == nil || compareFixes(fix, *query.After) > 0) {
+			fixes = append(fixes, cloneRecord(fix))
+		}
+	}
+	slices.SortFunc(fixes, compareFixes)
+	if query.Limit > 0 && int64(len(fixes)) > query.Limit {
+		fixes = fixes[:query.Limit]
+	}
+	return fixes, nil
+}
+
+func (r memoryLocationRepository) Latest(ctx context.Context, animalID primitive.ObjectID) (*LocationFix, error) {
+	defer r.store.rlock()()
+
+	var latest *LocationFix
+	for _, fix := range r.store.locations {
+		if fix.AnimalID == animalID && (latest == nil || compareFixes(fix, *latest) > 0) {
+			latest = &fix
+		}
+	}
+	if latest == nil {
+		return nil, ErrNotFound
+	}
+	clone := cloneRecord(*latest)
+	return &clone, nil
+}
+
+func (r memoryLocationRepository) Purge(ctx context.Context) (int64, error) {
+	defer r.store.lock()()
+
+	var purged int64
+	for id, fix := range r.store.locations {
+		if _, ok := r.store.animals[fix.AnimalID]; !ok {
+			delete(r.store.locations, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// compareFixes orders location fixes by time and then by ID
+func compareFixes(a, b LocationFix) int {
+	if c := a.RecordedAt.Compare(b.RecordedAt); c != 0 {
+		return c
+	}
+	return bytes.Compare(a.ID[:], b.ID[:])
+}
+
+// Geofence repository
+
+type memoryGeofenceRepository struct {
+	store *memoryStore
+}
+
+func (r memoryGeofenceRepository) List(ctx context.Context) ([]Geofence, error) {
+	defer r.store.rlock()()
+
+	geofences := []Geofence{}
+	for _, geofence := range r.store.geofences {
+		geofences = append(geofences, cloneRecord(geofence))
+	}
+	slices.SortFunc(geofences, func(a, b Geofence) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+	return geofences, nil
+}
+
+func (r memoryGeofenceRepository) Get(ctx context.Context, id primitive.ObjectID) (*Geofence, error) {
+	defer r.store.rlock()()
+
+	geofence, ok := r.store.geofences[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	geofence = cloneRecord(geofence)
+	return &geofence, nil
+}
+
+func (r memoryGeofenceRepository) Create(ctx context.Context, geofence *Geofence) error {
+	defer r.store.lock()()
+
+	if geofence.ID.IsZero() {
+		geofence.ID = primitive.NewObjectID()
+	} else if _, ok := r.store.geofences[geofence.ID]; ok {
+		return ErrDuplicateID
+	}
+	geofence.Version = 1
+	r.store.geofences[geofence.ID] = cloneRecord(*geofence)
+	return nil
+}
+
+func (r memoryGeofenceRepository) Update(ctx context.Context, geofence *Geofence) error {
+	defer r.store.lock()()
+
+	stored, ok := r.store.geofences[geofence.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != geofence.Version {
+		return ErrVersionConflict
+	}
+	geofence.Version++
+	r.store.geofences[geofence.ID] = cloneRecord(*geofence)
+	return nil
+}
+
+func (r memoryGeofenceRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	defer r.store.lock()()
+
+	if _, ok := r.store.geofences[id]; !ok {
+		return ErrNotFound
+	}
+	delete(r.store.geofences, id)
+	return nil
+}
+
+// Alert repository
+
+type memoryAlertRepository struct {
+	store *memoryStore
+}
+
+func (r memoryAlertRepository) List(ctx context.Context, query AlertQuery) ([]Alert, error) {
+	defer r.store.rlock()()
+
+	alerts := []Alert{}
+	for _, alert := range r.store.alerts {
+		if query.matches(alert) {
+			alerts = append(alerts, alert)
+		}
+	}
+	slices.SortFunc(alerts, func(a, b Alert) int {
+		if c := b.RaisedAt.Compare(a.RaisedAt); c != 0 {
+			return c
+		}
+		return bytes.Compare(b.ID[:], a.ID[:])
+	})
+
+	alerts = alerts[min(query.Skip, int64(len(alerts))):]
+	if query.Limit > 0 && int64(len(alerts)) > query.Limit {
+		alerts = alerts[:query.Limit]
+	}
+	for i, alert := range alerts {
+		alerts[i] = cloneRecord(alert)
+	}
+	return alerts, nil
+}
+
+// matches reports whether the alert passes the filters of the query
+func (q AlertQuery) matches(alert Alert) bool {
+	return (len(q.Statuses) == 0 || slices.Contains(q.Statuses, alert.Status)) &&
+		(q.AnimalID.IsZero() || alert.AnimalID == q.AnimalID) &&
+		(q.GeofenceID.IsZero() || alert.GeofenceID == q.GeofenceID) &&
+		(q.Tenant == "" || alert.Tenant == q.Tenant)
+}
+
+func (r memoryAlertRepository) Get(ctx context.Context, id primitive.ObjectID) (*Alert, error) {
+	defer r.store.rlock()()
+
+	alert, ok := r.store.alerts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	alert = cloneRecord(alert)
+	return &alert, nil
+}
+
+func (r memoryAlertRepository) Create(ctx context.Context, alert *Alert) error {
+	defer r.store.lock()()
+
+	if _, ok := r.store.alerts[alert.ID]; ok {
+		return ErrDuplicateID
+	}
+	alert.Version = 1
+	r.store.alerts[alert.ID] = cloneRecord(*alert)
+	return nil
+}
+
+func (r memoryAlertRepository) Update(ctx context.Context, alert *Alert) error {
+	defer r.store.lock()()
+
+	stored, ok := r.store.alerts[alert.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != alert.Version {
+		return ErrVersionConflict
+	}
+	alert.Version++
+	r.store.alerts[alert.ID] = cloneRecord(*alert)
+	return nil
+}
+
+// User repository
+
+type memoryUserRepository struct {
+	store *memoryStore
+}
+
+func (r memoryUserRepository) List(ctx context.Context) ([]User, error) {
+	defer r.store.rlock()()
+
+	users := []User{}
+	for _, user := range r.store.users {
+		users = append(users, cloneRecord(user))
+	}
+	slices.SortFunc(users, func(a, b User) int {
+		return strings.Compare(a.Username, b.Username)
+	})
+	return users, nil
+}
+
+func (r memoryUserRepository) Get(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	defer r.store.rlock()()
+
+	user, ok := r.store.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	user = cloneRecord(user)
+	return &user, nil
+}
+
+func (r memoryUserRepository) GetByUsername(ctx context.Context, tenant, username string) (*User, error) {
+	defer r.store.rlock()()
+
+	for _, user := range r.store.users {
+		if user.Tenant == tenant && user.Username == username {
+			user = cloneRecord(user)
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r memoryUserRepository) Create(ctx context.Context, user *User) error {
+	defer r.store.lock()()
+
+	if _, ok := r.store.users[user.ID]; ok {
+		return ErrDuplicateID
+	}
+	for _, other := range r.store.users {
+		if other.Tenant == user.Tenant && other.Username == user.Username {
+			return ErrUsernameTaken
+		}
+	}
+	user.Version = 1
+	r.store.users[user.ID] = cloneRecord(*user)
+	return nil
+}
+
+func (r memoryUserRepository) Update(ctx context.Context, user *User) error {
+	defer r.store.lock()()
+
+	stored, ok := r.store.users[user.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != user.Version {
+		return ErrVersionConflict
+	}
+	user.Version++
+	r.store.users[user.ID] = cloneRecord(*user)
+	return nil
+}
+
+func (r memoryUserRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	defer r.store.lock()()
+
+	if _, ok := r.store.users[id]; !ok {
+		return ErrNotFound
+	}
+	delete(r.store.users, id)
+	return nil
+}
+
+// API key repository
+
+type memoryAPIKeyRepository struct {
+	store *memoryStore
+}
+
+func (r memoryAPIKeyRepository) ListByUser(ctx context.Context, userID primitive.ObjectID) ([]APIKey, error) {
+	defer r.store.rlock()()
+
+	keys := []APIKey{}
+	for _, key := range r.store.apiKeys {
+		if key.UserID == userID {
+			keys = append(keys, cloneRecord(key))
+		}
+	}
+	slices.SortFunc(keys, func(a, b APIKey) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+	return keys, nil
+}
+
+func (r memoryAPIKeyRepository) Get(ctx context.Context, id primitive.ObjectID) (*APIKey, error) {
+	defer r.store.rlock()()
+
+	key, ok := r.store.apiKeys[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	key = cloneRecord(key)
+	return &key, nil
+}
+
+func (r memoryAPIKeyRepository) Create(ctx context.Context, key *APIKey) error {
+	defer r.store.lock()()
+
+	if _, ok := r.store.apiKeys[key.ID]; ok {
+		return ErrDuplicateID
+	}
+	key.Version = 1
+	r.store.apiKeys[key.ID] = cloneRecord(*key)
+	return nil
+}
+
+func (r memoryAPIKeyRepository) Update(ctx context.Context, key *APIKey) error {
+	defer r.store.lock()()
+
+	stored, ok := r.store.apiKeys[key.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != key.Version {
+		return ErrVersionConflict
+	}
+	key.Version++
+	r.store.apiKeys[key.ID] = cloneRecord(*key)
+	return nil
+}
+
+func (r memoryAPIKeyRepository) Touch(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	defer r.store.lock()()
+
+	key, ok := r.store.apiKeys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	key.LastUsedAt = &at
+	r.store.apiKeys[id] = key
+	return nil
+}
+
+func (r memoryAPIKeyRepository) DeleteByUser(ctx context.Context, userID primitive.ObjectID) error {
+	defer r.store.lock()()
+
+	maps.DeleteFunc(r.store.apiKeys, func(_ primitive.ObjectID, key APIKey) bool {
+		return key.UserID == userID
+	})
+	return nil
+}
+
+// Trash helpers
+
+// deletedRecords returns copies of the records in the trash, most recently deleted first
+func deletedRecords[T trashable](records map[primitive.ObjectID]T) []T {
+	deleted := []T{}
+	for _, record := range records {
+		if record.deletion().IsDeleted() {
+			deleted = append(deleted, cloneRecord(record))
+		}
+	}
+	sort.Slice(deleted, func(i, j int) bool {
+		return deleted[i].deletion().DeletedAt.After(*deleted[j].deletion().DeletedAt)
+	})
+	return deleted
+}
+
+// purgeRecords removes the records deleted before the given time and returns how many it removed
+func purgeRecords[T trashable](records map[primitive.ObjectID]T, before time.Time) int64 {
+	var purged int64
+	for id, record := range records {
+		if deletedAt := record.deletion().DeletedAt; deletedAt != nil && deletedAt.Before(before) {
+			delete(records, id)
+			purged++
+		}
+	}
+	return purged
+}
+
+// Document helpers
+//
+// The in-memory repositories evaluate filters and sorting on the BSON form of the
+// records so they behave like the MongoDB queries they stand in for.
+
+// cloneRecord returns a deep copy of the record so callers can't mutate stored data
+func cloneRecord[T any](record T) T {
+	var clone T
+	data, err := bson.Marshal(record)
+	if err == nil {
+		err = bson.Unmarshal(data, &clone)
+	}
+	if err != nil {
+		return record
+	}
+	return clone
+}
+
+// toDocument converts a record to its BSON document form
+func toDocument(record interface{}) (bson.M, error) {
+	data, err := bson.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	err = bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// decodeDocuments decodes the documents into records
+func decodeDocuments[T any](docs []bson.M) ([]T, error) {
+	records := []T{}
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		var record T
+		if err := bson.Unmarshal(data, &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// filterDocuments keeps the documents whose fields match the given case-insensitive patterns
+// and the filter expression, empty patterns and a nil filter are ignored
+func filterDocuments(docs []bson.M, patterns map[string]string, filter Filter) ([]bson.M, error) {
+	matchers := map[string]*regexp.Regexp{}
+	for field, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, err
+		}
+		matchers[field] = re
+	}
+
+	var filtered []bson.M
+	for _, doc := range docs {
+		matched := true
+		for field, re := range matchers {
+			value, ok := lookupField(doc, field).(string)
+			if !ok || !re.MatchString(value) {
+				matched = false
+				break
+			}
+		}
+		if matched && matchFilter(doc, filter) {
+			filtered = append(filtered, doc)
+		}
+	}
+	return filtered, nil
+}
+
+// matchFilter evaluates a filter expression against a document like Mongo would
+func matchFilter(doc bson.M, filter Filter) bool {
+	switch f := filter.(type) {
+	case FilterAnd:
+		for _, operand := range f {
+			if !matchFilter(doc, operand) {
+				return false
+			}
+		}
+		return true
+	case FilterOr:
+		for _, operand := range f {
+			if matchFilter(doc, operand) {
+				return true
+			}
+		}
+		return false
+	case FilterCondition:
+		value := lookupField(doc, f.Field)
+		in := slices.ContainsFunc(f.Values, func(v interface{}) bool {
+			return value != nil && compareValues(value, v) == 0
+		})
+		switch f.Op {
+		case FilterEq, FilterIn:
+			return in
+		case FilterNe, FilterNin:
+			return !in
+		}
+		if value == nil {
+			return false
+		}
+		cmp := compareValues(value, f.Values[0])
+		switch f.Op {
+		case FilterGt:
+			return cmp > 0
+		case FilterGte:
+			return cmp >= 0
+		case FilterLt:
+			return cmp < 0
+		case FilterLte:
+			return cmp <= 0
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// pageDocuments sorts the documents and applies the cursor, skip and limit of the list options
+func pageDocuments(docs []bson.M, opts ListOptions, defaultSort string) []bson.M {
+	keys := opts.order(defaultSort)
+	compare := func(doc bson.M, values []interface{}) int {
+		for i, key := range keys {
+			cmp := compareValues(lookupField(doc, key.Field), values[i])
+			if key.Desc {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp
+			}
+		}
+		return 0
+	}
+
+	valuesOf := func(doc bson.M) []interface{} {
+		values := make([]interface{}, len(keys))
+		for i, key := range keys {
+			values[i] = lookupField(doc, key.Field)
+		}
+		return values
+	}
+	sort.Slice(docs, func(i, j int) bool { return compare(docs[i], valuesOf(docs[j])) < 0 })
+
+	if opts.Cursor != nil {
+		cursor := opts.cursorValues()
+		start := sort.Search(len(docs), func(i int) bool { return compare(docs[i], cursor) > 0 })
+		docs = docs[start:]
+	}
+
+	if opts.Skip >= int64(len(docs)) {
+		return nil
+	}
+	docs = docs[opts.Skip:]
+	if opts.Limit > 0 && opts.Limit < int64(len(docs)) {
+		docs = docs[:opts.Limit]
+	}
+	return docs
+}
+
+// lookupField resolves a dotted field path in the document
+func lookupField(doc bson.M, path string) interface{} {
+	var value interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case bson.M:
+			value = v[key]
+		case bson.D:
+			value = v.Map()[key]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+// compareValues orders two BSON values, missing values sort first like they do in MongoDB
+func compareValues(a, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y)
+		}
+	case primitive.DateTime:
+		if y, ok := b.(primitive.DateTime); ok {
+			return x.Time().Compare(y.Time())
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y)
+		}
+	case primitive.ObjectID:
+		if y, ok := b.(primitive.ObjectID); ok {
+			return bytes.Compare(x[:], y[:])
+		}
+	case bool:
+		if y, ok := b.(bool); ok && x != y {
+			if !x {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// toFloat converts numeric BSON values to float64
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
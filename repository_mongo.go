@@ -0,0 +1,1096 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoStore is the MongoDB storage backend
+type mongoStore struct {
+	client *mongo.Client
+	// transactions is false on standalone servers, which only support replica set transactions
+	transactions bool
+	animals      *mongoAnimalRepository
+	species      *mongoSpeciesRepository
+	categories   *mongoCategoryRepository
+	audit        *mongoAuditRepository
+	locations    *mongoLocationRepository
+	geofences    *mongoGeofenceRepository
+	alerts       *mongoAlertRepository
+	users        *mongoUserRepository
+	apiKeys      *mongoAPIKeyRepository
+}
+
+// newMongoStore connects to MongoDB and returns a store backed by the given database
+func newMongoStore(ctx context.Context, uri, database string) (*mongoStore, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+
+	db := client.Database(database)
+
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := db.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+
+	if err := migrateDocuments(ctx, db); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	if err := ensureGeoIndexes(ctx, db); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	_, err = db.Collection("animal_locations").Indexes().CreateOne(ctx,
+		mongo.IndexModel{Keys: bson.D{{Key: "animal", Value: 1}, {Key: "recorded_at", Value: 1}}})
+	if err != nil {
+		client.Disconnect(ctx)
+		return nil, fmt.Errorf("creating the index of animal_locations: %w", err)
+	}
+	_, err = db.Collection("alerts").Indexes().CreateOne(ctx,
+		mongo.IndexModel{Keys: bson.D{{Key: "animal", Value: 1}, {Key: "geofence", Value: 1}, {Key: "status", Value: 1}}})
+	if err != nil {
+		client.Disconnect(ctx)
+		return nil, fmt.Errorf("creating the index of alerts: %w", err)
+	}
+	_, err = db.Collection("users").Indexes().CreateOne(ctx,
+		mongo.IndexModel{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "username", Value: 1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		client.Disconnect(ctx)
+		return nil, fmt.Errorf("creating the index of users: %w", err)
+	}
+	_, err = db.Collection("api_keys").Indexes().CreateOne(ctx,
+		mongo.IndexModel{Keys: bson.D{{Key: "user", Value: 1}, {Key: "created_at", Value: 1}}})
+	if err != nil {
+		client.Disconnect(ctx)
+		return nil, fmt.Errorf("creating the index of api_keys: %w", err)
+	}
+	// Zoos sharing the database list their records by tenant
+	for _, name := range []string{"animals", "species", "categories", "audit_events", "alerts"} {
+		_, err = db.Collection(name).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "tenant", Value: 1}}})
+		if err != nil {
+			client.Disconnect(ctx)
+			return nil, fmt.Errorf("creating the tenant index of %s: %w", name, err)
+		}
+	}
+
+	return &mongoStore{
+		client:       client,
+		transactions: hello.SetName != "" || hello.Msg == "isdbgrid",
+		animals:      &mongoAnimalRepository{collection: db.Collection("animals")},
+		species:      &mongoSpeciesRepository{collection: db.Collection("species")},
+		categories:   &mongoCategoryRepository{collection: db.Collection("categories")},
+		// The recorded field values are free-form, decode their documents as maps rather than bson.D
+		audit: &mongoAuditRepository{collection: db.Collection("audit_events",
+			options.Collection().SetBSONOptions(&options.BSONOptions{DefaultDocumentM: true}))},
+		locations: &mongoLocationRepository{collection: db.Collection("animal_locations"), animals: db.Collection("animals")},
+		geofences: &mongoGeofenceRepository{collection: db.Collection("geofences")},
+		alerts:    &mongoAlertRepository{collection: db.Collection("alerts")},
+		users:     &mongoUserRepository{collection: db.Collection("users")},
+		apiKeys:   &mongoAPIKeyRepository{collection: db.Collection("api_keys")},
+	}, nil
+}
+
+// ensureGeoIndexes creates the 2dsphere indexes the geospatial queries need on the locations of
+// animals and species and on the habitats of species. The migrations have made the stored
+// locations valid for them.
+func ensureGeoIndexes(ctx context.Context, db *mongo.Database) error {
+	for name, fields := range geoFields {
+		collection := db.Collection(name)
+		for _, field := range fields {
+			_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: field, Value: "2dsphere"}}})
+			if err != nil {
+				return fmt.Errorf("creating the %s index of %s: %w", field, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *mongoStore) Animals() AnimalRepository      { return s.animals }
+func (s *mongoStore) Species() SpeciesRepository     { return s.species }
+func (s *mongoStore) Categories() CategoryRepository { return s.categories }
+func (s *mongoStore) Audit() AuditRepository         { return s.audit }
+func (s *mongoStore) Locations() LocationRepository  { return s.locations }
+func (s *mongoStore) Geofences() GeofenceRepository  { return s.geofences }
+func (s *mongoStore) Alerts() AlertRepository        { return s.alerts }
+func (s *mongoStore) Users() UserRepository          { return s.users }
+func (s *mongoStore) APIKeys() APIKeyRepository      { return s.apiKeys }
+
+func (s *mongoStore) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
+
+func (s *mongoStore) Transactional() bool { return s.transactions }
+
+// WithTransaction runs fn in a transaction when the server supports them. On a standalone
+// server fn runs without one and a failure can leave its earlier writes in place.
+func (s *mongoStore) WithTransaction(ctx context.Context, fn func(ctx context.Context, tx Store) error) error {
+	if !s.transactions || mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx, s)
+	}
+
+	session, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc, s)
+	})
+	return err
+}
+
+// sortSpec builds the Mongo sort document for the list options, falling back to the given field
+func (o ListOptions) sortSpec(defaultField string) bson.D {
+	var spec bson.D
+	for _, key := range o.order(defaultField) {
+		direction := 1
+		if key.Desc {
+			direction = -1
+		}
+		spec = append(spec, bson.E{Key: key.Field, Value: direction})
+	}
+	return spec
+}
+
+// cursorFilter matches the documents that come after the cursor in the sort order, as an
+// aggregation expression because those compare values of different types like $sort does.
+// Missing fields are compared as null, which sorts first.
+func (o ListOptions) cursorFilter(defaultField string) bson.M {
+	keys := o.order(defaultField)
+	values := o.cursorValues()
+
+	var or bson.A
+	for i, key := range keys {
+		var and bson.A
+		for j := 0; j < i; j++ {
+			and = append(and, bson.M{"$eq": bson.A{fieldOrNull(keys[j].Field), values[j]}})
+		}
+		operator := "$gt"
+		if key.Desc {
+			operator = "$lt"
+		}
+		and = append(and, bson.M{operator: bson.A{fieldOrNull(key.Field), values[i]}})
+		or = append(or, bson.M{"$and": and})
+	}
+	return bson.M{"$expr": bson.M{"$or": or}}
+}
+
+// fieldOrNull refers to a field in an aggregation expression, missing fields are null
+func fieldOrNull(field string) bson.M {
+	return bson.M{"$ifNull": bson.A{"$" + field, nil}}
+}
+
+// geoNearStage starts a pipeline with the records nearest to the position of the geo query,
+// setting their distance, among those matching the query
+func geoNearStage(geo GeoQuery, query bson.M) bson.D {
+	stage := bson.M{
+		"near":          bson.M{"type": "Point", "coordinates": geo.Near},
+		"distanceField": "distance",
+		"key":           "location",
+		"spherical":     true,
+		"query":         query,
+	}
+	if geo.MaxDistance > 0 {
+		stage["maxDistance"] = geo.MaxDistance
+	}
+	return bson.D{{Key: "$geoNear", Value: stage}}
+}
+
+// geoIntersects matches the geometries intersecting the area of the geo query
+func geoIntersects(geo GeoQuery) bson.M {
+	return bson.M{"$geoIntersects": bson.M{"$geometry": bson.M{"type": "Polygon", "coordinates": bson.A{geo.Area}}}}
+}
+
+// pageStages sorts the documents of a pipeline and selects the page of the list options
+func pageStages(opts ListOptions, defaultSort string) []bson.D {
+	var stages []bson.D
+	if opts.Cursor != nil {
+		stages = append(stages, bson.D{{Key: "$match", Value: opts.cursorFilter(defaultSort)}})
+	}
+	stages = append(stages, bson.D{{Key: "$sort", Value: opts.sortSpec(defaultSort)}})
+	if opts.Skip > 0 {
+		stages = append(stages, bson.D{{Key: "$skip", Value: opts.Skip}})
+	}
+	if opts.Limit > 0 {
+		stages = append(stages, bson.D{{Key: "$limit", Value: opts.Limit}})
+	}
+	return stages
+}
+
+// aggregateCount returns the number of documents the pipeline outputs
+func aggregateCount(ctx context.Context, collection *mongo.Collection, pipeline mongo.Pipeline) (int64, error) {
+	pipeline = append(pipeline, bson.D{{Key: "$count", Value: "total"}})
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var result struct {
+		Total int64 `bson:"total"`
+	}
+	if cursor.Next(ctx) {
+		err = cursor.Decode(&result)
+	} else {
+		err = cursor.Err()
+	}
+	return result.Total, err
+}
+
+// mongoFilter translates a filter expression into a Mongo query
+func mongoFilter(filter Filter) bson.M {
+	switch f := filter.(type) {
+	case FilterAnd:
+		and := bson.A{}
+		for _, operand := range f {
+			and = append(and, mongoFilter(operand))
+		}
+		return bson.M{"$and": and}
+	case FilterOr:
+		or := bson.A{}
+		for _, operand := range f {
+			or = append(or, mongoFilter(operand))
+		}
+		return bson.M{"$or": or}
+	case FilterCondition:
+		if f.Op == FilterIn || f.Op == FilterNin {
+			return bson.M{f.Field: bson.M{"$" + string(f.Op): bson.A(f.Values)}}
+		}
+		return bson.M{f.Field: bson.M{"$" + string(f.Op): f.Values[0]}}
+	default:
+		return bson.M{}
+	}
+}
+
+// Animal repository
+
+type mongoAnimalRepository struct {
+	collection *mongo.Collection
+}
+
+// animalDetailStages joins an animal with its species and category
+var animalDetailStages = mongo.Pipeline{
+	{
+		{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "species"},
+			{Key: "localField", Value: "species"},
+			{Key: "foreignField", Value: "_id"},
+			{Key: "as", Value: "species_info"},
+		}},
+	},
+	{
+		{Key: "$unwind", Value: bson.D{
+			{Key: "path", Value: "$species_info"},
+			{Key: "preserveNullAndEmptyArrays", Value: true},
+		}},
+	},
+	{
+		{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "categories"},
+			{Key: "localField", Value: "species_info.category"},
+			{Key: "foreignField", Value: "_id"},
+			{Key: "as", Value: "category_info"},
+		}},
+	},
+	{
+		{Key: "$unwind", Value: bson.D{
+			{Key: "path", Value: "$category_info"},
+			{Key: "preserveNullAndEmptyArrays", Value: true},
+		}},
+	},
+}
+
+// animalProjectStage flattens the joined species and category to their names
+var animalProjectStage = bson.D{
+	{Key: "$project", Value: bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "animal_name", Value: 1},
+		{Key: "birthdate", Value: 1},
+		{Key: "species", Value: "$species_info.species_name"},
+		{Key: "category", Value: "$category_info.category_name"},
+		{Key: "location", Value: 1},
+		{Key: "version", Value: 1},
+		{Key: "distance", Value: 1},
+	}},
+}
+
+// animalFilter matches the joined animals against the filters of the query
+func animalFilter(query AnimalQuery) bson.M {
+	filter := bson.M{"deleted_at": nil}
+	if query.AnimalName != "" {
+		filter["animal_name"] = bson.M{"$regex": query.AnimalName, "$options": "i"}
+	}
+	if query.SpeciesName != "" {
+		filter["species_info.species_name"] = bson.M{"$regex": query.SpeciesName, "$options": "i"}
+	}
+	if query.CategoryName != "" {
+		filter["category_info.category_name"] = bson.M{"$regex": query.CategoryName, "$options": "i"}
+	}
+	if query.Geo.Area != nil {
+		filter["location"] = geoIntersects(query.Geo)
+	}
+	if query.Tenant != "" {
+		filter["tenant"] = query.Tenant
+	}
+	return filter
+}
+
+func (r *mongoAnimalRepository) List(ctx context.Context, query AnimalQuery) ([]AnimalDetail, error) {
+	pipeline := r.pipeline(query)
+	pipeline = append(pipeline, pageStages(query.ListOptions, "animal_name")...)
+
+	cursor, err := r.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	animals := []AnimalDetail{}
+	if err := cursor.All(ctx, &animals); err != nil {
+		return nil, err
+	}
+
+	return animals, nil
+}
+
+func (r *mongoAnimalRepository) Count(ctx context.Context, query AnimalQuery) (int64, error) {
+	return aggregateCount(ctx, r.collection, r.pipeline(query))
+}
+
+// pipeline returns the joined animals matching the query, near queries start with the nearest
+func (r *mongoAnimalRepository) pipeline(query AnimalQuery) mongo.Pipeline {
+	var pipeline mongo.Pipeline
+	if query.Geo.Near != nil {
+		pipeline = append(pipeline, geoNearStage(query.Geo, bson.M{}))
+	}
+	pipeline = append(pipeline, animalDetailStages...)
+	pipeline = append(pipeline,
+		bson.D{{Key: "$match", Value: animalFilter(query)}},
+		animalProjectStage,
+	)
+	if query.Filter != nil {
+		// The filter refers to the fields of the projection
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: mongoFilter(query.Filter)}})
+	}
+	return pipeline
+}
+
+func (r *mongoAnimalRepository) GetDetail(ctx context.Context, id primitive.ObjectID) (*AnimalDetail, error) {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "_id", Value: id}, {Key: "deleted_at", Value: nil}}}}}
+	pipeline = append(pipeline, animalDetailStages...)
+	pipeline = append(pipeline, animalProjectStage)
+
+	cursor, err := r.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	if !cursor.Next(ctx) {
+		if err := cursor.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	}
+
+	var animal AnimalDetail
+	if err := cursor.Decode(&animal); err != nil {
+		return nil, err
+	}
+
+	return &animal, nil
+}
+
+func (r *mongoAnimalRepository) Get(ctx context.Context, id primitive.ObjectID) (*Animal, error) {
+	var animal Animal
+	if err := findByID(ctx, r.collection, id, &animal); err != nil {
+		return nil, err
+	}
+	return &animal, nil
+}
+
+func (r *mongoAnimalRepository) ListBySpecies(ctx context.Context, speciesID primitive.ObjectID) ([]Animal, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{"species": speciesID, "deleted_at": nil})
+	if err != nil {
+		return nil, err
+	}
+
+	animals := []Animal{}
+	if err := cursor.All(ctx, &animals); err != nil {
+		return nil, err
+	}
+	return animals, nil
+}
+
+func (r *mongoAnimalRepository) ListDeleted(ctx context.Context) ([]Animal, error) {
+	animals := []Animal{}
+	if err := findDeleted(ctx, r.collection, &animals); err != nil {
+		return nil, err
+	}
+	return animals, nil
+}
+
+func (r *mongoAnimalRepository) Create(ctx context.Context, animal *Animal) error {
+	animal.Version = 1
+	id, err := insert(ctx, r.collection, animal)
+	if err != nil {
+		return err
+	}
+	animal.ID = id
+	return nil
+}
+
+func (r *mongoAnimalRepository) Update(ctx context.Context, animal *Animal) error {
+	return replaceVersion(ctx, r.collection, animal.ID, &animal.Version, animal)
+}
+
+func (r *mongoAnimalRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return deleteByID(ctx, r.collection, id)
+}
+
+func (r *mongoAnimalRepository) Purge(ctx context.Context, before time.Time) (int64, error) {
+	return purgeDeleted(ctx, r.collection, before)
+}
+
+// Species repository
+
+type mongoSpeciesRepository struct {
+	collection *mongo.Collection
+}
+
+// speciesFilter matches the species against the filters of the query
+func speciesFilter(query SpeciesQuery) bson.M {
+	filter := bson.M{"deleted_at": nil}
+	if query.SpeciesName != "" {
+		filter["species_name"] = bson.M{"$regex": query.SpeciesName, "$options": "i"}
+	}
+	if !query.CategoryID.IsZero() {
+		filter["category"] = query.CategoryID
+	}
+	if query.Geo.Area != nil {
+		filter["$or"] = bson.A{bson.M{"location": geoIntersects(query.Geo)}, bson.M{"habitat": geoIntersects(query.Geo)}}
+	}
+	if query.Filter != nil {
+		filter["$and"] = bson.A{mongoFilter(query.Filter)}
+	}
+	if query.Tenant != "" {
+		filter["tenant"] = query.Tenant
+	}
+	return filter
+}
+
+func (r *mongoSpeciesRepository) List(ctx context.Context, query SpeciesQuery) ([]Species, error) {
+	species := []Species{}
+	if query.Geo.Near == nil {
+		if err := find(ctx, r.collection, speciesFilter(query), query.ListOptions, "species_name", &species); err != nil {
+			return nil, err
+		}
+		return species, nil
+	}
+
+	pipeline := mongo.Pipeline{geoNearStage(query.Geo, speciesFilter(query))}
+	pipeline = append(pipeline, pageStages(query.ListOptions, "species_name")...)
+	cursor, err := r.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &species); err != nil {
+		return nil, err
+	}
+	return species, nil
+}
+
+func (r *mongoSpeciesRepository) Count(ctx context.Context, query SpeciesQuery) (int64, error) {
+	if query.Geo.Near != nil {
+		return aggregateCount(ctx, r.collection, mongo.Pipeline{geoNearStage(query.Geo, speciesFilter(query))})
+	}
+	return r.collection.CountDocuments(ctx, speciesFilter(query))
+}
+
+func (r *mongoSpeciesRepository) Get(ctx context.Context, id primitive.ObjectID) (*Species, error) {
+	var species Species
+	if err := findByID(ctx, r.collection, id, &species); err != nil {
+		return nil, err
+	}
+	return &species, nil
+}
+
+func (r *mongoSpeciesRepository) ListByCategory(ctx context.Context, categoryID primitive.ObjectID) ([]Species, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{"category": categoryID, "deleted_at": nil})
+	if err != nil {
+		return nil, err
+	}
+
+	species := []Species{}
+	if err := cursor.All(ctx, &species); err != nil {
+		return nil, err
+	}
+	return species, nil
+}
+
+func (r *mongoSpeciesRepository) ListDeleted(ctx context.Context) ([]Species, error) {
+	species := []Species{}
+	if err := findDeleted(ctx, r.collection, &species); err != nil {
+		return nil, err
+	}
+	return species, nil
+}
+
+func (r *mongoSpeciesRepository) Create(ctx context.Context, species *Species) error {
+	species.Version = 1
+	// The distance is decoded from $geoNear results but never stored
+	species.Distance = nil
+	id, err := insert(ctx, r.collection, species)
+	if err != nil {
+		return err
+	}
+	species.ID = id
+	return nil
+}
+
+func (r *mongoSpeciesRepository) Update(ctx context.Context, species *Species) error {
+	species.Distance = nil
+	return replaceVersion(ctx, r.collection, species.ID, &species.Version, species)
+}
+
+func (r *mongoSpeciesRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return deleteByID(ctx, r.collection, id)
+}
+
+func (r *mongoSpeciesRepository) Purge(ctx context.Context, before time.Time) (int64, error) {
+	return purgeDeleted(ctx, r.collection, before)
+}
+
+// Category repository
+
+type mongoCategoryRepository struct {
+	collection *mongo.Collection
+}
+
+// categoryFilter matches the categories against the filters of the query
+func categoryFilter(query CategoryQuery) bson.M {
+	filter := bson.M{"deleted_at": nil}
+	if query.CategoryName != "" {
+		filter["category_name"] = bson.M{"$regex": query.CategoryName, "$options": "i"}
+	}
+	if query.Filter != nil {
+		filter["$and"] = bson.A{mongoFilter(query.Filter)}
+	}
+	if query.Tenant != "" {
+		filter["tenant"] = query.Tenant
+	}
+	return filter
+}
+
+func (r *mongoCategoryRepository) List(ctx context.Context, query CategoryQuery) ([]Category, error) {
+	categories := []Category{}
+	if err := find(ctx, r.collection, categoryFilter(query), query.ListOptions, "category_name", &categories); err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+func (r *mongoCategoryRepository) Count(ctx context.Context, query CategoryQuery) (int64, error) {
+	return r.collection.CountDocuments(ctx, categoryFilter(query))
+}
+
+func (r *mongoCategoryRepository) Get(ctx context.Context, id primitive.ObjectID) (*Category, error) {
+	var category Category
+	if err := findByID(ctx, r.collection, id, &category); err != nil {
+		return nil, err
+	}
+	return &category, nil
+}
+
+func (r *mongoCategoryRepository) ListDeleted(ctx context.Context) ([]Category, error) {
+	categories := []Category{}
+	if err := findDeleted(ctx, r.collection, &categories); err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+func (r *mongoCategoryRepository) Create(ctx context.Context, category *Category) error {
+	category.Version = 1
+	id, err := insert(ctx, r.collection, category)
+	if err != nil {
+		return err
+	}
+	category.ID = id
+	return nil
+}
+
+func (r *mongoCategoryRepository) Update(ctx context.Context, category *Category) error {
+	return replaceVersion(ctx, r.collection, category.ID, &category.Version, category)
+}
+
+func (r *mongoCategoryRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return deleteByID(ctx, r.collection, id)
+}
+
+func (r *mongoCategoryRepository) Purge(ctx context.Context, before time.Time) (int64, error) {
+	return purgeDeleted(ctx, r.collection, before)
+}
+
+// Audit repository
+
+type mongoAuditRepository struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoAuditRepository) Append(ctx context.Context, event *AuditEvent) error {
+	_, err := r.collection.InsertOne(ctx, event)
+	return err
+}
+
+func (r *mongoAuditRepository) List(ctx context.Context, query AuditQuery) ([]AuditEvent, error) {
+	filter := bson.M{}
+	for field, value := range map[string]string{
+		"entity":     query.Entity,
+		"action":     query.Action,
+		"actor":      query.Actor,
+		"request_id": query.RequestID,
+		"tenant":     query.Tenant,
+	} {
+		if value != "" {
+			filter[field] = value
+		}
+	}
+	if !query.EntityID.IsZero() {
+		filter["entity_id"] = query.EntityID
+	}
+	timestamp := bson.M{}
+	if !query.From.IsZero() {
+		timestamp["$gte"] = query.From
+	}
+	if !query.To.IsZero() {
+		timestamp["$lt"] = query.To
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(query.Limit).
+		SetSkip(query.Skip)
+
+	cursor, err := r.collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []AuditEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Location repository
+
+type mongoLocationRepository struct {
+	collection *mongo.Collection
+	animals    *mongo.Collection
+}
+
+func (r *mongoLocationRepository) Append(ctx context.Context, fix *LocationFix) error {
+	_, err := r.collection.InsertOne(ctx, fix)
+	return err
+}
+
+func (r *mongoLocationRepository) List(ctx context.Context, query TrackQuery) ([]LocationFix, error) {
+	filter := bson.M{"animal": query.AnimalID}
+	recordedAt := bson.M{}
+	if !query.From.IsZero() {
+		recordedAt["$gte"] = query.From
+	}
+	if !query.To.IsZero() {
+		recordedAt["$lt"] = query.To
+	}
+	if len(recordedAt) > 0 {
+		filter["recorded_at"] = recordedAt
+	}
+	if query.After != nil {
+		filter["$or"] = bson.A{
+			bson.M{"recorded_at": bson.M{"$gt": query.After.RecordedAt}},
+			bson.M{"recorded_at": query.After.RecordedAt, "_id": bson.M{"$gt": query.After.ID}},
+		}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "recorded_at", Value: 1}, {Key: "_id", Value: 1}})
+	if query.Limit > 0 {
+		opts.SetLimit(query.Limit)
+	}
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	fixes := []LocationFix{}
+	if err := cursor.All(ctx, &fixes); err != nil {
+		return nil, err
+	}
+	return fixes, nil
+}
+
+func (r *mongoLocationRepository) Latest(ctx context.Context, animalID primitive.ObjectID) (*LocationFix, error) {
+	var fix LocationFix
+	err := r.collection.FindOne(ctx, bson.M{"animal": animalID},
+		options.FindOne().SetSort(bson.D{{Key: "recorded_at", Value: -1}, {Key: "_id", Value: -1}})).Decode(&fix)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fix, nil
+}
+
+func (r *mongoLocationRepository) Purge(ctx context.Context) (int64, error) {
+	animals, err := r.animals.Distinct(ctx, "_id", bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	result, err := r.collection.DeleteMany(ctx, bson.M{"animal": bson.M{"$nin": animals}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// Geofence repository
+
+type mongoGeofenceRepository struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoGeofenceRepository) List(ctx context.Context) ([]Geofence, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{},
+		options.Find().SetSort(bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	geofences := []Geofence{}
+	if err := cursor.All(ctx, &geofences); err != nil {
+		return nil, err
+	}
+	return geofences, nil
+}
+
+func (r *mongoGeofenceRepository) Get(ctx context.Context, id primitive.ObjectID) (*Geofence, error) {
+	var geofence Geofence
+	if err := findByID(ctx, r.collection, id, &geofence); err != nil {
+		return nil, err
+	}
+	return &geofence, nil
+}
+
+func (r *mongoGeofenceRepository) Create(ctx context.Context, geofence *Geofence) error {
+	geofence.Version = 1
+	id, err := insert(ctx, r.collection, geofence)
+	if err != nil {
+		return err
+	}
+	geofence.ID = id
+	return nil
+}
+
+func (r *mongoGeofenceRepository) Update(ctx context.Context, geofence *Geofence) error {
+	return replaceVersion(ctx, r.collection, geofence.ID, &geofence.Version, geofence)
+}
+
+func (r *mongoGeofenceRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return deleteByID(ctx, r.collection, id)
+}
+
+// Alert repository
+
+type mongoAlertRepository struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoAlertRepository) List(ctx context.Context, query AlertQuery) ([]Alert, error) {
+	filter := bson.M{}
+	if len(query.Statuses) > 0 {
+		filter["status"] = bson.M{"$in": query.Statuses}
+	}
+	if !query.AnimalID.IsZero() {
+		filter["animal"] = query.AnimalID
+	}
+	if !query.GeofenceID.IsZero() {
+		filter["geofence"] = query.GeofenceID
+	}
+	if query.Tenant != "" {
+		filter["tenant"] = query.Tenant
+	}
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "raised_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(query.Limit).
+		SetSkip(query.Skip)
+
+	cursor, err := r.collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	alerts := []Alert{}
+	if err := cursor.All(ctx, &alerts); err != nil {
+		return nil, err
+	}
+	return alerts, nil
+}
+
+func (r *mongoAlertRepository) Get(ctx context.Context, id primitive.ObjectID) (*Alert, error) {
+	var alert Alert
+	if err := findByID(ctx, r.collection, id, &alert); err != nil {
+		return nil, err
+	}
+	return &alert, nil
+}
+
+func (r *mongoAlertRepository) Create(ctx context.Context, alert *Alert) error {
+	alert.Version = 1
+	_, err := insert(ctx, r.collection, alert)
+	return err
+}
+
+func (r *mongoAlertRepository) Update(ctx context.Context, alert *Alert) error {
+	return replaceVersion(ctx, r.collection, alert.ID, &alert.Version, alert)
+}
+
+// User repository
+
+type mongoUserRepository struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoUserRepository) List(ctx context.Context) ([]User, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "username", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	users := []User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (r *mongoUserRepository) Get(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	var user User
+	if err := findByID(ctx, r.collection, id, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *mongoUserRepository) GetByUsername(ctx context.Context, tenant, username string) (*User, error) {
+	var user User
+	// Users tagged with no tenant have no tenant field
+	filter := bson.M{"username": username, "tenant": nil}
+	if tenant != "" {
+		filter["tenant"] = tenant
+	}
+	err := r.collection.FindOne(ctx, filter).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *mongoUserRepository) Create(ctx context.Context, user *User) error {
+	user.Version = 1
+	_, err := insert(ctx, r.collection, user)
+	if errors.Is(err, ErrDuplicateID) {
+		// The IDs are fresh, the unique index on the usernames is the one that was hit
+		return ErrUsernameTaken
+	}
+	return err
+}
+
+func (r *mongoUserRepository) Update(ctx context.Context, user *User) error {
+	return replaceVersion(ctx, r.collection, user.ID, &user.Version, user)
+}
+
+func (r *mongoUserRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return deleteByID(ctx, r.collection, id)
+}
+
+// API key repository
+
+type mongoAPIKeyRepository struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoAPIKeyRepository) ListByUser(ctx context.Context, userID primitive.ObjectID) ([]APIKey, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{"user": userID},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (r *mongoAPIKeyRepository) Get(ctx context.Context, id primitive.ObjectID) (*APIKey, error) {
+	var key APIKey
+	if err := findByID(ctx, r.collection, id, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (r *mongoAPIKeyRepository) Create(ctx context.Context, key *APIKey) error {
+	key.Version = 1
+	_, err := insert(ctx, r.collection, key)
+	return err
+}
+
+func (r *mongoAPIKeyRepository) Update(ctx context.Context, key *APIKey) error {
+	return replaceVersion(ctx, r.collection, key.ID, &key.Version, key)
+}
+
+func (r *mongoAPIKeyRepository) Touch(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	result, err := r.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"last_used_at": at}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoAPIKeyRepository) DeleteByUser(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := r.collection.DeleteMany(ctx, bson.M{"user": userID})
+	return err
+}
+
+// Collection helpers
+
+// find decodes every document matching the filter into results
+func find(ctx context.Context, collection *mongo.Collection, filter bson.M, opts ListOptions, defaultSort string, results interface{}) error {
+	if opts.Cursor != nil {
+		filter = bson.M{"$and": bson.A{filter, opts.cursorFilter(defaultSort)}}
+	}
+
+	findOptions := options.Find()
+	findOptions.SetSort(opts.sortSpec(defaultSort))
+	findOptions.SetLimit(opts.Limit)
+	findOptions.SetSkip(opts.Skip)
+
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, results)
+}
+
+// findDeleted decodes the documents in the trash into results, most recently deleted first
+func findDeleted(ctx context.Context, collection *mongo.Collection, results interface{}) error {
+	findOptions := options.Find().SetSort(bson.D{{Key: "deleted_at", Value: -1}})
+
+	cursor, err := collection.Find(ctx, bson.M{"deleted_at": bson.M{"$ne": nil}}, findOptions)
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, results)
+}
+
+// purgeDeleted removes the documents deleted before the given time
+func purgeDeleted(ctx context.Context, collection *mongo.Collection, before time.Time) (int64, error) {
+	result, err := collection.DeleteMany(ctx, bson.M{"deleted_at": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// findByID decodes the document with the given ID into result
+func findByID(ctx context.Context, collection *mongo.Collection, id primitive.ObjectID, result interface{}) error {
+	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// insert stores the document and returns its ID, which is generated unless the document has one
+func insert(ctx context.Context, collection *mongo.Collection, document interface{}) (primitive.ObjectID, error) {
+	insertResult, err := collection.InsertOne(ctx, document)
+	if mongo.IsDuplicateKeyError(err) {
+		return primitive.NilObjectID, ErrDuplicateID
+	}
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return insertResult.InsertedID.(primitive.ObjectID), nil
+}
+
+// replaceVersion replaces the document with the given ID if it is still at the given version,
+// which is incremented for the replacement and restored if nothing was replaced
+func replaceVersion(ctx context.Context, collection *mongo.Collection, id primitive.ObjectID, version *int64, document interface{}) error {
+	filter := bson.M{"_id": id, "version": *version}
+	if *version == 0 {
+		// Documents stored before versioning have no version field
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+
+	*version++
+	result, err := collection.ReplaceOne(ctx, filter, document)
+	if err == nil && result.MatchedCount == 0 {
+		err = ErrVersionConflict
+		if count, countErr := collection.CountDocuments(ctx, bson.M{"_id": id}); countErr != nil {
+			err = countErr
+		} else if count == 0 {
+			err = ErrNotFound
+		}
+	}
+	if err != nil {
+		*version--
+	}
+	return err
+}
+
+// deleteByID removes the document with the given ID
+func deleteByID(ctx context.Context, collection *mongo.Collection, id primitive.ObjectID) error {
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoMigrations are applied in order and recorded in the schema_migrations collection so each
+// runs once. Add new migrations at the end, released ones must not change.
+var mongoMigrations = []func(ctx context.Context, db *mongo.Database) error{
+	// 1: GeoJSON locations the 2dsphere indexes accept
+	migrateGeoLocations,
+	// 2: usernames unique within each zoo
+	dropUsernameIndex,
+}
+
+// migrateDocuments brings the documents of the database up to date
+func migrateDocuments(ctx context.Context, db *mongo.Database) error {
+	migrations := db.Collection("schema_migrations")
+	var latest struct {
+		Version int `bson:"_id"`
+	}
+	err := migrations.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}})).Decode(&latest)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("migrating documents: %w", err)
+	}
+
+	for version := latest.Version; version < len(mongoMigrations); version++ {
+		log.Printf("Migrating the documents of %s to version %d", db.Name(), version+1)
+		if err := mongoMigrations[version](ctx, db); err != nil {
+			return fmt.Errorf("migrating documents to version %d: %w", version+1, err)
+		}
+		if _, err := migrations.InsertOne(ctx, bson.M{"_id": version + 1}); err != nil {
+			return fmt.Errorf("migrating documents to version %d: %w", version+1, err)
+		}
+	}
+	return nil
+}
+
+// geoFields are the fields holding GeoJSON geometries by collection
+var geoFields = map[string][]string{"animals": {"location"}, "species": {"location", "habitat"}}
+
+// migrateGeoLocations prepares the locations for the 2dsphere indexes. Unset locations used to be
+// stored as empty points, which are removed, and legacy [longitude, latitude] pairs are turned into
+// GeoJSON points. Any other value that isn't a valid GeoJSON geometry is reported and fails the
+// migration, since the index can't be built until it is fixed by hand.
+func migrateGeoLocations(ctx context.Context, db *mongo.Database) error {
+	var invalid int
+	for name, fields := range geoFields {
+		collection := db.Collection(name)
+		for _, field := range fields {
+			cursor, err := collection.Find(ctx, bson.M{field: bson.M{"$exists": true}},
+				options.Find().SetProjection(bson.M{field: 1}))
+			if err != nil {
+				return err
+			}
+			var empty []primitive.ObjectID
+			converted := 0
+			for cursor.Next(ctx) {
+				id, _ := cursor.Current.Lookup("_id").ObjectIDOK()
+				value := cursor.Current.Lookup(field)
+				point, isEmpty, err := legacyGeometry(value)
+				switch {
+				case err != nil:
+					log.Printf("%s %s: the %s can't be indexed: %v", name, id.Hex(), field, err)
+					invalid++
+				case isEmpty:
+					empty = append(empty, id)
+				case point != nil:
+					_, err := collection.UpdateByID(ctx, id, bson.M{"$set": bson.M{field: point}})
+					if err != nil {
+						cursor.Close(ctx)
+						return err
+					}
+					converted++
+				}
+			}
+			err = cursor.Err()
+			cursor.Close(ctx)
+			if err != nil {
+				return err
+			}
+
+			if len(empty) > 0 {
+				_, err := collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": empty}}, bson.M{"$unset": bson.M{field: ""}})
+				if err != nil {
+					return err
+				}
+				log.Printf("Removed the empty %s of %d %s", field, len(empty), name)
+			}
+			if converted > 0 {
+				log.Printf("Converted the %s of %d %s from coordinate pairs to GeoJSON points", field, converted, name)
+			}
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d documents have locations that aren't GeoJSON geometries, fix or unset them and restart", invalid)
+	}
+	return nil
+}
+
+// legacyGeometry checks a stored location. It reports empty points, which are unset, converts
+// legacy coordinate pairs to points and fails for values that aren't valid geometries.
+func legacyGeometry(value bson.RawValue) (point *Point, empty bool, err error) {
+	switch value.Type {
+	case bsontype.Null:
+		return nil, true, nil
+	case bsontype.Array:
+		var position []float64
+		if value.Unmarshal(&position) != nil || len(position) != 2 || !validCoordinates(position) {
+			return nil, false, errors.New("the coordinate pair must be a longitude and a latitude in range")
+		}
+		return &Point{Type: "Point", Coordinates: position}, false, nil
+	case bsontype.EmbeddedDocument:
+		var geometry Geometry
+		if err := value.Unmarshal(&geometry); err != nil {
+			return nil, false, err
+		}
+		if geometry.IsZero() && geometry.Coordinates == nil && geometry.Geometries == nil {
+			return nil, true, nil
+		}
+		return nil, false, geometry.validate()
+	default:
+		return nil, false, fmt.Errorf("a %s is not a GeoJSON geometry", value.Type)
+	}
+}
+
+// dropUsernameIndex drops the index keeping usernames unique across the zoos, the one on the
+// tenant and the username takes its place
+func dropUsernameIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("users").Indexes().DropOne(ctx, "username_1")
+	var command mongo.CommandError
+	// A database without the users or the index has nothing to drop
+	if errors.As(err, &command) && (command.Code == 26 || command.Code == 27) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,1765 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"modernc.org/sqlite"
+)
+
+// sqlDialect captures the differences between the supported SQL databases
+type sqlDialect struct {
+	driver        string
+	timestampType string
+	// geometryType is the column type of points, anyGeometryType the one of geometries of any type
+	geometryType    string
+	anyGeometryType string
+	// placeholder returns the bind parameter for the n-th argument (1-based)
+	placeholder func(n int) string
+	// geometryIn converts a GeoJSON bind parameter to the geometry column type
+	geometryIn func(param string) string
+	// geometryOut converts a geometry column to GeoJSON text
+	geometryOut func(column string) string
+	// regexMatch returns a case-insensitive regular expression match of the column
+	regexMatch func(column, param string) string
+	// regexArg prepares the pattern bound to the regexMatch parameter
+	regexArg func(pattern string) string
+	// distance returns the distance in meters between a geometry column and a position
+	distance func(column string, lng, lat float64) string
+	// intersects returns whether a geometry column intersects the GeoJSON polygon bound to the
+	// parameter
+	intersects func(column, param string) string
+	// spatialIndexes is set when the geometry columns can be indexed with GiST
+	spatialIndexes bool
+	// setup runs before the schema is created
+	setup []string
+}
+
+var postgresDialect = &sqlDialect{
+	driver:          "pgx",
+	timestampType:   "TIMESTAMPTZ",
+	geometryType:    "geometry(Point, 4326)",
+	anyGeometryType: "geometry(Geometry, 4326)",
+	placeholder:     func(n int) string { return fmt.Sprintf("$%d", n) },
+	geometryIn: func(param string) string {
+		return fmt.Sprintf("ST_SetSRID(ST_GeomFromGeoJSON(%s::text), 4326)", param)
+	},
+	geometryOut: func(column string) string { return fmt.Sprintf("ST_AsGeoJSON(%s)", column) },
+	regexMatch:  func(column, param string) string { return column + " ~* " + param },
+	regexArg:    func(pattern string) string { return pattern },
+	distance: func(column string, lng, lat float64) string {
+		return fmt.Sprintf("ST_Distance(%s::geography, ST_SetSRID(ST_MakePoint(%s, %s), 4326)::geography, false)", column, sqlFloat(lng), sqlFloat(lat))
+	},
+	intersects: func(column, param string) string {
+		return fmt.Sprintf("ST_Intersects(%s, ST_SetSRID(ST_GeomFromGeoJSON(%s::text), 4326))", column, param)
+	},
+	spatialIndexes: true,
+	setup:          []string{"CREATE EXTENSION IF NOT EXISTS postgis"},
+}
+
+// SQLite has no spatial types, so geometries are kept as GeoJSON text
+var sqliteDialect = &sqlDialect{
+	driver:          "sqlite",
+	timestampType:   "TIMESTAMP",
+	geometryType:    "TEXT",
+	anyGeometryType: "TEXT",
+	placeholder:     func(n int) string { return "?" },
+	geometryIn:      func(param string) string { return param },
+	geometryOut:     func(column string) string { return column },
+	regexMatch:      func(column, param string) string { return column + " REGEXP " + param },
+	regexArg:        func(pattern string) string { return "(?i)" + pattern },
+	distance: func(column string, lng, lat float64) string {
+		return fmt.Sprintf("geo_distance(%s, %s, %s)", column, sqlFloat(lng), sqlFloat(lat))
+	},
+	intersects: func(column, param string) string { return fmt.Sprintf("geo_intersects(%s, %s)", column, param) },
+}
+
+func init() {
+	// SQLite declares the REGEXP operator but leaves its implementation to the application
+	sqlite.MustRegisterDeterministicScalarFunction("regexp", 2, sqliteRegexp)
+	sqlite.MustRegisterDeterministicScalarFunction("geo_distance", 3, sqliteGeoDistance)
+	sqlite.MustRegisterDeterministicScalarFunction("geo_intersects", 2, sqliteGeoIntersects)
+}
+
+// sqlFloat formats a number for use in a statement
+func sqlFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sqliteGeoDistance implements geo_distance(location, lng, lat), the distance in meters between
+// a GeoJSON geometry column and a position, NULL for rows without a location
+func sqliteGeoDistance(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	location, ok := sqliteGeometry(args[0])
+	if !ok {
+		return nil, nil
+	}
+	var position []float64
+	for _, arg := range args[1:] {
+		switch v := arg.(type) {
+		case float64:
+			position = append(position, v)
+		case int64:
+			position = append(position, float64(v))
+		default:
+			return nil, errors.New("geo_distance: position must be numbers")
+		}
+	}
+	return location.distance(position), nil
+}
+
+// sqliteGeoIntersects implements geo_intersects(geometry, polygon), whether a GeoJSON geometry
+// column intersects a GeoJSON polygon
+func sqliteGeoIntersects(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	geometry, ok := sqliteGeometry(args[0])
+	if !ok {
+		return false, nil
+	}
+	text, ok := args[1].(string)
+	if !ok {
+		return nil, errors.New("geo_intersects: polygon must be text")
+	}
+	var polygon struct {
+		Coordinates [][][]float64 `json:"coordinates"`
+	}
+	if err := json.Unmarshal([]byte(text), &polygon); err != nil || len(polygon.Coordinates) == 0 {
+		return nil, errors.New("geo_intersects: invalid polygon")
+	}
+	return geometry.intersects(polygon.Coordinates[0]), nil
+}
+
+// sqliteGeometry reads a GeoJSON geometry column
+func sqliteGeometry(value driver.Value) (geometryParts, bool) {
+	text, ok := value.(string)
+	if !ok {
+		return geometryParts{}, false
+	}
+	var geometry Geometry
+	if err := json.Unmarshal([]byte(text), &geometry); err != nil {
+		return geometryParts{}, false
+	}
+	parts, err := geometry.parts()
+	return parts, err == nil
+}
+
+// sqliteRegexpCacheSize bounds the compiled patterns kept between the rows and queries, the
+// patterns come from clients
+const sqliteRegexpCacheSize = 64
+
+// regexpCache keeps the most recently used compiled patterns
+type regexpCache struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+var sqliteRegexpCache = &regexpCache{order: list.New(), entries: map[string]*list.Element{}}
+
+// compile returns the compiled pattern, evicting the least recently used one when the cache is full
+func (c *regexpCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[pattern]; ok {
+		c.order.MoveToFront(element)
+		return element.Value.(*regexp.Regexp), nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	c.entries[pattern] = c.order.PushFront(re)
+	if c.order.Len() > sqliteRegexpCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*regexp.Regexp).String())
+	}
+	return re, nil
+}
+
+// sqliteRegexp implements "value REGEXP pattern", which SQLite calls as regexp(pattern, value)
+func sqliteRegexp(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	pattern, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("regexp: pattern must be text")
+	}
+	value, ok := args[1].(string)
+	if !ok {
+		return false, nil
+	}
+
+	re, err := sqliteRegexpCache.compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString(value), nil
+}
+
+// sqlConn is the part of *sql.DB and *sql.Tx used by the repositories
+type sqlConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqlStore is the PostgreSQL and SQLite storage backend
+type sqlStore struct {
+	db *sql.DB
+	// conn runs the statements, it is the transaction for stores handed to WithTransaction
+	conn    sqlConn
+	dialect *sqlDialect
+}
+
+// newSQLStore opens the database, creates the schema if needed and returns a store backed by it
+func newSQLStore(ctx context.Context, dialect *sqlDialect, dsn string) (*sqlStore, error) {
+	if dialect == sqliteDialect && !strings.Contains(dsn, "foreign_keys") {
+		// SQLite only enforces foreign keys when asked to, per connection
+		if strings.Contains(dsn, "?") {
+			dsn += "&_pragma=foreign_keys(1)"
+		} else {
+			dsn += "?_pragma=foreign_keys(1)"
+		}
+	}
+
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dialect == sqliteDialect {
+		// SQLite allows a single writer, serialise access instead of failing with SQLITE_BUSY
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &sqlStore{db: db, conn: db, dialect: dialect}
+	if err := store.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (s *sqlStore) Animals() AnimalRepository      { return sqlAnimalRepository{s} }
+func (s *sqlStore) Species() SpeciesRepository     { return sqlSpeciesRepository{s} }
+func (s *sqlStore) Categories() CategoryRepository { return sqlCategoryRepository{s} }
+func (s *sqlStore) Audit() AuditRepository         { return sqlAuditRepository{s} }
+func (s *sqlStore) Locations() LocationRepository  { return sqlLocationRepository{s} }
+func (s *sqlStore) Geofences() GeofenceRepository  { return sqlGeofenceRepository{s} }
+func (s *sqlStore) Alerts() AlertRepository        { return sqlAlertRepository{s} }
+func (s *sqlStore) Users() UserRepository          { return sqlUserRepository{s} }
+func (s *sqlStore) APIKeys() APIKeyRepository      { return sqlAPIKeyRepository{s} }
+
+func (s *sqlStore) Close(ctx context.Context) error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) Transactional() bool { return true }
+
+func (s *sqlStore) WithTransaction(ctx context.Context, fn func(ctx context.Context, tx Store) error) error {
+	if _, ok := s.conn.(*sql.Tx); ok {
+		return fn(ctx, s)
+	}
+
+	sqlTx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	tx := *s
+	tx.conn = sqlTx
+	if err := fn(ctx, &tx); err != nil {
+		sqlTx.Rollback()
+		return err
+	}
+	return sqlTx.Commit()
+}
+
+// sqlQuery builds a statement, numbering bind parameters for the dialect
+type sqlQuery struct {
+	dialect *sqlDialect
+	where   []string
+	args    []interface{}
+}
+
+// arg binds a value and returns its placeholder
+func (q *sqlQuery) arg(value interface{}) string {
+	q.args = append(q.args, value)
+	return q.dialect.placeholder(len(q.args))
+}
+
+// matchRegex adds a case-insensitive regular expression condition, empty patterns are ignored
+func (q *sqlQuery) matchRegex(column, pattern string) {
+	if pattern == "" {
+		return
+	}
+	q.where = append(q.where, q.dialect.regexMatch(column, q.arg(q.dialect.regexArg(pattern))))
+}
+
+// matchTenant keeps the rows of the tenant, an empty tenant keeps every row
+func (q *sqlQuery) matchTenant(column, tenant string) {
+	if tenant == "" {
+		return
+	}
+	q.where = append(q.where, column+" = "+q.arg(tenant))
+}
+
+// matchGeo adds the conditions of a geo query on a geometry column. The area is also matched
+// against the other columns, a row matches when one of them intersects it.
+func (q *sqlQuery) matchGeo(geo GeoQuery, column string, others ...string) error {
+	if geo.Near != nil {
+		q.where = append(q.where, column+" IS NOT NULL")
+	}
+	if geo.Area != nil {
+		polygon, err := json.Marshal(map[string]interface{}{"type": "Polygon", "coordinates": [][][]float64{geo.Area}})
+		if err != nil {
+			return err
+		}
+		var intersects []string
+		for _, c := range append([]string{column}, others...) {
+			intersects = append(intersects, q.dialect.intersects(c, q.arg(string(polygon))))
+		}
+		q.where = append(q.where, "("+strings.Join(intersects, " OR ")+")")
+	}
+	if geo.MaxDistance > 0 {
+		q.where = append(q.where, q.distance(geo, column)+" <= "+sqlFloat(geo.MaxDistance))
+	}
+	return nil
+}
+
+// distance returns the distance of a geometry column from the position of a near query, NULL
+// when the query isn't one
+func (q *sqlQuery) distance(geo GeoQuery, column string) string {
+	if geo.Near == nil {
+		return "NULL"
+	}
+	return q.dialect.distance(column, geo.Near[0], geo.Near[1])
+}
+
+// withDistance adds the distance of a near query to the columns that can be sorted on
+func withDistance(columns map[string]string, distance string) map[string]string {
+	extended := map[string]string{"distance": distance}
+	for field, column := range columns {
+		extended[field] = column
+	}
+	return extended
+}
+
+// matchFilter adds the condition of a filter expression over the fields in the given map,
+// records without the field only match != and !=in like in MongoDB
+func (q *sqlQuery) matchFilter(filter Filter, columns map[string]string) {
+	if filter != nil {
+		q.where = append(q.where, q.filterCondition(filter, columns))
+	}
+}
+
+func (q *sqlQuery) filterCondition(filter Filter, columns map[string]string) string {
+	switch f := filter.(type) {
+	case FilterAnd:
+		and := make([]string, len(f))
+		for i, operand := range f {
+			and[i] = q.filterCondition(operand, columns)
+		}
+		return "(" + strings.Join(and, " AND ") + ")"
+	case FilterOr:
+		or := make([]string, len(f))
+		for i, operand := range f {
+			or[i] = q.filterCondition(operand, columns)
+		}
+		return "(" + strings.Join(or, " OR ") + ")"
+	case FilterCondition:
+		column := columns[f.Field]
+		switch f.Op {
+		case FilterIn, FilterNin:
+			params := make([]string, len(f.Values))
+			for i, value := range f.Values {
+				params[i] = q.arg(sqlValue(value))
+			}
+			if f.Op == FilterNin {
+				return fmt.Sprintf("(%s NOT IN (%s) OR %s IS NULL)", column, strings.Join(params, ", "), column)
+			}
+			return fmt.Sprintf("%s IN (%s)", column, strings.Join(params, ", "))
+		case FilterNe:
+			return fmt.Sprintf("(%s <> %s OR %s IS NULL)", column, q.arg(sqlValue(f.Values[0])), column)
+		default:
+			return column + " " + sqlOperators[f.Op] + " " + q.arg(sqlValue(f.Values[0]))
+		}
+	default:
+		return "1 = 1"
+	}
+}
+
+// sqlOperators maps the comparisons of filter conditions to SQL
+var sqlOperators = map[FilterOp]string{
+	FilterEq:  "=",
+	FilterGt:  ">",
+	FilterGte: ">=",
+	FilterLt:  "<",
+	FilterLte: "<=",
+}
+
+// whereClause joins the conditions into a WHERE clause
+func (q *sqlQuery) whereClause() string {
+	if len(q.where) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(q.where, " AND ")
+}
+
+// sortKeys returns the keys of the sort order that have a column in the given map, and the
+// matching cursor values when there is a cursor
+func sortKeys(opts ListOptions, columns map[string]string, defaultField string) ([]SortKey, []interface{}) {
+	var keys []SortKey
+	var values []interface{}
+	for i, key := range opts.order(defaultField) {
+		if _, ok := columns[key.Field]; !ok {
+			continue
+		}
+		keys = append(keys, key)
+		if opts.Cursor != nil {
+			values = append(values, opts.cursorValues()[i])
+		}
+	}
+	return keys, values
+}
+
+// matchCursor adds the condition selecting the rows after the cursor of the list options in
+// the sort order, NULLs come first like in MongoDB
+func (q *sqlQuery) matchCursor(opts ListOptions, columns map[string]string, defaultField string) {
+	if opts.Cursor == nil {
+		return
+	}
+
+	keys, values := sortKeys(opts, columns, defaultField)
+	var or []string
+	for i, key := range keys {
+		var and []string
+		for j := 0; j < i; j++ {
+			if values[j] == nil {
+				and = append(and, columns[keys[j].Field]+" IS NULL")
+			} else {
+				and = append(and, columns[keys[j].Field]+" = "+q.arg(sqlValue(values[j])))
+			}
+		}
+
+		column := columns[key.Field]
+		switch {
+		case key.Desc && values[i] == nil:
+			and = append(and, "1 = 0")
+		case key.Desc:
+			and = append(and, fmt.Sprintf("(%s < %s OR %s IS NULL)", column, q.arg(sqlValue(values[i])), column))
+		case values[i] == nil:
+			and = append(and, column+" IS NOT NULL")
+		default:
+			and = append(and, column+" > "+q.arg(sqlValue(values[i])))
+		}
+		or = append(or, "("+strings.Join(and, " AND ")+")")
+	}
+	q.where = append(q.where, "("+strings.Join(or, " OR ")+")")
+}
+
+// sqlValue converts a cursor value to the type of its column
+func sqlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case primitive.DateTime:
+		return v.Time().UTC()
+	case primitive.ObjectID:
+		return v.Hex()
+	}
+	return value
+}
+
+// orderClause builds the ORDER BY and LIMIT/OFFSET clauses for the list options. Sort
+// fields without a column in the given map are ignored, NULLs come first like in MongoDB.
+func (q *sqlQuery) orderClause(opts ListOptions, columns map[string]string, defaultField string) string {
+	keys, _ := sortKeys(opts, columns, defaultField)
+	terms := make([]string, len(keys))
+	for i, key := range keys {
+		if key.Desc {
+			terms[i] = columns[key.Field] + " DESC NULLS LAST"
+		} else {
+			terms[i] = columns[key.Field] + " ASC NULLS FIRST"
+		}
+	}
+	return " ORDER BY " + strings.Join(terms, ", ") + q.limitClause(opts.Limit, opts.Skip)
+}
+
+// limitClause builds the LIMIT/OFFSET clause, a zero limit means no limit
+func (q *sqlQuery) limitClause(limit, skip int64) string {
+	var clause string
+	if limit > 0 {
+		clause += " LIMIT " + q.arg(limit)
+	}
+	if skip > 0 {
+		if limit <= 0 && q.dialect == sqliteDialect {
+			// SQLite only accepts OFFSET after a LIMIT
+			clause += " LIMIT -1"
+		}
+		clause += " OFFSET " + q.arg(skip)
+	}
+	return clause
+}
+
+// Column conversions
+
+// sqlRow is implemented by *sql.Row and *sql.Rows
+type sqlRow interface {
+	Scan(dest ...interface{}) error
+}
+
+// sqlColumn is a column and the value written to it
+type sqlColumn struct {
+	name  string
+	value interface{}
+	// geometry marks GeoJSON values that the dialect converts to its geometry type
+	geometry bool
+}
+
+// nullableID stores zero object IDs as NULL
+func nullableID(id primitive.ObjectID) interface{} {
+	if id.IsZero() {
+		return nil
+	}
+	return id.Hex()
+}
+
+// scanID converts a nullable ID column back to an object ID
+func scanID(value sql.NullString) (primitive.ObjectID, error) {
+	if !value.Valid {
+		return primitive.NilObjectID, nil
+	}
+	return primitive.ObjectIDFromHex(value.String)
+}
+
+// nullableGeometry stores unset points and geometries as NULL and the others as GeoJSON
+func nullableGeometry[T interface{ IsZero() bool }](geometry T) (interface{}, error) {
+	if geometry.IsZero() {
+		return nil, nil
+	}
+	data, err := json.Marshal(geometry)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// scanGeometry converts a nullable GeoJSON column back to a point or a geometry
+func scanGeometry[T any](value sql.NullString) (T, error) {
+	var geometry T
+	if !value.Valid {
+		return geometry, nil
+	}
+	err := json.Unmarshal([]byte(value.String), &geometry)
+	return geometry, err
+}
+
+// nullableTime stores unset times as NULL
+func nullableTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+// scanTime converts a nullable time column back to a time, nil for NULL
+func scanTime(value sql.NullTime) *time.Time {
+	if !value.Valid {
+		return nil
+	}
+	t := value.Time.UTC()
+	return &t
+}
+
+// deletionColumns returns the soft delete columns of a record
+func deletionColumns(deletion Deletion) []sqlColumn {
+	var deletedAt interface{}
+	if deletion.DeletedAt != nil {
+		deletedAt = deletion.DeletedAt.UTC()
+	}
+	return []sqlColumn{
+		{name: "deleted_at", value: deletedAt},
+		{name: "deleted_by", value: deletion.DeletedBy},
+	}
+}
+
+// scanDeletion converts the soft delete columns back to a Deletion
+func scanDeletion(deletedAt sql.NullTime, deletedBy sql.NullString) Deletion {
+	var deletion Deletion
+	if deletedAt.Valid {
+		deletion.DeletedAt = &deletedAt.Time
+	}
+	deletion.DeletedBy = deletedBy.String
+	return deletion
+}
+
+// Statement helpers
+
+// queryRows runs the query and scans every row with scan
+func queryRows[T any](ctx context.Context, conn sqlConn, statement string, args []interface{}, scan func(sqlRow) (T, error)) ([]T, error) {
+	rows, err := conn.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []T{}
+	for rows.Next() {
+		record, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// queryRow runs the query and scans the single resulting row, returning ErrNotFound if there is none
+func queryRow[T any](ctx context.Context, conn sqlConn, statement string, args []interface{}, scan func(sqlRow) (T, error)) (*T, error) {
+	record, err := scan(conn.QueryRowContext(ctx, statement, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// insert adds a row with the given ID and columns to the table, or returns ErrDuplicateID
+// when the ID is taken
+func (s *sqlStore) insert(ctx context.Context, table string, id primitive.ObjectID, columns []sqlColumn) error {
+	q := &sqlQuery{dialect: s.dialect}
+	names := []string{"id"}
+	values := []string{q.arg(id.Hex())}
+	for _, column := range columns {
+		names = append(names, column.name)
+		values = append(values, q.value(column))
+	}
+
+	statement := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (id) DO NOTHING",
+		table, strings.Join(names, ", "), strings.Join(values, ", "))
+	result, err := s.conn.ExecContext(ctx, statement, q.args...)
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		return ErrDuplicateID
+	}
+	return nil
+}
+
+// count returns the number of rows the statement selects
+func (s *sqlStore) count(ctx context.Context, statement string, args []interface{}) (int64, error) {
+	var count int64
+	err := s.conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM ("+statement+") counted", args...).Scan(&count)
+	return count, err
+}
+
+// update overwrites the columns of the row with the given ID if it is still at the given
+// version, which is incremented on success
+func (s *sqlStore) update(ctx context.Context, table string, id primitive.ObjectID, version *int64, columns []sqlColumn) error {
+	q := &sqlQuery{dialect: s.dialect}
+	assignments := make([]string, len(columns))
+	for i, column := range columns {
+		assignments[i] = column.name + " = " + q.value(column)
+	}
+	assignments = append(assignments, "version = "+q.arg(*version+1))
+
+	statement := fmt.Sprintf("UPDATE %s SET %s WHERE id = %s AND version = %s",
+		table, strings.Join(assignments, ", "), q.arg(id.Hex()), q.arg(*version))
+	result, err := s.conn.ExecContext(ctx, statement, q.args...)
+	if err != nil {
+		return err
+	}
+
+	err = checkAffected(result)
+	if errors.Is(err, ErrNotFound) {
+		// Tell a missing row apart from one that has moved on to another version
+		q = &sqlQuery{dialect: s.dialect}
+		var exists int
+		err = s.conn.QueryRowContext(ctx, "SELECT 1 FROM "+table+" WHERE id = "+q.arg(id.Hex()), q.args...).Scan(&exists)
+		switch {
+		case err == nil:
+			return ErrVersionConflict
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrNotFound
+		default:
+			return err
+		}
+	}
+	if err == nil {
+		*version++
+	}
+	return err
+}
+
+// deleteByID removes the row with the given ID from the table
+func (s *sqlStore) deleteByID(ctx context.Context, table string, id primitive.ObjectID) error {
+	q := &sqlQuery{dialect: s.dialect}
+	result, err := s.conn.ExecContext(ctx, "DELETE FROM "+table+" WHERE id = "+q.arg(id.Hex()), q.args...)
+	if err != nil {
+		return err
+	}
+	return checkAffected(result)
+}
+
+// purge removes the rows of the table deleted before the given time
+func (s *sqlStore) purge(ctx context.Context, table string, before time.Time) (int64, error) {
+	q := &sqlQuery{dialect: s.dialect}
+	result, err := s.conn.ExecContext(ctx, "DELETE FROM "+table+" WHERE deleted_at < "+q.arg(before.UTC()), q.args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// value binds the column value and returns the SQL expression writing it
+func (q *sqlQuery) value(column sqlColumn) string {
+	if column.geometry {
+		return q.dialect.geometryIn(q.arg(column.value))
+	}
+	return q.arg(column.value)
+}
+
+// checkAffected returns ErrNotFound when the statement didn't touch any row
+func checkAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Animal repository
+
+type sqlAnimalRepository struct {
+	store *sqlStore
+}
+
+// animalSortColumns maps the fields the animals are sorted and filtered on to their columns
+var animalSortColumns = map[string]string{
+	"_id":         "a.id",
+	"animal_name": "a.animal_name",
+	"birthdate":   "a.birthdate",
+	"species":     "s.species_name",
+	"category":    "c.category_name",
+}
+
+// detailSelect joins an animal with its species and category names
+func (r sqlAnimalRepository) detailSelect() string {
+	return r.detailSelectWithDistance("NULL")
+}
+
+// detailSelectWithDistance is detailSelect that also selects the given distance
+func (r sqlAnimalRepository) detailSelectWithDistance(distance string) string {
+	return fmt.Sprintf(`SELECT a.id, a.animal_name, a.birthdate, s.species_name, c.category_name, %s, a.version, %s AS distance
+		FROM animals a
+		LEFT JOIN species s ON s.id = a.species_id
+		LEFT JOIN categories c ON c.id = s.category_id`, r.store.dialect.geometryOut("a.location"), distance)
+}
+
+func scanAnimalDetail(row sqlRow) (AnimalDetail, error) {
+	var (
+		animal            AnimalDetail
+		id                string
+		species, category sql.NullString
+		location          sql.NullString
+		distance          sql.NullFloat64
+		err               error
+	)
+	if err = row.Scan(&id, &animal.AnimalName, &animal.Birthdate, &species, &category, &location, &animal.Version, &distance); err != nil {
+		return animal, err
+	}
+	if distance.Valid {
+		animal.Distance = &distance.Float64
+	}
+	if animal.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return animal, err
+	}
+	animal.Species = species.String
+	animal.Category = category.String
+	animal.Location, err = scanGeometry[Point](location)
+	return animal, err
+}
+
+// selectColumns selects the animal columns in the order scanAnimal reads them
+func (r sqlAnimalRepository) selectColumns() string {
+	return fmt.Sprintf("SELECT id, animal_name, birthdate, species_id, %s, version, deleted_at, deleted_by, tenant FROM animals",
+		r.store.dialect.geometryOut("location"))
+}
+
+func scanAnimal(row sqlRow) (Animal, error) {
+	var (
+		animal            Animal
+		id                string
+		species, location sql.NullString
+		deletedAt         sql.NullTime
+		deletedBy         sql.NullString
+		err               error
+	)
+	if err = row.Scan(&id, &animal.AnimalName, &animal.Birthdate, &species, &location, &animal.Version, &deletedAt, &deletedBy, &animal.Tenant); err != nil {
+		return animal, err
+	}
+	if animal.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return animal, err
+	}
+	if animal.Species, err = scanID(species); err != nil {
+		return animal, err
+	}
+	animal.Deletion = scanDeletion(deletedAt, deletedBy)
+	animal.Location, err = scanGeometry[Point](location)
+	return animal, err
+}
+
+// animalColumns returns the columns written for the animal
+func animalColumns(animal *Animal) ([]sqlColumn, error) {
+	location, err := nullableGeometry(animal.Location)
+	if err != nil {
+		return nil, err
+	}
+	columns := []sqlColumn{
+		{name: "animal_name", value: animal.AnimalName},
+		{name: "birthdate", value: animal.Birthdate.UTC()},
+		{name: "species_id", value: nullableID(animal.Species)},
+		{name: "location", value: location, geometry: true},
+		{name: "tenant", value: animal.Tenant},
+	}
+	return append(columns, deletionColumns(animal.Deletion)...), nil
+}
+
+// filter starts a query matching the joined animals against the filters of the query. It
+// returns the columns the animals can be sorted on, which include the distance of near queries.
+func (r sqlAnimalRepository) filter(query AnimalQuery) (*sqlQuery, map[string]string, error) {
+	q := &sqlQuery{dialect: r.store.dialect, where: []string{"a.deleted_at IS NULL"}}
+	q.matchRegex("a.animal_name", query.AnimalName)
+	q.matchRegex("s.species_name", query.SpeciesName)
+	q.matchRegex("c.category_name", query.CategoryName)
+	q.matchTenant("a.tenant", query.Tenant)
+	q.matchFilter(query.Filter, animalSortColumns)
+	err := q.matchGeo(query.Geo, "a.location")
+	return q, withDistance(animalSortColumns, q.distance(query.Geo, "a.location")), err
+}
+
+func (r sqlAnimalRepository) List(ctx context.Context, query AnimalQuery) ([]AnimalDetail, error) {
+	q, columns, err := r.filter(query)
+	if err != nil {
+		return nil, err
+	}
+	q.matchCursor(query.ListOptions, columns, "animal_name")
+
+	statement := r.detailSelectWithDistance(columns["distance"]) + q.whereClause() +
+		q.orderClause(query.ListOptions, columns, "animal_name")
+	return queryRows(ctx, r.store.conn, statement, q.args, scanAnimalDetail)
+}
+
+func (r sqlAnimalRepository) Count(ctx context.Context, query AnimalQuery) (int64, error) {
+	q, _, err := r.filter(query)
+	if err != nil {
+		return 0, err
+	}
+	return r.store.count(ctx, r.detailSelect()+q.whereClause(), q.args)
+}
+
+func (r sqlAnimalRepository) GetDetail(ctx context.Context, id primitive.ObjectID) (*AnimalDetail, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	statement := r.detailSelect() + " WHERE a.deleted_at IS NULL AND a.id = " + q.arg(id.Hex())
+	return queryRow(ctx, r.store.conn, statement, q.args, scanAnimalDetail)
+}
+
+func (r sqlAnimalRepository) Get(ctx context.Context, id primitive.ObjectID) (*Animal, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	statement := r.selectColumns() + " WHERE id = " + q.arg(id.Hex())
+	return queryRow(ctx, r.store.conn, statement, q.args, scanAnimal)
+}
+
+func (r sqlAnimalRepository) ListBySpecies(ctx context.Context, speciesID primitive.ObjectID) ([]Animal, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	statement := r.selectColumns() + " WHERE deleted_at IS NULL AND species_id = " + q.arg(speciesID.Hex())
+	return queryRows(ctx, r.store.conn, statement, q.args, scanAnimal)
+}
+
+func (r sqlAnimalRepository) ListDeleted(ctx context.Context) ([]Animal, error) {
+	statement := r.selectColumns() + " WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC"
+	return queryRows(ctx, r.store.conn, statement, nil, scanAnimal)
+}
+
+func (r sqlAnimalRepository) Create(ctx context.Context, animal *Animal) error {
+	columns, err := animalColumns(animal)
+	if err != nil {
+		return err
+	}
+
+	id := animal.ID
+	if id.IsZero() {
+		id = primitive.NewObjectID()
+	}
+	if err := r.store.insert(ctx, "animals", id, append(columns, sqlColumn{name: "version", value: 1})); err != nil {
+		return err
+	}
+	animal.ID = id
+	animal.Version = 1
+	return nil
+}
+
+func (r sqlAnimalRepository) Update(ctx context.Context, animal *Animal) error {
+	columns, err := animalColumns(animal)
+	if err != nil {
+		return err
+	}
+	return r.store.update(ctx, "animals", animal.ID, &animal.Version, columns)
+}
+
+func (r sqlAnimalRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return r.store.deleteByID(ctx, "animals", id)
+}
+
+func (r sqlAnimalRepository) Purge(ctx context.Context, before time.Time) (int64, error) {
+	return r.store.purge(ctx, "animals", before)
+}
+
+// Species repository
+
+type sqlSpeciesRepository struct {
+	store *sqlStore
+}
+
+// speciesSortColumns maps the fields the species are sorted and filtered on to their columns
+var speciesSortColumns = map[string]string{
+	"_id":          "id",
+	"species_name": "species_name",
+	"image":        "image",
+	"category":     "category_id",
+}
+
+// selectColumns selects the species columns in the order scanSpecies reads them
+func (r sqlSpeciesRepository) selectColumns() string {
+	return r.selectColumnsWithDistance("NULL")
+}
+
+// selectColumnsWithDistance is selectColumns that also selects the given distance
+func (r sqlSpeciesRepository) selectColumnsWithDistance(distance string) string {
+	return fmt.Sprintf("SELECT id, species_name, image, category_id, %s, %s, version, deleted_at, deleted_by, tenant, %s AS distance FROM species",
+		r.store.dialect.geometryOut("location"), r.store.dialect.geometryOut("habitat"), distance)
+}
+
+func scanSpecies(row sqlRow) (Species, error) {
+	var (
+		species                     Species
+		id                          string
+		category, location, habitat sql.NullString
+		deletedAt                   sql.NullTime
+		deletedBy                   sql.NullString
+		distance                    sql.NullFloat64
+		err                         error
+	)
+	if err = row.Scan(&id, &species.SpeciesName, &species.Image, &category, &location, &habitat, &species.Version, &deletedAt, &deletedBy, &species.Tenant, &distance); err != nil {
+		return species, err
+	}
+	if distance.Valid {
+		species.Distance = &distance.Float64
+	}
+	if species.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return species, err
+	}
+	if species.Category, err = scanID(category); err != nil {
+		return species, err
+	}
+	species.Deletion = scanDeletion(deletedAt, deletedBy)
+	if habitat.Valid {
+		h, err := scanGeometry[Geometry](habitat)
+		if err != nil {
+			return species, err
+		}
+		species.Habitat = &h
+	}
+	species.Location, err = scanGeometry[Geometry](location)
+	return species, err
+}
+
+// speciesColumns returns the columns written for the species
+func speciesColumns(species *Species) ([]sqlColumn, error) {
+	location, err := nullableGeometry(species.Location)
+	if err != nil {
+		return nil, err
+	}
+	var habitat interface{}
+	if species.Habitat != nil {
+		if habitat, err = nullableGeometry(*species.Habitat); err != nil {
+			return nil, err
+		}
+	}
+	columns := []sqlColumn{
+		{name: "species_name", value: species.SpeciesName},
+		{name: "image", value: species.Image},
+		{name: "category_id", value: nullableID(species.Category)},
+		{name: "location", value: location, geometry: true},
+		{name: "habitat", value: habitat, geometry: true},
+		{name: "tenant", value: species.Tenant},
+	}
+	return append(columns, deletionColumns(species.Deletion)...), nil
+}
+
+// filter starts a query matching the species against the filters of the query. It returns the
+// columns the species can be sorted on, which include the distance of near queries.
+func (r sqlSpeciesRepository) filter(query SpeciesQuery) (*sqlQuery, map[string]string, error) {
+	q := &sqlQuery{dialect: r.store.dialect, where: []string{"deleted_at IS NULL"}}
+	q.matchRegex("species_name", query.SpeciesName)
+	q.matchTenant("tenant", query.Tenant)
+	if !query.CategoryID.IsZero() {
+		q.where = append(q.where, "category_id = "+q.arg(query.CategoryID.Hex()))
+	}
+	q.matchFilter(query.Filter, speciesSortColumns)
+	err := q.matchGeo(query.Geo, "location", "habitat")
+	return q, withDistance(speciesSortColumns, q.distance(query.Geo, "location")), err
+}
+
+func (r sqlSpeciesRepository) List(ctx context.Context, query SpeciesQuery) ([]Species, error) {
+	q, columns, err := r.filter(query)
+	if err != nil {
+		return nil, err
+	}
+	q.matchCursor(query.ListOptions, columns, "species_name")
+
+	statement := r.selectColumnsWithDistance(columns["distance"]) + q.whereClause() +
+		q.orderClause(query.ListOptions, columns, "species_name")
+	return queryRows(ctx, r.store.conn, statement, q.args, scanSpecies)
+}
+
+func (r sqlSpeciesRepository) Count(ctx context.Context, query SpeciesQuery) (int64, error) {
+	q, _, err := r.filter(query)
+	if err != nil {
+		return 0, err
+	}
+	return r.store.count(ctx, r.selectColumns()+q.whereClause(), q.args)
+}
+
+func (r sqlSpeciesRepository) Get(ctx context.Context, id primitive.ObjectID) (*Species, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	statement := r.selectColumns() + " WHERE id = " + q.arg(id.Hex())
+	return queryRow(ctx, r.store.conn, statement, q.args, scanSpecies)
+}
+
+func (r sqlSpeciesRepository) ListByCategory(ctx context.Context, categoryID primitive.ObjectID) ([]Species, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	statement := r.selectColumns() + " WHERE deleted_at IS NULL AND category_id = " + q.arg(categoryID.Hex())
+	return queryRows(ctx, r.store.conn, statement, q.args, scanSpecies)
+}
+
+func (r sqlSpeciesRepository) ListDeleted(ctx context.Context) ([]Species, error) {
+	statement := r.selectColumns() + " WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC"
+	return queryRows(ctx, r.store.conn, statement, nil, scanSpecies)
+}
+
+func (r sqlSpeciesRepository) Create(ctx context.Context, species *Species) error {
+	columns, err := speciesColumns(species)
+	if err != nil {
+		return err
+	}
+
+	id := species.ID
+	if id.IsZero() {
+		id = primitive.NewObjectID()
+	}
+	if err := r.store.insert(ctx, "species", id, append(columns, sqlColumn{name: "version", value: 1})); err != nil {
+		return err
+	}
+	species.ID = id
+	species.Version = 1
+	return nil
+}
+
+func (r sqlSpeciesRepository) Update(ctx context.Context, species *Species) error {
+	columns, err := speciesColumns(species)
+	if err != nil {
+		return err
+	}
+	return r.store.update(ctx, "species", species.ID, &species.Version, columns)
+}
+
+func (r sqlSpeciesRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return r.store.deleteByID(ctx, "species", id)
+}
+
+func (r sqlSpeciesRepository) Purge(ctx context.Context, before time.Time) (int64, error) {
+	return r.store.purge(ctx, "species", before)
+}
+
+// Category repository
+
+type sqlCategoryRepository struct {
+	store *sqlStore
+}
+
+// categorySortColumns maps the fields the categories are sorted and filtered on to their columns
+var categorySortColumns = map[string]string{
+	"_id":           "id",
+	"category_name": "category_name",
+}
+
+// selectColumns selects the category columns in the order scanCategory reads them
+func (r sqlCategoryRepository) selectColumns() string {
+	return "SELECT id, category_name, version, deleted_at, deleted_by, tenant FROM categories"
+}
+
+func scanCategory(row sqlRow) (Category, error) {
+	var (
+		category  Category
+		id        string
+		deletedAt sql.NullTime
+		deletedBy sql.NullString
+		err       error
+	)
+	if err = row.Scan(&id, &category.CategoryName, &category.Version, &deletedAt, &deletedBy, &category.Tenant); err != nil {
+		return category, err
+	}
+	category.Deletion = scanDeletion(deletedAt, deletedBy)
+	category.ID, err = primitive.ObjectIDFromHex(id)
+	return category, err
+}
+
+// categoryColumns returns the columns written for the category
+func categoryColumns(category *Category) []sqlColumn {
+	columns := []sqlColumn{
+		{name: "category_name", value: category.CategoryName},
+		{name: "tenant", value: category.Tenant},
+	}
+	return append(columns, deletionColumns(category.Deletion)...)
+}
+
+// filter starts a query matching the categories against the filters of the query
+func (r sqlCategoryRepository) filter(query CategoryQuery) *sqlQuery {
+	q := &sqlQuery{dialect: r.store.dialect, where: []string{"deleted_at IS NULL"}}
+	q.matchRegex("category_name", query.CategoryName)
+	q.matchTenant("tenant", query.Tenant)
+	q.matchFilter(query.Filter, categorySortColumns)
+	return q
+}
+
+func (r sqlCategoryRepository) List(ctx context.Context, query CategoryQuery) ([]Category, error) {
+	q := r.filter(query)
+	q.matchCursor(query.ListOptions, categorySortColumns, "category_name")
+
+	statement := r.selectColumns() + q.whereClause() + q.orderClause(query.ListOptions, categorySortColumns, "category_name")
+	return queryRows(ctx, r.store.conn, statement, q.args, scanCategory)
+}
+
+func (r sqlCategoryRepository) Count(ctx context.Context, query CategoryQuery) (int64, error) {
+	q := r.filter(query)
+	return r.store.count(ctx, r.selectColumns()+q.whereClause(), q.args)
+}
+
+func (r sqlCategoryRepository) Get(ctx context.Context, id primitive.ObjectID) (*Category, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	statement := r.selectColumns() + " WHERE id = " + q.arg(id.Hex())
+	return queryRow(ctx, r.store.conn, statement, q.args, scanCategory)
+}
+
+func (r sqlCategoryRepository) ListDeleted(ctx context.Context) ([]Category, error) {
+	statement := r.selectColumns() + " WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC"
+	return queryRows(ctx, r.store.conn, statement, nil, scanCategory)
+}
+
+func (r sqlCategoryRepository) Create(ctx context.Context, category *Category) error {
+	id := category.ID
+	if id.IsZero() {
+		id = primitive.NewObjectID()
+	}
+	if err := r.store.insert(ctx, "categories", id, append(categoryColumns(category), sqlColumn{name: "version", value: 1})); err != nil {
+		return err
+	}
+	category.ID = id
+	category.Version = 1
+	return nil
+}
+
+func (r sqlCategoryRepository) Update(ctx context.Context, category *Category) error {
+	return r.store.update(ctx, "categories", category.ID, &category.Version, categoryColumns(category))
+}
+
+func (r sqlCategoryRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return r.store.deleteByID(ctx, "categories", id)
+}
+
+func (r sqlCategoryRepository) Purge(ctx context.Context, before time.Time) (int64, error) {
+	return r.store.purge(ctx, "categories", before)
+}
+
+// Audit repository
+
+type sqlAuditRepository struct {
+	store *sqlStore
+}
+
+func scanAuditEvent(row sqlRow) (AuditEvent, error) {
+	var (
+		event        AuditEvent
+		id, entityID string
+		changes      string
+		err          error
+	)
+	if err = row.Scan(&id, &event.Entity, &entityID, &event.Action, &event.Actor, &event.RequestID, &event.Timestamp, &changes, &event.Tenant); err != nil {
+		return event, err
+	}
+	if event.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return event, err
+	}
+	if event.EntityID, err = primitive.ObjectIDFromHex(entityID); err != nil {
+		return event, err
+	}
+	err = json.Unmarshal([]byte(changes), &event.Changes)
+	return event, err
+}
+
+func (r sqlAuditRepository) Append(ctx context.Context, event *AuditEvent) error {
+	changes, err := json.Marshal(event.Changes)
+	if err != nil {
+		return err
+	}
+
+	return r.store.insert(ctx, "audit_events", event.ID, []sqlColumn{
+		{name: "entity", value: event.Entity},
+		{name: "entity_id", value: event.EntityID.Hex()},
+		{name: "action", value: event.Action},
+		{name: "actor", value: event.Actor},
+		{name: "request_id", value: event.RequestID},
+		{name: "occurred_at", value: event.Timestamp.UTC()},
+		{name: "changes", value: string(changes)},
+		{name: "tenant", value: event.Tenant},
+	})
+}
+
+func (r sqlAuditRepository) List(ctx context.Context, query AuditQuery) ([]AuditEvent, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	for _, filter := range []struct{ column, value string }{
+		{"entity", query.Entity},
+		{"action", query.Action},
+		{"actor", query.Actor},
+		{"request_id", query.RequestID},
+		{"tenant", query.Tenant},
+	} {
+		if filter.value != "" {
+			q.where = append(q.where, filter.column+" = "+q.arg(filter.value))
+		}
+	}
+	if !query.EntityID.IsZero() {
+		q.where = append(q.where, "entity_id = "+q.arg(query.EntityID.Hex()))
+	}
+	if !query.From.IsZero() {
+		q.where = append(q.where, "occurred_at >= "+q.arg(query.From.UTC()))
+	}
+	if !query.To.IsZero() {
+		q.where = append(q.where, "occurred_at < "+q.arg(query.To.UTC()))
+	}
+
+	statement := "SELECT id, entity, entity_id, action, actor, request_id, occurred_at, changes, tenant FROM audit_events" +
+		q.whereClause() + " ORDER BY occurred_at DESC, id DESC" + q.limitClause(query.Limit, query.Skip)
+	return queryRows(ctx, r.store.conn, statement, q.args, scanAuditEvent)
+}
+
+// Location repository
+
+type sqlLocationRepository struct {
+	store *sqlStore
+}
+
+// selectColumns selects the location fix columns in the order scanLocationFix reads them
+func (r sqlLocationRepository) selectColumns() string {
+	return fmt.Sprintf("SELECT id, animal_id, %s, recorded_at FROM animal_locations", r.store.dialect.geometryOut("location"))
+}
+
+func scanLocationFix(row sqlRow) (LocationFix, error) {
+	var (
+		fix                    LocationFix
+		id, animalID, location string
+		err                    error
+	)
+	if err = row.Scan(&id, &animalID, &location, &fix.RecordedAt); err != nil {
+		return fix, err
+	}
+	if fix.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return fix, err
+	}
+	if fix.AnimalID, err = primitive.ObjectIDFromHex(animalID); err != nil {
+		return fix, err
+	}
+	fix.RecordedAt = fix.RecordedAt.UTC()
+	err = json.Unmarshal([]byte(location), &fix.Location)
+	return fix, err
+}
+
+func (r sqlLocationRepository) Append(ctx context.Context, fix *LocationFix) error {
+	location, err := nullableGeometry(fix.Location)
+	if err != nil {
+		return err
+	}
+	return r.store.insert(ctx, "animal_locations", fix.ID, []sqlColumn{
+		{name: "animal_id", value: fix.AnimalID.Hex()},
+		{name: "location", value: location, geometry: true},
+		{name: "recorded_at", value: fix.RecordedAt.UTC()},
+	})
+}
+
+func (r sqlLocationRepository) List(ctx context.Context, query TrackQuery) ([]LocationFix, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	q.where = append(q.where, "animal_id = "+q.arg(query.AnimalID.Hex()))
+	if !query.From.IsZero() {
+		q.where = append(q.where, "recorded_at >= "+q.arg(query.From.UTC()))
+	}
+	if !query.To.IsZero() {
+		q.where = append(q.where, "recorded_at < "+q.arg(query.To.UTC()))
+	}
+	if query.After != nil {
+		// Hex IDs sort like the ObjectIDs they encode
+		recordedAt := query.After.RecordedAt.UTC()
+		q.where = append(q.where, "(recorded_at > "+q.arg(recordedAt)+" OR (recorded_at = "+q.arg(recordedAt)+
+			" AND id > "+q.arg(query.After.ID.Hex())+"))")
+	}
+
+	statement := r.selectColumns() + q.whereClause() + " ORDER BY recorded_at, id" + q.limitClause(query.Limit, 0)
+	return queryRows(ctx, r.store.conn, statement, q.args, scanLocationFix)
+}
+
+func (r sqlLocationRepository) Latest(ctx context.Context, animalID primitive.ObjectID) (*LocationFix, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	statement := r.selectColumns() + " WHERE animal_id = " + q.arg(animalID.Hex()) +
+		" ORDER BY recorded_at DESC, id DESC" + q.limitClause(1, 0)
+	return queryRow(ctx, r.store.conn, statement, q.args, scanLocationFix)
+}
+
+func (r sqlLocationRepository) Purge(ctx context.Context) (int64, error) {
+	// The foreign key removes the fixes along with their animal, this only catches stragglers
+	result, err := r.store.conn.ExecContext(ctx, "DELETE FROM animal_locations WHERE animal_id NOT IN (SELECT id FROM animals)")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Geofence repository
+
+type sqlGeofenceRepository struct {
+	store *sqlStore
+}
+
+// selectColumns selects the geofence columns in the order scanGeofence reads them
+func (r sqlGeofenceRepository) selectColumns() string {
+	return fmt.Sprintf("SELECT id, name, %s, animal_ids, species_ids, version, tenant FROM geofences", r.store.dialect.geometryOut("area"))
+}
+
+func scanGeofence(row sqlRow) (Geofence, error) {
+	var (
+		geofence                   Geofence
+		id, area, animals, species string
+		err                        error
+	)
+	if err = row.Scan(&id, &geofence.Name, &area, &animals, &species, &geofence.Version, &geofence.Tenant); err != nil {
+		return geofence, err
+	}
+	if geofence.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return geofence, err
+	}
+	if err = json.Unmarshal([]byte(area), &geofence.Area); err != nil {
+		return geofence, err
+	}
+	if err = json.Unmarshal([]byte(animals), &geofence.Animals); err != nil {
+		return geofence, err
+	}
+	err = json.Unmarshal([]byte(species), &geofence.Species)
+	return geofence, err
+}
+
+// geofenceColumns returns the columns written for the geofence, the linked IDs are kept as JSON
+// arrays
+func geofenceColumns(geofence *Geofence) ([]sqlColumn, error) {
+	area, err := nullableGeometry(geofence.Area)
+	if err != nil {
+		return nil, err
+	}
+	animals, err := json.Marshal(compactIDs(geofence.Animals))
+	if err != nil {
+		return nil, err
+	}
+	species, err := json.Marshal(compactIDs(geofence.Species))
+	if err != nil {
+		return nil, err
+	}
+	return []sqlColumn{
+		{name: "name", value: geofence.Name},
+		{name: "area", value: area, geometry: true},
+		{name: "animal_ids", value: string(animals)},
+		{name: "species_ids", value: string(species)},
+		{name: "tenant", value: geofence.Tenant},
+	}, nil
+}
+
+func (r sqlGeofenceRepository) List(ctx context.Context) ([]Geofence, error) {
+	return queryRows(ctx, r.store.conn, r.selectColumns()+" ORDER BY name, id", nil, scanGeofence)
+}
+
+func (r sqlGeofenceRepository) Get(ctx context.Context, id primitive.ObjectID) (*Geofence, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	statement := r.selectColumns() + " WHERE id = " + q.arg(id.Hex())
+	return queryRow(ctx, r.store.conn, statement, q.args, scanGeofence)
+}
+
+func (r sqlGeofenceRepository) Create(ctx context.Context, geofence *Geofence) error {
+	columns, err := geofenceColumns(geofence)
+	if err != nil {
+		return err
+	}
+	id := geofence.ID
+	if id.IsZero() {
+		id = primitive.NewObjectID()
+	}
+	if err := r.store.insert(ctx, "geofences", id, append(columns, sqlColumn{name: "version", value: 1})); err != nil {
+		return err
+	}
+	geofence.ID = id
+	geofence.Version = 1
+	return nil
+}
+
+func (r sqlGeofenceRepository) Update(ctx context.Context, geofence *Geofence) error {
+	columns, err := geofenceColumns(geofence)
+	if err != nil {
+		return err
+	}
+	return r.store.update(ctx, "geofences", geofence.ID, &geofence.Version, columns)
+}
+
+func (r sqlGeofenceRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return r.store.deleteByID(ctx, "geofences", id)
+}
+
+// Alert repository
+
+type sqlAlertRepository struct {
+	store *sqlStore
+}
+
+// selectColumns selects the alert columns in the order scanAlert reads them
+func (r sqlAlertRepository) selectColumns() string {
+	return fmt.Sprintf("SELECT id, type, animal_id, geofence_id, %s, status, raised_at, acknowledged_at, acknowledged_by, resolved_at, resolved_by, version, tenant FROM alerts",
+		r.store.dialect.geometryOut("location"))
+}
+
+func scanAlert(row sqlRow) (Alert, error) {
+	var (
+		alert                              Alert
+		id, animalID, geofenceID, location string
+		acknowledgedAt, resolvedAt         sql.NullTime
+		acknowledgedBy, resolvedBy         sql.NullString
+		err                                error
+	)
+	if err = row.Scan(&id, &alert.Type, &animalID, &geofenceID, &location, &alert.Status, &alert.RaisedAt,
+		&acknowledgedAt, &acknowledgedBy, &resolvedAt, &resolvedBy, &alert.Version, &alert.Tenant); err != nil {
+		return alert, err
+	}
+	if alert.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return alert, err
+	}
+	if alert.AnimalID, err = primitive.ObjectIDFromHex(animalID); err != nil {
+		return alert, err
+	}
+	if alert.GeofenceID, err = primitive.ObjectIDFromHex(geofenceID); err != nil {
+		return alert, err
+	}
+	alert.RaisedAt = alert.RaisedAt.UTC()
+	if acknowledgedAt.Valid {
+		t := acknowledgedAt.Time.UTC()
+		alert.AcknowledgedAt = &t
+	}
+	if resolvedAt.Valid {
+		t := resolvedAt.Time.UTC()
+		alert.ResolvedAt = &t
+	}
+	alert.AcknowledgedBy, alert.ResolvedBy = acknowledgedBy.String, resolvedBy.String
+	err = json.Unmarshal([]byte(location), &alert.Location)
+	return alert, err
+}
+
+// alertColumns returns the columns written for the alert
+func alertColumns(alert *Alert) ([]sqlColumn, error) {
+	location, err := nullableGeometry(alert.Location)
+	if err != nil {
+		return nil, err
+	}
+	var acknowledgedAt, resolvedAt interface{}
+	if alert.AcknowledgedAt != nil {
+		acknowledgedAt = alert.AcknowledgedAt.UTC()
+	}
+	if alert.ResolvedAt != nil {
+		resolvedAt = alert.ResolvedAt.UTC()
+	}
+	return []sqlColumn{
+		{name: "type", value: alert.Type},
+		{name: "animal_id", value: alert.AnimalID.Hex()},
+		{name: "geofence_id", value: alert.GeofenceID.Hex()},
+		{name: "location", value: location, geometry: true},
+		{name: "status", value: alert.Status},
+		{name: "raised_at", value: alert.RaisedAt.UTC()},
+		{name: "acknowledged_at", value: acknowledgedAt},
+		{name: "acknowledged_by", value: alert.AcknowledgedBy},
+		{name: "resolved_at", value: resolvedAt},
+		{name: "resolved_by", value: alert.ResolvedBy},
+		{name: "tenant", value: alert.Tenant},
+	}, nil
+}
+
+func (r sqlAlertRepository) List(ctx context.Context, query AlertQuery) ([]Alert, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	if len(query.Statuses) > 0 {
+		params := make([]string, len(query.Statuses))
+		for i, status := range query.Statuses {
+			params[i] = q.arg(status)
+		}
+		q.where = append(q.where, "status IN ("+strings.Join(params, ", ")+")")
+	}
+	if !query.AnimalID.IsZero() {
+		q.where = append(q.where, "animal_id = "+q.arg(query.AnimalID.Hex()))
+	}
+	if !query.GeofenceID.IsZero() {
+		q.where = append(q.where, "geofence_id = "+q.arg(query.GeofenceID.Hex()))
+	}
+	q.matchTenant("tenant", query.Tenant)
+
+	statement := r.selectColumns() + q.whereClause() + " ORDER BY raised_at DESC, id DESC" + q.limitClause(query.Limit, query.Skip)
+	return queryRows(ctx, r.store.conn, statement, q.args, scanAlert)
+}
+
+func (r sqlAlertRepository) Get(ctx context.Context, id primitive.ObjectID) (*Alert, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	statement := r.selectColumns() + " WHERE id = " + q.arg(id.Hex())
+	return queryRow(ctx, r.store.conn, statement, q.args, scanAlert)
+}
+
+func (r sqlAlertRepository) Create(ctx context.Context, alert *Alert) error {
+	columns, err := alertColumns(alert)
+	if err != nil {
+		return err
+	}
+	if err := r.store.insert(ctx, "alerts", alert.ID, append(columns, sqlColumn{name: "version", value: 1})); err != nil {
+		return err
+	}
+	alert.Version = 1
+	return nil
+}
+
+func (r sqlAlertRepository) Update(ctx context.Context, alert *Alert) error {
+	columns, err := alertColumns(alert)
+	if err != nil {
+		return err
+	}
+	return r.store.update(ctx, "alerts", alert.ID, &alert.Version, columns)
+}
+
+// User repository
+
+type sqlUserRepository struct {
+	store *sqlStore
+}
+
+// selectColumns selects the user columns in the order scanUser reads them
+func (r sqlUserRepository) selectColumns() string {
+	return "SELECT id, username, password_hash, roles, created_at, version, tenant FROM users"
+}
+
+func scanUser(row sqlRow) (User, error) {
+	var (
+		user      User
+		id, roles string
+		err       error
+	)
+	if err = row.Scan(&id, &user.Username, &user.PasswordHash, &roles, &user.CreatedAt, &user.Version, &user.Tenant); err != nil {
+		return user, err
+	}
+	if user.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return user, err
+	}
+	user.CreatedAt = user.CreatedAt.UTC()
+	err = json.Unmarshal([]byte(roles), &user.Roles)
+	return user, err
+}
+
+// userColumns returns the columns written for the user, the roles are kept as a JSON array
+func userColumns(user *User) ([]sqlColumn, error) {
+	roles, err := json.Marshal(compactStrings(user.Roles))
+	if err != nil {
+		return nil, err
+	}
+	return []sqlColumn{
+		{name: "username", value: user.Username},
+		{name: "password_hash", value: user.PasswordHash},
+		{name: "roles", value: string(roles)},
+		{name: "created_at", value: user.CreatedAt.UTC()},
+		{name: "tenant", value: user.Tenant},
+	}, nil
+}
+
+func (r sqlUserRepository) List(ctx context.Context) ([]User, error) {
+	return queryRows(ctx, r.store.conn, r.selectColumns()+" ORDER BY username", nil, scanUser)
+}
+
+func (r sqlUserRepository) Get(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	statement := r.selectColumns() + " WHERE id = " + q.arg(id.Hex())
+	return queryRow(ctx, r.store.conn, statement, q.args, scanUser)
+}
+
+func (r sqlUserRepository) GetByUsername(ctx context.Context, tenant, username string) (*User, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	statement := r.selectColumns() + " WHERE tenant = " + q.arg(tenant) + " AND username = " + q.arg(username)
+	return queryRow(ctx, r.store.conn, statement, q.args, scanUser)
+}
+
+func (r sqlUserRepository) Create(ctx context.Context, user *User) error {
+	columns, err := userColumns(user)
+	if err != nil {
+		return err
+	}
+	// The unique index on the usernames still holds if another user is created in between
+	if _, err := r.GetByUsername(ctx, user.Tenant, user.Username); err == nil {
+		return ErrUsernameTaken
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err := r.store.insert(ctx, "users", user.ID, append(columns, sqlColumn{name: "version", value: 1})); err != nil {
+		return err
+	}
+	user.Version = 1
+	return nil
+}
+
+func (r sqlUserRepository) Update(ctx context.Context, user *User) error {
+	columns, err := userColumns(user)
+	if err != nil {
+		return err
+	}
+	return r.store.update(ctx, "users", user.ID, &user.Version, columns)
+}
+
+func (r sqlUserRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return r.store.deleteByID(ctx, "users", id)
+}
+
+// API key repository
+
+type sqlAPIKeyRepository struct {
+	store *sqlStore
+}
+
+// selectColumns selects the API key columns in the order scanAPIKey reads them
+func (r sqlAPIKeyRepository) selectColumns() string {
+	return "SELECT id, user_id, name, hash, scopes, expires_at, created_at, rotated_at, last_used_at, revoked_at, version FROM api_keys"
+}
+
+func scanAPIKey(row sqlRow) (APIKey, error) {
+	var (
+		key                                       APIKey
+		id, userID, scopes                        string
+		expiresAt, rotatedAt, lastUsedAt, revoked sql.NullTime
+		err                                       error
+	)
+	if err = row.Scan(&id, &userID, &key.Name, &key.Hash, &scopes, &expiresAt, &key.CreatedAt,
+		&rotatedAt, &lastUsedAt, &revoked, &key.Version); err != nil {
+		return key, err
+	}
+	if key.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return key, err
+	}
+	if key.UserID, err = primitive.ObjectIDFromHex(userID); err != nil {
+		return key, err
+	}
+	key.CreatedAt = key.CreatedAt.UTC()
+	key.ExpiresAt, key.RotatedAt = scanTime(expiresAt), scanTime(rotatedAt)
+	key.LastUsedAt, key.RevokedAt = scanTime(lastUsedAt), scanTime(revoked)
+	err = json.Unmarshal([]byte(scopes), &key.Scopes)
+	return key, err
+}
+
+// apiKeyColumns returns the columns written for the key, the scopes are kept as a JSON array
+func apiKeyColumns(key *APIKey) ([]sqlColumn, error) {
+	scopes, err := json.Marshal(compactStrings(key.Scopes))
+	if err != nil {
+		return nil, err
+	}
+	return []sqlColumn{
+		{name: "user_id", value: key.UserID.Hex()},
+		{name: "name", value: key.Name},
+		{name: "hash", value: key.Hash},
+		{name: "scopes", value: string(scopes)},
+		{name: "expires_at", value: nullableTime(key.ExpiresAt)},
+		{name: "created_at", value: key.CreatedAt.UTC()},
+		{name: "rotated_at", value: nullableTime(key.RotatedAt)},
+		{name: "last_used_at", value: nullableTime(key.LastUsedAt)},
+		{name: "revoked_at", value: nullableTime(key.RevokedAt)},
+	}, nil
+}
+
+func (r sqlAPIKeyRepository) ListByUser(ctx context.Context, userID primitive.ObjectID) ([]APIKey, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	statement := r.selectColumns() + " WHERE user_id = " + q.arg(userID.Hex()) + " ORDER BY created_at, id"
+	return queryRows(ctx, r.store.conn, statement, q.args, scanAPIKey)
+}
+
+func (r sqlAPIKeyRepository) Get(ctx context.Context, id primitive.ObjectID) (*APIKey, error) {
+	q := &sqlQuery{dialect: r.store.dialect}
+	statement := r.selectColumns() + " WHERE id = " + q.arg(id.Hex())
+	return queryRow(ctx, r.store.conn, statement, q.args, scanAPIKey)
+}
+
+func (r sqlAPIKeyRepository) Create(ctx context.Context, key *APIKey) error {
+	columns, err := apiKeyColumns(key)
+	if err != nil {
+		return err
+	}
+	if err := r.store.insert(ctx, "api_keys", key.ID, append(columns, sqlColumn{name: "version", value: 1})); err != nil {
+		return err
+	}
+	key.Version = 1
+	return nil
+}
+
+func (r sqlAPIKeyRepository) Update(ctx context.Context, key *APIKey) error {
+	columns, err := apiKeyColumns(key)
+	if err != nil {
+		return err
+	}
+	return r.store.update(ctx, "api_keys", key.ID, &key.Version, columns)
+}
+
+func (r sqlAPIKeyRepository) Touch(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	q := &sqlQuery{dialect: r.store.dialect}
+	statement := "UPDATE api_keys SET last_used_at = " + q.arg(at.UTC()) + " WHERE id = " + q.arg(id.Hex())
+	result, err := r.store.conn.ExecContext(ctx, statement, q.args...)
+	if err != nil {
+		return err
+	}
+	return checkAffected(result)
+}
+
+func (r sqlAPIKeyRepository) DeleteByUser(ctx context.Context, userID primitive.ObjectID) error {
+	q := &sqlQuery{dialect: r.store.dialect}
+	_, err := r.store.conn.ExecContext(ctx, "DELETE FROM api_keys WHERE user_id = "+q.arg(userID.Hex()), q.args...)
+	return err
+}
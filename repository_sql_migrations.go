@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// sqlMigrations are applied in order and recorded in the schema_migrations table so each
+// runs once. Add new migrations at the end, released ones must not change.
+var sqlMigrations = []func(d *sqlDialect) []string{
+	// 1: animals, species and categories
+	func(d *sqlDialect) []string {
+		return []string{
+			`CREATE TABLE IF NOT EXISTS categories (
+				id TEXT PRIMARY KEY,
+				category_name TEXT NOT NULL
+			)`,
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS species (
+				id TEXT PRIMARY KEY,
+				species_name TEXT NOT NULL,
+				image TEXT NOT NULL,
+				category_id TEXT REFERENCES categories(id) ON DELETE SET NULL,
+				location %s
+			)`, d.geometryType),
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS animals (
+				id TEXT PRIMARY KEY,
+				animal_name TEXT NOT NULL,
+				birthdate %s NOT NULL,
+				species_id TEXT REFERENCES species(id) ON DELETE SET NULL,
+				location %s
+			)`, d.timestampType, d.geometryType),
+			`CREATE INDEX IF NOT EXISTS species_category_id ON species (category_id)`,
+			`CREATE INDEX IF NOT EXISTS animals_species_id ON animals (species_id)`,
+		}
+	},
+	// 2: soft delete
+	func(d *sqlDialect) []string {
+		var statements []string
+		for _, table := range []string{"categories", "species", "animals"} {
+			statements = append(statements,
+				fmt.Sprintf("ALTER TABLE %s ADD COLUMN deleted_at %s", table, d.timestampType),
+				fmt.Sprintf("ALTER TABLE %s ADD COLUMN deleted_by TEXT", table),
+			)
+		}
+		return statements
+	},
+	// 3: audit log
+	func(d *sqlDialect) []string {
+		return []string{
+			fmt.Sprintf(`CREATE TABLE audit_events (
+				id TEXT PRIMARY KEY,
+				entity TEXT NOT NULL,
+				entity_id TEXT NOT NULL,
+				action TEXT NOT NULL,
+				actor TEXT NOT NULL,
+				request_id TEXT NOT NULL,
+				occurred_at %s NOT NULL,
+				changes TEXT NOT NULL
+			)`, d.timestampType),
+			`CREATE INDEX audit_events_entity ON audit_events (entity, entity_id, occurred_at)`,
+			`CREATE INDEX audit_events_occurred_at ON audit_events (occurred_at)`,
+		}
+	},
+	// 4: optimistic concurrency
+	func(d *sqlDialect) []string {
+		var statements []string
+		for _, table := range []string{"categories", "species", "animals"} {
+			statements = append(statements, fmt.Sprintf("ALTER TABLE %s ADD COLUMN version INTEGER NOT NULL DEFAULT 1", table))
+		}
+		return statements
+	},
+	// 5: spatial indexes for the geo queries
+	func(d *sqlDialect) []string {
+		if !d.spatialIndexes {
+			return nil
+		}
+		return []string{
+			`CREATE INDEX animals_location ON animals USING GIST (location)`,
+			`CREATE INDEX species_location ON species USING GIST (location)`,
+		}
+	},
+	// 6: species locations of any geometry type and habitats
+	func(d *sqlDialect) []string {
+		statements := []string{fmt.Sprintf("ALTER TABLE species ADD COLUMN habitat %s", d.anyGeometryType)}
+		if d.anyGeometryType != d.geometryType {
+			statements = append(statements, fmt.Sprintf("ALTER TABLE species ALTER COLUMN location TYPE %s", d.anyGeometryType))
+		}
+		if d.spatialIndexes {
+			statements = append(statements, `CREATE INDEX species_habitat ON species USING GIST (habitat)`)
+		}
+		return statements
+	},
+	// 7: location fixes of animals
+	func(d *sqlDialect) []string {
+		return []string{
+			fmt.Sprintf(`CREATE TABLE animal_locations (
+				id TEXT PRIMARY KEY,
+				animal_id TEXT NOT NULL REFERENCES animals(id) ON DELETE CASCADE,
+				location %s NOT NULL,
+				recorded_at %s NOT NULL
+			)`, d.geometryType, d.timestampType),
+			`CREATE INDEX animal_locations_animal_id ON animal_locations (animal_id, recorded_at)`,
+		}
+	},
+	// 8: geofences and their alerts
+	func(d *sqlDialect) []string {
+		return []string{
+			fmt.Sprintf(`CREATE TABLE geofences (
+				id TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				area %s NOT NULL,
+				animal_ids TEXT NOT NULL,
+				species_ids TEXT NOT NULL,
+				version INTEGER NOT NULL DEFAULT 1
+			)`, d.anyGeometryType),
+			fmt.Sprintf(`CREATE TABLE alerts (
+				id TEXT PRIMARY KEY,
+				type TEXT NOT NULL,
+				animal_id TEXT NOT NULL,
+				geofence_id TEXT NOT NULL,
+				location %s NOT NULL,
+				status TEXT NOT NULL,
+				raised_at %s NOT NULL,
+				acknowledged_at %s,
+				acknowledged_by TEXT,
+				resolved_at %s,
+				resolved_by TEXT,
+				version INTEGER NOT NULL DEFAULT 1
+			)`, d.geometryType, d.timestampType, d.timestampType, d.timestampType),
+			`CREATE INDEX alerts_animal_id ON alerts (animal_id, geofence_id, status)`,
+			`CREATE INDEX alerts_raised_at ON alerts (raised_at)`,
+		}
+	},
+	// 9: users and their API keys
+	func(d *sqlDialect) []string {
+		return []string{
+			fmt.Sprintf(`CREATE TABLE users (
+				id TEXT PRIMARY KEY,
+				username TEXT NOT NULL UNIQUE,
+				password_hash TEXT NOT NULL,
+				roles TEXT NOT NULL,
+				created_at %s NOT NULL,
+				version INTEGER NOT NULL DEFAULT 1
+			)`, d.timestampType),
+			fmt.Sprintf(`CREATE TABLE api_keys (
+				id TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				name TEXT NOT NULL,
+				hash TEXT NOT NULL,
+				scopes TEXT NOT NULL,
+				expires_at %s,
+				created_at %s NOT NULL,
+				rotated_at %s,
+				last_used_at %s,
+				revoked_at %s,
+				version INTEGER NOT NULL DEFAULT 1
+			)`, d.timestampType, d.timestampType, d.timestampType, d.timestampType, d.timestampType),
+			`CREATE INDEX api_keys_user_id ON api_keys (user_id, created_at)`,
+		}
+	},
+	// 10: the zoo owning each record when zoos share the database
+	func(d *sqlDialect) []string {
+		var statements []string
+		for _, table := range []string{"animals", "species", "categories", "audit_events", "geofences", "alerts", "users"} {
+			statements = append(statements,
+				fmt.Sprintf("ALTER TABLE %s ADD COLUMN tenant TEXT NOT NULL DEFAULT ''", table),
+				fmt.Sprintf("CREATE INDEX %s_tenant ON %s (tenant)", table, table),
+			)
+		}
+		return statements
+	},
+	// 11: geometries with an altitude, which the PostGIS columns typed as 2D geometries reject.
+	// No type modifier admits both 2D and 3D geometries, so a check keeps the SRID instead.
+	// Points of animals have no altitude and keep their columns.
+	func(d *sqlDialect) []string {
+		if d.anyGeometryType == d.geometryType {
+			return nil
+		}
+		var statements []string
+		for _, column := range []string{"species.location", "species.habitat", "geofences.area"} {
+			table, name, _ := strings.Cut(column, ".")
+			statements = append(statements,
+				fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE geometry", table, name),
+				fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s_%s_srid CHECK (ST_SRID(%s) = 4326)", table, table, name, name),
+			)
+		}
+		return statements
+	},
+	// 12: usernames unique within each zoo. SQLite can't drop the constraint and rebuilds the
+	// table, with the API keys set aside so that dropping it doesn't cascade to them.
+	func(d *sqlDialect) []string {
+		if d != sqliteDialect {
+			return []string{
+				`ALTER TABLE users DROP CONSTRAINT users_username_key`,
+				`CREATE UNIQUE INDEX users_tenant_username ON users (tenant, username)`,
+			}
+		}
+		return []string{
+			fmt.Sprintf(`CREATE TABLE users_rebuilt (
+				id TEXT PRIMARY KEY,
+				username TEXT NOT NULL,
+				password_hash TEXT NOT NULL,
+				roles TEXT NOT NULL,
+				created_at %s NOT NULL,
+				version INTEGER NOT NULL DEFAULT 1,
+				tenant TEXT NOT NULL DEFAULT ''
+			)`, d.timestampType),
+			`INSERT INTO users_rebuilt (id, username, password_hash, roles, created_at, version, tenant)
+				SELECT id, username, password_hash, roles, created_at, version, tenant FROM users`,
+			`CREATE TABLE api_keys_kept AS SELECT * FROM api_keys`,
+			`DROP TABLE api_keys`,
+			`DROP TABLE users`,
+			`ALTER TABLE users_rebuilt RENAME TO users`,
+			`CREATE INDEX users_tenant ON users (tenant)`,
+			`CREATE UNIQUE INDEX users_tenant_username ON users (tenant, username)`,
+			fmt.Sprintf(`CREATE TABLE api_keys (
+				id TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				name TEXT NOT NULL,
+				hash TEXT NOT NULL,
+				scopes TEXT NOT NULL,
+				expires_at %s,
+				created_at %s NOT NULL,
+				rotated_at %s,
+				last_used_at %s,
+				revoked_at %s,
+				version INTEGER NOT NULL DEFAULT 1
+			)`, d.timestampType, d.timestampType, d.timestampType, d.timestampType, d.timestampType),
+			`INSERT INTO api_keys SELECT * FROM api_keys_kept`,
+			`DROP TABLE api_keys_kept`,
+			`CREATE INDEX api_keys_user_id ON api_keys (user_id, created_at)`,
+		}
+	},
+}
+
+// migrate brings the schema up to date
+func (s *sqlStore) migrate(ctx context.Context) error {
+	setup := append([]string{}, s.dialect.setup...)
+	setup = append(setup, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	for _, statement := range setup {
+		if _, err := s.db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("migrating schema: %w", err)
+		}
+	}
+
+	var version int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return fmt.Errorf("migrating schema: %w", err)
+	}
+
+	for ; version < len(sqlMigrations); version++ {
+		err := s.WithTransaction(ctx, func(ctx context.Context, tx Store) error {
+			conn := tx.(*sqlStore).conn
+			for _, statement := range sqlMigrations[version](s.dialect) {
+				if _, err := conn.ExecContext(ctx, statement); err != nil {
+					return err
+				}
+			}
+			q := &sqlQuery{dialect: s.dialect}
+			_, err := conn.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ("+q.arg(version+1)+")", q.args...)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migrating schema to version %d: %w", version+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,996 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// tenantHeader names the zoo a request is for
+const tenantHeader = "X-Tenant-ID"
+
+// TenantStrategy decides how the data of the zoos is kept apart
+type TenantStrategy string
+
+const (
+	// TenantField keeps the zoos in one database and records the zoo of every record
+	TenantField TenantStrategy = "field"
+	// TenantDatabase gives every zoo a database of its own
+	TenantDatabase TenantStrategy = "database"
+)
+
+// TenancyConfig lists the zoos served by the deployment
+type TenancyConfig struct {
+	// Tenants are the IDs of the zoos, there is a single zoo without any
+	Tenants  []string
+	Strategy TenantStrategy
+	// Claim is the claim of tokens naming the zoo of their subject
+	Claim string
+}
+
+// tenantPattern matches the IDs of zoos, which also name their databases
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// errNoTenant is returned by the stores of several zoos when the context names none of them
+var errNoTenant = errors.New("no tenant given")
+
+// enabled reports whether the deployment serves several zoos
+func (t TenancyConfig) enabled() bool {
+	return len(t.Tenants) > 0
+}
+
+// known reports whether the tenant is one of the zoos
+func (t TenancyConfig) known(tenant string) bool {
+	return slices.Contains(t.Tenants, tenant)
+}
+
+// purgeTenants returns the tenants the trash is purged for, zoos sharing the database share
+// the trash as well
+func (t TenancyConfig) purgeTenants() []string {
+	switch {
+	case !t.enabled():
+		return []string{""}
+	case t.Strategy == TenantField:
+		return t.Tenants[:1]
+	default:
+		return t.Tenants
+	}
+}
+
+// loadTenancyConfig reads the zoos from the environment: TENANTS lists their IDs separated by
+// commas, TENANT_STRATEGY is field or database and TENANT_CLAIM the claim of tokens naming the
+// zoo of their subject
+func loadTenancyConfig() (TenancyConfig, error) {
+	tenancy := TenancyConfig{Strategy: TenantField, Claim: "tenant"}
+
+	if tenants := os.Getenv("TENANTS"); tenants != "" {
+		for _, tenant := range strings.Split(tenants, ",") {
+			tenant = strings.TrimSpace(tenant)
+			if !tenantPattern.MatchString(tenant) {
+				return tenancy, fmt.Errorf("TENANTS: invalid tenant %q, expected lowercase letters, digits, - and _", tenant)
+			}
+			if tenancy.known(tenant) {
+				return tenancy, fmt.Errorf("TENANTS: tenant %q is given more than once", tenant)
+			}
+			tenancy.Tenants = append(tenancy.Tenants, tenant)
+		}
+	}
+
+	switch strategy := TenantStrategy(os.Getenv("TENANT_STRATEGY")); strategy {
+	case "":
+	case TenantField, TenantDatabase:
+		tenancy.Strategy = strategy
+	default:
+		return tenancy, fmt.Errorf("TENANT_STRATEGY: unknown strategy %q", strategy)
+	}
+
+	if claim := os.Getenv("TENANT_CLAIM"); claim != "" {
+		tenancy.Claim = claim
+	}
+	return tenancy, nil
+}
+
+// loadAPIKeyTenants reads the zoos the static API keys may act for from API_KEY_TENANTS, which
+// lists name:tenant pairs separated by commas, a name once for each of its zoos. With several
+// zoos every key needs at least one.
+func loadAPIKeyTenants(auth *AuthConfig, tenancy TenancyConfig) error {
+	pairs := os.Getenv("API_KEY_TENANTS")
+	if pairs != "" && !tenancy.enabled() {
+		return errors.New("API_KEY_TENANTS: only allowed with TENANTS")
+	}
+	if pairs != "" {
+		for _, pair := range strings.Split(pairs, ",") {
+			name, tenant, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok || name == "" || tenant == "" {
+				return errors.New("API_KEY_TENANTS: expected comma-separated name:tenant pairs")
+			}
+			if !tenancy.known(tenant) {
+				return fmt.Errorf("API_KEY_TENANTS: unknown tenant %q", tenant)
+			}
+			i := slices.IndexFunc(auth.APIKeys, func(key StaticAPIKey) bool { return key.Name == name })
+			if i < 0 {
+				return fmt.Errorf("API_KEY_TENANTS: no API key named %q", name)
+			}
+			auth.APIKeys[i].Tenants = append(auth.APIKeys[i].Tenants, tenant)
+		}
+	}
+
+	for _, key := range auth.APIKeys {
+		if tenancy.enabled() && len(key.Tenants) == 0 {
+			return fmt.Errorf("API_KEY_TENANTS: API key %s acts for no tenant", key.Name)
+		}
+	}
+	return nil
+}
+
+// claimTenant returns the zoo named by the claims of a token, which must be one of the zoos
+// when there are several
+func (t TenancyConfig) claimTenant(claims jwt.MapClaims) (string, error) {
+	if !t.enabled() {
+		return "", nil
+	}
+	tenant, _ := claims[t.Claim].(string)
+	if tenant == "" {
+		return "", fmt.Errorf("token has no %s claim", t.Claim)
+	}
+	if !t.known(tenant) {
+		return "", fmt.Errorf("unknown tenant %q", tenant)
+	}
+	return tenant, nil
+}
+
+// tenantKey is the key of the tenant in the context of a request
+type tenantKey struct{}
+
+// withTenant returns a context whose queries are scoped to the tenant
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// contextTenant returns the tenant the context is scoped to, empty when there is none
+func contextTenant(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// requestTenant scopes the request to the zoo named in the X-Tenant-ID header, which must be
+// one of the zoos. It returns the tenant, empty without the header.
+func (s *server) requestTenant(c *fiber.Ctx) (string, error) {
+	// The header is only valid during the request, the records written keep the tenant
+	tenant := strings.Clone(c.Get(tenantHeader))
+	if tenant == "" || !s.config.Tenancy.enabled() {
+		return "", nil
+	}
+	if !s.config.Tenancy.known(tenant) {
+		return "", newProblem(fiber.StatusBadRequest, "unknown_tenant", "Unknown tenant "+tenant)
+	}
+	c.SetUserContext(withTenant(c.UserContext(), tenant))
+	return tenant, nil
+}
+
+// scopeTenant scopes the request to the zoo of the principal, which must agree with the
+// X-Tenant-ID header. Static API keys act for the zoo in the header, which must be one of
+// theirs, and anonymous requests can't act for any zoo unless authentication is disabled.
+func (s *server) scopeTenant(c *fiber.Ctx, header string, principal *Principal) error {
+	if !s.config.Tenancy.enabled() {
+		return nil
+	}
+	tenant := header
+	switch {
+	case principal == nil:
+		if !s.config.Auth.Disabled {
+			return unauthorized(c, "unauthenticated", "Authentication required to act for a zoo, send an API key in X-API-Key, or a bearer token or basic credentials in Authorization", "")
+		}
+	case principal.Tenant != "":
+		if header != "" && header != principal.Tenant {
+			return newProblem(fiber.StatusForbidden, "tenant_mismatch", "Credentials belong to tenant "+principal.Tenant+", not "+header)
+		}
+		tenant = principal.Tenant
+	case header == "" && len(principal.Tenants) == 1:
+		tenant = principal.Tenants[0]
+	case header != "" && !slices.Contains(principal.Tenants, header):
+		return newProblem(fiber.StatusForbidden, "tenant_mismatch", "API key "+principal.Subject+" can't act for tenant "+header)
+	}
+	if tenant == "" {
+		return errNoTenant
+	}
+	c.SetUserContext(withTenant(c.UserContext(), tenant))
+	return nil
+}
+
+// openTenantStore opens the storage of the zoos. With several zoos the store scopes every query
+// to the tenant of its context, a single store keeps the records of every zoo with the field
+// strategy and every zoo gets a store of its own with the database strategy.
+func openTenantStore(ctx context.Context, tenancy TenancyConfig) (Store, error) {
+	if !tenancy.enabled() {
+		return openStore(ctx, "")
+	}
+
+	s := &tenantStore{stores: map[string]Store{}, shared: tenancy.Strategy == TenantField}
+	if s.shared {
+		store, err := openStore(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, tenant := range tenancy.Tenants {
+			s.stores[tenant] = store
+		}
+		return s, nil
+	}
+
+	for _, tenant := range tenancy.Tenants {
+		store, err := openStore(ctx, tenant)
+		if err != nil {
+			s.Close(ctx)
+			return nil, fmt.Errorf("tenant %s: %w", tenant, err)
+		}
+		s.stores[tenant] = store
+	}
+	return s, nil
+}
+
+// tenantStore sends the queries of a context to the store of its tenant. When the zoos share a
+// store the records are tagged with their tenant, which is checked on every read and write so
+// that another zoo's records look like they don't exist.
+type tenantStore struct {
+	stores map[string]Store
+	// shared tells whether the zoos share the stores, with the field strategy
+	shared bool
+}
+
+// scope returns the store of the context's tenant and the tenant its records are tagged with,
+// empty when the zoo has the store to itself
+func (s *tenantStore) scope(ctx context.Context) (Store, string, error) {
+	tenant := contextTenant(ctx)
+	store, ok := s.stores[tenant]
+	if !ok {
+		return nil, "", errNoTenant
+	}
+	if !s.shared {
+		return store, "", nil
+	}
+	return store, tenant, nil
+}
+
+func (s *tenantStore) Animals() AnimalRepository      { return tenantAnimals{s} }
+func (s *tenantStore) Species() SpeciesRepository     { return tenantSpecies{s} }
+func (s *tenantStore) Categories() CategoryRepository { return tenantCategories{s} }
+func (s *tenantStore) Audit() AuditRepository         { return tenantAudit{s} }
+func (s *tenantStore) Locations() LocationRepository  { return tenantLocations{s} }
+func (s *tenantStore) Geofences() GeofenceRepository  { return tenantGeofences{s} }
+func (s *tenantStore) Alerts() AlertRepository        { return tenantAlerts{s} }
+func (s *tenantStore) Users() UserRepository          { return tenantUsers{s} }
+func (s *tenantStore) APIKeys() APIKeyRepository      { return tenantAPIKeys{s} }
+
+func (s *tenantStore) WithTransaction(ctx context.Context, fn func(ctx context.Context, tx Store) error) error {
+	store, _, err := s.scope(ctx)
+	if err != nil {
+		return err
+	}
+	tenant := contextTenant(ctx)
+	return store.WithTransaction(ctx, func(ctx context.Context, tx Store) error {
+		return fn(ctx, &tenantStore{stores: map[string]Store{tenant: tx}, shared: s.shared})
+	})
+}
+
+// Transactional reports whether the stores of all the zoos support transactions
+func (s *tenantStore) Transactional() bool {
+	for _, store := range s.stores {
+		if !store.Transactional() {
+			return false
+		}
+	}
+	return true
+}
+
+// Close closes the store of every zoo, shared stores once
+func (s *tenantStore) Close(ctx context.Context) error {
+	var errs []error
+	closed := map[Store]bool{}
+	for _, store := range s.stores {
+		if !closed[store] {
+			closed[store] = true
+			errs = append(errs, store.Close(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// tenanted is implemented by the records tagged with their tenant
+type tenanted interface {
+	tenant() string
+}
+
+func (a Animal) tenant() string   { return a.Tenant }
+func (s Species) tenant() string  { return s.Tenant }
+func (c Category) tenant() string { return c.Tenant }
+func (g Geofence) tenant() string { return g.Tenant }
+func (a Alert) tenant() string    { return a.Tenant }
+func (u User) tenant() string     { return u.Tenant }
+
+// owned returns the record read with err, or ErrNotFound when the record belongs to another
+// tenant than scope. An empty scope owns every record.
+func owned[T tenanted](record T, err error, scope string) (T, error) {
+	if err == nil && scope != "" && record.tenant() != scope {
+		var zero T
+		return zero, ErrNotFound
+	}
+	return record, err
+}
+
+// ownedRecords keeps the records of the scope's tenant
+func ownedRecords[T tenanted](records []T, scope string) []T {
+	if scope == "" {
+		return records
+	}
+	return slices.DeleteFunc(records, func(record T) bool { return record.tenant() != scope })
+}
+
+// checkOwner returns ErrNotFound unless the stored record with the ID belongs to the scope's
+// tenant
+func checkOwner[T tenanted](ctx context.Context, scope string, get func(context.Context, primitive.ObjectID) (T, error), id primitive.ObjectID) error {
+	if scope == "" {
+		return nil
+	}
+	record, err := get(ctx, id)
+	_, err = owned(record, err, scope)
+	return err
+}
+
+// checkUnclaimed returns ErrNotFound when the ID a new record comes with is taken by another
+// tenant's record, which must look like it doesn't exist rather than conflict with the record
+func checkUnclaimed[T tenanted](ctx context.Context, scope string, get func(context.Context, primitive.ObjectID) (T, error), id primitive.ObjectID) error {
+	if scope == "" || id.IsZero() {
+		return nil
+	}
+	record, err := get(ctx, id)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return nil
+	case err != nil:
+		return err
+	case record.tenant() != scope:
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Animal repository
+
+type tenantAnimals struct {
+	store *tenantStore
+}
+
+func (r tenantAnimals) List(ctx context.Context, query AnimalQuery) ([]AnimalDetail, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query.Tenant = scope
+	return store.Animals().List(ctx, query)
+}
+
+func (r tenantAnimals) Count(ctx context.Context, query AnimalQuery) (int64, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return 0, err
+	}
+	query.Tenant = scope
+	return store.Animals().Count(ctx, query)
+}
+
+func (r tenantAnimals) GetDetail(ctx context.Context, id primitive.ObjectID) (*AnimalDetail, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOwner(ctx, scope, store.Animals().Get, id); err != nil {
+		return nil, err
+	}
+	return store.Animals().GetDetail(ctx, id)
+}
+
+func (r tenantAnimals) Get(ctx context.Context, id primitive.ObjectID) (*Animal, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	animal, err := store.Animals().Get(ctx, id)
+	return owned(animal, err, scope)
+}
+
+func (r tenantAnimals) ListBySpecies(ctx context.Context, speciesID primitive.ObjectID) ([]Animal, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	animals, err := store.Animals().ListBySpecies(ctx, speciesID)
+	return ownedRecords(animals, scope), err
+}
+
+func (r tenantAnimals) ListDeleted(ctx context.Context) ([]Animal, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	animals, err := store.Animals().ListDeleted(ctx)
+	return ownedRecords(animals, scope), err
+}
+
+func (r tenantAnimals) Create(ctx context.Context, animal *Animal) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkUnclaimed(ctx, scope, store.Animals().Get, animal.ID); err != nil {
+		return err
+	}
+	if scope != "" {
+		animal.Tenant = scope
+	}
+	return store.Animals().Create(ctx, animal)
+}
+
+func (r tenantAnimals) Update(ctx context.Context, animal *Animal) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(ctx, scope, store.Animals().Get, animal.ID); err != nil {
+		return err
+	}
+	if scope != "" {
+		animal.Tenant = scope
+	}
+	return store.Animals().Update(ctx, animal)
+}
+
+func (r tenantAnimals) Delete(ctx context.Context, id primitive.ObjectID) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(ctx, scope, store.Animals().Get, id); err != nil {
+		return err
+	}
+	return store.Animals().Delete(ctx, id)
+}
+
+// Purge empties the trash of every zoo sharing the store
+func (r tenantAnimals) Purge(ctx context.Context, before time.Time) (int64, error) {
+	store, _, err := r.store.scope(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return store.Animals().Purge(ctx, before)
+}
+
+// Species repository
+
+type tenantSpecies struct {
+	store *tenantStore
+}
+
+func (r tenantSpecies) List(ctx context.Context, query SpeciesQuery) ([]Species, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query.Tenant = scope
+	return store.Species().List(ctx, query)
+}
+
+func (r tenantSpecies) Count(ctx context.Context, query SpeciesQuery) (int64, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return 0, err
+	}
+	query.Tenant = scope
+	return store.Species().Count(ctx, query)
+}
+
+func (r tenantSpecies) Get(ctx context.Context, id primitive.ObjectID) (*Species, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	species, err := store.Species().Get(ctx, id)
+	return owned(species, err, scope)
+}
+
+func (r tenantSpecies) ListByCategory(ctx context.Context, categoryID primitive.ObjectID) ([]Species, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	species, err := store.Species().ListByCategory(ctx, categoryID)
+	return ownedRecords(species, scope), err
+}
+
+func (r tenantSpecies) ListDeleted(ctx context.Context) ([]Species, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	species, err := store.Species().ListDeleted(ctx)
+	return ownedRecords(species, scope), err
+}
+
+func (r tenantSpecies) Create(ctx context.Context, species *Species) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkUnclaimed(ctx, scope, store.Species().Get, species.ID); err != nil {
+		return err
+	}
+	if scope != "" {
+		species.Tenant = scope
+	}
+	return store.Species().Create(ctx, species)
+}
+
+func (r tenantSpecies) Update(ctx context.Context, species *Species) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(ctx, scope, store.Species().Get, species.ID); err != nil {
+		return err
+	}
+	if scope != "" {
+		species.Tenant = scope
+	}
+	return store.Species().Update(ctx, species)
+}
+
+func (r tenantSpecies) Delete(ctx context.Context, id primitive.ObjectID) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(ctx, scope, store.Species().Get, id); err != nil {
+		return err
+	}
+	return store.Species().Delete(ctx, id)
+}
+
+// Purge empties the trash of every zoo sharing the store
+func (r tenantSpecies) Purge(ctx context.Context, before time.Time) (int64, error) {
+	store, _, err := r.store.scope(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return store.Species().Purge(ctx, before)
+}
+
+// Category repository
+
+type tenantCategories struct {
+	store *tenantStore
+}
+
+func (r tenantCategories) List(ctx context.Context, query CategoryQuery) ([]Category, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query.Tenant = scope
+	return store.Categories().List(ctx, query)
+}
+
+func (r tenantCategories) Count(ctx context.Context, query CategoryQuery) (int64, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return 0, err
+	}
+	query.Tenant = scope
+	return store.Categories().Count(ctx, query)
+}
+
+func (r tenantCategories) Get(ctx context.Context, id primitive.ObjectID) (*Category, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	category, err := store.Categories().Get(ctx, id)
+	return owned(category, err, scope)
+}
+
+func (r tenantCategories) ListDeleted(ctx context.Context) ([]Category, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	categories, err := store.Categories().ListDeleted(ctx)
+	return ownedRecords(categories, scope), err
+}
+
+func (r tenantCategories) Create(ctx context.Context, category *Category) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkUnclaimed(ctx, scope, store.Categories().Get, category.ID); err != nil {
+		return err
+	}
+	if scope != "" {
+		category.Tenant = scope
+	}
+	return store.Categories().Create(ctx, category)
+}
+
+func (r tenantCategories) Update(ctx context.Context, category *Category) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(ctx, scope, store.Categories().Get, category.ID); err != nil {
+		return err
+	}
+	if scope != "" {
+		category.Tenant = scope
+	}
+	return store.Categories().Update(ctx, category)
+}
+
+func (r tenantCategories) Delete(ctx context.Context, id primitive.ObjectID) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(ctx, scope, store.Categories().Get, id); err != nil {
+		return err
+	}
+	return store.Categories().Delete(ctx, id)
+}
+
+// Purge empties the trash of every zoo sharing the store
+func (r tenantCategories) Purge(ctx context.Context, before time.Time) (int64, error) {
+	store, _, err := r.store.scope(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return store.Categories().Purge(ctx, before)
+}
+
+// Audit repository
+
+type tenantAudit struct {
+	store *tenantStore
+}
+
+func (r tenantAudit) Append(ctx context.Context, event *AuditEvent) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if scope != "" {
+		event.Tenant = scope
+	}
+	return store.Audit().Append(ctx, event)
+}
+
+func (r tenantAudit) List(ctx context.Context, query AuditQuery) ([]AuditEvent, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query.Tenant = scope
+	return store.Audit().List(ctx, query)
+}
+
+// Location repository, the fixes belong to the zoo of their animal
+
+type tenantLocations struct {
+	store *tenantStore
+}
+
+func (r tenantLocations) Append(ctx context.Context, fix *LocationFix) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(ctx, scope, store.Animals().Get, fix.AnimalID); err != nil {
+		return err
+	}
+	return store.Locations().Append(ctx, fix)
+}
+
+func (r tenantLocations) List(ctx context.Context, query TrackQuery) ([]LocationFix, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOwner(ctx, scope, store.Animals().Get, query.AnimalID); err != nil {
+		return nil, err
+	}
+	return store.Locations().List(ctx, query)
+}
+
+func (r tenantLocations) Latest(ctx context.Context, animalID primitive.ObjectID) (*LocationFix, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOwner(ctx, scope, store.Animals().Get, animalID); err != nil {
+		return nil, err
+	}
+	return store.Locations().Latest(ctx, animalID)
+}
+
+func (r tenantLocations) Purge(ctx context.Context) (int64, error) {
+	store, _, err := r.store.scope(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return store.Locations().Purge(ctx)
+}
+
+// Geofence repository
+
+type tenantGeofences struct {
+	store *tenantStore
+}
+
+func (r tenantGeofences) List(ctx context.Context) ([]Geofence, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	geofences, err := store.Geofences().List(ctx)
+	return ownedRecords(geofences, scope), err
+}
+
+func (r tenantGeofences) Get(ctx context.Context, id primitive.ObjectID) (*Geofence, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	geofence, err := store.Geofences().Get(ctx, id)
+	return owned(geofence, err, scope)
+}
+
+func (r tenantGeofences) Create(ctx context.Context, geofence *Geofence) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if scope != "" {
+		geofence.Tenant = scope
+	}
+	return store.Geofences().Create(ctx, geofence)
+}
+
+func (r tenantGeofences) Update(ctx context.Context, geofence *Geofence) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(ctx, scope, store.Geofences().Get, geofence.ID); err != nil {
+		return err
+	}
+	if scope != "" {
+		geofence.Tenant = scope
+	}
+	return store.Geofences().Update(ctx, geofence)
+}
+
+func (r tenantGeofences) Delete(ctx context.Context, id primitive.ObjectID) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(ctx, scope, store.Geofences().Get, id); err != nil {
+		return err
+	}
+	return store.Geofences().Delete(ctx, id)
+}
+
+// Alert repository
+
+type tenantAlerts struct {
+	store *tenantStore
+}
+
+func (r tenantAlerts) List(ctx context.Context, query AlertQuery) ([]Alert, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query.Tenant = scope
+	return store.Alerts().List(ctx, query)
+}
+
+func (r tenantAlerts) Get(ctx context.Context, id primitive.ObjectID) (*Alert, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	alert, err := store.Alerts().Get(ctx, id)
+	return owned(alert, err, scope)
+}
+
+func (r tenantAlerts) Create(ctx context.Context, alert *Alert) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if scope != "" {
+		alert.Tenant = scope
+	}
+	return store.Alerts().Create(ctx, alert)
+}
+
+func (r tenantAlerts) Update(ctx context.Context, alert *Alert) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(ctx, scope, store.Alerts().Get, alert.ID); err != nil {
+		return err
+	}
+	if scope != "" {
+		alert.Tenant = scope
+	}
+	return store.Alerts().Update(ctx, alert)
+}
+
+// User repository, usernames are unique across the zoos sharing a store
+
+type tenantUsers struct {
+	store *tenantStore
+}
+
+func (r tenantUsers) List(ctx context.Context) ([]User, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	users, err := store.Users().List(ctx)
+	return ownedRecords(users, scope), err
+}
+
+func (r tenantUsers) Get(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, err := store.Users().Get(ctx, id)
+	return owned(user, err, scope)
+}
+
+// GetByUsername looks the user up in the zoo of the context, whose users are tagged with the scope
+func (r tenantUsers) GetByUsername(ctx context.Context, _, username string) (*User, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return store.Users().GetByUsername(ctx, scope, username)
+}
+
+func (r tenantUsers) Create(ctx context.Context, user *User) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if scope != "" {
+		user.Tenant = scope
+	}
+	return store.Users().Create(ctx, user)
+}
+
+func (r tenantUsers) Update(ctx context.Context, user *User) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(ctx, scope, store.Users().Get, user.ID); err != nil {
+		return err
+	}
+	if scope != "" {
+		user.Tenant = scope
+	}
+	return store.Users().Update(ctx, user)
+}
+
+func (r tenantUsers) Delete(ctx context.Context, id primitive.ObjectID) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(ctx, scope, store.Users().Get, id); err != nil {
+		return err
+	}
+	return store.Users().Delete(ctx, id)
+}
+
+// API key repository, the keys belong to the zoo of their user
+
+type tenantAPIKeys struct {
+	store *tenantStore
+}
+
+// get returns the stored key when its user belongs to the scope's tenant
+func (r tenantAPIKeys) get(ctx context.Context, store Store, scope string, id primitive.ObjectID) (*APIKey, error) {
+	key, err := store.APIKeys().Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOwner(ctx, scope, store.Users().Get, key.UserID); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (r tenantAPIKeys) ListByUser(ctx context.Context, userID primitive.ObjectID) ([]APIKey, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOwner(ctx, scope, store.Users().Get, userID); err != nil {
+		return nil, err
+	}
+	return store.APIKeys().ListByUser(ctx, userID)
+}
+
+func (r tenantAPIKeys) Get(ctx context.Context, id primitive.ObjectID) (*APIKey, error) {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.get(ctx, store, scope, id)
+}
+
+func (r tenantAPIKeys) Create(ctx context.Context, key *APIKey) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(ctx, scope, store.Users().Get, key.UserID); err != nil {
+		return err
+	}
+	return store.APIKeys().Create(ctx, key)
+}
+
+func (r tenantAPIKeys) Update(ctx context.Context, key *APIKey) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := r.get(ctx, store, scope, key.ID); err != nil {
+		return err
+	}
+	return store.APIKeys().Update(ctx, key)
+}
+
+func (r tenantAPIKeys) Touch(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := r.get(ctx, store, scope, id); err != nil {
+		return err
+	}
+	return store.APIKeys().Touch(ctx, id, at)
+}
+
+func (r tenantAPIKeys) DeleteByUser(ctx context.Context, userID primitive.ObjectID) error {
+	store, scope, err := r.store.scope(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(ctx, scope, store.Users().Get, userID); err != nil {
+		return err
+	}
+	return store.APIKeys().DeleteByUser(ctx, userID)
+}
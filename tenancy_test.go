@@ -0,0 +1,148 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tenancyConfig is authConfig serving the zoos zoo-a and zoo-b, where testAPIKey acts for both
+// and zoo-a-key only for zoo-a
+func tenancyConfig(strategy TenantStrategy) Config {
+	config := authConfig()
+	config.Tenancy = TenancyConfig{Tenants: []string{"zoo-a", "zoo-b"}, Strategy: strategy, Claim: "tenant"}
+	config.Auth.APIKeys = []StaticAPIKey{
+		{Name: "ops", Key: testAPIKey, Roles: defaultAPIKeyRoles, Tenants: []string{"zoo-a", "zoo-b"}},
+		{Name: "zoo-a", Key: "zoo-a-key", Roles: defaultAPIKeyRoles, Tenants: []string{"zoo-a"}},
+	}
+	return config
+}
+
+// newTenantTestStore returns an empty store of the zoos of tenancyConfig, kept in memory
+func newTenantTestStore(strategy TenantStrategy) Store {
+	if strategy == TenantField {
+		store := newMemoryStore()
+		return &tenantStore{stores: map[string]Store{"zoo-a": store, "zoo-b": store}, shared: true}
+	}
+	return &tenantStore{stores: map[string]Store{"zoo-a": newMemoryStore(), "zoo-b": newMemoryStore()}}
+}
+
+// The records and users of a zoo don't exist for the others, whichever way the zoos are stored
+func TestTenantIsolation(t *testing.T) {
+	for _, strategy := range []TenantStrategy{TenantField, TenantDatabase} {
+		t.Run(string(strategy), func(t *testing.T) {
+			app := newApp(newServer(newTenantTestStore(strategy), tenancyConfig(strategy)))
+			inZoo := func(tenant string, headers ...string) []string {
+				return append([]string{tenantHeader, tenant}, headers...)
+			}
+			opsIn := func(tenant string) []string { return inZoo(tenant, "X-API-Key", testAPIKey) }
+			token := func(tenant string) []string {
+				claims := jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix(), "roles": "admin"}
+				if tenant != "" {
+					claims["tenant"] = tenant
+				}
+				return bearer(signToken(t, testSecret, claims))
+			}
+
+			const animal = `{"animal_name":"Leo","birthdate":"2020-01-02T00:00:00Z"}`
+			leo := "/api/animals/" + create(t, app, "/api/animals", animal, opsIn("zoo-a")...)
+			create(t, app, "/api/users", `{"username":"bob","password":"secret-a"}`, opsIn("zoo-a")...)
+			bobB := create(t, app, "/api/users", `{"username":"bob","password":"secret-b"}`, opsIn("zoo-b")...)
+
+			// Each zoo has its own stores with the database strategy, so upserting creates the animal in
+			// zoo-b instead of finding it taken
+			upsertInOtherZoo := fiber.StatusNotFound
+			if strategy == TenantDatabase {
+				upsertInOtherZoo = fiber.StatusCreated
+			}
+			tests := []struct {
+				name    string
+				method  string
+				path    string
+				body    string
+				headers []string
+				status  int
+				code    string
+			}{
+				{"get in the zoo", fiber.MethodGet, leo, "", opsIn("zoo-a"), fiber.StatusOK, ""},
+				{"get in another zoo", fiber.MethodGet, leo, "", opsIn("zoo-b"), fiber.StatusNotFound, "not_found"},
+				{"patch in another zoo", fiber.MethodPatch, leo, `{"animal_name":"Renamed"}`, opsIn("zoo-b"), fiber.StatusNotFound, "not_found"},
+				{"delete in another zoo", fiber.MethodDelete, leo, "", opsIn("zoo-b"), fiber.StatusNotFound, "not_found"},
+				{"history in another zoo", fiber.MethodGet, leo + "/history", "", opsIn("zoo-b"), fiber.StatusNotFound, "not_found"},
+				{"key of several zoos without a zoo", fiber.MethodGet, leo, "", []string{"X-API-Key", testAPIKey}, fiber.StatusBadRequest, "tenant_required"},
+				{"unknown zoo", fiber.MethodGet, leo, "", opsIn("zoo-c"), fiber.StatusBadRequest, "unknown_tenant"},
+				{"anonymous", fiber.MethodGet, "/api/animals", "", inZoo("zoo-a"), fiber.StatusUnauthorized, "unauthenticated"},
+				{"key of a single zoo", fiber.MethodGet, leo, "", []string{"X-API-Key", "zoo-a-key"}, fiber.StatusOK, ""},
+				{"key of another zoo", fiber.MethodGet, "/api/animals", "", inZoo("zoo-b", "X-API-Key", "zoo-a-key"), fiber.StatusForbidden, "tenant_mismatch"},
+				{"token of the zoo", fiber.MethodGet, leo, "", token("zoo-a"), fiber.StatusOK, ""},
+				{"token of another zoo", fiber.MethodGet, leo, "", inZoo("zoo-a", token("zoo-b")...), fiber.StatusForbidden, "tenant_mismatch"},
+				{"token of another zoo without a header", fiber.MethodGet, leo, "", token("zoo-b"), fiber.StatusNotFound, "not_found"},
+				{"token without a zoo", fiber.MethodGet, leo, "", token(""), fiber.StatusUnauthorized, "invalid_token"},
+				{"upsert in another zoo", fiber.MethodPut, leo + "?upsert=true", animal, opsIn("zoo-b"), upsertInOtherZoo, ""},
+				{"unchanged by the other zoo", fiber.MethodGet, leo, "", opsIn("zoo-a"), fiber.StatusOK, ""},
+				{"username taken in the zoo", fiber.MethodPost, "/api/users", `{"username":"bob","password":"secret-c"}`, opsIn("zoo-a"), fiber.StatusConflict, "username_taken"},
+				{"user of the zoo", fiber.MethodGet, "/api/users/" + bobB, "", inZoo("zoo-b", basic("bob", "secret-b")...), fiber.StatusOK, ""},
+				{"user of another zoo", fiber.MethodGet, "/api/users/" + bobB, "", inZoo("zoo-b", basic("bob", "secret-a")...), fiber.StatusUnauthorized, "invalid_credentials"},
+				{"user without a zoo", fiber.MethodGet, "/api/users/" + bobB, "", basic("bob", "secret-b"), fiber.StatusBadRequest, "tenant_required"},
+			}
+			for _, tt := range tests {
+				status, body := send(t, app, tt.method, tt.path, tt.body, tt.headers...)
+				if status != tt.status || (tt.code != "" && field(body, "code") != tt.code) {
+					t.Errorf("%s: got status %d and %v, want %d with code %q", tt.name, status, body, tt.status, tt.code)
+				}
+			}
+
+			_, listA := send(t, app, fiber.MethodGet, "/api/animals", "", opsIn("zoo-a")...)
+			_, users := send(t, app, fiber.MethodGet, "/api/users", "", opsIn("zoo-b")...)
+			if animals, _ := listA.([]any); len(animals) != 1 {
+				t.Errorf("animals of zoo-a: got %v, want Leo alone", listA)
+			}
+			if users, _ := users.([]any); len(users) != 1 || field(users[0], "_id") != bobB {
+				t.Errorf("users of zoo-b: got %v, want the bob of zoo-b alone", users)
+			}
+		})
+	}
+}
+
+func TestLoadAPIKeyTenants(t *testing.T) {
+	zoos := TenancyConfig{Tenants: []string{"zoo-a", "zoo-b"}, Strategy: TenantField}
+	tests := []struct {
+		name    string
+		pairs   string
+		tenancy TenancyConfig
+		// want lists the zoos of the keys ops and vet, err is part of the expected error
+		want [][]string
+		err  string
+	}{
+		{"single zoo", "", TenancyConfig{}, [][]string{nil, nil}, ""},
+		{"pairs", "ops:zoo-a, ops:zoo-b,vet:zoo-b", zoos, [][]string{{"zoo-a", "zoo-b"}, {"zoo-b"}}, ""},
+		{"pairs without zoos", "ops:zoo-a", TenancyConfig{}, nil, "only allowed with TENANTS"},
+		{"key without a zoo", "ops:zoo-a", zoos, nil, "API key vet acts for no tenant"},
+		{"no pairs", "", zoos, nil, "API key ops acts for no tenant"},
+		{"malformed pair", "ops:zoo-a,vet", zoos, nil, "expected comma-separated name:tenant pairs"},
+		{"unknown zoo", "ops:zoo-a,vet:zoo-c", zoos, nil, `unknown tenant "zoo-c"`},
+		{"unknown key", "ops:zoo-a,vet:zoo-b,cat:zoo-b", zoos, nil, `no API key named "cat"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("API_KEY_TENANTS", tt.pairs)
+			auth := AuthConfig{APIKeys: []StaticAPIKey{{Name: "ops", Key: "ops-key"}, {Name: "vet", Key: "vet-key"}}}
+			err := loadAPIKeyTenants(&auth, tt.tenancy)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("got error %v, want none", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("got error %v, want one containing %q", err, tt.err)
+			}
+			for i, want := range tt.want {
+				if got := auth.APIKeys[i].Tenants; !slices.Equal(got, want) {
+					t.Errorf("key %s: got zoos %v, want %v", auth.APIKeys[i].Name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxFixesPerRequest limits the number of location fixes posted at once
+const maxFixesPerRequest = 1000
+
+// LocationFix is a position an animal was seen at, as reported by its tracker
+type LocationFix struct {
+	ID         primitive.ObjectID `json:"_id" bson:"_id"`
+	AnimalID   primitive.ObjectID `json:"animal" bson:"animal"`
+	Location   Point              `json:"location" bson:"location" validate:"required"`
+	RecordedAt time.Time          `json:"recorded_at" bson:"recorded_at" validate:"required,notfuture"`
+}
+
+// LocationFixRequest is a location fix posted for an animal, the time defaults to when it is
+// received
+type LocationFixRequest struct {
+	Location   Point      `json:"location"`
+	RecordedAt *time.Time `json:"recorded_at,omitempty"`
+}
+
+// Record location fixes of an animal
+// @Summary Record location fixes of an animal
+// @Description Record where an animal was seen, one fix or an array of up to 1000. The location of the animal is moved to the newest fix unless a later one was recorded before, raising an alert for every geofence of the animal it lies outside of.
+// @Tags animals
+// @Accept json
+// @Produce json
+// @Param id path string true "Animal ID"
+// @Param fix body LocationFixRequest true "Location fix, or an array of them"
+// @Success 201 {array} LocationFix
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /animals/{id}/locations [post]
+func (s *server) addAnimalLocations(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return invalidID("Invalid ID")
+	}
+
+	fixes, batch, err := decodeLocationFixes(c, id)
+	if err != nil {
+		return err
+	}
+
+	err = s.auditedStore(c).WithTransaction(c.UserContext(), func(ctx context.Context, tx Store) error {
+		animal, err := live(tx.Animals().Get(ctx, id))
+		if err != nil {
+			return err
+		}
+		latest, err := tx.Locations().Latest(ctx, id)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		newest := fixes[0]
+		for _, fix := range fixes {
+			if err := tx.Locations().Append(ctx, fix); err != nil {
+				return err
+			}
+			if fix.RecordedAt.After(newest.RecordedAt) {
+				newest = fix
+			}
+		}
+
+		// Fixes can arrive out of order, an older one doesn't move the animal back
+		if latest != nil && newest.RecordedAt.Before(latest.RecordedAt) {
+			return nil
+		}
+		animal.Location = newest.Location
+		if err := tx.Animals().Update(ctx, animal); err != nil {
+			return err
+		}
+		return checkGeofences(ctx, tx, animal)
+	})
+	if err != nil {
+		return entityProblem(c, "Animal", err)
+	}
+
+	if !batch {
+		return c.Status(201).JSON(fixes[0])
+	}
+	return c.Status(201).JSON(fixes)
+}
+
+// writeAnimal creates or updates the animal. When that moves the animal the new location is
+// recorded as a fix, so the track also follows locations that are edited by hand, and checked
+// against the geofences of the animal. The location of an animal with a track is its latest fix
+// and can't be cleared.
+func (s *server) writeAnimal(c *fiber.Ctx, animal *Animal, create bool, previous Point) error {
+	return s.auditedStore(c).WithTransaction(c.UserContext(), func(ctx context.Context, tx Store) error {
+		if !create && animal.Location.IsZero() && !previous.IsZero() {
+			_, err := tx.Locations().Latest(ctx, animal.ID)
+			if err == nil {
+				return &ValidationError{Fields: []FieldError{{Field: "location", Code: "required",
+					Message: "can't be cleared once the animal has a track"}}}
+			}
+			if !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+
+		var err error
+		if create {
+			err = tx.Animals().Create(ctx, animal)
+		} else {
+			err = tx.Animals().Update(ctx, animal)
+		}
+		if err != nil || animal.Location.IsZero() ||
+			(animal.Location.Type == previous.Type && slices.Equal(animal.Location.Coordinates, previous.Coordinates)) {
+			return err
+		}
+		err = tx.Locations().Append(ctx, &LocationFix{
+			ID:         primitive.NewObjectID(),
+			AnimalID:   animal.ID,
+			Location:   animal.Location,
+			RecordedAt: time.Now().UTC().Truncate(time.Millisecond),
+		})
+		if err != nil {
+			return err
+		}
+		return checkGeofences(ctx, tx, animal)
+	})
+}
+
+// decodeLocationFixes reads the fix or the array of fixes in the request body and validates
+// them. batch tells whether the body was an array.
+func decodeLocationFixes(c *fiber.Ctx, animalID primitive.ObjectID) (fixes []*LocationFix, batch bool, err error) {
+	if !c.Is("json") {
+		return nil, false, newProblem(fiber.StatusBadRequest, "invalid_body", "Request body must be JSON")
+	}
+
+	raw := []json.RawMessage{c.Body()}
+	if body := bytes.TrimSpace(c.Body()); len(body) > 0 && body[0] == '[' {
+		batch = true
+		if err := json.Unmarshal(body, &raw); err != nil {
+			return nil, true, newProblem(fiber.StatusBadRequest, "invalid_body", "Request body must be a fix or an array of fixes")
+		}
+		if len(raw) == 0 || len(raw) > maxFixesPerRequest {
+			return nil, true, newProblem(fiber.StatusBadRequest, "invalid_body",
+				fmt.Sprintf("Post between 1 and %d fixes at once", maxFixesPerRequest))
+		}
+	}
+
+	// Times are kept to the millisecond like in MongoDB, whichever backend stores them
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	validationErr := &ValidationError{}
+	for i, data := range raw {
+		var request LocationFixRequest
+		if err := decodeJSONFields(data, &request); err != nil {
+			if batch {
+				err = fmt.Errorf("Fix %d: %w", i, err)
+			}
+			return nil, batch, newProblem(fiber.StatusBadRequest, "invalid_body", err.Error())
+		}
+
+		fix := &LocationFix{ID: primitive.NewObjectID(), AnimalID: animalID, Location: request.Location, RecordedAt: now}
+		if request.RecordedAt != nil {
+			fix.RecordedAt = request.RecordedAt.UTC().Truncate(time.Millisecond)
+		}
+		var fieldsErr *ValidationError
+		if err := validateRecord(fix); errors.As(err, &fieldsErr) {
+			for _, field := range fieldsErr.Fields {
+				if batch {
+					field.Field = fmt.Sprintf("%d.%s", i, field.Field)
+				}
+				validationErr.Fields = append(validationErr.Fields, field)
+			}
+		} else if err != nil {
+			return nil, batch, err
+		}
+		fixes = append(fixes, fix)
+	}
+	if len(validationErr.Fields) > 0 {
+		return nil, batch, validationErr
+	}
+	return fixes, batch, nil
+}
+
+// Get the track of an animal
+// @Summary Get the track of an animal
+// @Description Get the location fixes of an animal, oldest first, a page at a time. The next page is linked in the Link header. With Accept: application/geo+json the page is a GeoJSON Feature whose geometry is a LineString through the fixes (a Point for a single fix, null without fixes) and whose recorded_at property lists their times.
+// @Tags animals
+// @Accept json
+// @Produce json,application/geo+json
+// @Param id path string true "Animal ID"
+// @Param from query string false "Only fixes at or after this time (RFC 3339)"
+// @Param to query string false "Only fixes before this time (RFC 3339)"
+// @Param limit query int false "Limit" default(10)
+// @Param cursor query string false "Cursor from the Link header"
+// @Success 200 {array} LocationFix
+// @Header 200 {string} Link "Link to the next page"
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /animals/{id}/track [get]
+func (s *server) getAnimalTrack(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return invalidID("Invalid ID")
+	}
+
+	query := TrackQuery{AnimalID: id}
+	if from := c.Query("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return invalidParameter("Invalid from time")
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return invalidParameter("Invalid to time")
+		}
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && !query.From.Before(query.To) {
+		return invalidParameter("from must be before to")
+	}
+	size, err := s.pageSize(c)
+	if err != nil {
+		return err
+	}
+	// One more fix is read to tell whether there is a next page
+	query.Limit = size + 1
+	if token := c.Query("cursor"); token != "" {
+		if query.After, err = decodeTrackCursor(token); err != nil {
+			return err
+		}
+	}
+
+	// The track outlives a move to the trash, like the history
+	if _, err := s.store.Animals().Get(c.UserContext(), id); err != nil {
+		return entityProblem(c, "Animal", err)
+	}
+	fixes, err := s.store.Locations().List(c.UserContext(), query)
+	if err != nil {
+		return err
+	}
+	if int64(len(fixes)) > size {
+		fixes = fixes[:size]
+		link, err := pageLink(c, page{}, fixes[len(fixes)-1], false, "recorded_at")
+		if err != nil {
+			return err
+		}
+		c.Set(fiber.HeaderLink, link+`; rel="next"`)
+	}
+
+	c.Vary(fiber.HeaderAccept)
+	if wantsGeoJSON(c) {
+		return c.JSON(newTrackFeature(id, fixes), mimeGeoJSON)
+	}
+	return c.JSON(fixes)
+}
+
+// decodeTrackCursor reads the cursor of a track page, which points at the last fix of the page
+// before it by its time and ID
+func decodeTrackCursor(token string) (*LocationFix, error) {
+	cursor, err := decodeCursor(token, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(cursor.Values) == 1 && !cursor.Before {
+		if recordedAt, ok := cursor.Values[0].(primitive.DateTime); ok {
+			return &LocationFix{ID: cursor.ID, RecordedAt: recordedAt.Time().UTC()}, nil
+		}
+	}
+	return nil, newProblem(fiber.StatusBadRequest, "invalid_cursor", "Invalid cursor, start again from the first page")
+}
+
+// newTrackFeature turns the fixes of an animal into a GeoJSON feature along its path
+func newTrackFeature(animalID primitive.ObjectID, fixes []LocationFix) Feature {
+	feature := Feature{Type: "Feature", ID: animalID.Hex()}
+	positions := make([][]float64, len(fixes))
+	times := make([]time.Time, len(fixes))
+	for i, fix := range fixes {
+		positions[i] = fix.Location.Coordinates
+		times[i] = fix.RecordedAt
+	}
+
+	switch len(fixes) {
+	case 0:
+	case 1:
+		feature.Geometry = &Geometry{Type: "Point", Coordinates: positions[0]}
+	default:
+		feature.Geometry = &Geometry{Type: "LineString", Coordinates: positions}
+	}
+	feature.Properties = map[string]interface{}{"recorded_at": times}
+	return feature
+}
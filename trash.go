@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Trash lists the records waiting to be purged
+type Trash struct {
+	Animals    []Animal   `json:"animals"`
+	Species    []Species  `json:"species"`
+	Categories []Category `json:"categories"`
+}
+
+// live passes through the result of a Get, treating records in the trash as not found
+func live[T trashable](record *T, err error) (*T, error) {
+	if err != nil {
+		return nil, err
+	}
+	if (*record).deletion().IsDeleted() {
+		return nil, ErrNotFound
+	}
+	return record, nil
+}
+
+// requestActor names whoever made the request: the authenticated principal, or the X-Actor
+// header when authentication is disabled. Clients can't name themselves otherwise.
+func (s *server) requestActor(c *fiber.Ctx) string {
+	if principal := requestPrincipal(c); principal != nil {
+		return principal.Subject
+	}
+	if actor := c.Get("X-Actor"); actor != "" && s.config.Auth.Disabled {
+		// Fiber reuses the request buffers, the actor outlives the request
+		return strings.Clone(actor)
+	}
+	return "anonymous"
+}
+
+// Get the trash
+// @Summary Get the trash
+// @Description Get the deleted animals, species and categories that haven't been purged yet
+// @Tags trash
+// @Accept json
+// @Produce json
+// @Success 200 {object} Trash
+// @Failure 500 {object} Problem
+// @Router /trash [get]
+func (s *server) getTrash(c *fiber.Ctx) error {
+	var trash Trash
+	var err error
+
+	ctx := c.UserContext()
+	if trash.Animals, err = s.store.Animals().ListDeleted(ctx); err == nil {
+		if trash.Species, err = s.store.Species().ListDeleted(ctx); err == nil {
+			trash.Categories, err = s.store.Categories().ListDeleted(ctx)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(trash)
+}
+
+// Restore an animal
+// @Summary Restore an animal
+// @Description Take an animal out of the trash. Its species has to be restored first.
+// @Tags animals
+// @Accept json
+// @Produce json
+// @Param id path string true "Animal ID"
+// @Success 200 {object} Animal
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /animals/{id}/restore [post]
+func (s *server) restoreAnimal(c *fiber.Ctx) error {
+	id := c.Params("id")
+	ObjectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return invalidID("Invalid ID")
+	}
+
+	animal, err := s.store.Animals().Get(c.UserContext(), ObjectID)
+	if err == nil && !animal.IsDeleted() {
+		err = errNotInTrash
+	}
+	if err == nil {
+		err = s.checkSpeciesReference(c.UserContext(), animal.Species)
+	}
+	if err == nil {
+		animal.Deletion = Deletion{}
+		err = s.auditedStore(c).Animals().Update(c.UserContext(), animal)
+	}
+	if err != nil {
+		return restoreProblem(c, "Animal", err)
+	}
+
+	return c.JSON(animal)
+}
+
+// Restore a species
+// @Summary Restore a species
+// @Description Take a species out of the trash. Its category has to be restored first, its animals are restored separately.
+// @Tags species
+// @Accept json
+// @Produce json
+// @Param id path string true "Species ID"
+// @Success 200 {object} Species
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /species/{id}/restore [post]
+func (s *server) restoreSpecies(c *fiber.Ctx) error {
+	id := c.Params("id")
+	ObjectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return invalidID("Invalid ID")
+	}
+
+	specie, err := s.store.Species().Get(c.UserContext(), ObjectID)
+	if err == nil && !specie.IsDeleted() {
+		err = errNotInTrash
+	}
+	if err == nil {
+		err = s.checkCategoryReference(c.UserContext(), specie.Category)
+	}
+	if err == nil {
+		specie.Deletion = Deletion{}
+		err = s.auditedStore(c).Species().Update(c.UserContext(), specie)
+	}
+	if err != nil {
+		return restoreProblem(c, "Species", err)
+	}
+
+	return c.JSON(specie)
+}
+
+// Restore a category
+// @Summary Restore a category
+// @Description Take a category out of the trash, its species are restored separately
+// @Tags categories
+// @Accept json
+// @Produce json
+// @Param id path string true "Category ID"
+// @Success 200 {object} Category
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /categories/{id}/restore [post]
+func (s *server) restoreCategory(c *fiber.Ctx) error {
+	id := c.Params("id")
+	ObjectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return invalidID("Invalid ID")
+	}
+
+	category, err := s.store.Categories().Get(c.UserContext(), ObjectID)
+	if err == nil && !category.IsDeleted() {
+		err = errNotInTrash
+	}
+	if err == nil {
+		category.Deletion = Deletion{}
+		err = s.auditedStore(c).Categories().Update(c.UserContext(), category)
+	}
+	if err != nil {
+		return restoreProblem(c, "Category", err)
+	}
+
+	return c.JSON(category)
+}
+
+// errNotInTrash is returned when restoring a record that isn't deleted
+var errNotInTrash = errors.New("not in the trash")
+
+// restoreProblem names the entity in the problem of a failed restore
+func restoreProblem(c *fiber.Ctx, name string, err error) error {
+	if errors.Is(err, errNotInTrash) {
+		return newProblem(fiber.StatusConflict, "not_in_trash", name+" is not in the trash")
+	}
+	return entityProblem(c, name, err)
+}
+
+// purgeTrash permanently removes the records that have been in the trash longer than the
+// retention period, children first so nothing is left pointing at a purged record. The location
+// fixes of animals that are gone go with them.
+func (s *server) purgeTrash(ctx context.Context) error {
+	before := time.Now().Add(-s.config.TrashRetention)
+
+	animals, err := s.store.Animals().Purge(ctx, before)
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.Locations().Purge(ctx); err != nil {
+		return err
+	}
+	species, err := s.store.Species().Purge(ctx, before)
+	if err != nil {
+		return err
+	}
+	categories, err := s.store.Categories().Purge(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	if animals+species+categories > 0 {
+		log.Printf("Purged %d animals, %d species and %d categories from the trash", animals, species, categories)
+	}
+	return nil
+}
+
+// runPurgeJob purges the trash every purge interval until the context is cancelled
+func (s *server) runPurgeJob(ctx context.Context) {
+	ticker := time.NewTicker(s.config.TrashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, tenant := range s.config.Tenancy.purgeTenants() {
+			if err := s.purgeTrash(withTenant(ctx, tenant)); err != nil {
+				log.Printf("Error purging trash: %v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
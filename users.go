@@ -0,0 +1,708 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// apiKeyPrefix starts the keys issued to users, the ID of the key and its secret follow
+const apiKeyPrefix = "zk_"
+
+// apiKeyTouchInterval is how stale the last use of a key can get before it is recorded again,
+// so busy keys don't write on every request
+const apiKeyTouchInterval = time.Minute
+
+// User is an account that signs in with its password or with its API keys
+type User struct {
+	ID           primitive.ObjectID `json:"_id" bson:"_id"`
+	Username     string             `json:"username" bson:"username"`
+	PasswordHash string             `json:"-" bson:"password_hash"`
+	// Roles are the roles of the policy the user has
+	Roles     []string  `json:"roles" bson:"roles"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	Version   int64     `json:"version" bson:"version"`
+	Tenant    string    `json:"-" bson:"tenant,omitempty"`
+}
+
+// UserRequest creates a user. Usernames can't contain colons, which separate them from the
+// password in basic credentials, and bcrypt only reads the first 72 bytes of passwords.
+type UserRequest struct {
+	Username string   `json:"username" validate:"notblank,max=64,excludes=:"`
+	Password string   `json:"password" validate:"min=8,max=72"`
+	Roles    []string `json:"roles"`
+}
+
+// PasswordRequest changes the password of a user, users changing their own password must also
+// send the current one
+type PasswordRequest struct {
+	CurrentPassword string `json:"current_password,omitempty"`
+	Password        string `json:"password" validate:"min=8,max=72"`
+}
+
+// RolesRequest replaces the roles of a user
+type RolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+// APIKey is a key a user authenticates with. Only a hash of its secret is stored, the key itself
+// is shown once when it is issued or rotated.
+type APIKey struct {
+	ID     primitive.ObjectID `json:"_id" bson:"_id"`
+	UserID primitive.ObjectID `json:"user" bson:"user"`
+	Name   string             `json:"name" bson:"name"`
+	Hash   string             `json:"-" bson:"hash"`
+	// Scopes limit the key to some of the permissions of its user, it has all of them without
+	Scopes     []string   `json:"scopes" bson:"scopes" example:"animals:read"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at" bson:"created_at"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty" bson:"rotated_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+	Version    int64      `json:"version" bson:"version"`
+}
+
+// inactive tells why the key can't be used at the given time, "" when it can
+func (k APIKey) inactive(now time.Time) string {
+	switch {
+	case k.RevokedAt != nil:
+		return "revoked"
+	case k.ExpiresAt != nil && !now.Before(*k.ExpiresAt):
+		return "expired"
+	default:
+		return ""
+	}
+}
+
+// APIKeyRequest issues an API key
+type APIKeyRequest struct {
+	Name      string     `json:"name" validate:"notblank"`
+	Scopes    []string   `json:"scopes" validate:"dive,permission"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" validate:"omitempty,future"`
+}
+
+// IssuedAPIKey is an API key along with the key itself, which isn't shown again
+type IssuedAPIKey struct {
+	APIKey
+	Key string `json:"key" example:"zk_66a0f1c2e4b0a1b2c3d4e5f6_..."`
+}
+
+// newAPIKeySecret generates the secret of a key and the hash that is stored
+func newAPIKeySecret() (secret, hash string, err error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", "", err
+	}
+	secret = base64.RawURLEncoding.EncodeToString(data)
+	return secret, hashAPIKeySecret(secret), nil
+}
+
+// hashAPIKeySecret hashes the secret of a key, the secrets are random so a plain hash is enough
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// formatAPIKey builds the key handed to the user from its ID and secret
+func formatAPIKey(id primitive.ObjectID, secret string) string {
+	return apiKeyPrefix + id.Hex() + "_" + secret
+}
+
+// parseAPIKey splits a key issued to a user into its ID and secret, ok is false for the static
+// keys of the configuration
+func parseAPIKey(key string) (id primitive.ObjectID, secret string, ok bool) {
+	rest, found := strings.CutPrefix(key, apiKeyPrefix)
+	if !found || len(rest) < 26 || rest[24] != '_' {
+		return primitive.NilObjectID, "", false
+	}
+	id, err := primitive.ObjectIDFromHex(rest[:24])
+	if err != nil {
+		return primitive.NilObjectID, "", false
+	}
+	return id, rest[25:], true
+}
+
+// authenticateKey checks an API key issued to a user and records its use
+func (s *server) authenticateKey(c *fiber.Ctx, id primitive.ObjectID, secret string) (*Principal, error) {
+	ctx := c.UserContext()
+	key, err := s.store.APIKeys().Get(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, unauthorized(c, "invalid_api_key", "Invalid API key", "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(secret)), []byte(key.Hash)) != 1 {
+		return nil, unauthorized(c, "invalid_api_key", "Invalid API key", "")
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if reason := key.inactive(now); reason != "" {
+		return nil, unauthorized(c, "invalid_api_key", "API key is "+reason, "")
+	}
+
+	user, err := s.store.Users().Get(ctx, key.UserID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, unauthorized(c, "invalid_api_key", "Invalid API key", "")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		// Failing to record the use shouldn't fail the request
+		if err := s.store.APIKeys().Touch(ctx, key.ID, now); err != nil {
+			log.Printf("recording the use of API key %s: %v", key.ID.Hex(), err)
+		}
+	}
+	return &Principal{Subject: user.Username, UserID: user.ID, Method: "api_key", Roles: user.Roles, Scopes: key.Scopes,
+		Tenant: contextTenant(ctx)}, nil
+}
+
+// dummyPasswordHash is compared against for unknown usernames, so they take as long to reject as
+// wrong passwords
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// authenticatePassword checks the basic credentials of a user (RFC 7617)
+func (s *server) authenticatePassword(c *fiber.Ctx, credentials string) (*Principal, error) {
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return nil, unauthorized(c, "invalid_credentials", "Basic credentials must be base64 encoded", "")
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return nil, unauthorized(c, "invalid_credentials", "Basic credentials must be a username and a password", "")
+	}
+
+	user, err := s.store.Users().GetByUsername(c.UserContext(), contextTenant(c.UserContext()), username)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	hash := dummyPasswordHash
+	if user != nil {
+		hash = []byte(user.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || user == nil {
+		return nil, unauthorized(c, "invalid_credentials", "Invalid username or password", "")
+	}
+	return &Principal{Subject: user.Username, UserID: user.ID, Method: "password", Roles: user.Roles,
+		Tenant: contextTenant(c.UserContext())}, nil
+}
+
+// hashPassword hashes a password with bcrypt, which rejects passwords longer than 72 bytes even
+// when they have fewer characters
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return "", &ValidationError{Fields: []FieldError{{Field: "password", Code: "too_long", Message: "must be at most 72 bytes long"}}}
+	}
+	return string(hash), err
+}
+
+// checkRoles verifies that the roles are defined by the policy and keeps each of them once.
+// Callers can only hand out roles whose permissions they hold themselves.
+func (s *server) checkRoles(c *fiber.Ctx, roles []string) ([]string, error) {
+	checked := []string{}
+	validationErr := &ValidationError{}
+	for i, role := range roles {
+		if _, ok := s.config.Policy.Roles[role]; !ok {
+			validationErr.Fields = append(validationErr.Fields, FieldError{
+				Field:   fmt.Sprintf("roles[%d]", i),
+				Code:    "invalid_value",
+				Message: "must be a role of the policy",
+			})
+		} else if !slices.Contains(checked, role) {
+			checked = append(checked, role)
+		}
+	}
+	if len(validationErr.Fields) > 0 {
+		return nil, validationErr
+	}
+
+	principal := requestPrincipal(c)
+	if principal == nil {
+		return checked, nil
+	}
+	held := s.config.Policy.permissions(principal)
+	for _, role := range checked {
+		for _, permission := range s.config.Policy.Roles[role] {
+			if !grants(held, permission) || (len(principal.Scopes) > 0 && !grants(principal.Scopes, permission)) {
+				p := newProblem(fiber.StatusForbidden, "role_not_grantable", "Role "+role+" has permission "+permission+", which you don't hold")
+				p.Extensions = fiber.Map{"role": role, "permission": permission}
+				return nil, p
+			}
+		}
+	}
+	return checked, nil
+}
+
+// User handlers
+// Get all users
+// @Summary Get all users
+// @Description Get every user, sorted by username
+// @Tags users
+// @Accept json
+// @Produce json
+// @Success 200 {array} User
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /users [get]
+func (s *server) getUsers(c *fiber.Ctx) error {
+	users, err := s.store.Users().List(c.UserContext())
+	if err != nil {
+		return err
+	}
+	return c.JSON(users)
+}
+
+// Get a user by ID
+// @Summary Get a user by ID
+// @Description Get a user by its ID, users can always get their own account
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {object} User
+// @Header 200 {string} ETag "Version of the user"
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /users/{id} [get]
+func (s *server) getUserByID(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return invalidID("Invalid ID")
+	}
+
+	user, err := s.store.Users().Get(c.UserContext(), id)
+	if err != nil {
+		return entityProblem(c, "User", err)
+	}
+
+	c.Set(fiber.HeaderETag, etag(user.Version))
+	return c.JSON(user)
+}
+
+// Create a user
+// @Summary Create a new user
+// @Description Create a user who signs in with basic credentials or with the API keys issued to them. The password is stored as a bcrypt hash and the roles must be defined by the policy, granting only permissions the caller holds.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param user body UserRequest true "User"
+// @Success 201 {object} User
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /users [post]
+func (s *server) createUser(c *fiber.Ctx) error {
+	var request UserRequest
+	if err := decodeJSONBody(c, &request); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid_body", err.Error())
+	}
+	request.Username = strings.TrimSpace(request.Username)
+	if err := validateRecord(request); err != nil {
+		return err
+	}
+	roles, err := s.checkRoles(c, request.Roles)
+	if err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(request.Password)
+	if err != nil {
+		return err
+	}
+	user := &User{
+		ID:           primitive.NewObjectID(),
+		Username:     request.Username,
+		PasswordHash: hash,
+		Roles:        roles,
+		CreatedAt:    time.Now().UTC().Truncate(time.Millisecond),
+	}
+	if err := s.store.Users().Create(c.UserContext(), user); err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderETag, etag(user.Version))
+	return c.Status(201).JSON(user)
+}
+
+// Replace the roles of a user
+// @Summary Replace the roles of a user
+// @Description Replace the roles of a user, they must be defined by the policy and grant only permissions the caller holds
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Param If-Match header string false "ETag the user must still have"
+// @Param roles body RolesRequest true "Roles"
+// @Success 200 {object} User
+// @Header 200 {string} ETag "New version of the user"
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 412 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /users/{id}/roles [put]
+func (s *server) replaceUserRoles(c *fiber.Ctx) error {
+	var request RolesRequest
+	if err := decodeJSONBody(c, &request); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid_body", err.Error())
+	}
+	roles, err := s.checkRoles(c, request.Roles)
+	if err != nil {
+		return err
+	}
+
+	user, err := s.changeUser(c, func(user *User) error {
+		user.Roles = roles
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(user)
+}
+
+// Change the password of a user
+// @Summary Change the password of a user
+// @Description Replace the password of a user. Users can change their own password, sending the current one along. The API keys of the user stay valid.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Param password body PasswordRequest true "New password"
+// @Success 200 {object} Response
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /users/{id}/password [put]
+func (s *server) changePassword(c *fiber.Ctx) error {
+	var request PasswordRequest
+	if err := decodeJSONBody(c, &request); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid_body", err.Error())
+	}
+	if err := validateRecord(request); err != nil {
+		return err
+	}
+	hash, err := hashPassword(request.Password)
+	if err != nil {
+		return err
+	}
+
+	principal := requestPrincipal(c)
+	_, err = s.changeUser(c, func(user *User) error {
+		if principal != nil && principal.UserID == user.ID &&
+			bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(request.CurrentPassword)) != nil {
+			return newProblem(fiber.StatusForbidden, "wrong_password", "current_password doesn't match the password of the user")
+		}
+		user.PasswordHash = hash
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"message": "Password changed successfully"})
+}
+
+// changeUser applies change to the user named by the id path parameter and stores it
+func (s *server) changeUser(c *fiber.Ctx, change func(user *User) error) (*User, error) {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return nil, invalidID("Invalid ID")
+	}
+
+	user, err := s.store.Users().Get(c.UserContext(), id)
+	if err != nil {
+		return nil, entityProblem(c, "User", err)
+	}
+	if err := checkIfMatch(c, user.Version); err != nil {
+		return nil, preconditionFailed("User")
+	}
+	if err := change(user); err != nil {
+		return nil, err
+	}
+	if err := s.store.Users().Update(c.UserContext(), user); err != nil {
+		return nil, entityProblem(c, "User", err)
+	}
+
+	c.Set(fiber.HeaderETag, etag(user.Version))
+	return user, nil
+}
+
+// Delete a user
+// @Summary Delete a user
+// @Description Permanently delete a user along with their API keys
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {object} Response
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /users/{id} [delete]
+func (s *server) deleteUser(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return invalidID("Invalid ID")
+	}
+
+	err = s.store.WithTransaction(c.UserContext(), func(ctx context.Context, tx Store) error {
+		if err := tx.APIKeys().DeleteByUser(ctx, id); err != nil {
+			return err
+		}
+		return tx.Users().Delete(ctx, id)
+	})
+	if err != nil {
+		return entityProblem(c, "User", err)
+	}
+	return c.JSON(fiber.Map{"message": "User deleted successfully"})
+}
+
+// API key handlers
+// Get the API keys of a user
+// @Summary Get the API keys of a user
+// @Description Get the API keys issued to a user, oldest first, including the revoked and expired ones. Users can always list their own keys.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {array} APIKey
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /users/{id}/keys [get]
+func (s *server) getAPIKeys(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return invalidID("Invalid ID")
+	}
+
+	if _, err := s.store.Users().Get(c.UserContext(), id); err != nil {
+		return entityProblem(c, "User", err)
+	}
+	keys, err := s.store.APIKeys().ListByUser(c.UserContext(), id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(keys)
+}
+
+// Issue an API key
+// @Summary Issue an API key to a user
+// @Description Issue an API key to a user, sent in the X-API-Key header. The key is only shown in this response. Scopes limit the key to some of the permissions of the user, a key without scopes has all of them. Users can issue keys to themselves.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Param key body APIKeyRequest true "API key"
+// @Success 201 {object} IssuedAPIKey
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /users/{id}/keys [post]
+func (s *server) createAPIKey(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return invalidID("Invalid ID")
+	}
+
+	var request APIKeyRequest
+	if err := decodeJSONBody(c, &request); err != nil {
+		return newProblem(fiber.StatusBadRequest, "invalid_body", err.Error())
+	}
+	if err := validateRecord(request); err != nil {
+		return err
+	}
+
+	if _, err := s.store.Users().Get(c.UserContext(), id); err != nil {
+		return entityProblem(c, "User", err)
+	}
+	secret, hash, err := newAPIKeySecret()
+	if err != nil {
+		return err
+	}
+	key := &APIKey{
+		ID:        primitive.NewObjectID(),
+		UserID:    id,
+		Name:      strings.TrimSpace(request.Name),
+		Hash:      hash,
+		Scopes:    compactStrings(request.Scopes),
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	if request.ExpiresAt != nil {
+		expiresAt := request.ExpiresAt.UTC().Truncate(time.Millisecond)
+		key.ExpiresAt = &expiresAt
+	}
+	if err := s.store.APIKeys().Create(c.UserContext(), key); err != nil {
+		return err
+	}
+	return c.Status(201).JSON(IssuedAPIKey{APIKey: *key, Key: formatAPIKey(key.ID, secret)})
+}
+
+// Rotate an API key
+// @Summary Rotate an API key
+// @Description Replace the secret of an API key, the previous key stops working at once. The name, scopes and expiry are kept and the new key is only shown in this response.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Param key path string true "API key ID"
+// @Success 200 {object} IssuedAPIKey
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /users/{id}/keys/{key}/rotate [post]
+func (s *server) rotateAPIKey(c *fiber.Ctx) error {
+	var secret string
+	key, err := s.changeAPIKey(c, func(key *APIKey, now time.Time) error {
+		if reason := key.inactive(now); reason != "" {
+			return newProblem(fiber.StatusConflict, "key_inactive", "The API key is "+reason+" and can't be rotated")
+		}
+		var err error
+		if secret, key.Hash, err = newAPIKeySecret(); err != nil {
+			return err
+		}
+		key.RotatedAt = &now
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(IssuedAPIKey{APIKey: *key, Key: formatAPIKey(key.ID, secret)})
+}
+
+// Revoke an API key
+// @Summary Revoke an API key
+// @Description Revoke an API key, it stops working at once and stays listed with the time it was revoked
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Param key path string true "API key ID"
+// @Success 200 {object} APIKey
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 500 {object} Problem
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Security BasicAuth
+// @Router /users/{id}/keys/{key} [delete]
+func (s *server) revokeAPIKey(c *fiber.Ctx) error {
+	key, err := s.changeAPIKey(c, func(key *APIKey, now time.Time) error {
+		if key.RevokedAt == nil {
+			key.RevokedAt = &now
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(key)
+}
+
+// changeAPIKey applies change to the key named by the key path parameter, which must belong to
+// the user named by the id parameter, and stores it
+func (s *server) changeAPIKey(c *fiber.Ctx, change func(key *APIKey, now time.Time) error) (*APIKey, error) {
+	userID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return nil, invalidID("Invalid ID")
+	}
+	id, err := primitive.ObjectIDFromHex(c.Params("key"))
+	if err != nil {
+		return nil, invalidID("Invalid API key ID")
+	}
+
+	key, err := s.store.APIKeys().Get(c.UserContext(), id)
+	if err == nil && key.UserID != userID {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return nil, entityProblem(c, "API key", err)
+	}
+
+	if err := change(key, time.Now().UTC().Truncate(time.Millisecond)); err != nil {
+		return nil, err
+	}
+	if err := s.store.APIKeys().Update(c.UserContext(), key); err != nil {
+		return nil, entityProblem(c, "API key", err)
+	}
+	return key, nil
+}
+
+// compactStrings drops repeated strings, keeping the first of each, and never returns nil
+func compactStrings(values []string) []string {
+	compacted := []string{}
+	for _, value := range values {
+		if !slices.Contains(compacted, value) {
+			compacted = append(compacted, value)
+		}
+	}
+	return compacted
+}
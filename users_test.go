@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// usersConfig is authConfig with a keeper role, who looks after the animals and manages users
+// without holding every permission
+func usersConfig() Config {
+	config := authConfig()
+	config.Policy.Roles = map[string][]string{
+		"admin":  {"*"},
+		"reader": {"*:read"},
+		"keeper": {"animals:*", "users:read", "users:write"},
+	}
+	return config
+}
+
+// Callers can only give out roles whose permissions they hold
+func TestCheckRoles(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller string
+		roles  string
+		status int
+		code   string
+	}{
+		{"admin gives admin", "admin", `["admin"]`, fiber.StatusCreated, ""},
+		{"admin gives every role", "admin", `["reader","keeper","reader"]`, fiber.StatusCreated, ""},
+		{"keeper gives keeper", "keeper", `["keeper"]`, fiber.StatusCreated, ""},
+		{"keeper gives no role", "keeper", `[]`, fiber.StatusCreated, ""},
+		{"keeper gives admin", "keeper", `["admin"]`, fiber.StatusForbidden, "role_not_grantable"},
+		{"keeper gives reader", "keeper", `["keeper","reader"]`, fiber.StatusForbidden, "role_not_grantable"},
+		{"unknown role", "admin", `["zookeeper"]`, fiber.StatusUnprocessableEntity, "validation_failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newApp(newServer(newMemoryStore(), usersConfig()))
+			create(t, app, "/api/users", `{"username":"caller","password":"secretpass","roles":["`+tt.caller+`"]}`, "X-API-Key", testAPIKey)
+
+			status, body := send(t, app, fiber.MethodPost, "/api/users", `{"username":"bob","password":"secretpass","roles":`+tt.roles+`}`,
+				basic("caller", "secretpass")...)
+			if status != tt.status || (tt.code != "" && field(body, "code") != tt.code) {
+				t.Errorf("got status %d and %v, want %d with code %q", status, body, tt.status, tt.code)
+			}
+		})
+	}
+}
+
+// Users without roles can only reach their own account, its password and its keys, keys work
+// until they are rotated or revoked and are limited to their scopes
+func TestUserAccounts(t *testing.T) {
+	app := newApp(newServer(newMemoryStore(), usersConfig()))
+	admin := []string{"X-API-Key", testAPIKey}
+	bob := create(t, app, "/api/users", `{"username":"bob","password":"secretpass","roles":["keeper"]}`, admin...)
+	carol := create(t, app, "/api/users", `{"username":"carol","password":"secretpass"}`, admin...)
+	asCarol := basic("carol", "secretpass")
+
+	steps := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		headers []string
+		status  int
+		code    string
+	}{
+		{"username taken", fiber.MethodPost, "/api/users", `{"username":"bob","password":"secretpass"}`, admin, fiber.StatusConflict, "username_taken"},
+		{"short password", fiber.MethodPost, "/api/users", `{"username":"dave","password":"short"}`, admin, fiber.StatusUnprocessableEntity, "validation_failed"},
+		{"wrong password", fiber.MethodGet, "/api/users/" + carol, "", basic("carol", "wrongpass"), fiber.StatusUnauthorized, "invalid_credentials"},
+		{"own account", fiber.MethodGet, "/api/users/" + carol, "", asCarol, fiber.StatusOK, ""},
+		{"another account", fiber.MethodGet, "/api/users/" + bob, "", asCarol, fiber.StatusForbidden, "permission_denied"},
+		{"every account", fiber.MethodGet, "/api/users", "", asCarol, fiber.StatusForbidden, "permission_denied"},
+		{"own roles", fiber.MethodPut, "/api/users/" + carol + "/roles", `{"roles":["admin"]}`, asCarol, fiber.StatusForbidden, "permission_denied"},
+		{"password of another account", fiber.MethodPut, "/api/users/" + bob + "/password", `{"password":"newsecret"}`, asCarol, fiber.StatusForbidden, "permission_denied"},
+		{"own password without the current one", fiber.MethodPut, "/api/users/" + carol + "/password", `{"password":"newsecret"}`, asCarol, fiber.StatusForbidden, "wrong_password"},
+		{"own password", fiber.MethodPut, "/api/users/" + carol + "/password", `{"current_password":"secretpass","password":"newsecret"}`, asCarol, fiber.StatusOK, ""},
+		{"previous password", fiber.MethodGet, "/api/users/" + carol, "", asCarol, fiber.StatusUnauthorized, "invalid_credentials"},
+		{"new password", fiber.MethodGet, "/api/users/" + carol, "", basic("carol", "newsecret"), fiber.StatusOK, ""},
+		{"password set by an admin", fiber.MethodPut, "/api/users/" + carol + "/password", `{"password":"secretpass"}`, admin, fiber.StatusOK, ""},
+		{"key with an invalid scope", fiber.MethodPost, "/api/users/" + bob + "/keys", `{"name":"ci","scopes":["animals"]}`, admin, fiber.StatusUnprocessableEntity, "validation_failed"},
+		{"key of another account", fiber.MethodPost, "/api/users/" + bob + "/keys", `{"name":"ci"}`, asCarol, fiber.StatusForbidden, "permission_denied"},
+		{"deleting a user without the permission", fiber.MethodDelete, "/api/users/" + carol, "", basic("bob", "secretpass"), fiber.StatusForbidden, "permission_denied"},
+		{"deleting a user", fiber.MethodDelete, "/api/users/" + carol, "", admin, fiber.StatusOK, ""},
+		{"deleted user", fiber.MethodGet, "/api/animals", "", asCarol, fiber.StatusUnauthorized, "invalid_credentials"},
+	}
+	for _, step := range steps {
+		status, body := send(t, app, step.method, step.path, step.body, step.headers...)
+		if status != step.status || (step.code != "" && field(body, "code") != step.code) {
+			t.Errorf("%s: got status %d and %v, want %d with code %q", step.name, status, body, step.status, step.code)
+		}
+	}
+}
+
+func TestUserAPIKeys(t *testing.T) {
+	app := newApp(newServer(newMemoryStore(), usersConfig()))
+	bob := create(t, app, "/api/users", `{"username":"bob","password":"secretpass","roles":["keeper"]}`, "X-API-Key", testAPIKey)
+	asBob := basic("bob", "secretpass")
+	keys := "/api/users/" + bob + "/keys"
+
+	// issue creates a key for bob and returns its ID and the key itself
+	issue := func(body string) (string, string) {
+		t.Helper()
+		status, issued := send(t, app, fiber.MethodPost, keys, body, asBob...)
+		id, _ := field(issued, "_id").(string)
+		key, _ := field(issued, "key").(string)
+		if status != fiber.StatusCreated || key == "" {
+			t.Fatalf("issuing %s: got status %d and %v, want %d and the key", body, status, issued, fiber.StatusCreated)
+		}
+		return id, key
+	}
+	id, key := issue(`{"name":"ci"}`)
+	_, scoped := issue(`{"name":"dashboard","scopes":["animals:read"]}`)
+
+	status, rotated := send(t, app, fiber.MethodPost, keys+"/"+id+"/rotate", "", asBob...)
+	rotatedKey, _ := field(rotated, "key").(string)
+	if status != fiber.StatusOK || rotatedKey == "" || rotatedKey == key {
+		t.Fatalf("rotate: got status %d and %v, want %d and a new key", status, rotated, fiber.StatusOK)
+	}
+
+	const animal = `{"animal_name":"Leo","birthdate":"2020-01-02T00:00:00Z"}`
+	tests := []struct {
+		name   string
+		key    string
+		method string
+		body   string
+		status int
+		code   string
+	}{
+		{"rotated key", rotatedKey, fiber.MethodPost, animal, fiber.StatusCreated, ""},
+		{"key before rotation", key, fiber.MethodPost, animal, fiber.StatusUnauthorized, "invalid_api_key"},
+		{"key with a tampered secret", rotatedKey[:len(rotatedKey)-1] + "x", fiber.MethodGet, "", fiber.StatusUnauthorized, "invalid_api_key"},
+		{"scoped key within its scopes", scoped, fiber.MethodGet, "", fiber.StatusOK, ""},
+		{"scoped key outside its scopes", scoped, fiber.MethodPost, animal, fiber.StatusForbidden, "permission_denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := send(t, app, tt.method, "/api/animals", tt.body, "X-API-Key", tt.key)
+			if status != tt.status || (tt.code != "" && field(body, "code") != tt.code) {
+				t.Errorf("got status %d and %v, want %d with code %q", status, body, tt.status, tt.code)
+			}
+		})
+	}
+
+	if status, body := send(t, app, fiber.MethodDelete, keys+"/"+id, "", asBob...); status != fiber.StatusOK || field(body, "revoked_at") == nil {
+		t.Fatalf("revoke: got status %d and %v, want %d and the revoked key", status, body, fiber.StatusOK)
+	}
+	if status, body := send(t, app, fiber.MethodGet, "/api/animals", "", "X-API-Key", rotatedKey); status != fiber.StatusUnauthorized {
+		t.Errorf("revoked key: got status %d and %v, want %d", status, body, fiber.StatusUnauthorized)
+	}
+	if status, body := send(t, app, fiber.MethodPost, keys+"/"+id+"/rotate", "", asBob...); status != fiber.StatusConflict || field(body, "code") != "key_inactive" {
+		t.Errorf("rotating a revoked key: got status %d and %v, want %d with code key_inactive", status, body, fiber.StatusConflict)
+	}
+}
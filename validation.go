@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// recordValidator checks the validate tags of the models
+var recordValidator = newRecordValidator()
+
+// validationCodes maps the validate tags to the codes reported to clients
+var validationCodes = map[string]string{
+	"required":      "required",
+	"required_with": "required",
+	"notblank":      "required",
+	"notfuture":     "in_future",
+	"eq":            "invalid_value",
+	"len":           "invalid_length",
+	"coordinates":   "out_of_range",
+	"geometry":      "invalid_geometry",
+	"area":          "invalid_geometry",
+	"min":           "too_short",
+	"max":           "too_long",
+	"excludes":      "invalid_value",
+	"future":        "in_past",
+	"permission":    "invalid_permission",
+}
+
+// FieldError describes a field that failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field of a record that failed validation
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Field + " " + field.Message
+	}
+	return "invalid " + strings.Join(messages, ", ")
+}
+
+func newRecordValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+
+	// Report fields by the names clients use
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	must(v.RegisterValidation("notblank", func(fl validator.FieldLevel) bool {
+		return strings.TrimSpace(fl.Field().String()) != ""
+	}))
+	must(v.RegisterValidation("notfuture", func(fl validator.FieldLevel) bool {
+		t, ok := fl.Field().Interface().(time.Time)
+		return ok && !t.After(time.Now())
+	}))
+	// coordinates checks the longitude and latitude of a GeoJSON position
+	must(v.RegisterValidation("coordinates", func(fl validator.FieldLevel) bool {
+		position, ok := fl.Field().Interface().([]float64)
+		return ok && validCoordinates(position)
+	}))
+	// geometry checks a GeoJSON geometry, unset ones pass
+	must(v.RegisterValidation("geometry", func(fl validator.FieldLevel) bool {
+		geometry, ok := fl.Field().Interface().(Geometry)
+		return ok && (geometry.IsZero() || geometry.validate() == nil)
+	}))
+	// area checks that a geometry encloses an area, as Polygons and MultiPolygons do
+	must(v.RegisterValidation("area", func(fl validator.FieldLevel) bool {
+		geometry, ok := fl.Field().Interface().(Geometry)
+		return ok && (geometry.Type == "Polygon" || geometry.Type == "MultiPolygon")
+	}))
+	must(v.RegisterValidation("future", func(fl validator.FieldLevel) bool {
+		t, ok := fl.Field().Interface().(time.Time)
+		return ok && t.After(time.Now())
+	}))
+	// permission checks a permission of the policy, like animals:read
+	must(v.RegisterValidation("permission", func(fl validator.FieldLevel) bool {
+		return permissionPattern.MatchString(fl.Field().String())
+	}))
+	return v
+}
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// validateRecord checks a record against the validate tags of its model and returns a
+// *ValidationError listing every failing field
+func validateRecord(record interface{}) error {
+	err := recordValidator.Struct(record)
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		return err
+	}
+
+	validationErr := &ValidationError{}
+	for _, fieldErr := range fieldErrs {
+		// The namespace starts with the name of the model
+		_, field, _ := strings.Cut(fieldErr.Namespace(), ".")
+		validationErr.Fields = append(validationErr.Fields, FieldError{
+			Field:   field,
+			Code:    validationCodes[fieldErr.Tag()],
+			Message: validationMessage(fieldErr),
+		})
+	}
+	return validationErr
+}
+
+// validationMessage describes a failed validation for humans
+func validationMessage(fieldErr validator.FieldError) string {
+	switch fieldErr.Tag() {
+	case "required", "required_with", "notblank":
+		return "is required"
+	case "notfuture":
+		return "must not be in the future"
+	case "eq":
+		return fmt.Sprintf("must be %q", fieldErr.Param())
+	case "len":
+		return fmt.Sprintf("must have %s items", fieldErr.Param())
+	case "coordinates":
+		return "must be a longitude between -180 and 180 followed by a latitude between -90 and 90"
+	case "geometry":
+		if geometry, ok := fieldErr.Value().(Geometry); ok {
+			if err := geometry.validate(); err != nil {
+				return "must be a valid GeoJSON geometry: " + err.Error()
+			}
+		}
+		return "must be a valid GeoJSON geometry"
+	case "area":
+		return "must be a Polygon or a MultiPolygon"
+	case "min":
+		return fmt.Sprintf("must be at least %s characters long", fieldErr.Param())
+	case "max":
+		return fmt.Sprintf("must be at most %s characters long", fieldErr.Param())
+	case "excludes":
+		return fmt.Sprintf("must not contain %q", fieldErr.Param())
+	case "future":
+		return "must be in the future"
+	case "permission":
+		return "must be a permission like animals:read"
+	default:
+		return "is invalid"
+	}
+}